@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/davidjspooner/go-http-server/pkg/mux"
+	"github.com/davidjspooner/go-text-cli/pkg/cmd"
+	"github.com/davidjspooner/repoxy/pkg/repo"
+)
+
+type FsckOptions struct {
+	Config  string `flag:"--config,Path to the configuration file"`
+	Repair  bool   `flag:"--repair,Remove temp files and corrupt blobs, drop dangling labels and re-fetch missing blobs"`
+	JSON    bool   `flag:"--json,Write the full report as JSON to stdout"`
+	Grace   string `flag:"--grace,Minimum age of a temp file before it is reported"`
+	Refetch bool   `flag:"--refetch,Re-fetch missing blobs from upstream when repairing"`
+}
+
+var fsckCommand = cmd.NewCommand(
+	"fsck",
+	"Verify blobs, versions and labels in the storage root",
+	func(ctx context.Context, options *FsckOptions, args []string) error {
+		config, err := repo.LoadConfigs(options.Config)
+		if err != nil {
+			return fmt.Errorf("failed to load repository configurations: %w", err)
+		}
+		grace, err := time.ParseDuration(options.Grace)
+		if err != nil {
+			return fmt.Errorf("invalid grace period %q: %w", options.Grace, err)
+		}
+		fs, err := repo.NewStorageRoot(ctx, config.Storage)
+		if err != nil {
+			return fmt.Errorf("failed to connect to storage root: %w", err)
+		}
+		opts := repo.FsckOptions{Repair: options.Repair, TempGrace: grace}
+		if options.Repair && options.Refetch {
+			if err := repo.Initialize(ctx, fs, mux.NewServeMux()); err != nil {
+				return fmt.Errorf("failed to initialize repository types: %w", err)
+			}
+			for _, r := range config.Repositories {
+				if _, err := repo.NewRepository(ctx, r); err != nil {
+					return fmt.Errorf("failed to create repository instance for %s: %w", r.Name, err)
+				}
+			}
+			opts.Fetch = repo.FetchRegisteredBlob
+		}
+		report, err := repo.CheckStorage(ctx, fs, opts)
+		if err != nil {
+			return fmt.Errorf("fsck failed: %w", err)
+		}
+		if options.JSON {
+			encoder := json.NewEncoder(os.Stdout)
+			encoder.SetIndent("", "  ")
+			if err := encoder.Encode(report); err != nil {
+				return err
+			}
+		} else {
+			for _, issue := range report.Issues {
+				slog.WarnContext(ctx, "integrity issue",
+					"root", issue.Root,
+					"kind", issue.Kind,
+					"path", issue.Path,
+					"detail", issue.Detail,
+					"repaired", issue.Repaired,
+				)
+			}
+		}
+		slog.InfoContext(ctx, "fsck completed",
+			"roots", report.Roots,
+			"blobs", report.Blobs,
+			"versions", report.Versions,
+			"labels", report.Labels,
+			"issues", len(report.Issues),
+			"repaired", report.Repaired,
+		)
+		if unresolved := report.Unresolved(); unresolved > 0 {
+			return fmt.Errorf("%d unresolved integrity issues", unresolved)
+		}
+		return nil
+	},
+	&FsckOptions{
+		Config: "config.yaml",
+		Grace:  repo.DefaultFsckTempGrace.String(),
+	},
+)
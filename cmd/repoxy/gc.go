@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/davidjspooner/go-text-cli/pkg/cmd"
+	"github.com/davidjspooner/repoxy/pkg/repo"
+)
+
+type GCOptions struct {
+	Config string `flag:"--config,Path to the configuration file"`
+	DryRun bool   `flag:"--dry-run,Report unreferenced blobs without deleting them"`
+	Grace  string `flag:"--grace,Minimum age of an unreferenced blob before it is deleted"`
+}
+
+var gcCommand = cmd.NewCommand(
+	"gc",
+	"Delete blobs that are no longer referenced by any version",
+	func(ctx context.Context, options *GCOptions, args []string) error {
+		config, err := repo.LoadConfigs(options.Config)
+		if err != nil {
+			return fmt.Errorf("failed to load repository configurations: %w", err)
+		}
+		grace, err := time.ParseDuration(options.Grace)
+		if err != nil {
+			return fmt.Errorf("invalid grace period %q: %w", options.Grace, err)
+		}
+		fs, err := repo.NewStorageRoot(ctx, config.Storage)
+		if err != nil {
+			return fmt.Errorf("failed to connect to storage root: %w", err)
+		}
+		report, err := repo.CollectGarbage(ctx, fs, repo.GCOptions{
+			GracePeriod: grace,
+			DryRun:      options.DryRun,
+		})
+		if err != nil {
+			return fmt.Errorf("garbage collection failed: %w", err)
+		}
+		for _, key := range report.DeletedKeys {
+			if report.DryRun {
+				slog.InfoContext(ctx, "would delete blob", "blob", key)
+			} else {
+				slog.DebugContext(ctx, "deleted blob", "blob", key)
+			}
+		}
+		slog.InfoContext(ctx, "garbage collection completed",
+			"roots", report.Roots,
+			"versions", report.Versions,
+			"scanned", report.Scanned,
+			"retained", report.Retained,
+			"deleted", report.Deleted,
+			"deleted_bytes", report.DeletedBytes,
+			"dry_run", report.DryRun,
+		)
+		return nil
+	},
+	&GCOptions{
+		Config: "config.yaml",
+		Grace:  repo.DefaultGCGracePeriod.String(),
+	},
+)
@@ -33,6 +33,9 @@ func main() {
 	subcommands.MustAdd(
 		versionCommand,
 		serveCommand,
+		gcCommand,
+		fsckCommand,
+		prefetchCommand,
 	)
 
 	ctx := context.Background()
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/davidjspooner/go-http-server/pkg/mux"
+	"github.com/davidjspooner/go-text-cli/pkg/cmd"
+	"github.com/davidjspooner/repoxy/pkg/repo"
+	"github.com/davidjspooner/repoxy/pkg/tf"
+)
+
+type PrefetchTerraformOptions struct {
+	Config   string `flag:"--config,Path to the configuration file"`
+	Lockfile string `flag:"--lockfile,Path to the .terraform.lock.hcl listing the providers to fetch"`
+	Platform string `flag:"--platform,Comma-separated os_arch platforms to fetch (default: every published platform)"`
+}
+
+var prefetchCommand = newPrefetchCommand()
+
+func newPrefetchCommand() cmd.Command {
+	prefetch := cmd.NewCommand(
+		"prefetch",
+		"Fill repository caches ahead of air-gapped use",
+		func(ctx context.Context, options *struct{}, args []string) error {
+			return cmd.ShowHelpForMissingSubcommand(ctx)
+		},
+		&struct{}{},
+	)
+	prefetch.SubCommands().MustAdd(prefetchTerraformCommand)
+	return prefetch
+}
+
+var prefetchTerraformCommand = cmd.NewCommand(
+	"terraform",
+	"Fetch the providers of a terraform lock file into the terraform and tofu caches",
+	func(ctx context.Context, options *PrefetchTerraformOptions, args []string) error {
+		if options.Lockfile == "" {
+			return fmt.Errorf("--lockfile is required")
+		}
+		data, err := os.ReadFile(options.Lockfile)
+		if err != nil {
+			return fmt.Errorf("failed to read lock file: %w", err)
+		}
+		providers, err := tf.ParseLockFile(data)
+		if err != nil {
+			return err
+		}
+		req := &tf.PrefetchRequest{Providers: providers}
+		if options.Platform != "" {
+			for _, platform := range strings.Split(options.Platform, ",") {
+				req.Platforms = append(req.Platforms, strings.TrimSpace(platform))
+			}
+		}
+		config, err := repo.LoadConfigs(options.Config)
+		if err != nil {
+			return fmt.Errorf("failed to load repository configurations: %w", err)
+		}
+		fs, err := repo.NewStorageRoot(ctx, config.Storage)
+		if err != nil {
+			return fmt.Errorf("failed to connect to storage root: %w", err)
+		}
+		if err := repo.Initialize(ctx, fs, mux.NewServeMux()); err != nil {
+			return fmt.Errorf("failed to initialize repository types: %w", err)
+		}
+		for _, r := range config.Repositories {
+			if _, err := repo.NewRepository(ctx, r); err != nil {
+				return fmt.Errorf("failed to create repository instance for %s: %w", r.Name, err)
+			}
+		}
+		summary, err := tf.Prefetch(ctx, req, func(event tf.PrefetchEvent) {
+			attrs := []any{"provider", event.Provider, "version", event.Version, "platform", event.Platform, "step", event.Step}
+			if event.File != "" {
+				attrs = append(attrs, "file", event.File)
+			}
+			if event.Error != "" {
+				slog.ErrorContext(ctx, "prefetch failed", append(attrs, "error", event.Error)...)
+				return
+			}
+			slog.InfoContext(ctx, "prefetched", attrs...)
+		})
+		if err != nil {
+			return fmt.Errorf("prefetch failed: %w", err)
+		}
+		slog.InfoContext(ctx, "prefetch completed", "providers", len(providers), "packages", summary.Packages, "failed", summary.Failed)
+		if summary.Failed > 0 {
+			return fmt.Errorf("%d prefetch steps failed", summary.Failed)
+		}
+		return nil
+	},
+	&PrefetchTerraformOptions{
+		Config: "config.yaml",
+	},
+)
@@ -5,10 +5,12 @@ import (
 	"fmt"
 	"net/http"
 
+	"github.com/davidjspooner/go-http-server/pkg/handler"
 	"github.com/davidjspooner/go-http-server/pkg/metric"
 	"github.com/davidjspooner/go-http-server/pkg/middleware"
 	"github.com/davidjspooner/go-http-server/pkg/mux"
 	"github.com/davidjspooner/go-text-cli/pkg/cmd"
+	"github.com/davidjspooner/repoxy/pkg/auth"
 	"github.com/davidjspooner/repoxy/pkg/observability"
 	"github.com/davidjspooner/repoxy/pkg/repo"
 	"github.com/davidjspooner/repoxy/reactui"
@@ -22,12 +24,23 @@ type ServeOptions struct {
 }
 
 func serveHttp(ctx context.Context, config *repo.ConfigFile) error {
-	serveMux := mux.NewServeMux(
+	authenticator, err := auth.New(ctx, config.Auth)
+	if err != nil {
+		return fmt.Errorf("failed to configure client authentication: %w", err)
+	}
+	middlewares := []handler.Middleware{
 		observability.HTTPLogger(),
 		metric.Middleware(),
 		&middleware.Recovery{},
-	)
+	}
+	if authenticator != nil {
+		middlewares = append(middlewares, authenticator)
+	}
+	serveMux := mux.NewServeMux(middlewares...)
 	serveMux.Handle("/metrics", metric.Handler())
+	if authenticator.IssuesTokens() {
+		_ = serveMux.Handle("GET "+auth.TokenPath, http.HandlerFunc(authenticator.ServeToken))
+	}
 	fs, err := repo.NewStorageRoot(ctx, config.Storage)
 	if err != nil {
 		return fmt.Errorf("failed to connect to storage root: %w", err)
@@ -35,6 +48,11 @@ func serveHttp(ctx context.Context, config *repo.ConfigFile) error {
 	if err := repo.Initialize(ctx, fs, serveMux); err != nil {
 		return fmt.Errorf("failed to initialize repository types: %w", err)
 	}
+	if config.Storage.SharedBlobs {
+		if err := repo.EnableSharedBlobs(ctx, fs); err != nil {
+			return fmt.Errorf("failed to open shared blob pool: %w", err)
+		}
+	}
 	if uiHandler, err := reactui.Handler(); err != nil {
 		return fmt.Errorf("failed to load embedded UI: %w", err)
 	} else {
@@ -42,6 +60,9 @@ func serveHttp(ctx context.Context, config *repo.ConfigFile) error {
 		_ = serveMux.Handle("/ui", uiHandler)
 		_ = serveMux.Handle("/", http.RedirectHandler("/ui/", http.StatusMovedPermanently))
 	}
+	if err := repo.EnableAccessControl(config.Access); err != nil {
+		return fmt.Errorf("failed to configure access control: %w", err)
+	}
 	repo.RegisterUIRoutes(serveMux)
 	for _, r := range config.Repositories {
 		_, err := repo.NewRepository(ctx, r)
@@ -49,7 +70,12 @@ func serveHttp(ctx context.Context, config *repo.ConfigFile) error {
 			return fmt.Errorf("failed to create repository instance for %s: %w", r.Name, err)
 		}
 	}
+	repo.StartGarbageCollector(ctx, fs, config.GC)
+	repo.StartRetention(ctx)
 	err = config.Server.ListenAndServe(ctx, serveMux)
+	if flushErr := repo.FlushAccessLogs(context.WithoutCancel(ctx)); flushErr != nil && err == nil {
+		err = fmt.Errorf("failed to persist access logs: %w", flushErr)
+	}
 	return err
 }
 
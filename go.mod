@@ -3,6 +3,7 @@ module github.com/davidjspooner/repoxy
 go 1.25.0
 
 require (
+	github.com/ProtonMail/go-crypto v1.5.2
 	github.com/aws/aws-sdk-go-v2 v1.39.6
 	github.com/aws/aws-sdk-go-v2/credentials v1.18.24
 	github.com/aws/aws-sdk-go-v2/service/ecr v1.52.0
@@ -10,7 +11,8 @@ require (
 	github.com/davidjspooner/go-http-client v0.0.0-20250615171724-82c6219a0df7
 	github.com/davidjspooner/go-http-server v0.0.0-20251201011633-2b56da02417e
 	github.com/davidjspooner/go-text-cli v0.0.8
-	golang.org/x/text v0.31.0
+	golang.org/x/crypto v0.55.0
+	golang.org/x/text v0.41.0
 	gopkg.in/yaml.v3 v3.0.1
 )
 
@@ -18,8 +20,10 @@ require (
 	github.com/aws/aws-sdk-go-v2/internal/configsources v1.4.13 // indirect
 	github.com/aws/aws-sdk-go-v2/internal/endpoints/v2 v2.7.13 // indirect
 	github.com/aws/smithy-go v1.23.2 // indirect
+	github.com/cloudflare/circl v1.6.3 // indirect
 	github.com/davidjspooner/go-resource-path v0.0.0-20250531073340-4f50db78c1d8 // indirect
 	github.com/kr/pretty v0.3.1 // indirect
 	github.com/rogpeppe/go-internal v1.10.0 // indirect
+	golang.org/x/sys v0.47.0 // indirect
 	gopkg.in/check.v1 v1.0.0-20201130134442-10cb98267c6c // indirect
 )
@@ -0,0 +1,340 @@
+// Package auth authenticates the clients of the proxy itself: HTTP Basic against an htpasswd file, static API tokens,
+// and bearer tokens issued by a Docker-compatible token service.
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/davidjspooner/repoxy/pkg/observability"
+)
+
+// Authentication methods recorded on a Principal.
+const (
+	MethodBasic         = "basic"
+	MethodToken         = "token"
+	MethodRegistryToken = "registry_token"
+)
+
+// ErrUnknownToken is returned by a TokenAuthenticator for tokens it did not issue, so the next one is tried.
+var ErrUnknownToken = errors.New("token not recognised")
+
+// TokenAuthenticator validates bearer tokens, such as the registry tokens of the token service or the ID tokens of an
+// OIDC issuer. Tokens are also accepted as the password of Basic credentials for clients that cannot send them
+// directly, like docker login.
+type TokenAuthenticator interface {
+	AuthenticateToken(ctx context.Context, token string) (*Principal, error)
+}
+
+// TokenAuthenticatorFunc adapts a function to TokenAuthenticator.
+type TokenAuthenticatorFunc func(ctx context.Context, token string) (*Principal, error)
+
+// AuthenticateToken implements TokenAuthenticator.
+func (f TokenAuthenticatorFunc) AuthenticateToken(ctx context.Context, token string) (*Principal, error) {
+	return f(ctx, token)
+}
+
+var (
+	errInvalidCredentials = errors.New("invalid credentials")
+	errInvalidToken       = errors.New("invalid token")
+	errInsufficientScope  = errors.New("token does not grant access to this resource")
+)
+
+// Principal is an authenticated client.
+type Principal struct {
+	Name   string
+	Method string
+	// Groups are reported by the identity provider; groups configured for access control are resolved separately.
+	Groups []string
+	// Access lists the scopes granted by a registry token; it is nil for other methods.
+	Access []Access
+}
+
+// Access is one Docker registry scope: a resource type and name and the actions granted on it.
+type Access struct {
+	Type    string   `json:"type"`
+	Name    string   `json:"name"`
+	Actions []string `json:"actions"`
+}
+
+type principalKey struct{}
+
+// WithPrincipal returns ctx carrying p.
+func WithPrincipal(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// PrincipalFromContext returns the client authenticated for the request, or nil when auth is disabled.
+func PrincipalFromContext(ctx context.Context) *Principal {
+	if ctx == nil {
+		return nil
+	}
+	p, _ := ctx.Value(principalKey{}).(*Principal)
+	return p
+}
+
+// Authenticator checks client credentials and, as middleware, refuses unauthenticated requests. A nil Authenticator
+// lets every request through.
+type Authenticator struct {
+	config   *Config
+	htpasswd *htpasswdFile
+	key      *signingKey // nil without a token service
+	bearers  []TokenAuthenticator
+	now      func() time.Time
+}
+
+// New returns an Authenticator for config, or nil when config is nil.
+func New(ctx context.Context, config *Config) (*Authenticator, error) {
+	if config == nil {
+		return nil, nil
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	a := &Authenticator{config: config, now: time.Now}
+	if config.Htpasswd != "" {
+		var err error
+		if a.htpasswd, err = loadHtpasswd(config.Htpasswd); err != nil {
+			return nil, err
+		}
+	}
+	if config.TokenService != nil {
+		var err error
+		if a.key, err = loadSigningKey(config.TokenService.Key); err != nil {
+			return nil, err
+		}
+		a.bearers = append(a.bearers, TokenAuthenticatorFunc(a.checkRegistryToken))
+	}
+	for _, oidc := range config.OIDC {
+		provider, err := newOIDCProvider(ctx, oidc)
+		if err != nil {
+			return nil, err
+		}
+		a.bearers = append(a.bearers, provider)
+	}
+	return a, nil
+}
+
+// Authenticate checks the Authorization header of r. It returns a nil Principal and nil error when r carries no
+// credentials.
+func (a *Authenticator) Authenticate(r *http.Request) (*Principal, error) {
+	header := strings.TrimSpace(r.Header.Get("Authorization"))
+	if header == "" {
+		return nil, nil
+	}
+	scheme, credentials, _ := strings.Cut(header, " ")
+	switch strings.ToLower(scheme) {
+	case "basic":
+		user, password, ok := r.BasicAuth()
+		if !ok {
+			return nil, errInvalidCredentials
+		}
+		return a.checkPassword(r.Context(), user, password)
+	case "bearer":
+		return a.checkBearer(r.Context(), strings.TrimSpace(credentials))
+	default:
+		return nil, fmt.Errorf("unsupported authorization scheme %q", scheme)
+	}
+}
+
+func (a *Authenticator) checkPassword(ctx context.Context, user, password string) (*Principal, error) {
+	if a.htpasswd != nil && a.htpasswd.authenticate(user, password) {
+		return &Principal{Name: user, Method: MethodBasic}, nil
+	}
+	if name, ok := a.staticToken(password); ok {
+		return &Principal{Name: name, Method: MethodToken}, nil
+	}
+	if len(a.bearers) > 0 && strings.Count(password, ".") == 2 {
+		return a.checkBearer(ctx, password)
+	}
+	return nil, errInvalidCredentials
+}
+
+func (a *Authenticator) checkBearer(ctx context.Context, token string) (*Principal, error) {
+	if name, ok := a.staticToken(token); ok {
+		return &Principal{Name: name, Method: MethodToken}, nil
+	}
+	for _, bearer := range a.bearers {
+		principal, err := bearer.AuthenticateToken(ctx, token)
+		if errors.Is(err, ErrUnknownToken) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", errInvalidToken, err)
+		}
+		return principal, nil
+	}
+	return nil, errInvalidToken
+}
+
+// checkRegistryToken validates a token issued by the token service.
+func (a *Authenticator) checkRegistryToken(_ context.Context, token string) (*Principal, error) {
+	if peekIssuer(token) != a.config.TokenService.issuer() {
+		return nil, ErrUnknownToken
+	}
+	var claims tokenClaims
+	err := parseJWT(token, func(alg, _ string) (crypto.PublicKey, error) {
+		if alg != a.key.alg {
+			return nil, fmt.Errorf("unexpected token algorithm %q", alg)
+		}
+		return a.key.signer.Public(), nil
+	}, &claims)
+	if err == nil {
+		err = claims.validAt(a.now())
+	}
+	if err == nil && !claims.Audience.contains(a.config.TokenService.service()) {
+		err = errors.New("token was issued for another service")
+	}
+	if err == nil && claims.Subject == "" {
+		err = errors.New("token has no subject")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &Principal{Name: claims.Subject, Method: MethodRegistryToken, Groups: claims.Groups, Access: claims.Access}, nil
+}
+
+// staticToken returns the name of the configured token equal to value.
+func (a *Authenticator) staticToken(value string) (string, bool) {
+	if value == "" {
+		return "", false
+	}
+	name, found := "", false
+	for _, token := range a.config.Tokens {
+		if subtle.ConstantTimeCompare([]byte(token.Token), []byte(value)) == 1 {
+			name, found = token.Name, true
+		}
+	}
+	return name, found
+}
+
+// WrapHandler implements handler.Middleware: requests without valid credentials are answered with a 401 challenge,
+// and the authenticated principal is stored in the request context and reported to the request logger.
+func (a *Authenticator) WrapHandler(next http.Handler) http.Handler {
+	if a == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if publicPath(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		principal, err := a.Authenticate(r)
+		if principal == nil {
+			if err != nil {
+				slog.InfoContext(r.Context(), "client authentication failed", "error", err)
+			}
+			a.challenge(w, r, err)
+			return
+		}
+		if scope := scopeFor(r); principal.Method == MethodRegistryToken && scope != "" && !principal.grants(scope) {
+			// Registry clients fetch a token per scope; a 401 makes them ask the token service for this one.
+			a.challenge(w, r, errInsufficientScope)
+			return
+		}
+		next.ServeHTTP(w, bind(r, principal))
+	})
+}
+
+// publicPath reports whether path is served without credentials: the token service authenticates its own requests,
+// terraform service discovery is fetched before credentials are chosen, and metrics are scraped separately.
+func publicPath(path string) bool {
+	return path == TokenPath || path == "/metrics" || strings.HasPrefix(path, "/.well-known/")
+}
+
+func bind(r *http.Request, principal *Principal) *http.Request {
+	r = observability.SetRequestUser(r, principal.Name)
+	return r.WithContext(WithPrincipal(r.Context(), principal))
+}
+
+// challenge answers r with 401. Registry clients get an OCI error document and, with a token service, a Bearer
+// challenge naming the scope they need; other clients get a Basic challenge.
+func (a *Authenticator) challenge(w http.ResponseWriter, r *http.Request, err error) {
+	message := "authentication required"
+	if err != nil {
+		message = err.Error()
+	}
+	basic := fmt.Sprintf("Basic realm=%q", a.config.realm())
+	if r.URL.Path != "/v2" && !strings.HasPrefix(r.URL.Path, "/v2/") {
+		w.Header().Set("WWW-Authenticate", basic)
+		writeJSON(w, http.StatusUnauthorized, map[string][]string{"errors": {message}})
+		return
+	}
+	if a.key != nil {
+		challenge := fmt.Sprintf("Bearer realm=%q,service=%q", a.tokenRealm(r), a.config.TokenService.service())
+		if scope := scopeFor(r); scope != "" {
+			challenge += fmt.Sprintf(",scope=%q", scope)
+		}
+		switch {
+		case errors.Is(err, errInvalidToken):
+			challenge += `,error="invalid_token"`
+		case errors.Is(err, errInsufficientScope):
+			challenge += `,error="insufficient_scope"`
+		}
+		w.Header().Set("WWW-Authenticate", challenge)
+	} else {
+		w.Header().Set("WWW-Authenticate", basic)
+	}
+	w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+	writeJSON(w, http.StatusUnauthorized, map[string]any{
+		"errors": []map[string]string{{"code": "UNAUTHORIZED", "message": message}},
+	})
+}
+
+// grants reports whether the registry token of p covers every action of scope.
+func (p *Principal) grants(scope string) bool {
+	need, ok := parseScope(scope)
+	if !ok {
+		return false
+	}
+	for _, action := range need.Actions {
+		if !slices.ContainsFunc(p.Access, func(granted Access) bool {
+			return granted.Type == need.Type && granted.Name == need.Name &&
+				(slices.Contains(granted.Actions, action) || slices.Contains(granted.Actions, "*"))
+		}) {
+			return false
+		}
+	}
+	return true
+}
+
+// scopeFor returns the Docker registry scope a /v2/ request needs.
+func scopeFor(r *http.Request) string {
+	rest := strings.TrimPrefix(r.URL.Path, "/v2/")
+	if rest == "_catalog" {
+		return "registry:catalog:*"
+	}
+	for _, marker := range []string{"/manifests/", "/blobs/", "/tags/", "/referrers/"} {
+		if i := strings.LastIndex(rest, marker); i > 0 {
+			return "repository:" + rest[:i] + ":" + actionsFor(r.Method)
+		}
+	}
+	return ""
+}
+
+func actionsFor(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead:
+		return "pull"
+	case http.MethodDelete:
+		return "delete"
+	default:
+		return "pull,push"
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, body any) {
+	data, _ := json.Marshal(body)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write(data)
+}
@@ -0,0 +1,192 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// writeHtpasswd writes user:bcrypt(password) pairs to a file in dir and returns its path.
+func writeHtpasswd(t *testing.T, dir string, users ...string) string {
+	t.Helper()
+	var lines []string
+	for i := 0; i+1 < len(users); i += 2 {
+		hash, err := bcrypt.GenerateFromPassword([]byte(users[i+1]), bcrypt.MinCost)
+		if err != nil {
+			t.Fatalf("bcrypt: %v", err)
+		}
+		lines = append(lines, users[i]+":"+string(hash))
+	}
+	file := filepath.Join(dir, "htpasswd")
+	if err := os.WriteFile(file, []byte(strings.Join(lines, "\n")+"\n"), 0o600); err != nil {
+		t.Fatalf("write htpasswd: %v", err)
+	}
+	return file
+}
+
+// serveAuthenticated sends req through a's middleware and returns the response and the principal the handler saw.
+func serveAuthenticated(a *Authenticator, req *http.Request) (*httptest.ResponseRecorder, *Principal) {
+	var seen *Principal
+	rr := httptest.NewRecorder()
+	a.WrapHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = PrincipalFromContext(r.Context())
+		w.WriteHeader(http.StatusOK)
+	})).ServeHTTP(rr, req)
+	return rr, seen
+}
+
+func TestAuthenticatorBasicAndStaticTokens(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	file := writeHtpasswd(t, dir, "alice", "secret")
+	a, err := New(context.Background(), &Config{Htpasswd: file, Tokens: []StaticToken{{Name: "ci", Token: "tok-123"}}})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+
+	cases := []struct {
+		name   string
+		setup  func(*http.Request)
+		status int
+		user   string
+	}{
+		{"anonymous", func(*http.Request) {}, http.StatusUnauthorized, ""},
+		{"basic", func(r *http.Request) { r.SetBasicAuth("alice", "secret") }, http.StatusOK, "alice"},
+		{"wrong password", func(r *http.Request) { r.SetBasicAuth("alice", "nope") }, http.StatusUnauthorized, ""},
+		{"token as password", func(r *http.Request) { r.SetBasicAuth("anyone", "tok-123") }, http.StatusOK, "ci"},
+		{"bearer token", func(r *http.Request) { r.Header.Set("Authorization", "Bearer tok-123") }, http.StatusOK, "ci"},
+		{"unknown bearer", func(r *http.Request) { r.Header.Set("Authorization", "Bearer other") }, http.StatusUnauthorized, ""},
+	}
+	for _, tc := range cases {
+		req := httptest.NewRequest(http.MethodGet, "/v1/providers/hashicorp/aws/versions", nil)
+		tc.setup(req)
+		rr, principal := serveAuthenticated(a, req)
+		if rr.Code != tc.status {
+			t.Fatalf("%s: expected %d, got %d", tc.name, tc.status, rr.Code)
+		}
+		if tc.status == http.StatusUnauthorized {
+			if got := rr.Header().Get("WWW-Authenticate"); got != `Basic realm="repoxy"` {
+				t.Fatalf("%s: unexpected challenge %q", tc.name, got)
+			}
+			continue
+		}
+		if principal == nil || principal.Name != tc.user {
+			t.Fatalf("%s: expected principal %q, got %+v", tc.name, tc.user, principal)
+		}
+	}
+
+	// Edits to the htpasswd file apply without a restart.
+	time.Sleep(10 * time.Millisecond)
+	writeHtpasswd(t, dir, "bob", "hunter2")
+	req := httptest.NewRequest(http.MethodGet, "/api/ui/v1/repos", nil)
+	req.SetBasicAuth("alice", "secret")
+	if rr, _ := serveAuthenticated(a, req); rr.Code != http.StatusUnauthorized {
+		t.Fatalf("expected removed user to be rejected, got %d", rr.Code)
+	}
+	req.SetBasicAuth("bob", "hunter2")
+	if rr, principal := serveAuthenticated(a, req); rr.Code != http.StatusOK || principal.Name != "bob" {
+		t.Fatalf("expected added user to be accepted, got %d", rr.Code)
+	}
+
+	if rr, _ := serveAuthenticated(a, httptest.NewRequest(http.MethodGet, "/metrics", nil)); rr.Code != http.StatusOK {
+		t.Fatalf("expected /metrics to stay public, got %d", rr.Code)
+	}
+}
+
+func TestTokenServiceIssuesRegistryTokens(t *testing.T) {
+	t.Parallel()
+	a, err := New(context.Background(), &Config{
+		Htpasswd:     writeHtpasswd(t, t.TempDir(), "alice", "secret"),
+		TokenService: &TokenServiceConfig{Expiry: time.Minute},
+	})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+
+	rr, _ := serveAuthenticated(a, httptest.NewRequest(http.MethodGet, "https://proxy.test/v2/library/alpine/manifests/latest", nil))
+	want := `Bearer realm="https://proxy.test/auth/token",service="repoxy",scope="repository:library/alpine:pull"`
+	if rr.Code != http.StatusUnauthorized || rr.Header().Get("WWW-Authenticate") != want {
+		t.Fatalf("unexpected challenge %d %q", rr.Code, rr.Header().Get("WWW-Authenticate"))
+	}
+	if !strings.Contains(rr.Body.String(), `"UNAUTHORIZED"`) {
+		t.Fatalf("expected OCI error body, got %s", rr.Body.String())
+	}
+
+	tokenReq := httptest.NewRequest(http.MethodGet, TokenPath+"?service=repoxy&scope=repository:library/alpine:pull", nil)
+	tokenReq.SetBasicAuth("alice", "secret")
+	tokenRR := httptest.NewRecorder()
+	a.ServeToken(tokenRR, tokenReq)
+	var issued struct {
+		Token     string `json:"token"`
+		ExpiresIn int    `json:"expires_in"`
+	}
+	if tokenRR.Code != http.StatusOK || json.Unmarshal(tokenRR.Body.Bytes(), &issued) != nil || issued.Token == "" || issued.ExpiresIn != 60 {
+		t.Fatalf("unexpected token response %d %s", tokenRR.Code, tokenRR.Body.String())
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/v2/library/alpine/manifests/latest", nil)
+	req.Header.Set("Authorization", "Bearer "+issued.Token)
+	rr, principal := serveAuthenticated(a, req)
+	if rr.Code != http.StatusOK || principal == nil || principal.Name != "alice" || principal.Method != MethodRegistryToken {
+		t.Fatalf("expected token to authenticate alice, got %d %+v", rr.Code, principal)
+	}
+	if len(principal.Access) != 1 || principal.Access[0].Name != "library/alpine" || principal.Access[0].Actions[0] != "pull" {
+		t.Fatalf("unexpected granted access %+v", principal.Access)
+	}
+
+	// A token for one repository does not open another; the client is sent back for a token with the new scope.
+	busybox := httptest.NewRequest(http.MethodGet, "/v2/library/busybox/manifests/latest", nil)
+	busybox.Header.Set("Authorization", "Bearer "+issued.Token)
+	if rr, _ := serveAuthenticated(a, busybox); rr.Code != http.StatusUnauthorized ||
+		!strings.Contains(rr.Header().Get("WWW-Authenticate"), `scope="repository:library/busybox:pull",error="insufficient_scope"`) {
+		t.Fatalf("expected insufficient_scope challenge, got %d %q", rr.Code, rr.Header().Get("WWW-Authenticate"))
+	}
+
+	a.now = func() time.Time { return time.Now().Add(time.Hour) }
+	rr, _ = serveAuthenticated(a, req)
+	if rr.Code != http.StatusUnauthorized || !strings.Contains(rr.Header().Get("WWW-Authenticate"), `error="invalid_token"`) {
+		t.Fatalf("expected expired token to be rejected, got %d %q", rr.Code, rr.Header().Get("WWW-Authenticate"))
+	}
+
+	other, err := New(context.Background(), &Config{Tokens: []StaticToken{{Name: "ci", Token: "tok"}}, TokenService: &TokenServiceConfig{}})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	if _, err := other.Authenticate(req); !errors.Is(err, errInvalidToken) {
+		t.Fatalf("expected token signed by another key to be rejected, got %v", err)
+	}
+
+	badReq := httptest.NewRequest(http.MethodGet, TokenPath, nil)
+	badReq.SetBasicAuth("alice", "wrong")
+	badRR := httptest.NewRecorder()
+	a.ServeToken(badRR, badReq)
+	if badRR.Code != http.StatusUnauthorized {
+		t.Fatalf("expected token request with bad credentials to fail, got %d", badRR.Code)
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	t.Parallel()
+	for name, cfg := range map[string]*Config{
+		"no credentials":  {},
+		"unnamed token":   {Tokens: []StaticToken{{Token: "x"}}},
+		"duplicate token": {Tokens: []StaticToken{{Name: "a", Token: "x"}, {Name: "b", Token: "x"}}},
+		"relative realm":  {Tokens: []StaticToken{{Name: "a", Token: "x"}}, TokenService: &TokenServiceConfig{Realm: "/auth/token"}},
+	} {
+		if err := cfg.Validate(); !errors.Is(err, ErrInvalidAuthConfig) {
+			t.Fatalf("%s: expected ErrInvalidAuthConfig, got %v", name, err)
+		}
+	}
+	if _, err := New(context.Background(), &Config{Htpasswd: filepath.Join(t.TempDir(), "missing")}); !errors.Is(err, ErrInvalidAuthConfig) {
+		t.Fatalf("expected missing htpasswd file to be rejected, got %v", err)
+	}
+}
@@ -0,0 +1,117 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+)
+
+// ErrInvalidAuthConfig is returned when the auth configuration cannot be used.
+var ErrInvalidAuthConfig = errors.New("invalid auth configuration")
+
+// Config enables authentication of the proxy's own clients. Without it every request is served anonymously.
+type Config struct {
+	// Realm is announced in Basic challenges; defaults to "repoxy".
+	Realm string `yaml:"realm,omitempty"`
+	// Htpasswd is a file of user:hash lines (bcrypt or {SHA}). It is reloaded when it changes.
+	Htpasswd string `yaml:"htpasswd,omitempty"`
+	// Tokens are static API tokens, accepted as bearer tokens or as the password of Basic credentials.
+	Tokens []StaticToken `yaml:"tokens,omitempty"`
+	// TokenService issues Docker registry bearer tokens to /v2/ clients that log in with Basic credentials.
+	TokenService *TokenServiceConfig `yaml:"token_service,omitempty"`
+	// OIDC accepts ID tokens from OpenID Connect issuers as bearer tokens or Basic passwords.
+	OIDC []OIDCConfig `yaml:"oidc,omitempty"`
+}
+
+// StaticToken is an API token configured for a named client.
+type StaticToken struct {
+	Name  string `yaml:"name"`
+	Token string `yaml:"token"`
+}
+
+// TokenServiceConfig configures the Docker-compatible token service mounted at TokenPath.
+type TokenServiceConfig struct {
+	// Realm is the absolute URL clients fetch tokens from; derived from the request when empty.
+	Realm string `yaml:"realm,omitempty"`
+	// Service is the audience of issued tokens; defaults to "repoxy".
+	Service string `yaml:"service,omitempty"`
+	// Issuer is the iss claim of issued tokens; defaults to "repoxy".
+	Issuer string `yaml:"issuer,omitempty"`
+	// Key is a PEM private key (ECDSA, RSA or Ed25519) to sign tokens with. A key generated at startup is used when
+	// empty, so tokens do not survive a restart or work across replicas.
+	Key string `yaml:"key,omitempty"`
+	// Expiry is how long issued tokens are valid; defaults to 5m.
+	Expiry time.Duration `yaml:"expiry,omitempty"`
+}
+
+// Default values for Config and TokenServiceConfig.
+const (
+	DefaultRealm       = "repoxy"
+	DefaultService     = "repoxy"
+	DefaultTokenExpiry = 5 * time.Minute
+)
+
+// Validate reports configuration errors in the auth block.
+func (c *Config) Validate() error {
+	if c == nil {
+		return nil
+	}
+	if c.Htpasswd == "" && len(c.Tokens) == 0 && len(c.OIDC) == 0 {
+		return fmt.Errorf("%w: htpasswd, tokens or oidc is required", ErrInvalidAuthConfig)
+	}
+	for i := range c.OIDC {
+		if err := c.OIDC[i].validate(); err != nil {
+			return err
+		}
+	}
+	seen := map[string]bool{}
+	for _, token := range c.Tokens {
+		if token.Name == "" || token.Token == "" {
+			return fmt.Errorf("%w: tokens need a name and a token", ErrInvalidAuthConfig)
+		}
+		if seen[token.Token] {
+			return fmt.Errorf("%w: token for %q is not unique", ErrInvalidAuthConfig, token.Name)
+		}
+		seen[token.Token] = true
+	}
+	if ts := c.TokenService; ts != nil {
+		if ts.Realm != "" {
+			if u, err := url.Parse(ts.Realm); err != nil || !u.IsAbs() {
+				return fmt.Errorf("%w: token_service.realm must be an absolute URL", ErrInvalidAuthConfig)
+			}
+		}
+		if ts.Expiry < 0 {
+			return fmt.Errorf("%w: token_service.expiry must not be negative", ErrInvalidAuthConfig)
+		}
+	}
+	return nil
+}
+
+func (c *Config) realm() string {
+	if c.Realm == "" {
+		return DefaultRealm
+	}
+	return c.Realm
+}
+
+func (c *TokenServiceConfig) service() string {
+	if c.Service == "" {
+		return DefaultService
+	}
+	return c.Service
+}
+
+func (c *TokenServiceConfig) issuer() string {
+	if c.Issuer == "" {
+		return DefaultService
+	}
+	return c.Issuer
+}
+
+func (c *TokenServiceConfig) expiry() time.Duration {
+	if c.Expiry <= 0 {
+		return DefaultTokenExpiry
+	}
+	return c.Expiry
+}
@@ -0,0 +1,114 @@
+package auth
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// htpasswdFile checks Basic credentials against an htpasswd file, reloading it when its size or modification time
+// changes.
+type htpasswdFile struct {
+	path string
+
+	mu       sync.Mutex
+	modTime  time.Time
+	size     int64
+	hashes   map[string]string
+	verified map[string][sha256.Size]byte // user -> hash of the last password that matched, so bcrypt runs once
+}
+
+func loadHtpasswd(path string) (*htpasswdFile, error) {
+	h := &htpasswdFile{path: path}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidAuthConfig, err)
+	}
+	if err := h.reloadLocked(info); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidAuthConfig, err)
+	}
+	return h, nil
+}
+
+// reloadLocked reads the file described by info; h.mu must be held unless h is not yet shared.
+func (h *htpasswdFile) reloadLocked(info os.FileInfo) error {
+	data, err := os.ReadFile(h.path)
+	if err != nil {
+		return err
+	}
+	hashes, err := parseHtpasswd(data)
+	if err != nil {
+		return fmt.Errorf("%s: %w", h.path, err)
+	}
+	h.hashes = hashes
+	h.verified = map[string][sha256.Size]byte{}
+	h.modTime, h.size = info.ModTime(), info.Size()
+	return nil
+}
+
+func parseHtpasswd(data []byte) (map[string]string, error) {
+	hashes := map[string]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		user, hash, ok := strings.Cut(text, ":")
+		if !ok || user == "" {
+			return nil, fmt.Errorf("line %d: expected user:hash", line)
+		}
+		if !strings.HasPrefix(hash, "$2") && !strings.HasPrefix(hash, "{SHA}") {
+			return nil, fmt.Errorf("line %d: unsupported hash for %q, use bcrypt (htpasswd -B)", line, user)
+		}
+		hashes[user] = hash
+	}
+	return hashes, scanner.Err()
+}
+
+// authenticate reports whether password matches the hash stored for user.
+func (h *htpasswdFile) authenticate(user, password string) bool {
+	h.mu.Lock()
+	if info, err := os.Stat(h.path); err != nil {
+		slog.Warn("failed to check htpasswd file, keeping loaded users", "path", h.path, "error", err)
+	} else if !info.ModTime().Equal(h.modTime) || info.Size() != h.size {
+		if err := h.reloadLocked(info); err != nil {
+			slog.Warn("failed to reload htpasswd file, keeping loaded users", "path", h.path, "error", err)
+		}
+	}
+	hash, ok := h.hashes[user]
+	sum := sha256.Sum256([]byte(password))
+	if previous, seen := h.verified[user]; ok && seen && subtle.ConstantTimeCompare(previous[:], sum[:]) == 1 {
+		h.mu.Unlock()
+		return true
+	}
+	h.mu.Unlock()
+	if !ok || !checkHtpasswdHash(hash, password) {
+		return false
+	}
+	h.mu.Lock()
+	if h.hashes[user] == hash {
+		h.verified[user] = sum
+	}
+	h.mu.Unlock()
+	return true
+}
+
+func checkHtpasswdHash(hash, password string) bool {
+	if digest, ok := strings.CutPrefix(hash, "{SHA}"); ok {
+		sum := sha1.Sum([]byte(password))
+		return subtle.ConstantTimeCompare([]byte(digest), []byte(base64.StdEncoding.EncodeToString(sum[:]))) == 1
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
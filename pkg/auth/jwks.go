@@ -0,0 +1,229 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// jwksRetryInterval is the minimum time between refreshes triggered by an unknown key ID.
+const jwksRetryInterval = time.Minute
+
+// maxJWKSBytes bounds the size of a JWKS document.
+const maxJWKSBytes = 1 << 20
+
+// jwks is a JSON Web Key Set read from a file or URL and cached for refresh.
+type jwks struct {
+	source  string
+	refresh time.Duration
+	client  *http.Client
+	now     func() time.Time
+
+	mu        sync.Mutex
+	keys      []jwk
+	loadedAt  time.Time
+	attempted time.Time
+	loading   chan struct{} // closed when the reload in progress finishes; nil when none is running
+}
+
+type jwk struct {
+	kid string
+	alg string
+	key crypto.PublicKey
+}
+
+func newJWKS(source string, refresh time.Duration) *jwks {
+	return &jwks{source: source, refresh: refresh, client: &http.Client{Timeout: 30 * time.Second}, now: time.Now}
+}
+
+// key returns the key with kid (or the only key when kid is empty) for alg. A set older than the refresh interval is
+// reloaded in the background while its keys keep being used; an unknown kid waits for a reload, at most once per
+// jwksRetryInterval, so rotated keys are picked up. Keys are never fetched while s.mu is held.
+func (s *jwks) key(ctx context.Context, alg, kid string) (crypto.PublicKey, error) {
+	now := s.now()
+	s.mu.Lock()
+	key, found := s.findLocked(alg, kid)
+	stale := s.keys == nil || now.Sub(s.loadedAt) >= s.refresh
+	retry := s.keys == nil || now.Sub(s.attempted) >= jwksRetryInterval
+	s.mu.Unlock()
+	if found {
+		if stale && retry {
+			s.reload(ctx, false)
+		}
+		return key, nil
+	}
+	if retry {
+		s.reload(ctx, true)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if key, ok := s.findLocked(alg, kid); ok {
+		return key, nil
+	}
+	if s.keys == nil {
+		return nil, fmt.Errorf("no keys loaded from %s", s.source)
+	}
+	return nil, fmt.Errorf("no key %q in %s", kid, s.source)
+}
+
+// reload replaces the keys from source unless a reload is already running, keeping the previous keys when loading
+// fails. With wait set it returns once the reload finishes or ctx is done.
+func (s *jwks) reload(ctx context.Context, wait bool) {
+	s.mu.Lock()
+	done := s.loading
+	if done == nil {
+		done = make(chan struct{})
+		s.loading = done
+		s.attempted = s.now()
+		go func() {
+			defer close(done)
+			loadCtx := context.WithoutCancel(ctx)
+			keys, err := s.load(loadCtx)
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			s.loading = nil
+			if err != nil {
+				slog.WarnContext(loadCtx, "failed to load JWKS, keeping previous keys", "source", s.source, "error", err)
+				return
+			}
+			s.keys, s.loadedAt = keys, s.now()
+		}()
+	}
+	s.mu.Unlock()
+	if wait {
+		select {
+		case <-done:
+		case <-ctx.Done():
+		}
+	}
+}
+
+func (s *jwks) findLocked(alg, kid string) (crypto.PublicKey, bool) {
+	var candidates []jwk
+	for _, k := range s.keys {
+		if (kid == "" || k.kid == kid) && (k.alg == "" || k.alg == alg) {
+			candidates = append(candidates, k)
+		}
+	}
+	if len(candidates) != 1 {
+		return nil, false
+	}
+	return candidates[0].key, true
+}
+
+func (s *jwks) load(ctx context.Context) ([]jwk, error) {
+	var data []byte
+	if strings.HasPrefix(s.source, "https://") || strings.HasPrefix(s.source, "http://") {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.source, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Accept", "application/json")
+		resp, err := s.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("unexpected status %d", resp.StatusCode)
+		}
+		if data, err = io.ReadAll(io.LimitReader(resp.Body, maxJWKSBytes)); err != nil {
+			return nil, err
+		}
+	} else {
+		var err error
+		if data, err = os.ReadFile(s.source); err != nil {
+			return nil, err
+		}
+	}
+	return parseJWKS(data)
+}
+
+// parseJWKS reads the signing keys of a JWKS document, skipping keys it cannot use.
+func parseJWKS(data []byte) ([]jwk, error) {
+	var doc struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Alg string `json:"alg"`
+			Use string `json:"use"`
+			Crv string `json:"crv"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("malformed JWKS: %w", err)
+	}
+	keys := make([]jwk, 0, len(doc.Keys))
+	for _, raw := range doc.Keys {
+		if raw.Use != "" && raw.Use != "sig" {
+			continue
+		}
+		key, err := func() (crypto.PublicKey, error) {
+			switch raw.Kty {
+			case "RSA":
+				n, e := decodeBase64URLInt(raw.N), decodeBase64URLInt(raw.E)
+				if n == nil || e == nil || !e.IsInt64() {
+					return nil, errors.New("invalid RSA key")
+				}
+				return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+			case "EC":
+				curves := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}
+				curve, ok := curves[raw.Crv]
+				if !ok {
+					return nil, fmt.Errorf("unsupported curve %q", raw.Crv)
+				}
+				size := (curve.Params().BitSize + 7) / 8
+				x, y := decodeBase64URLInt(raw.X), decodeBase64URLInt(raw.Y)
+				if x == nil || y == nil || x.BitLen() > curve.Params().BitSize || y.BitLen() > curve.Params().BitSize {
+					return nil, errors.New("invalid EC key")
+				}
+				point := append([]byte{4}, append(x.FillBytes(make([]byte, size)), y.FillBytes(make([]byte, size))...)...)
+				return ecdsa.ParseUncompressedPublicKey(curve, point)
+			case "OKP":
+				x, err := base64.RawURLEncoding.DecodeString(raw.X)
+				if raw.Crv != "Ed25519" || err != nil || len(x) != ed25519.PublicKeySize {
+					return nil, errors.New("invalid Ed25519 key")
+				}
+				return ed25519.PublicKey(x), nil
+			default:
+				return nil, fmt.Errorf("unsupported key type %q", raw.Kty)
+			}
+		}()
+		if err != nil {
+			slog.Warn("skipping unusable JWKS key", "kid", raw.Kid, "error", err)
+			continue
+		}
+		keys = append(keys, jwk{kid: raw.Kid, alg: raw.Alg, key: key})
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("JWKS has no usable signing keys")
+	}
+	return keys, nil
+}
+
+func decodeBase64URLInt(s string) *big.Int {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(data) == 0 {
+		return nil
+	}
+	return new(big.Int).SetBytes(data)
+}
@@ -0,0 +1,306 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+)
+
+// clockSkew is how far exp and nbf may be off before a token is rejected.
+const clockSkew = time.Minute
+
+// tokenClaims are the registered JWT claims plus the Docker registry access claim and the subject's groups.
+type tokenClaims struct {
+	Issuer    string   `json:"iss,omitempty"`
+	Subject   string   `json:"sub,omitempty"`
+	Audience  audience `json:"aud,omitempty"`
+	ExpiresAt int64    `json:"exp,omitempty"`
+	NotBefore int64    `json:"nbf,omitempty"`
+	IssuedAt  int64    `json:"iat,omitempty"`
+	ID        string   `json:"jti,omitempty"`
+	Access    []Access `json:"access,omitempty"`
+	Groups    []string `json:"groups,omitempty"`
+}
+
+// audience is the aud claim, which may be a single string or a list.
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return fmt.Errorf("invalid aud claim: %w", err)
+	}
+	*a = list
+	return nil
+}
+
+func (a audience) MarshalJSON() ([]byte, error) {
+	if len(a) == 1 {
+		return json.Marshal(a[0])
+	}
+	return json.Marshal([]string(a))
+}
+
+func (a audience) contains(value string) bool {
+	for _, entry := range a {
+		if entry == value {
+			return true
+		}
+	}
+	return false
+}
+
+// validAt checks the time claims of c at now.
+func (c *tokenClaims) validAt(now time.Time) error {
+	if c.ExpiresAt == 0 {
+		return errors.New("token has no expiry")
+	}
+	if now.After(time.Unix(c.ExpiresAt, 0).Add(clockSkew)) {
+		return errors.New("token has expired")
+	}
+	if c.NotBefore != 0 && now.Add(clockSkew).Before(time.Unix(c.NotBefore, 0)) {
+		return errors.New("token is not valid yet")
+	}
+	return nil
+}
+
+// signingKey signs the JWTs issued by the token service.
+type signingKey struct {
+	signer crypto.Signer
+	alg    string
+	kid    string
+}
+
+// loadSigningKey reads a PEM private key, or generates an ECDSA P-256 key when file is empty.
+func loadSigningKey(file string) (*signingKey, error) {
+	if file == "" {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		return newSigningKey(key)
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to read token signing key: %v", ErrInvalidAuthConfig, err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%w: %s is not a PEM file", ErrInvalidAuthConfig, file)
+	}
+	var key any
+	switch block.Type {
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	default:
+		err = fmt.Errorf("unsupported PEM block %q", block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: token signing key %s: %v", ErrInvalidAuthConfig, file, err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("%w: token signing key %s cannot sign", ErrInvalidAuthConfig, file)
+	}
+	return newSigningKey(signer)
+}
+
+func newSigningKey(signer crypto.Signer) (*signingKey, error) {
+	k := &signingKey{signer: signer}
+	switch key := signer.Public().(type) {
+	case *ecdsa.PublicKey:
+		switch key.Curve {
+		case elliptic.P256():
+			k.alg = "ES256"
+		case elliptic.P384():
+			k.alg = "ES384"
+		case elliptic.P521():
+			k.alg = "ES512"
+		default:
+			return nil, fmt.Errorf("%w: unsupported token signing curve", ErrInvalidAuthConfig)
+		}
+	case *rsa.PublicKey:
+		k.alg = "RS256"
+	case ed25519.PublicKey:
+		k.alg = "EdDSA"
+	default:
+		return nil, fmt.Errorf("%w: unsupported token signing key type %T", ErrInvalidAuthConfig, key)
+	}
+	der, err := x509.MarshalPKIXPublicKey(signer.Public())
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(der)
+	k.kid = base64.RawURLEncoding.EncodeToString(sum[:12])
+	return k, nil
+}
+
+// sign returns claims as a compact JWS.
+func (k *signingKey) sign(claims any) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": k.alg, "typ": "JWT", "kid": k.kid})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	input := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	var sig []byte
+	hash := jwsHash(k.alg)
+	switch signer := k.signer.(type) {
+	case ed25519.PrivateKey:
+		sig = ed25519.Sign(signer, []byte(input))
+	case *ecdsa.PrivateKey:
+		// JWS wants fixed-size r||s rather than the ASN.1 crypto.Signer produces.
+		h := hash.New()
+		h.Write([]byte(input))
+		r, s, err := ecdsa.Sign(rand.Reader, signer, h.Sum(nil))
+		if err != nil {
+			return "", err
+		}
+		size := (signer.Curve.Params().BitSize + 7) / 8
+		sig = append(r.FillBytes(make([]byte, size)), s.FillBytes(make([]byte, size))...)
+	default:
+		h := hash.New()
+		h.Write([]byte(input))
+		if sig, err = k.signer.Sign(rand.Reader, h.Sum(nil), hash); err != nil {
+			return "", err
+		}
+	}
+	return input + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// parseJWT verifies the compact JWS token with the key returned by keyFor and decodes its payload into each of claims.
+func parseJWT(token string, keyFor func(alg, kid string) (crypto.PublicKey, error), claims ...any) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return errors.New("malformed token")
+	}
+	rawHeader, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return errors.New("malformed token header")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := json.Unmarshal(rawHeader, &header); err != nil {
+		return errors.New("malformed token header")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return errors.New("malformed token signature")
+	}
+	key, err := keyFor(header.Alg, header.Kid)
+	if err != nil {
+		return err
+	}
+	if err := verifyJWS(header.Alg, key, []byte(parts[0]+"."+parts[1]), sig); err != nil {
+		return err
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return errors.New("malformed token payload")
+	}
+	for _, target := range claims {
+		if err := json.Unmarshal(payload, target); err != nil {
+			return fmt.Errorf("malformed token claims: %w", err)
+		}
+	}
+	return nil
+}
+
+// peekIssuer returns the iss claim of token without verifying it, to choose the key to verify it with.
+func peekIssuer(token string) string {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return ""
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return ""
+	}
+	var claims struct {
+		Issuer string `json:"iss"`
+	}
+	_ = json.Unmarshal(payload, &claims)
+	return claims.Issuer
+}
+
+func jwsHash(alg string) crypto.Hash {
+	switch alg[len(alg)-3:] {
+	case "256":
+		return crypto.SHA256
+	case "384":
+		return crypto.SHA384
+	case "512":
+		return crypto.SHA512
+	}
+	return 0
+}
+
+// verifyJWS checks a JWS signature for the RS*, PS*, ES* and EdDSA algorithms.
+func verifyJWS(alg string, key crypto.PublicKey, input, sig []byte) error {
+	if len(alg) < 5 {
+		return fmt.Errorf("unsupported token algorithm %q", alg)
+	}
+	if alg == "EdDSA" {
+		if key, ok := key.(ed25519.PublicKey); ok && ed25519.Verify(key, input, sig) {
+			return nil
+		}
+		return errors.New("token signature does not verify")
+	}
+	hash := jwsHash(alg)
+	if hash == 0 {
+		return fmt.Errorf("unsupported token algorithm %q", alg)
+	}
+	h := hash.New()
+	h.Write(input)
+	sum := h.Sum(nil)
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		switch alg[:2] {
+		case "RS":
+			if rsa.VerifyPKCS1v15(key, hash, sum, sig) == nil {
+				return nil
+			}
+		case "PS":
+			if rsa.VerifyPSS(key, hash, sum, sig, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash}) == nil {
+				return nil
+			}
+		}
+	case *ecdsa.PublicKey:
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if alg[:2] == "ES" && len(sig) == 2*size {
+			r, s := new(big.Int).SetBytes(sig[:size]), new(big.Int).SetBytes(sig[size:])
+			if ecdsa.Verify(key, sum, r, s) {
+				return nil
+			}
+		}
+	}
+	return errors.New("token signature does not verify")
+}
@@ -0,0 +1,171 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"errors"
+	"fmt"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultJWKSRefresh is how long a JWKS is cached when OIDCConfig.Refresh is unset.
+const DefaultJWKSRefresh = time.Hour
+
+// MethodOIDC is recorded on principals authenticated by an OIDC token.
+const MethodOIDC = "oidc"
+
+// OIDCConfig accepts the ID tokens of an OpenID Connect issuer, such as GitHub Actions or Kubernetes service
+// accounts, as client credentials.
+type OIDCConfig struct {
+	// Issuer must equal the iss claim.
+	Issuer string `yaml:"issuer"`
+	// Audience must be one of the aud claim values.
+	Audience string `yaml:"audience"`
+	// JWKS is the URL or file path of the issuer's signing keys.
+	JWKS string `yaml:"jwks"`
+	// Refresh is how long the keys are cached; defaults to 1h. Unknown key IDs trigger an earlier refresh.
+	Refresh time.Duration `yaml:"refresh,omitempty"`
+	// NameClaim is the claim used as the principal name; defaults to "sub".
+	NameClaim string `yaml:"name_claim,omitempty"`
+	// GroupsClaim optionally names a claim, a string or a list of strings, whose values become the principal's groups.
+	GroupsClaim string `yaml:"groups_claim,omitempty"`
+	// Prefix is prepended to the principal name and groups, e.g. "github:", to keep them apart from local users.
+	// Defaults to the issuer host followed by a colon.
+	Prefix string `yaml:"prefix,omitempty"`
+	// Claims are required claim values as path.Match globs, e.g. repository_owner: my-org. At least one is needed,
+	// since public issuers sign tokens for anyone who asks.
+	Claims map[string]string `yaml:"claims,omitempty"`
+}
+
+func (c *OIDCConfig) validate() error {
+	if c.Issuer == "" || c.Audience == "" || c.JWKS == "" {
+		return fmt.Errorf("%w: oidc providers need an issuer, audience and jwks", ErrInvalidAuthConfig)
+	}
+	if c.Refresh < 0 {
+		return fmt.Errorf("%w: oidc refresh must not be negative", ErrInvalidAuthConfig)
+	}
+	if len(c.Claims) == 0 {
+		return fmt.Errorf("%w: oidc provider %s needs at least one required claim", ErrInvalidAuthConfig, c.Issuer)
+	}
+	for claim, pattern := range c.Claims {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("%w: invalid pattern %q for claim %q", ErrInvalidAuthConfig, pattern, claim)
+		}
+	}
+	return nil
+}
+
+// oidcProvider validates the tokens of one OIDC issuer.
+type oidcProvider struct {
+	config OIDCConfig
+	keys   *jwks
+	now    func() time.Time
+}
+
+var _ TokenAuthenticator = (*oidcProvider)(nil)
+
+// newOIDCProvider returns a provider for config. Keys from a file are loaded now so a bad file fails at startup;
+// keys from a URL are fetched on first use.
+func newOIDCProvider(ctx context.Context, config OIDCConfig) (*oidcProvider, error) {
+	refresh := config.Refresh
+	if refresh <= 0 {
+		refresh = DefaultJWKSRefresh
+	}
+	if config.Prefix == "" {
+		config.Prefix = issuerPrefix(config.Issuer)
+	}
+	p := &oidcProvider{config: config, keys: newJWKS(config.JWKS, refresh), now: time.Now}
+	if !strings.HasPrefix(config.JWKS, "https://") && !strings.HasPrefix(config.JWKS, "http://") {
+		keys, err := p.keys.load(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("%w: jwks for %s: %v", ErrInvalidAuthConfig, config.Issuer, err)
+		}
+		p.keys.keys, p.keys.loadedAt = keys, p.now()
+	}
+	return p, nil
+}
+
+// AuthenticateToken implements TokenAuthenticator.
+func (p *oidcProvider) AuthenticateToken(ctx context.Context, token string) (*Principal, error) {
+	if peekIssuer(token) != p.config.Issuer {
+		return nil, ErrUnknownToken
+	}
+	var registered tokenClaims
+	var claims map[string]any
+	err := parseJWT(token, func(alg, kid string) (crypto.PublicKey, error) {
+		return p.keys.key(ctx, alg, kid)
+	}, &registered, &claims)
+	if err != nil {
+		return nil, err
+	}
+	if err := registered.validAt(p.now()); err != nil {
+		return nil, err
+	}
+	if !registered.Audience.contains(p.config.Audience) {
+		return nil, errors.New("token audience does not include " + p.config.Audience)
+	}
+	for claim, pattern := range p.config.Claims {
+		value := claimString(claims[claim])
+		if ok, _ := path.Match(pattern, value); !ok || value == "" {
+			return nil, fmt.Errorf("claim %q does not match", claim)
+		}
+	}
+	nameClaim := p.config.NameClaim
+	if nameClaim == "" {
+		nameClaim = "sub"
+	}
+	name := claimString(claims[nameClaim])
+	if name == "" {
+		return nil, fmt.Errorf("token has no %q claim", nameClaim)
+	}
+	principal := &Principal{Name: p.config.Prefix + name, Method: MethodOIDC}
+	if p.config.GroupsClaim != "" {
+		for _, group := range claimStrings(claims[p.config.GroupsClaim]) {
+			principal.Groups = append(principal.Groups, p.config.Prefix+group)
+		}
+	}
+	return principal, nil
+}
+
+// issuerPrefix returns the default principal prefix for issuer: its host, or the whole issuer when it is not a URL.
+func issuerPrefix(issuer string) string {
+	if u, err := url.Parse(issuer); err == nil && u.Host != "" {
+		return u.Host + ":"
+	}
+	return issuer + ":"
+}
+
+// claimString returns a scalar claim as a string, or "" for anything else.
+func claimString(value any) string {
+	switch value := value.(type) {
+	case string:
+		return value
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(value)
+	default:
+		return ""
+	}
+}
+
+// claimStrings returns a claim holding a string or a list of strings as a list.
+func claimStrings(value any) []string {
+	if list, ok := value.([]any); ok {
+		var values []string
+		for _, entry := range list {
+			if s := claimString(entry); s != "" {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	if s := claimString(value); s != "" {
+		return []string{s}
+	}
+	return nil
+}
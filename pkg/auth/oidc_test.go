@@ -0,0 +1,376 @@
+package auth
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestKey returns a signing key and its JWKS entry.
+func newTestKey(t *testing.T, kind string) (*signingKey, map[string]string) {
+	t.Helper()
+	b64 := func(n *big.Int, size int) string {
+		return base64.RawURLEncoding.EncodeToString(n.FillBytes(make([]byte, size)))
+	}
+	var key *signingKey
+	var entry map[string]string
+	var err error
+	switch kind {
+	case "EC":
+		private, genErr := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if genErr != nil {
+			t.Fatalf("generate key: %v", genErr)
+		}
+		key, err = newSigningKey(private)
+		entry = map[string]string{"kty": "EC", "crv": "P-256", "x": b64(private.X, 32), "y": b64(private.Y, 32)}
+	case "RSA":
+		private, genErr := rsa.GenerateKey(rand.Reader, 2048)
+		if genErr != nil {
+			t.Fatalf("generate key: %v", genErr)
+		}
+		key, err = newSigningKey(private)
+		entry = map[string]string{"kty": "RSA", "n": b64(private.N, private.Size()), "e": "AQAB"}
+	case "OKP":
+		public, private, genErr := ed25519.GenerateKey(rand.Reader)
+		if genErr != nil {
+			t.Fatalf("generate key: %v", genErr)
+		}
+		key, err = newSigningKey(private)
+		entry = map[string]string{"kty": "OKP", "crv": "Ed25519", "x": base64.RawURLEncoding.EncodeToString(public)}
+	}
+	if err != nil {
+		t.Fatalf("signing key: %v", err)
+	}
+	entry["kid"], entry["alg"], entry["use"] = key.kid, key.alg, "sig"
+	return key, entry
+}
+
+func marshalJWKS(t *testing.T, entries ...map[string]string) []byte {
+	t.Helper()
+	data, err := json.Marshal(map[string]any{"keys": entries})
+	if err != nil {
+		t.Fatalf("marshal JWKS: %v", err)
+	}
+	return data
+}
+
+// githubClaims returns claims shaped like a GitHub Actions ID token.
+func githubClaims(now time.Time, overrides map[string]any) map[string]any {
+	claims := map[string]any{
+		"iss":              "https://token.actions.githubusercontent.com",
+		"aud":              "repoxy",
+		"sub":              "repo:my-org/app:ref:refs/heads/main",
+		"repository":       "my-org/app",
+		"repository_owner": "my-org",
+		"exp":              now.Add(5 * time.Minute).Unix(),
+		"iat":              now.Unix(),
+	}
+	for name, value := range overrides {
+		if value == nil {
+			delete(claims, name)
+		} else {
+			claims[name] = value
+		}
+	}
+	return claims
+}
+
+func TestOIDCProviderValidatesTokensFromJWKSFile(t *testing.T) {
+	t.Parallel()
+	ecKey, ecEntry := newTestKey(t, "EC")
+	rsaKey, rsaEntry := newTestKey(t, "RSA")
+	edKey, edEntry := newTestKey(t, "OKP")
+	file := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(file, marshalJWKS(t, ecEntry, rsaEntry, edEntry), 0o600); err != nil {
+		t.Fatalf("write JWKS: %v", err)
+	}
+	provider, err := newOIDCProvider(context.Background(), OIDCConfig{
+		Issuer:      "https://token.actions.githubusercontent.com",
+		Audience:    "repoxy",
+		JWKS:        file,
+		NameClaim:   "repository",
+		GroupsClaim: "repository_owner",
+		Prefix:      "github:",
+		Claims:      map[string]string{"repository_owner": "my-org", "sub": "repo:my-org/*:ref:refs/heads/*"},
+	})
+	if err != nil {
+		t.Fatalf("newOIDCProvider failed: %v", err)
+	}
+	now := time.Now()
+
+	for _, key := range []*signingKey{ecKey, rsaKey, edKey} {
+		token, err := key.sign(githubClaims(now, nil))
+		if err != nil {
+			t.Fatalf("sign: %v", err)
+		}
+		principal, err := provider.AuthenticateToken(context.Background(), token)
+		if err != nil {
+			t.Fatalf("%s: expected token to validate, got %v", key.alg, err)
+		}
+		if principal.Name != "github:my-org/app" || principal.Method != MethodOIDC ||
+			len(principal.Groups) != 1 || principal.Groups[0] != "github:my-org" {
+			t.Fatalf("%s: unexpected principal %+v", key.alg, principal)
+		}
+	}
+
+	other, _ := newTestKey(t, "EC")
+	otherToken, _ := other.sign(githubClaims(now, nil))
+	rejected := map[string]string{
+		"wrong audience":   mustSign(t, ecKey, githubClaims(now, map[string]any{"aud": []string{"sigstore"}})),
+		"claim mismatch":   mustSign(t, ecKey, githubClaims(now, map[string]any{"repository_owner": "someone-else"})),
+		"missing claim":    mustSign(t, ecKey, githubClaims(now, map[string]any{"repository_owner": nil})),
+		"expired":          mustSign(t, ecKey, githubClaims(now.Add(-time.Hour), nil)),
+		"no expiry":        mustSign(t, ecKey, githubClaims(now, map[string]any{"exp": nil})),
+		"missing name":     mustSign(t, ecKey, githubClaims(now, map[string]any{"repository": nil})),
+		"unknown key":      otherToken,
+		"tampered":         tamper(mustSign(t, ecKey, githubClaims(now, nil))),
+		"sub glob differs": mustSign(t, ecKey, githubClaims(now, map[string]any{"sub": "repo:other-org/app:ref:refs/heads/main"})),
+	}
+	for name, token := range rejected {
+		if _, err := provider.AuthenticateToken(context.Background(), token); err == nil || errors.Is(err, ErrUnknownToken) {
+			t.Fatalf("%s: expected token to be rejected, got %v", name, err)
+		}
+	}
+	foreign := mustSign(t, ecKey, githubClaims(now, map[string]any{"iss": "https://kubernetes.default.svc"}))
+	if _, err := provider.AuthenticateToken(context.Background(), foreign); !errors.Is(err, ErrUnknownToken) {
+		t.Fatalf("expected token of another issuer to be passed on, got %v", err)
+	}
+
+	if _, err := newOIDCProvider(context.Background(), OIDCConfig{Issuer: "x", Audience: "y", JWKS: filepath.Join(t.TempDir(), "missing")}); !errors.Is(err, ErrInvalidAuthConfig) {
+		t.Fatalf("expected missing JWKS file to be rejected, got %v", err)
+	}
+}
+
+func TestParseJWKSSkipsOversizedECCoordinates(t *testing.T) {
+	t.Parallel()
+	good, goodEntry := newTestKey(t, "EC")
+	_, badEntry := newTestKey(t, "EC")
+	badEntry["kid"] = "oversized"
+	badEntry["x"] = base64.RawURLEncoding.EncodeToString(append([]byte{1}, make([]byte, 32)...))
+	keys, err := parseJWKS(marshalJWKS(t, badEntry, goodEntry))
+	if err != nil {
+		t.Fatalf("parseJWKS: %v", err)
+	}
+	if len(keys) != 1 || keys[0].kid != good.kid {
+		t.Fatalf("expected only the valid key, got %+v", keys)
+	}
+	if _, err := parseJWKS(marshalJWKS(t, badEntry)); err == nil {
+		t.Fatalf("expected a JWKS with only an oversized key to be rejected")
+	}
+}
+
+func TestOIDCProviderRefreshesRotatedJWKS(t *testing.T) {
+	t.Parallel()
+	first, firstEntry := newTestKey(t, "EC")
+	second, secondEntry := newTestKey(t, "RSA")
+	var mu sync.Mutex
+	served, fetches := marshalJWKS(t, firstEntry), 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		fetches++
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(served)
+	}))
+	defer server.Close()
+	fetched := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return fetches
+	}
+
+	provider, err := newOIDCProvider(context.Background(), OIDCConfig{
+		Issuer:   "https://kubernetes.default.svc",
+		Audience: "repoxy",
+		JWKS:     server.URL + "/openid/v1/jwks",
+	})
+	if err != nil {
+		t.Fatalf("newOIDCProvider failed: %v", err)
+	}
+	clock := time.Now()
+	provider.now = func() time.Time { return clock }
+	provider.keys.now = func() time.Time { return clock }
+	claims := func() map[string]any {
+		return map[string]any{
+			"iss": "https://kubernetes.default.svc",
+			"aud": []string{"repoxy", "api"},
+			"sub": "system:serviceaccount:ci:builder",
+			"exp": clock.Add(time.Hour).Unix(),
+		}
+	}
+
+	for i := 0; i < 3; i++ {
+		if _, err := provider.AuthenticateToken(context.Background(), mustSign(t, first, claims())); err != nil {
+			t.Fatalf("expected token to validate, got %v", err)
+		}
+	}
+	if fetched() != 1 {
+		t.Fatalf("expected JWKS to be cached, fetched %d times", fetched())
+	}
+
+	// The issuer rotates to a new key; an unknown kid triggers a refresh, but not more often than jwksRetryInterval.
+	mu.Lock()
+	served = marshalJWKS(t, secondEntry)
+	mu.Unlock()
+	clock = clock.Add(2 * jwksRetryInterval)
+	principal, err := provider.AuthenticateToken(context.Background(), mustSign(t, second, claims()))
+	if err != nil || principal.Name != "kubernetes.default.svc:system:serviceaccount:ci:builder" {
+		t.Fatalf("expected rotated key to validate, got %+v %v", principal, err)
+	}
+	if _, err := provider.AuthenticateToken(context.Background(), mustSign(t, first, claims())); err == nil {
+		t.Fatal("expected token signed by the retired key to be rejected")
+	}
+	if fetched() != 2 {
+		t.Fatalf("expected a single refresh for unknown kids, fetched %d times", fetched())
+	}
+
+	// Keys are kept when the issuer is unreachable.
+	server.Close()
+	clock = clock.Add(DefaultJWKSRefresh)
+	if _, err := provider.AuthenticateToken(context.Background(), mustSign(t, second, claims())); err != nil {
+		t.Fatalf("expected cached keys to survive a failed refresh, got %v", err)
+	}
+}
+
+func TestJWKSKeepsServingKnownKeysDuringSlowReload(t *testing.T) {
+	t.Parallel()
+	key, entry := newTestKey(t, "EC")
+	body := marshalJWKS(t, entry)
+	release := make(chan struct{})
+	var fetches atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fetches.Add(1) > 1 {
+			<-release
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(body)
+	}))
+	defer server.Close()
+	defer close(release)
+
+	keys := newJWKS(server.URL, time.Hour)
+	clock := time.Now()
+	keys.now = func() time.Time { return clock }
+	if _, err := keys.key(context.Background(), key.alg, key.kid); err != nil {
+		t.Fatalf("expected key to load, got %v", err)
+	}
+	clock = clock.Add(2 * time.Hour)
+	done := make(chan error, 1)
+	go func() {
+		_, err := keys.key(context.Background(), key.alg, key.kid)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("expected the cached key while reloading, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("key lookup waited for the JWKS reload")
+	}
+	for deadline := time.Now().Add(5 * time.Second); fetches.Load() < 2; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the stale keys to be reloaded in the background")
+		}
+	}
+	if _, err := keys.key(context.Background(), key.alg, "unknown"); err == nil {
+		t.Fatal("expected an unknown kid to be rejected")
+	}
+}
+
+func TestAuthenticatorAcceptsOIDCTokens(t *testing.T) {
+	t.Parallel()
+	key, entry := newTestKey(t, "EC")
+	file := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(file, marshalJWKS(t, entry), 0o600); err != nil {
+		t.Fatalf("write JWKS: %v", err)
+	}
+	config := &Config{
+		TokenService: &TokenServiceConfig{},
+		OIDC: []OIDCConfig{{
+			Issuer:      "https://token.actions.githubusercontent.com",
+			Audience:    "repoxy",
+			JWKS:        file,
+			GroupsClaim: "repository_owner",
+			Prefix:      "github:",
+			Claims:      map[string]string{"repository_owner": "my-org"},
+		}},
+	}
+	if err := config.Validate(); err != nil {
+		t.Fatalf("Validate failed: %v", err)
+	}
+	a, err := New(context.Background(), config)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	token := mustSign(t, key, githubClaims(time.Now(), nil))
+
+	req := httptest.NewRequest(http.MethodGet, "/v1/providers/hashicorp/aws/versions", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	if rr, principal := serveAuthenticated(a, req); rr.Code != http.StatusOK || principal.Name != "github:repo:my-org/app:ref:refs/heads/main" {
+		t.Fatalf("expected bearer OIDC token to authenticate, got %d %+v", rr.Code, principal)
+	}
+
+	// docker login -u ci -p $ID_TOKEN, then the token service keeps the identity and groups.
+	tokenReq := httptest.NewRequest(http.MethodGet, TokenPath+"?scope=repository:library/alpine:pull", nil)
+	tokenReq.SetBasicAuth("ci", token)
+	tokenRR := httptest.NewRecorder()
+	a.ServeToken(tokenRR, tokenReq)
+	var issued struct {
+		Token string `json:"token"`
+	}
+	if tokenRR.Code != http.StatusOK || json.Unmarshal(tokenRR.Body.Bytes(), &issued) != nil {
+		t.Fatalf("unexpected token response %d %s", tokenRR.Code, tokenRR.Body.String())
+	}
+	req = httptest.NewRequest(http.MethodGet, "/v2/library/alpine/manifests/latest", nil)
+	req.Header.Set("Authorization", "Bearer "+issued.Token)
+	rr, principal := serveAuthenticated(a, req)
+	if rr.Code != http.StatusOK || principal.Method != MethodRegistryToken || len(principal.Groups) != 1 || principal.Groups[0] != "github:my-org" {
+		t.Fatalf("expected registry token to carry the OIDC identity, got %d %+v", rr.Code, principal)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/v1/providers/hashicorp/aws/versions", nil)
+	req.Header.Set("Authorization", "Bearer "+tamper(token))
+	if rr, _ := serveAuthenticated(a, req); rr.Code != http.StatusUnauthorized {
+		t.Fatalf("expected tampered token to be rejected, got %d", rr.Code)
+	}
+	if err := (&Config{OIDC: []OIDCConfig{{Issuer: "x", JWKS: file}}}).Validate(); !errors.Is(err, ErrInvalidAuthConfig) {
+		t.Fatalf("expected oidc provider without an audience to be rejected, got %v", err)
+	}
+	if err := (&Config{OIDC: []OIDCConfig{{Issuer: "x", Audience: "y", JWKS: file}}}).Validate(); !errors.Is(err, ErrInvalidAuthConfig) {
+		t.Fatalf("expected oidc provider without required claims to be rejected, got %v", err)
+	}
+}
+
+func mustSign(t *testing.T, key *signingKey, claims map[string]any) string {
+	t.Helper()
+	token, err := key.sign(claims)
+	if err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	return token
+}
+
+// tamper changes the payload of token without re-signing it.
+func tamper(token string) string {
+	parts := strings.Split(token, ".")
+	payload, _ := base64.RawURLEncoding.DecodeString(parts[1])
+	payload = []byte(strings.Replace(string(payload), "my-org", "my-0rg", 1))
+	return parts[0] + "." + base64.RawURLEncoding.EncodeToString(payload) + "." + parts[2]
+}
@@ -0,0 +1,119 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// TokenPath is where serve mounts the token service.
+const TokenPath = "/auth/token"
+
+// IssuesTokens reports whether the token service is configured.
+func (a *Authenticator) IssuesTokens() bool {
+	return a != nil && a.key != nil
+}
+
+// ServeToken implements the Docker registry token endpoint. Clients present Basic credentials (or a static token or
+// an earlier registry token) and receive a JWT for the requested scopes.
+func (a *Authenticator) ServeToken(w http.ResponseWriter, r *http.Request) {
+	principal, err := a.Authenticate(r)
+	if principal == nil {
+		if err != nil {
+			slog.InfoContext(r.Context(), "token request authentication failed", "error", err)
+		} else {
+			err = errInvalidCredentials
+		}
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", a.config.realm()))
+		writeJSON(w, http.StatusUnauthorized, map[string]any{
+			"errors": []map[string]string{{"code": "UNAUTHORIZED", "message": err.Error()}},
+		})
+		return
+	}
+	r = bind(r, principal)
+	ts := a.config.TokenService
+	query := r.URL.Query()
+	if service := query.Get("service"); service != "" && service != ts.service() {
+		writeTokenError(w, fmt.Sprintf("unknown service %q", service))
+		return
+	}
+	var access []Access
+	for _, param := range query["scope"] {
+		for _, scope := range strings.Fields(param) {
+			parsed, ok := parseScope(scope)
+			if !ok {
+				writeTokenError(w, fmt.Sprintf("invalid scope %q", scope))
+				return
+			}
+			access = append(access, parsed)
+		}
+	}
+	now := a.now()
+	id := make([]byte, 16)
+	_, _ = rand.Read(id)
+	token, err := a.key.sign(tokenClaims{
+		Issuer:    ts.issuer(),
+		Subject:   principal.Name,
+		Audience:  audience{ts.service()},
+		ExpiresAt: now.Add(ts.expiry()).Unix(),
+		NotBefore: now.Unix(),
+		IssuedAt:  now.Unix(),
+		ID:        hex.EncodeToString(id),
+		Access:    access,
+		Groups:    principal.Groups,
+	})
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to sign registry token", "error", err)
+		writeJSON(w, http.StatusInternalServerError, map[string][]string{"errors": {"failed to issue token"}})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"token":        token,
+		"access_token": token,
+		"expires_in":   int(ts.expiry().Seconds()),
+		"issued_at":    now.UTC().Format(time.RFC3339),
+	})
+}
+
+func writeTokenError(w http.ResponseWriter, message string) {
+	writeJSON(w, http.StatusBadRequest, map[string]any{
+		"errors": []map[string]string{{"code": "UNSUPPORTED", "message": message}},
+	})
+}
+
+// parseScope reads "type:name:action,action". Names may contain ':' (a registry host with a port), so the type ends
+// at the first colon and the actions start after the last.
+func parseScope(scope string) (Access, bool) {
+	kind, rest, ok := strings.Cut(scope, ":")
+	if !ok {
+		return Access{}, false
+	}
+	i := strings.LastIndex(rest, ":")
+	if kind == "" || i <= 0 || i == len(rest)-1 {
+		return Access{}, false
+	}
+	return Access{Type: kind, Name: rest[:i], Actions: strings.Split(rest[i+1:], ",")}, true
+}
+
+// tokenRealm returns the absolute URL of the token service as seen by the client of r.
+func (a *Authenticator) tokenRealm(r *http.Request) string {
+	if realm := a.config.TokenService.Realm; realm != "" {
+		return realm
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" {
+		scheme = proto
+	}
+	host := r.Host
+	if forwarded := r.Header.Get("X-Forwarded-Host"); forwarded != "" {
+		host = forwarded
+	}
+	return scheme + "://" + host + TokenPath
+}
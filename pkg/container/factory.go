@@ -2,8 +2,12 @@ package container
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
+	"log/slog"
 	"net/http"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -59,25 +63,60 @@ func (f *factory) Initialize(ctx context.Context, typeName string, mux *mux.Serv
 	//manifests
 	mux.HandleFunc("GET|PUT|DELETE /v2/{name...}/manifests/{tag}", f.HandleV2Manifest) //note tag may also match manifest
 
+	//referrers
+	mux.HandleFunc("GET /v2/{name...}/referrers/{digest}", f.HandleV2Referrers) //auto HEAD
+
 	//blobs
 	mux.HandleFunc("POST /v2/{name...}/blobs/uploads/", f.HandleV2BlobUpload)
-	mux.HandleFunc("PATCH|PUT|DELETE /v2/{name...}/blobs/uploads/{uuid}", f.HandleV2BlobUID)
+	mux.HandleFunc("GET|PATCH|PUT|DELETE /v2/{name...}/blobs/uploads/{uuid}", f.HandleV2BlobUID)
 	mux.HandleFunc("GET|DELETE /v2/{name...}/blobs/{digest}", f.HandleV2BlobByDigest) //auto HEAD
 	return nil
 }
 
-// lookupParam extracts the Container repository instance from the request path.
-// This is a placeholder implementation.
-func (f *factory) lookupParam(r *http.Request) (*containerRegistryInstance, *param) {
+// lookupParam extracts the Container repository instance from the request path and checks the client may perform the
+// request there. When no instance maps the name or access is denied it answers r itself and returns a nil instance.
+func (f *factory) lookupParam(w http.ResponseWriter, r *http.Request) (*containerRegistryInstance, *param) {
 	param := &param{
 		name:   r.PathValue("name"),
 		tag:    r.PathValue("tag"),
 		uuid:   r.PathValue("uuid"),
 		digest: r.PathValue("digest"),
 	}
+	instance := f.bestInstance(param.name)
+	if instance == nil {
+		f.HandleNotFound(w, r)
+		return nil, param
+	}
+	if action := requiredAction(r); !repo.Authorized(r.Context(), &instance.config, param.name, action) {
+		slog.InfoContext(r.Context(), "request denied by access control", "name", param.name, "action", action)
+		instance.recordDenied(repo.AccessDenied)
+		writeRegistryError(w, http.StatusForbidden, "DENIED", "requested access to the resource is denied")
+		return nil, param
+	}
+	return instance, param
+}
+
+// requiredAction maps a registry request to the access control action it needs: pulls read, pushes write and
+// deleting manifests or blobs is an admin action. Cancelling an upload only needs write.
+func requiredAction(r *http.Request) string {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		return repo.ActionRead
+	case http.MethodDelete:
+		if r.PathValue("uuid") != "" {
+			return repo.ActionWrite
+		}
+		return repo.ActionAdmin
+	default:
+		return repo.ActionWrite
+	}
+}
+
+// bestInstance returns the instance whose mappings match name most specifically.
+func (f *factory) bestInstance(name string) *containerRegistryInstance {
 	var bestInstance *containerRegistryInstance
 	var bestScore int
-	nameParts := strings.Split(param.name, "/")
+	nameParts := strings.Split(name, "/")
 	for _, instance := range f.instances {
 		score := instance.GetMatchWeight(nameParts)
 		if score > bestScore {
@@ -85,12 +124,38 @@ func (f *factory) lookupParam(r *http.Request) (*containerRegistryInstance, *par
 			bestInstance = instance
 		}
 	}
-	return bestInstance, param
+	return bestInstance
 }
 
-// HandleV2Catalog handles requests to the Container v2 catalog endpoint.
+// HandleV2Catalog lists repositories known to every container instance, paginated with `n`/`last`.
+// A name is only listed by the instance that requests for it would be routed to, and only if the client may read it.
 func (f *factory) HandleV2Catalog(w http.ResponseWriter, r *http.Request) {
-	http.Error(w, "Repository is read-only; catalog listing is not implemented", http.StatusMethodNotAllowed)
+	ctx := r.Context()
+	seen := map[string]struct{}{}
+	for _, instance := range f.instances {
+		for _, name := range instance.catalogNames(ctx) {
+			if f.bestInstance(name) == instance && repo.Authorized(ctx, &instance.config, name, repo.ActionRead) {
+				seen[name] = struct{}{}
+			}
+		}
+	}
+	names := make([]string, 0, len(seen))
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	names = paginate(w, r, names)
+	body, err := json.Marshal(map[string]any{"repositories": names})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(http.StatusOK)
+	if r.Method != http.MethodHead {
+		_, _ = w.Write(body)
+	}
 }
 
 // HandleV2 handles requests to the Container v2 API root endpoint.
@@ -108,9 +173,8 @@ func (f *factory) HandleV2(w http.ResponseWriter, r *http.Request) {
 
 // HandleV2Tags handles requests to the Container v2 tags endpoint.
 func (f *factory) HandleV2Tags(w http.ResponseWriter, r *http.Request) {
-	instance, param := f.lookupParam(r)
+	instance, param := f.lookupParam(w, r)
 	if instance == nil {
-		f.HandleNotFound(w, r)
 		return
 	}
 	instance.HandleV2Tags(param, w, r)
@@ -118,19 +182,26 @@ func (f *factory) HandleV2Tags(w http.ResponseWriter, r *http.Request) {
 
 // HandleV2Manifest handles requests to the Container v2 manifest endpoint.
 func (f *factory) HandleV2Manifest(w http.ResponseWriter, r *http.Request) {
-	instance, param := f.lookupParam(r)
+	instance, param := f.lookupParam(w, r)
 	if instance == nil {
-		f.HandleNotFound(w, r)
 		return
 	}
 	instance.HandleV2Manifest(param, w, r)
 }
 
+// HandleV2Referrers handles requests to the OCI referrers endpoint.
+func (f *factory) HandleV2Referrers(w http.ResponseWriter, r *http.Request) {
+	instance, param := f.lookupParam(w, r)
+	if instance == nil {
+		return
+	}
+	instance.HandleV2Referrers(param, w, r)
+}
+
 // HandleV2BlobUpload handles requests to the Container v2 blob upload endpoint.
 func (f *factory) HandleV2BlobUpload(w http.ResponseWriter, r *http.Request) {
-	instance, param := f.lookupParam(r)
+	instance, param := f.lookupParam(w, r)
 	if instance == nil {
-		f.HandleNotFound(w, r)
 		return
 	}
 	instance.HandleV2BlobUpload(param, w, r)
@@ -138,9 +209,8 @@ func (f *factory) HandleV2BlobUpload(w http.ResponseWriter, r *http.Request) {
 
 // HandleV2BlobUID handles requests to the Container v2 blob UID endpoint.
 func (f *factory) HandleV2BlobUID(w http.ResponseWriter, r *http.Request) {
-	instance, param := f.lookupParam(r)
+	instance, param := f.lookupParam(w, r)
 	if instance == nil {
-		f.HandleNotFound(w, r)
 		return
 	}
 	instance.HandleV2BlobUID(param, w, r)
@@ -148,9 +218,8 @@ func (f *factory) HandleV2BlobUID(w http.ResponseWriter, r *http.Request) {
 
 // HandleV2BlobByDigest handles requests to the Container v2 blob digest endpoint.
 func (f *factory) HandleV2BlobByDigest(w http.ResponseWriter, r *http.Request) {
-	instance, param := f.lookupParam(r)
+	instance, param := f.lookupParam(w, r)
 	if instance == nil {
-		f.HandleNotFound(w, r)
 		return
 	}
 	instance.HandleV2BlobByDigest(param, w, r)
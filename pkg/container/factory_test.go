@@ -0,0 +1,116 @@
+package container
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/davidjspooner/repoxy/pkg/auth"
+	"github.com/davidjspooner/repoxy/pkg/repo"
+)
+
+func TestCatalogListsCachedAndUpstreamRepositories(t *testing.T) {
+	t.Parallel()
+	manifest := []byte(`{"schemaVersion":2}`)
+	sum := sha256.Sum256(manifest)
+	digest := "sha256:" + hex.EncodeToString(sum[:])
+	inst := newContainerInstanceForTest(t, "https://registry.test")
+	inst.config.Upstream.Config = map[string]string{"catalog": "true"}
+	inst.httpClientFactory = newContainerClientFactory(func(req *http.Request) (*http.Response, error) {
+		if req.URL.Path == "/v2/_catalog" {
+			return httpResponse(http.StatusOK, nil, []byte(`{"repositories":["library/redis","other/unrouted"]}`)), nil
+		}
+		return httpResponse(http.StatusOK, map[string]string{"Docker-Content-Digest": digest}, manifest), nil
+	})
+	for _, name := range []string{"library/nginx", "library/alpine", "library/busybox"} {
+		req := httptest.NewRequest(http.MethodGet, "/v2/"+name+"/manifests/latest", nil)
+		inst.HandleV2Manifest(&param{name: name, tag: "latest"}, httptest.NewRecorder(), req)
+	}
+	f := &factory{instances: []*containerRegistryInstance{inst}}
+
+	fetch := func(target string) ([]string, string) {
+		t.Helper()
+		rr := httptest.NewRecorder()
+		f.HandleV2Catalog(rr, httptest.NewRequest(http.MethodGet, target, nil))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("catalog %s returned %d", target, rr.Code)
+		}
+		var payload struct {
+			Repositories []string `json:"repositories"`
+		}
+		if err := json.Unmarshal(rr.Body.Bytes(), &payload); err != nil {
+			t.Fatalf("decode catalog: %v", err)
+		}
+		return payload.Repositories, rr.Header().Get("Link")
+	}
+
+	page, link := fetch("/v2/_catalog?n=2")
+	if len(page) != 2 || page[0] != "library/alpine" || page[1] != "library/busybox" {
+		t.Fatalf("unexpected first page: %v", page)
+	}
+	if link != `</v2/_catalog?last=library%2Fbusybox&n=2>; rel="next"` {
+		t.Fatalf("unexpected Link header: %q", link)
+	}
+	page, link = fetch("/v2/_catalog?n=2&last=library/busybox")
+	if len(page) != 2 || page[0] != "library/nginx" || page[1] != "library/redis" {
+		t.Fatalf("unexpected second page: %v", page)
+	}
+	if link != "" {
+		t.Fatalf("expected no Link header on the last page, got %q", link)
+	}
+	if all, _ := fetch("/v2/_catalog"); len(all) != 4 {
+		t.Fatalf("expected 4 routable repositories, got %v", all)
+	}
+}
+
+func TestFactoryEnforcesAccessControl(t *testing.T) {
+	manifest := []byte(`{"schemaVersion":2}`)
+	inst := newContainerInstanceForTest(t, "https://registry.test")
+	inst.httpClientFactory = newContainerClientFactory(func(req *http.Request) (*http.Response, error) {
+		return httpResponse(http.StatusOK, map[string]string{"Docker-Content-Digest": manifestDigest(manifest)}, manifest), nil
+	})
+	f := &factory{instances: []*containerRegistryInstance{inst}}
+	if err := repo.EnableAccessControl(&repo.AccessControl{Grants: []repo.Grant{
+		{Principals: []string{"alice"}, Names: []string{"library/alpine"}, Actions: []string{repo.ActionRead}},
+		{Principals: []string{"admin"}, Actions: []string{repo.ActionAdmin}},
+	}}); err != nil {
+		t.Fatalf("EnableAccessControl failed: %v", err)
+	}
+	defer func() { _ = repo.EnableAccessControl(nil) }()
+
+	request := func(method, user, name string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/v2/"+name+"/manifests/latest", nil)
+		req.SetPathValue("name", name)
+		req.SetPathValue("tag", "latest")
+		if user != "" {
+			req = req.WithContext(auth.WithPrincipal(req.Context(), &auth.Principal{Name: user}))
+		}
+		rr := httptest.NewRecorder()
+		f.HandleV2Manifest(rr, req)
+		return rr
+	}
+	if rr := request(http.MethodGet, "alice", "library/alpine"); rr.Code != http.StatusOK {
+		t.Fatalf("expected alice to pull library/alpine, got %d", rr.Code)
+	}
+	for _, tc := range []struct{ method, user, name string }{
+		{http.MethodGet, "alice", "library/busybox"},
+		{http.MethodGet, "", "library/alpine"},
+		{http.MethodDelete, "alice", "library/alpine"},
+	} {
+		if rr := request(tc.method, tc.user, tc.name); rr.Code != http.StatusForbidden || !strings.Contains(rr.Body.String(), `"DENIED"`) {
+			t.Fatalf("expected %s %s by %q to be denied, got %d", tc.method, tc.name, tc.user, rr.Code)
+		}
+	}
+	request(http.MethodGet, "admin", "library/busybox")
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/v2/_catalog", nil)
+	f.HandleV2Catalog(rr, req.WithContext(auth.WithPrincipal(req.Context(), &auth.Principal{Name: "alice"})))
+	if rr.Body.String() != `{"repositories":["library/alpine"]}` {
+		t.Fatalf("expected catalog filtered to readable names, got %s", rr.Body.String())
+	}
+}
@@ -0,0 +1,130 @@
+package container
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+const (
+	mediaTypeOCIIndex       = "application/vnd.oci.image.index.v1+json"
+	mediaTypeDockerList     = "application/vnd.docker.distribution.manifest.list.v2+json"
+	mediaTypeOCIManifest    = "application/vnd.oci.image.manifest.v1+json"
+	mediaTypeDockerManifest = "application/vnd.docker.distribution.manifest.v2+json"
+	defaultPlatform         = "linux/amd64"
+)
+
+// manifestDocument holds the descriptors of an image manifest or of a multi-arch index / manifest list. Subject is set
+// on artifacts (signatures, SBOMs, attestations) that refer to another manifest.
+type manifestDocument struct {
+	MediaType    string               `json:"mediaType"`
+	ArtifactType string               `json:"artifactType"`
+	Config       *manifestDescriptor  `json:"config"`
+	Layers       []manifestDescriptor `json:"layers"`
+	Manifests    []manifestDescriptor `json:"manifests"`
+	Subject      *manifestDescriptor  `json:"subject"`
+	Annotations  map[string]string    `json:"annotations"`
+}
+
+type manifestDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Platform    *manifestPlatform `json:"platform,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+type manifestPlatform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+// parsePlatform parses an "os/arch" or "os/arch/variant" platform.
+func parsePlatform(s string) (manifestPlatform, error) {
+	parts := strings.Split(s, "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" || (len(parts) == 3 && parts[2] == "") {
+		return manifestPlatform{}, fmt.Errorf("invalid platform %q, expected os/arch or os/arch/variant", s)
+	}
+	platform := manifestPlatform{OS: parts[0], Architecture: parts[1]}
+	if len(parts) == 3 {
+		platform.Variant = parts[2]
+	}
+	return platform, nil
+}
+
+// matches reports whether p satisfies want. An empty variant in want matches any variant.
+func (p *manifestPlatform) matches(want manifestPlatform) bool {
+	return p != nil && p.OS == want.OS && p.Architecture == want.Architecture && (want.Variant == "" || p.Variant == want.Variant)
+}
+
+// parseManifest decodes body, returning nil when it is not a JSON manifest.
+func parseManifest(body []byte) *manifestDocument {
+	var doc manifestDocument
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return nil
+	}
+	return &doc
+}
+
+// isIndex reports whether the document is an OCI image index or Docker manifest list, judged by mediaType when known.
+func (m *manifestDocument) isIndex(mediaType string) bool {
+	if mediaType == "" {
+		mediaType = m.MediaType
+	}
+	switch mediaType {
+	case mediaTypeOCIIndex, mediaTypeDockerList:
+		return true
+	case "":
+		return len(m.Manifests) > 0
+	}
+	return false
+}
+
+// childDigests lists the platform manifests referenced by an index.
+func (m *manifestDocument) childDigests() []string {
+	digests := make([]string, 0, len(m.Manifests))
+	for _, child := range m.Manifests {
+		if child.Digest != "" {
+			digests = append(digests, child.Digest)
+		}
+	}
+	return digests
+}
+
+// selectChild picks the manifest for platform of an index whose media type the client accepts.
+func (m *manifestDocument) selectChild(platform manifestPlatform, accept []string) *manifestDescriptor {
+	for i := range m.Manifests {
+		child := &m.Manifests[i]
+		if !child.Platform.matches(platform) {
+			continue
+		}
+		if acceptsMediaType(accept, child.MediaType) {
+			return child
+		}
+	}
+	return nil
+}
+
+// acceptsMediaType evaluates the Accept header values of a manifest request. No Accept header, an unknown media type
+// and wildcards all match.
+func acceptsMediaType(accept []string, mediaType string) bool {
+	if mediaType == "" {
+		return true
+	}
+	found := false
+	for _, header := range accept {
+		for _, candidate := range strings.Split(header, ",") {
+			candidate, _, _ = strings.Cut(candidate, ";")
+			candidate = strings.TrimSpace(candidate)
+			if candidate == "" {
+				continue
+			}
+			found = true
+			if candidate == mediaType || candidate == "*/*" || candidate == "application/*" {
+				return true
+			}
+		}
+	}
+	return !found
+}
@@ -0,0 +1,148 @@
+package container
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/davidjspooner/repoxy/pkg/repo"
+)
+
+func getManifest(inst *containerRegistryInstance, reference, accept string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "/v2/library/alpine/manifests/"+reference, nil)
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	rr := httptest.NewRecorder()
+	inst.HandleV2Manifest(&param{name: "library/alpine", tag: reference}, rr, req)
+	return rr
+}
+
+func TestContainerMultiArchIndexServedOffline(t *testing.T) {
+	t.Parallel()
+	amd64 := []byte(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","config":{"digest":"sha256:aa"},"layers":[]}`)
+	arm64 := []byte(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","config":{"digest":"sha256:bb"},"layers":[]}`)
+	amd64Digest, arm64Digest := manifestDigest(amd64), manifestDigest(arm64)
+	index := []byte(fmt.Sprintf(`{"schemaVersion":2,"mediaType":%q,"manifests":[`+
+		`{"mediaType":%q,"digest":%q,"platform":{"architecture":"arm64","os":"linux"}},`+
+		`{"mediaType":%q,"digest":%q,"platform":{"architecture":"amd64","os":"linux"}}]}`,
+		mediaTypeOCIIndex, mediaTypeOCIManifest, arm64Digest, mediaTypeOCIManifest, amd64Digest))
+	indexDigest := manifestDigest(index)
+
+	inst := newContainerInstanceForTest(t, "https://registry.test")
+	inst.httpClientFactory = newContainerClientFactory(func(req *http.Request) (*http.Response, error) {
+		switch req.URL.Path {
+		case "/v2/library/alpine/manifests/latest":
+			if strings.Contains(req.Header.Get("Accept"), mediaTypeOCIIndex) {
+				return httpResponse(http.StatusOK, map[string]string{"Content-Type": mediaTypeOCIIndex, "Docker-Content-Digest": indexDigest}, index), nil
+			}
+			fallthrough
+		case "/v2/library/alpine/manifests/" + amd64Digest:
+			return httpResponse(http.StatusOK, map[string]string{"Content-Type": mediaTypeOCIManifest, "Docker-Content-Digest": amd64Digest}, amd64), nil
+		}
+		return httpResponse(http.StatusNotFound, nil, nil), nil
+	})
+
+	both := mediaTypeOCIIndex + ", " + mediaTypeOCIManifest
+	if rr := getManifest(inst, "latest", both); rr.Code != http.StatusOK || rr.Body.String() != string(index) {
+		t.Fatalf("expected index from upstream, got %d", rr.Code)
+	}
+	if rr := getManifest(inst, amd64Digest, both); rr.Code != http.StatusOK {
+		t.Fatalf("expected platform manifest from upstream, got %d", rr.Code)
+	}
+	// A client without index support gets the platform manifest from upstream, but the tag must stay on the index.
+	if rr := getManifest(inst, "latest", mediaTypeOCIManifest); rr.Code != http.StatusOK || rr.Body.String() != string(amd64) {
+		t.Fatalf("expected platform manifest for single-arch client, got %d", rr.Code)
+	}
+	ctx := context.Background()
+	loc, err := inst.storage.ResolveLabel(ctx, repo.Locator{Host: inst.upstreamHost(), Name: "library/alpine", Label: "latest"})
+	if err != nil {
+		t.Fatalf("ResolveLabel failed: %v", err)
+	}
+	meta, err := inst.storage.GetVersionMeta(ctx, loc)
+	if err != nil {
+		t.Fatalf("GetVersionMeta failed: %v", err)
+	}
+	if meta.VersionID != indexDigest || len(meta.Links) != 2 || meta.Links[1] != amd64Digest {
+		t.Fatalf("expected tag on index linking both platforms, got %s %v", meta.VersionID, meta.Links)
+	}
+
+	inst.config.Mode = repo.ModeOffline
+	if rr := getManifest(inst, "latest", both); rr.Code != http.StatusOK || rr.Body.String() != string(index) ||
+		rr.Header().Get("Content-Type") != mediaTypeOCIIndex {
+		t.Fatalf("expected cached index offline, got %d %q", rr.Code, rr.Header().Get("Content-Type"))
+	}
+	if rr := getManifest(inst, "latest", mediaTypeOCIManifest); rr.Code != http.StatusOK || rr.Body.String() != string(amd64) ||
+		rr.Header().Get("Docker-Content-Digest") != amd64Digest {
+		t.Fatalf("expected negotiated platform manifest offline, got %d %s", rr.Code, rr.Body.String())
+	}
+	if rr := getManifest(inst, indexDigest, ""); rr.Code != http.StatusOK || rr.Body.String() != string(index) {
+		t.Fatalf("expected index by digest offline, got %d", rr.Code)
+	}
+	if rr := getManifest(inst, amd64Digest, both); rr.Code != http.StatusOK || rr.Body.String() != string(amd64) {
+		t.Fatalf("expected platform manifest by digest offline, got %d", rr.Code)
+	}
+	if rr := getManifest(inst, arm64Digest, both); rr.Code != http.StatusNotFound {
+		t.Fatalf("expected uncached platform to be unknown offline, got %d", rr.Code)
+	}
+	if rr := getManifest(inst, "latest", mediaTypeDockerManifest); rr.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 when no cached manifest matches Accept, got %d", rr.Code)
+	}
+}
+
+func TestContainerIndexServesConfiguredPlatform(t *testing.T) {
+	t.Parallel()
+	amd64 := []byte(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","config":{"digest":"sha256:aa"},"layers":[]}`)
+	arm64 := []byte(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","config":{"digest":"sha256:bb"},"layers":[]}`)
+	amd64Digest, arm64Digest := manifestDigest(amd64), manifestDigest(arm64)
+	index := []byte(fmt.Sprintf(`{"schemaVersion":2,"mediaType":%q,"manifests":[`+
+		`{"mediaType":%q,"digest":%q,"platform":{"architecture":"amd64","os":"linux"}},`+
+		`{"mediaType":%q,"digest":%q,"platform":{"architecture":"arm64","os":"linux","variant":"v8"}}]}`,
+		mediaTypeOCIIndex, mediaTypeOCIManifest, amd64Digest, mediaTypeOCIManifest, arm64Digest))
+	indexDigest := manifestDigest(index)
+
+	cfg := &repo.Repo{
+		Name:     "mirror",
+		Type:     "container",
+		Upstream: repo.Upstream{URL: "https://registry.test", Config: map[string]string{"platform": "linux/arm64/v8"}},
+		Mappings: []string{"library/*"},
+	}
+	inst := newContainerInstanceFromConfig(t, cfg)
+	inst.httpClientFactory = newContainerClientFactory(func(req *http.Request) (*http.Response, error) {
+		switch req.URL.Path {
+		case "/v2/library/alpine/manifests/latest":
+			return httpResponse(http.StatusOK, map[string]string{"Content-Type": mediaTypeOCIIndex, "Docker-Content-Digest": indexDigest}, index), nil
+		case "/v2/library/alpine/manifests/" + amd64Digest:
+			return httpResponse(http.StatusOK, map[string]string{"Content-Type": mediaTypeOCIManifest, "Docker-Content-Digest": amd64Digest}, amd64), nil
+		case "/v2/library/alpine/manifests/" + arm64Digest:
+			return httpResponse(http.StatusOK, map[string]string{"Content-Type": mediaTypeOCIManifest, "Docker-Content-Digest": arm64Digest}, arm64), nil
+		}
+		return httpResponse(http.StatusNotFound, nil, nil), nil
+	})
+	both := mediaTypeOCIIndex + ", " + mediaTypeOCIManifest
+	for _, reference := range []string{"latest", amd64Digest, arm64Digest} {
+		if rr := getManifest(inst, reference, both); rr.Code != http.StatusOK {
+			t.Fatalf("expected %s from upstream, got %d", reference, rr.Code)
+		}
+	}
+
+	inst.config.Mode = repo.ModeOffline
+	if rr := getManifest(inst, "latest", mediaTypeOCIManifest); rr.Code != http.StatusOK || rr.Body.String() != string(arm64) {
+		t.Fatalf("expected the configured platform for a single-arch client, got %d %s", rr.Code, rr.Body.String())
+	}
+	inst.platform = manifestPlatform{OS: "linux", Architecture: "s390x"}
+	if rr := getManifest(inst, "latest", mediaTypeOCIManifest); rr.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 when the index has no manifest for the platform, got %d", rr.Code)
+	}
+
+	for _, platform := range []string{"linux", "linux/", "/amd64", "linux/arm64/", "linux/arm64/v8/extra"} {
+		cfg.Upstream.Config["platform"] = platform
+		if _, err := newContainerRegistryInstance(&factory{}, inst.storage, cfg); !errors.Is(err, repo.ErrInvalidRepoConfig) {
+			t.Errorf("expected platform %q to be rejected, got %v", platform, err)
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package container
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+)
+
+// paginate applies the distribution spec `n`/`last` query parameters to sorted items and sets a
+// `Link: <...>; rel="next"` header when more results remain.
+func paginate(w http.ResponseWriter, r *http.Request, items []string) []string {
+	query := r.URL.Query()
+	if last := query.Get("last"); last != "" {
+		i := sort.SearchStrings(items, last)
+		if i < len(items) && items[i] == last {
+			i++
+		}
+		items = items[i:]
+	}
+	n, err := strconv.Atoi(query.Get("n"))
+	if err != nil || n < 0 || n >= len(items) {
+		return items
+	}
+	page := items[:n]
+	if n > 0 {
+		next := url.Values{}
+		next.Set("n", strconv.Itoa(n))
+		next.Set("last", page[n-1])
+		w.Header().Set("Link", fmt.Sprintf("<%s?%s>; rel=\"next\"", r.URL.Path, next.Encode()))
+	}
+	return page
+}
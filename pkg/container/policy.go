@@ -0,0 +1,259 @@
+package container
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/davidjspooner/repoxy/pkg/repo"
+)
+
+// signaturePolicy enforces a repository policy block: manifests must carry a cosign or Notation signature made with a
+// trusted key before they are cached or served.
+type signaturePolicy struct {
+	config   *repo.Policy
+	trusted  *trustedKeys
+	verified sync.Map // manifest digest -> struct{}; digests that passed, including the children of verified indexes
+}
+
+func newSignaturePolicy(config *repo.Policy) (*signaturePolicy, error) {
+	trusted, err := loadTrustedKeys(config.Keys)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", repo.ErrInvalidRepoConfig, err)
+	}
+	return &signaturePolicy{config: config, trusted: trusted}, nil
+}
+
+// policyError is returned when a manifest fails the repository signature policy.
+type policyError struct {
+	digest string
+	reason string
+}
+
+func (e *policyError) Error() string {
+	return "manifest " + e.digest + " rejected by signature policy: " + e.reason
+}
+
+// writePolicyDenial answers a request for a manifest rejected by the signature policy.
+func (d *containerRegistryInstance) writePolicyDenial(ctx context.Context, w http.ResponseWriter, denied *policyError) {
+	slog.WarnContext(ctx, "manifest rejected by signature policy", "digest", denied.digest, "reason", denied.reason)
+	d.recordDenied("signature")
+	writeRegistryError(w, http.StatusForbidden, "DENIED", denied.Error())
+}
+
+// enforcePolicy checks the manifest body with the given digest, requested as param, against the signature policy and
+// returns nil when it passes.
+// Signature and attestation artifacts themselves are exempt so clients can still fetch them for their own
+// verification. Signatures are looked up in the cache first and then upstream, and are cached so verification also
+// works offline.
+func (d *containerRegistryInstance) enforcePolicy(ctx context.Context, param *param, digest string, body []byte) *policyError {
+	policy := d.policy
+	if policy == nil {
+		return nil
+	}
+	if param == nil || param.name == "" {
+		return &policyError{digest: digest, reason: "repository name unknown"}
+	}
+	doc := parseManifest(body)
+	if signatureArtifact(doc) {
+		return nil
+	}
+	if _, ok := policy.verified.Load(digest); ok {
+		return nil
+	}
+	var reasons []string
+	verify := func(format string, check func(context.Context, string, string, bool) error) bool {
+		if !policy.config.Accepts(format) {
+			return false
+		}
+		err := check(ctx, param.name, digest, false)
+		if err != nil && d.config.ContactsUpstream() {
+			err = check(ctx, param.name, digest, true)
+		}
+		if err != nil {
+			reasons = append(reasons, err.Error())
+		}
+		return err == nil
+	}
+	if !verify(repo.SignatureCosign, d.verifyCosignSignatures) && !verify(repo.SignatureNotation, d.verifyNotationSignatures) {
+		return &policyError{digest: digest, reason: strings.Join(reasons, "; ")}
+	}
+	policy.verified.Store(digest, struct{}{})
+	if doc != nil {
+		for _, child := range doc.childDigests() {
+			policy.verified.Store(child, struct{}{})
+		}
+	}
+	return nil
+}
+
+// signatureArtifact reports whether doc is a cosign signature or attestation, or a Notation signature. The tag and
+// subject of a manifest are chosen by whoever pushed it, so only the content counts: a single manifest whose layers
+// are all signature envelopes. Indexes and manifests with any other layer are runnable and never exempt.
+func signatureArtifact(doc *manifestDocument) bool {
+	if doc == nil || doc.isIndex("") || len(doc.Manifests) > 0 || len(doc.Layers) == 0 {
+		return false
+	}
+	kind := doc.ArtifactType
+	if kind == "" && doc.Config != nil {
+		kind = doc.Config.MediaType
+	}
+	envelopes := []string{cosignSimpleSigningMediaType, dsseEnvelopeMediaType}
+	if kind == notationArtifactType {
+		envelopes = []string{notationJWSMediaType, notationCOSEMediaType}
+	}
+	for _, layer := range doc.Layers {
+		if !slices.Contains(envelopes, layer.MediaType) {
+			return false
+		}
+	}
+	return true
+}
+
+// verifyCosignSignatures checks the `<alg>-<hex>.sig` manifest of digest for a layer signed with a trusted key.
+// refresh fetches the signature from upstream instead of the cache.
+func (d *containerRegistryInstance) verifyCosignSignatures(ctx context.Context, name, digest string, refresh bool) error {
+	tag := strings.Replace(digest, ":", "-", 1) + ".sig"
+	body, err := d.signatureManifest(ctx, name, tag, refresh)
+	if err != nil {
+		return fmt.Errorf("no cosign signature: %w", err)
+	}
+	doc := parseManifest(body)
+	if doc == nil {
+		return errors.New("malformed cosign signature manifest")
+	}
+	err = errors.New("cosign signature manifest has no signed layers")
+	for _, layer := range doc.Layers {
+		signature := layer.Annotations[cosignSignatureAnnotation]
+		if signature == "" {
+			continue
+		}
+		payload, blobErr := d.signatureBlob(ctx, name, layer.Digest, refresh)
+		if blobErr != nil {
+			err = blobErr
+			continue
+		}
+		if err = d.policy.trusted.verifyCosign(payload, signature, digest); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// verifyNotationSignatures checks the Notation signatures among the referrers of digest for one signed with a trusted
+// key. refresh fetches the referrers and signatures from upstream instead of the cache.
+func (d *containerRegistryInstance) verifyNotationSignatures(ctx context.Context, name, digest string, refresh bool) error {
+	var list *referrerList
+	if refresh {
+		var err error
+		if list, err = d.fetchReferrers(ctx, &param{name: name, digest: digest}); err != nil {
+			return fmt.Errorf("no notation signature: %w", err)
+		}
+	} else {
+		list = d.loadReferrers(ctx, name, digest)
+	}
+	err := errors.New("no notation signature")
+	if list == nil {
+		return err
+	}
+	for _, ref := range append(append([]referrerDescriptor{}, list.Upstream...), list.Local...) {
+		if ref.ArtifactType != notationArtifactType {
+			continue
+		}
+		body, manifestErr := d.signatureManifest(ctx, name, ref.Digest, refresh)
+		if manifestErr != nil {
+			err = manifestErr
+			continue
+		}
+		doc := parseManifest(body)
+		if doc == nil {
+			continue
+		}
+		for _, layer := range doc.Layers {
+			if layer.MediaType != notationJWSMediaType {
+				err = fmt.Errorf("unsupported notation envelope %q", layer.MediaType)
+				continue
+			}
+			envelope, blobErr := d.signatureBlob(ctx, name, layer.Digest, refresh)
+			if blobErr != nil {
+				err = blobErr
+				continue
+			}
+			if err = d.policy.trusted.verifyNotation(envelope, digest, time.Now()); err == nil {
+				return nil
+			}
+		}
+	}
+	return err
+}
+
+// signatureManifest returns the signature manifest cached for reference or, with refresh, fetches and caches it.
+func (d *containerRegistryInstance) signatureManifest(ctx context.Context, name, reference string, refresh bool) ([]byte, error) {
+	if !refresh {
+		loc := repo.Locator{Host: d.upstreamHost(), Name: name, Label: reference}
+		if isDigestReference(reference) {
+			loc.Label, loc.VersionID = "", reference
+		} else if resolved, err := d.storage.ResolveLabel(ctx, loc); err == nil {
+			loc = resolved
+		} else {
+			return nil, err
+		}
+		meta, err := d.storage.GetVersionMeta(ctx, loc)
+		if err != nil {
+			return nil, err
+		}
+		if meta.Manifest != "" {
+			return []byte(meta.Manifest), nil
+		}
+		return d.signatureBlob(ctx, name, meta.VersionID, false)
+	}
+	status, header, body, err := d.getUpstream(ctx, "/v2/"+name+"/manifests/"+reference, mediaTypeOCIManifest+", "+mediaTypeDockerManifest)
+	if err != nil {
+		return nil, err
+	}
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("upstream returned %d for %s", status, reference)
+	}
+	digest := manifestDigest(body)
+	if isDigestReference(reference) && reference != digest {
+		return nil, fmt.Errorf("signature manifest does not match %s", reference)
+	}
+	if err := d.storeManifest(ctx, name, digest, header.Get("Content-Type"), body, reference); err != nil {
+		slog.WarnContext(ctx, "failed to cache signature manifest", "name", name, "reference", reference, "error", err)
+	}
+	return body, nil
+}
+
+// signatureBlob returns a signature payload or envelope blob from the cache or, with refresh, from upstream.
+func (d *containerRegistryInstance) signatureBlob(ctx context.Context, name, digest string, refresh bool) ([]byte, error) {
+	if !refresh {
+		reader, err := d.storage.OpenBlob(ctx, digest)
+		if err != nil {
+			return nil, err
+		}
+		defer reader.Close()
+		return io.ReadAll(io.LimitReader(reader, maxManifestBytes))
+	}
+	status, _, body, err := d.getUpstream(ctx, "/v2/"+name+"/blobs/"+digest, "")
+	if err != nil {
+		return nil, err
+	}
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("upstream returned %d for signature blob %s", status, digest)
+	}
+	if manifestDigest(body) != digest {
+		return nil, fmt.Errorf("signature blob does not match %s", digest)
+	}
+	if _, err := d.storage.PutBlob(ctx, digest, bytes.NewReader(body)); err != nil {
+		slog.WarnContext(ctx, "failed to cache signature blob", "digest", digest, "error", err)
+	}
+	return body, nil
+}
@@ -0,0 +1,270 @@
+package container
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/davidjspooner/repoxy/pkg/repo"
+)
+
+var policyTestImage = []byte(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","config":{"digest":"sha256:aa"},"layers":[]}`)
+
+// writeTestPEM writes a PEM block to a file in dir and returns its path.
+func writeTestPEM(t *testing.T, dir, name, blockType string, der []byte) string {
+	t.Helper()
+	file := filepath.Join(dir, name)
+	if err := os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0o600); err != nil {
+		t.Fatalf("write %s: %v", name, err)
+	}
+	return file
+}
+
+func newTestKey(t *testing.T) *ecdsa.PrivateKey {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	return key
+}
+
+// newPolicyInstanceForTest returns a pull-through instance with policy whose upstream serves policyTestImage as
+// library/alpine:latest plus the extra paths.
+func newPolicyInstanceForTest(t *testing.T, policy *repo.Policy, extra map[string][]byte) *containerRegistryInstance {
+	t.Helper()
+	inst := newContainerInstanceFromConfig(t, &repo.Repo{
+		Name:     "mirror",
+		Type:     "container",
+		Upstream: repo.Upstream{URL: "https://registry.test"},
+		Mappings: []string{"library/*"},
+		Policy:   policy,
+	})
+	digest := manifestDigest(policyTestImage)
+	inst.httpClientFactory = newContainerClientFactory(func(req *http.Request) (*http.Response, error) {
+		switch req.URL.Path {
+		case "/v2/library/alpine/manifests/latest", "/v2/library/alpine/manifests/" + digest:
+			return httpResponse(http.StatusOK, map[string]string{"Content-Type": mediaTypeOCIManifest, "Docker-Content-Digest": digest}, policyTestImage), nil
+		}
+		body, ok := extra[req.URL.Path]
+		switch {
+		case !ok:
+		case strings.Contains(req.URL.Path, "/referrers/"):
+			return httpResponse(http.StatusOK, map[string]string{"Content-Type": mediaTypeOCIIndex}, body), nil
+		case strings.Contains(req.URL.Path, "/manifests/"):
+			return httpResponse(http.StatusOK, map[string]string{"Content-Type": mediaTypeOCIManifest}, body), nil
+		default:
+			return httpResponse(http.StatusOK, nil, body), nil
+		}
+		return httpResponse(http.StatusNotFound, nil, nil), nil
+	})
+	return inst
+}
+
+// cosignSignature returns upstream responses for a cosign signature of digest made with key.
+func cosignSignature(t *testing.T, key *ecdsa.PrivateKey, digest string) map[string][]byte {
+	t.Helper()
+	payload := []byte(fmt.Sprintf(`{"critical":{"identity":{"docker-reference":"registry.test/library/alpine"},`+
+		`"image":{"docker-manifest-digest":%q},"type":"cosign container image signature"},"optional":null}`, digest))
+	sum := sha256.Sum256(payload)
+	sig, err := ecdsa.SignASN1(rand.Reader, key, sum[:])
+	if err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	payloadDigest := manifestDigest(payload)
+	manifest := []byte(fmt.Sprintf(`{"schemaVersion":2,"mediaType":%q,"config":{"digest":"sha256:bb"},"layers":[`+
+		`{"mediaType":"application/vnd.dev.cosign.simplesigning.v1+json","digest":%q,"size":%d,"annotations":{%q:%q}}]}`,
+		mediaTypeOCIManifest, payloadDigest, len(payload), cosignSignatureAnnotation, base64.StdEncoding.EncodeToString(sig)))
+	tag := strings.Replace(digest, ":", "-", 1) + ".sig"
+	return map[string][]byte{
+		"/v2/library/alpine/manifests/" + tag:       manifest,
+		"/v2/library/alpine/blobs/" + payloadDigest: payload,
+	}
+}
+
+func TestContainerPolicyAcceptsCosignSignedImagesOffline(t *testing.T) {
+	t.Parallel()
+	key := newTestKey(t)
+	der, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	policy := &repo.Policy{Signatures: []string{repo.SignatureCosign}, Keys: []string{writeTestPEM(t, t.TempDir(), "cosign.pub", "PUBLIC KEY", der)}}
+	inst := newPolicyInstanceForTest(t, policy, cosignSignature(t, key, manifestDigest(policyTestImage)))
+
+	if rr := getManifest(inst, "latest", mediaTypeOCIManifest); rr.Code != http.StatusOK || rr.Body.String() != string(policyTestImage) {
+		t.Fatalf("expected signed image to be served, got %d %s", rr.Code, rr.Body.String())
+	}
+
+	// A restarted proxy has to verify again, from the signature cached alongside the image.
+	var err error
+	if inst.policy, err = newSignaturePolicy(policy); err != nil {
+		t.Fatalf("newSignaturePolicy failed: %v", err)
+	}
+	inst.config.Mode = repo.ModeOffline
+	if rr := getManifest(inst, "latest", mediaTypeOCIManifest); rr.Code != http.StatusOK || rr.Body.String() != string(policyTestImage) {
+		t.Fatalf("expected signed image to be served offline, got %d %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestContainerPolicyRejectsUnsignedAndUntrustedImages(t *testing.T) {
+	t.Parallel()
+	trusted, untrusted := newTestKey(t), newTestKey(t)
+	der, _ := x509.MarshalPKIXPublicKey(&trusted.PublicKey)
+	policy := &repo.Policy{Keys: []string{writeTestPEM(t, t.TempDir(), "cosign.pub", "PUBLIC KEY", der)}}
+
+	for name, extra := range map[string]map[string][]byte{
+		"unsigned":     nil,
+		"untrusted":    cosignSignature(t, untrusted, manifestDigest(policyTestImage)),
+		"wrong digest": cosignSignature(t, trusted, manifestDigest([]byte("other"))),
+	} {
+		inst := newPolicyInstanceForTest(t, policy, extra)
+		rr := getManifest(inst, "latest", mediaTypeOCIManifest)
+		var body struct {
+			Errors []struct {
+				Code string `json:"code"`
+			} `json:"errors"`
+		}
+		if rr.Code != http.StatusForbidden || json.Unmarshal(rr.Body.Bytes(), &body) != nil || len(body.Errors) != 1 || body.Errors[0].Code != "DENIED" {
+			t.Fatalf("%s: expected DENIED, got %d %s", name, rr.Code, rr.Body.String())
+		}
+		inst.config.Mode = repo.ModeOffline
+		if rr := getManifest(inst, "latest", mediaTypeOCIManifest); rr.Code != http.StatusNotFound {
+			t.Fatalf("%s: expected rejected manifest not to be cached, got %d", name, rr.Code)
+		}
+	}
+}
+
+func TestContainerPolicyAppliesToHeadRequests(t *testing.T) {
+	t.Parallel()
+	key := newTestKey(t)
+	der, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	policy := &repo.Policy{Keys: []string{writeTestPEM(t, t.TempDir(), "cosign.pub", "PUBLIC KEY", der)}}
+	digest := manifestDigest(policyTestImage)
+	head := func(inst *containerRegistryInstance) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodHead, "/v2/library/alpine/manifests/latest", nil)
+		req.Header.Set("Accept", mediaTypeOCIManifest)
+		rr := httptest.NewRecorder()
+		inst.HandleV2Manifest(&param{name: "library/alpine", tag: "latest"}, rr, req)
+		return rr
+	}
+
+	// Clients use the digest of a HEAD to pull by digest, so an unsigned image must not be resolved.
+	if rr := head(newPolicyInstanceForTest(t, policy, nil)); rr.Code != http.StatusForbidden || rr.Header().Get("Docker-Content-Digest") != "" {
+		t.Fatalf("expected unsigned HEAD to be denied, got %d %v", rr.Code, rr.Header())
+	}
+	if rr := head(newPolicyInstanceForTest(t, policy, cosignSignature(t, key, digest))); rr.Code != http.StatusOK ||
+		rr.Header().Get("Docker-Content-Digest") != digest || rr.Body.Len() != 0 {
+		t.Fatalf("expected signed HEAD to succeed without a body, got %d %v %d bytes", rr.Code, rr.Header(), rr.Body.Len())
+	}
+}
+
+func TestContainerPolicyAcceptsNotationSignatureChainedToTrustedCertificate(t *testing.T) {
+	t.Parallel()
+	caKey, leafKey := newTestKey(t), newTestKey(t)
+	now := time.Now()
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("create ca: %v", err)
+	}
+	ca, _ := x509.ParseCertificate(caDER)
+	leafDER, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "signer"},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+	}, ca, &leafKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("create leaf: %v", err)
+	}
+
+	digest := manifestDigest(policyTestImage)
+	encode := base64.RawURLEncoding.EncodeToString
+	protected := encode([]byte(fmt.Sprintf(`{"alg":"ES256","cty":"application/vnd.cncf.notary.payload.v1+json","io.cncf.notary.signingTime":%q}`,
+		now.UTC().Format(time.RFC3339))))
+	payload := encode([]byte(fmt.Sprintf(`{"targetArtifact":{"mediaType":%q,"digest":%q,"size":%d}}`, mediaTypeOCIManifest, digest, len(policyTestImage))))
+	sum := sha256.Sum256([]byte(protected + "." + payload))
+	r, s, err := ecdsa.Sign(rand.Reader, leafKey, sum[:])
+	if err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	sig := append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	envelope, _ := json.Marshal(map[string]any{
+		"payload":   payload,
+		"protected": protected,
+		"header":    map[string]any{"x5c": [][]byte{leafDER}},
+		"signature": encode(sig),
+	})
+	envelopeDigest := manifestDigest(envelope)
+	signature := []byte(fmt.Sprintf(`{"schemaVersion":2,"mediaType":%q,"artifactType":%q,"config":{"mediaType":"application/vnd.oci.empty.v1+json","digest":"sha256:cc","size":2},`+
+		`"layers":[{"mediaType":%q,"digest":%q,"size":%d}],"subject":{"mediaType":%q,"digest":%q,"size":%d}}`,
+		mediaTypeOCIManifest, notationArtifactType, notationJWSMediaType, envelopeDigest, len(envelope), mediaTypeOCIManifest, digest, len(policyTestImage)))
+	signatureDigest := manifestDigest(signature)
+	referrers := []byte(fmt.Sprintf(`{"schemaVersion":2,"mediaType":%q,"manifests":[{"mediaType":%q,"digest":%q,"size":%d,"artifactType":%q}]}`,
+		mediaTypeOCIIndex, mediaTypeOCIManifest, signatureDigest, len(signature), notationArtifactType))
+
+	policy := &repo.Policy{Signatures: []string{repo.SignatureNotation}, Keys: []string{writeTestPEM(t, t.TempDir(), "ca.crt", "CERTIFICATE", caDER)}}
+	inst := newPolicyInstanceForTest(t, policy, map[string][]byte{
+		"/v2/library/alpine/referrers/" + digest:          referrers,
+		"/v2/library/alpine/manifests/" + signatureDigest: signature,
+		"/v2/library/alpine/blobs/" + envelopeDigest:      envelope,
+	})
+	if rr := getManifest(inst, "latest", mediaTypeOCIManifest); rr.Code != http.StatusOK {
+		t.Fatalf("expected notation-signed image to be served, got %d %s", rr.Code, rr.Body.String())
+	}
+	// The signature manifest itself is exempt so notation clients can fetch it through the proxy.
+	if rr := getManifest(inst, signatureDigest, mediaTypeOCIManifest); rr.Code != http.StatusOK || rr.Body.String() != string(signature) {
+		t.Fatalf("expected cached signature manifest, got %d", rr.Code)
+	}
+}
+
+func TestContainerPolicyExemptsOnlySignatureArtifacts(t *testing.T) {
+	t.Parallel()
+	key := newTestKey(t)
+	der, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	policy := &repo.Policy{Keys: []string{writeTestPEM(t, t.TempDir(), "cosign.pub", "PUBLIC KEY", der)}}
+	runnable := fmt.Sprintf(`{"schemaVersion":2,"mediaType":%q,"config":{"mediaType":"application/vnd.oci.image.config.v1+json","digest":"sha256:aa"},`+
+		`"layers":[{"mediaType":"application/vnd.oci.image.layer.v1.tar+gzip","digest":"sha256:dd","size":10}]`, mediaTypeOCIManifest)
+	imageTag := strings.Replace(manifestDigest(policyTestImage), ":", "-", 1) + ".sig"
+	withSubject := []byte(runnable + fmt.Sprintf(`,"subject":{"mediaType":%q,"digest":%q,"size":%d}}`,
+		mediaTypeOCIManifest, manifestDigest(policyTestImage), len(policyTestImage)))
+	signatures := cosignSignature(t, key, manifestDigest(policyTestImage))
+	inst := newPolicyInstanceForTest(t, policy, map[string][]byte{
+		"/v2/library/alpine/manifests/" + imageTag: []byte(runnable + "}"),
+		"/v2/library/alpine/manifests/child":       withSubject,
+	})
+	for _, reference := range []string{imageTag, "child"} {
+		if rr := getManifest(inst, reference, mediaTypeOCIManifest); rr.Code != http.StatusForbidden {
+			t.Fatalf("%s: expected unsigned image posing as a signature to be denied, got %d %s", reference, rr.Code, rr.Body.String())
+		}
+	}
+
+	// A genuine cosign signature manifest is still served for clients to verify themselves.
+	inst = newPolicyInstanceForTest(t, policy, signatures)
+	if rr := getManifest(inst, imageTag, mediaTypeOCIManifest); rr.Code != http.StatusOK {
+		t.Fatalf("expected cosign signature manifest to be served, got %d %s", rr.Code, rr.Body.String())
+	}
+}
@@ -0,0 +1,489 @@
+package container
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/davidjspooner/go-fs/pkg/storage"
+	"github.com/davidjspooner/repoxy/pkg/repo"
+)
+
+// hostedHost is the storage host that hosted repositories keep their images under.
+const hostedHost = "local"
+
+// maxManifestBytes bounds the size of a pushed manifest.
+const maxManifestBytes = 4 << 20
+
+const (
+	uploadsDir        = "uploads"
+	uploadSessionKind = "registry.upload"
+)
+
+// uploadSessionTTL is how long an upload session may stay idle before it counts as abandoned and is removed. Abandoned
+// sessions are looked for at most every uploadSweepInterval, when a new session starts.
+const (
+	uploadSessionTTL    = 24 * time.Hour
+	uploadSweepInterval = time.Hour
+)
+
+// uploadSession mirrors uploads/<uuid>/session.json for an in-progress blob upload.
+// Each PATCH is stored as its own chunk file so appends never rewrite earlier data.
+type uploadSession struct {
+	Kind      string    `json:"kind"`
+	UUID      string    `json:"uuid"`
+	Name      string    `json:"name"`
+	Size      int64     `json:"size"`
+	Chunks    int       `json:"chunks"`
+	StartedAt time.Time `json:"startedAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+func uploadSessionPath(uuid string) string {
+	return path.Join(uploadsDir, uuid, "session.json")
+}
+
+func uploadChunkPath(uuid string, index int) string {
+	return path.Join(uploadsDir, uuid, fmt.Sprintf("chunk-%06d", index))
+}
+
+func newUploadID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	h := hex.EncodeToString(b[:])
+	return h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:], nil
+}
+
+// validUploadID rejects session ids that were not minted by newUploadID, keeping them safe to use as paths.
+func validUploadID(id string) bool {
+	if len(id) != 36 {
+		return false
+	}
+	for i, c := range id {
+		switch {
+		case i == 8 || i == 13 || i == 18 || i == 23:
+			if c != '-' {
+				return false
+			}
+		case (c < '0' || c > '9') && (c < 'a' || c > 'f'):
+			return false
+		}
+	}
+	return true
+}
+
+func isDigestReference(reference string) bool {
+	return strings.Contains(reference, ":")
+}
+
+// validDigest reports whether digest is a sha256 or sha512 digest in canonical lower-case hex.
+func validDigest(digest string) bool {
+	algo, encoded, ok := strings.Cut(digest, ":")
+	switch {
+	case !ok:
+		return false
+	case algo == "sha256" && len(encoded) == 64, algo == "sha512" && len(encoded) == 128:
+	default:
+		return false
+	}
+	_, err := hex.DecodeString(encoded)
+	return err == nil && strings.ToLower(encoded) == encoded
+}
+
+// handleUploadStart handles POST /v2/<name>/blobs/uploads/. A `digest` query completes a monolithic upload in one
+// request and `mount`/`from` mounts a blob from another repository; otherwise a new session is opened for PATCH/PUT.
+func (d *containerRegistryInstance) handleUploadStart(param *param, w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if digest := r.URL.Query().Get("digest"); digest != "" {
+		d.completeUpload(param, digest, r.Body, w, r)
+		return
+	}
+	if mount := r.URL.Query().Get("mount"); mount != "" && d.mountBlob(param, mount, r.URL.Query().Get("from"), w, r) {
+		return
+	}
+	id, err := newUploadID()
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to allocate upload id", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	now := time.Now().UTC()
+	session := &uploadSession{Kind: uploadSessionKind, UUID: id, Name: param.name, StartedAt: now, UpdatedAt: now}
+	if err := d.saveUploadSession(r, session); err != nil {
+		slog.ErrorContext(ctx, "failed to create upload session", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if d.uploadSweepDue(now) {
+		go d.sweepAbandonedUploads(context.WithoutCancel(ctx), now)
+	}
+	writeUploadStatus(w, session, http.StatusAccepted)
+}
+
+// mountBlob links a blob already stored for the repository named from into this repository, answering 201 on success.
+// It reports false when the blob cannot be mounted, including when the client may not read from, so the caller falls
+// back to a regular upload session.
+func (d *containerRegistryInstance) mountBlob(param *param, digest, from string, w http.ResponseWriter, r *http.Request) bool {
+	ctx := r.Context()
+	if !validDigest(digest) {
+		return false
+	}
+	if _, err := d.storage.StatBlob(ctx, digest); err != nil {
+		source := d
+		if d.factory != nil && from != "" {
+			source = d.factory.bestInstance(from)
+		}
+		if source == nil || source == d || source.storage == nil {
+			return false
+		}
+		if !repo.Authorized(ctx, &source.config, from, repo.ActionRead) {
+			slog.DebugContext(ctx, "cross-repository mount denied", "digest", digest, "from", from)
+			return false
+		}
+		if err := d.storage.MountBlob(ctx, digest, source.storage); err != nil {
+			slog.DebugContext(ctx, "cross-repository mount failed", "digest", digest, "from", from, "error", err)
+			return false
+		}
+	}
+	w.Header().Set("Location", "/v2/"+param.name+"/blobs/"+digest)
+	w.Header().Set("Docker-Content-Digest", digest)
+	w.Header().Set("Content-Length", "0")
+	w.WriteHeader(http.StatusCreated)
+	return true
+}
+
+// handleUploadSession reports (GET), appends to (PATCH), completes (PUT) or cancels (DELETE) an upload session.
+func (d *containerRegistryInstance) handleUploadSession(param *param, w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	lock := d.uploadLock(param.uuid)
+	lock.Lock()
+	defer lock.Unlock()
+
+	session := d.loadUploadSession(r, param)
+	if session == nil {
+		d.uploadLocks.Delete(param.uuid)
+		writeRegistryError(w, http.StatusNotFound, "BLOB_UPLOAD_UNKNOWN", "blob upload unknown to registry")
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		writeUploadStatus(w, session, http.StatusNoContent)
+	case http.MethodPatch:
+		if !d.checkContentRange(session, w, r) {
+			return
+		}
+		if err := d.appendUploadChunk(r, session, r.Body); err != nil {
+			slog.ErrorContext(ctx, "failed to append upload chunk", "uuid", session.UUID, "error", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		writeUploadStatus(w, session, http.StatusAccepted)
+	case http.MethodPut:
+		digest := r.URL.Query().Get("digest")
+		if digest == "" {
+			writeRegistryError(w, http.StatusBadRequest, "DIGEST_INVALID", "digest query parameter is required")
+			return
+		}
+		if !d.checkContentRange(session, w, r) {
+			return
+		}
+		if err := d.appendUploadChunk(r, session, r.Body); err != nil {
+			slog.ErrorContext(ctx, "failed to append upload chunk", "uuid", session.UUID, "error", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		chunks := make([]io.Reader, 0, session.Chunks)
+		for i := 0; i < session.Chunks; i++ {
+			reader, err := d.storage.OpenFile(ctx, uploadChunkPath(session.UUID, i))
+			if err != nil {
+				slog.ErrorContext(ctx, "failed to open upload chunk", "uuid", session.UUID, "chunk", i, "error", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			defer reader.Close()
+			chunks = append(chunks, reader)
+		}
+		if d.completeUpload(param, digest, io.MultiReader(chunks...), w, r) {
+			d.removeUploadSession(ctx, session.UUID)
+		}
+	case http.MethodDelete:
+		d.removeUploadSession(ctx, session.UUID)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// completeUpload stores body under digest and answers 201 Created. It reports whether the blob was stored.
+func (d *containerRegistryInstance) completeUpload(param *param, digest string, body io.Reader, w http.ResponseWriter, r *http.Request) bool {
+	ctx := r.Context()
+	if !validDigest(digest) {
+		writeRegistryError(w, http.StatusBadRequest, "DIGEST_INVALID", "invalid digest "+digest)
+		return false
+	}
+	if _, err := d.storage.PutBlob(ctx, digest, body); err != nil {
+		if repo.IsDigestMismatch(err) {
+			writeRegistryError(w, http.StatusBadRequest, "DIGEST_INVALID", "uploaded content does not match digest")
+			return false
+		}
+		slog.ErrorContext(ctx, "failed to store uploaded blob", "digest", digest, "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return false
+	}
+	w.Header().Set("Location", "/v2/"+param.name+"/blobs/"+digest)
+	w.Header().Set("Docker-Content-Digest", digest)
+	w.Header().Set("Content-Length", "0")
+	w.WriteHeader(http.StatusCreated)
+	return true
+}
+
+// checkContentRange rejects a chunk whose Content-Range does not start where the session currently ends.
+func (d *containerRegistryInstance) checkContentRange(session *uploadSession, w http.ResponseWriter, r *http.Request) bool {
+	header := r.Header.Get("Content-Range")
+	if header == "" {
+		return true
+	}
+	start, _, _ := strings.Cut(strings.TrimPrefix(header, "bytes="), "-")
+	offset, err := strconv.ParseInt(start, 10, 64)
+	if err == nil && offset == session.Size {
+		return true
+	}
+	w.Header().Set("Location", "/v2/"+session.Name+"/blobs/uploads/"+session.UUID)
+	w.Header().Set("Range", uploadRange(session))
+	w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+	return false
+}
+
+func (d *containerRegistryInstance) appendUploadChunk(r *http.Request, session *uploadSession, body io.Reader) error {
+	n, err := d.storage.StoreFile(r.Context(), uploadChunkPath(session.UUID, session.Chunks), body)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return nil
+	}
+	session.Size += n
+	session.Chunks++
+	session.UpdatedAt = time.Now().UTC()
+	return d.saveUploadSession(r, session)
+}
+
+func (d *containerRegistryInstance) saveUploadSession(r *http.Request, session *uploadSession) error {
+	body, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	_, err = d.storage.StoreFile(r.Context(), uploadSessionPath(session.UUID), bytes.NewReader(body))
+	return err
+}
+
+func (d *containerRegistryInstance) loadUploadSession(r *http.Request, param *param) *uploadSession {
+	session := d.readUploadSession(r.Context(), param.uuid)
+	if session == nil || session.Name != param.name {
+		return nil
+	}
+	return session
+}
+
+func (d *containerRegistryInstance) readUploadSession(ctx context.Context, uuid string) *uploadSession {
+	if !validUploadID(uuid) {
+		return nil
+	}
+	reader, err := d.storage.OpenFile(ctx, uploadSessionPath(uuid))
+	if err != nil {
+		return nil
+	}
+	defer reader.Close()
+	var session uploadSession
+	if err := json.NewDecoder(reader).Decode(&session); err != nil || session.Kind != uploadSessionKind {
+		return nil
+	}
+	return &session
+}
+
+// uploadSweepDue reports whether a sweep for abandoned uploads should run at now, claiming it for the caller.
+func (d *containerRegistryInstance) uploadSweepDue(now time.Time) bool {
+	last := d.lastUploadSweep.Load()
+	if now.UnixNano()-last < int64(uploadSweepInterval) {
+		return false
+	}
+	return d.lastUploadSweep.CompareAndSwap(last, now.UnixNano())
+}
+
+// sweepAbandonedUploads removes the chunks and session of every upload that has been idle for uploadSessionTTL at now.
+func (d *containerRegistryInstance) sweepAbandonedUploads(ctx context.Context, now time.Time) {
+	uploadsFS, err := d.storage.EnsureSub(ctx, uploadsDir)
+	if err != nil {
+		slog.WarnContext(ctx, "failed to open upload sessions", "error", err)
+		return
+	}
+	entries, err := uploadsFS.ReadDir(ctx, "")
+	if err != nil {
+		slog.WarnContext(ctx, "failed to list upload sessions", "error", err)
+		return
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		lock := d.uploadLock(entry.Name())
+		lock.Lock()
+		session := d.readUploadSession(ctx, entry.Name())
+		switch {
+		case session == nil:
+			d.uploadLocks.Delete(entry.Name())
+		case now.Sub(session.UpdatedAt) > uploadSessionTTL:
+			slog.InfoContext(ctx, "removing abandoned upload session", "uuid", session.UUID, "name", session.Name, "updated", session.UpdatedAt)
+			d.removeUploadSession(ctx, session.UUID)
+		}
+		lock.Unlock()
+	}
+}
+
+func (d *containerRegistryInstance) removeUploadSession(ctx context.Context, uuid string) {
+	uploadsFS, err := d.storage.EnsureSub(ctx, uploadsDir)
+	if err == nil {
+		err = uploadsFS.Delete(ctx, uuid, &storage.DeleteOptions{Recursive: true})
+	}
+	if err != nil {
+		slog.WarnContext(ctx, "failed to remove upload session", "uuid", uuid, "error", err)
+	}
+	d.uploadLocks.Delete(uuid)
+}
+
+func (d *containerRegistryInstance) uploadLock(uuid string) *sync.Mutex {
+	lock, _ := d.uploadLocks.LoadOrStore(uuid, &sync.Mutex{})
+	return lock.(*sync.Mutex)
+}
+
+func uploadRange(session *uploadSession) string {
+	return fmt.Sprintf("0-%d", max(session.Size-1, 0))
+}
+
+func writeUploadStatus(w http.ResponseWriter, session *uploadSession, status int) {
+	w.Header().Set("Location", "/v2/"+session.Name+"/blobs/uploads/"+session.UUID)
+	w.Header().Set("Docker-Upload-UUID", session.UUID)
+	w.Header().Set("Range", uploadRange(session))
+	w.Header().Set("Content-Length", "0")
+	w.WriteHeader(status)
+}
+
+// handleManifestPut stores a pushed manifest once every blob and child manifest it references is present,
+// labelling it with its digest and, for tag references, the tag.
+func (d *containerRegistryInstance) handleManifestPut(param *param, w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxManifestBytes+1))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if len(body) > maxManifestBytes {
+		writeRegistryError(w, http.StatusRequestEntityTooLarge, "MANIFEST_INVALID", "manifest exceeds 4 MiB")
+		return
+	}
+	digest := manifestDigest(body)
+	if isDigestReference(param.tag) && param.tag != digest {
+		writeRegistryError(w, http.StatusBadRequest, "DIGEST_INVALID", "manifest does not match digest "+param.tag)
+		return
+	}
+	var doc manifestDocument
+	if err := json.Unmarshal(body, &doc); err != nil {
+		writeRegistryError(w, http.StatusBadRequest, "MANIFEST_INVALID", "manifest is not valid JSON")
+		return
+	}
+	blobs := doc.Layers
+	if doc.Config != nil {
+		blobs = append([]manifestDescriptor{*doc.Config}, blobs...)
+	}
+	for _, blob := range blobs {
+		if _, err := d.storage.StatBlob(ctx, blob.Digest); err != nil {
+			writeRegistryError(w, http.StatusBadRequest, "MANIFEST_BLOB_UNKNOWN", "blob unknown to registry: "+blob.Digest)
+			return
+		}
+	}
+	for _, child := range doc.Manifests {
+		loc := repo.Locator{Host: d.upstreamHost(), Name: param.name, VersionID: child.Digest}
+		if _, err := d.storage.GetVersionMeta(ctx, loc); err != nil {
+			writeRegistryError(w, http.StatusBadRequest, "MANIFEST_BLOB_UNKNOWN", "manifest unknown to registry: "+child.Digest)
+			return
+		}
+	}
+	mediaType := r.Header.Get("Content-Type")
+	if mediaType == "" {
+		mediaType = doc.MediaType
+	}
+	labels := []string{digest}
+	if !isDigestReference(param.tag) {
+		labels = []string{param.tag, digest}
+	}
+	if err := d.storeManifest(ctx, param.name, digest, mediaType, body, labels...); err != nil {
+		slog.ErrorContext(ctx, "failed to store pushed manifest", "name", param.name, "reference", param.tag, "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if doc.Subject != nil {
+		w.Header().Set("OCI-Subject", doc.Subject.Digest)
+	}
+	w.Header().Set("Location", "/v2/"+param.name+"/manifests/"+digest)
+	w.Header().Set("Docker-Content-Digest", digest)
+	w.Header().Set("Content-Length", "0")
+	w.WriteHeader(http.StatusCreated)
+}
+
+// handleManifestDelete untags a tag reference, or removes a digest reference together with every tag pointing at it.
+// Blobs are left for gc.
+func (d *containerRegistryInstance) handleManifestDelete(param *param, w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	loc := repo.Locator{Host: d.upstreamHost(), Name: param.name}
+	bindings, err := d.storage.GetLabels(ctx, loc)
+	if err != nil || bindings.Labels == nil {
+		writeRegistryError(w, http.StatusNotFound, "MANIFEST_UNKNOWN", "manifest unknown to registry")
+		return
+	}
+	var remove []string
+	if isDigestReference(param.tag) {
+		for label, versionID := range bindings.Labels {
+			if versionID == param.tag {
+				remove = append(remove, label)
+			}
+		}
+	} else if _, ok := bindings.Labels[param.tag]; ok {
+		remove = []string{param.tag}
+	}
+	if len(remove) == 0 {
+		writeRegistryError(w, http.StatusNotFound, "MANIFEST_UNKNOWN", "manifest unknown to registry")
+		return
+	}
+	for _, label := range remove {
+		loc.Label = label
+		if err := d.storage.DeleteLabel(ctx, loc); err != nil {
+			slog.ErrorContext(ctx, "failed to delete manifest label", "name", param.name, "label", label, "error", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+	if isDigestReference(param.tag) {
+		loc.Label = ""
+		loc.VersionID = param.tag
+		if meta, err := d.storage.GetVersionMeta(ctx, loc); err == nil {
+			d.forgetReferrer(ctx, param.name, param.tag, []byte(meta.Manifest))
+		}
+		if err := d.storage.DeleteVersion(ctx, loc); err != nil {
+			slog.ErrorContext(ctx, "failed to delete manifest version", "name", param.name, "digest", param.tag, "error", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
@@ -0,0 +1,307 @@
+package container
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/davidjspooner/repoxy/pkg/auth"
+	"github.com/davidjspooner/repoxy/pkg/repo"
+)
+
+func newHostedInstanceForTest(t *testing.T) *containerRegistryInstance {
+	t.Helper()
+	inst := newContainerInstanceFromConfig(t, &repo.Repo{
+		Name:     "internal",
+		Type:     "container",
+		Mode:     repo.ModeHosted,
+		Mappings: []string{"team/*"},
+	})
+	inst.httpClientFactory = newContainerClientFactory(func(req *http.Request) (*http.Response, error) {
+		t.Errorf("hosted repository contacted upstream: %s", req.URL)
+		return nil, fmt.Errorf("no upstream")
+	})
+	return inst
+}
+
+func hostedRequest(inst *containerRegistryInstance, method, target string, p *param, body []byte, headers map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, bytes.NewReader(body))
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	rr := httptest.NewRecorder()
+	switch {
+	case strings.Contains(target, "/manifests/"):
+		inst.HandleV2Manifest(p, rr, req)
+	case strings.HasSuffix(req.URL.Path, "/blobs/uploads/"):
+		inst.HandleV2BlobUpload(p, rr, req)
+	case strings.Contains(target, "/blobs/uploads/"):
+		inst.HandleV2BlobUID(p, rr, req)
+	case strings.Contains(target, "/tags/list"):
+		inst.HandleV2Tags(p, rr, req)
+	case strings.Contains(target, "/referrers/"):
+		inst.HandleV2Referrers(p, rr, req)
+	default:
+		inst.HandleV2BlobByDigest(p, rr, req)
+	}
+	return rr
+}
+
+// pushTestImage pushes a config blob monolithically and a layer in two chunks, then tags a manifest referencing both.
+func pushTestImage(t *testing.T, inst *containerRegistryInstance, tag string) (string, []byte) {
+	t.Helper()
+	name := &param{name: "team/app"}
+	config := []byte(`{"architecture":"amd64"}`)
+	configDigest := manifestDigest(config)
+	if rr := hostedRequest(inst, http.MethodPost, "/v2/team/app/blobs/uploads/?digest="+configDigest, name, config, nil); rr.Code != http.StatusCreated {
+		t.Fatalf("monolithic upload failed: %d %s", rr.Code, rr.Body.String())
+	}
+
+	rr := hostedRequest(inst, http.MethodPost, "/v2/team/app/blobs/uploads/", name, nil, nil)
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("expected 202 starting upload, got %d", rr.Code)
+	}
+	location := rr.Header().Get("Location")
+	session := &param{name: "team/app", uuid: rr.Header().Get("Docker-Upload-UUID")}
+	layer := []byte("layer-one-layer-two")
+	rr = hostedRequest(inst, http.MethodPatch, location, session, layer[:10], map[string]string{"Content-Range": "0-9"})
+	if rr.Code != http.StatusAccepted || rr.Header().Get("Range") != "0-9" {
+		t.Fatalf("unexpected chunk response: %d range %q", rr.Code, rr.Header().Get("Range"))
+	}
+	if rr := hostedRequest(inst, http.MethodPatch, location, session, layer[10:], map[string]string{"Content-Range": "0-8"}); rr.Code != http.StatusRequestedRangeNotSatisfiable {
+		t.Fatalf("expected 416 for out-of-order chunk, got %d", rr.Code)
+	}
+	layerDigest := manifestDigest(layer)
+	if rr := hostedRequest(inst, http.MethodPut, location+"?digest="+layerDigest, session, layer[10:], nil); rr.Code != http.StatusCreated {
+		t.Fatalf("completing upload failed: %d %s", rr.Code, rr.Body.String())
+	}
+	if rr := hostedRequest(inst, http.MethodGet, location, session, nil, nil); rr.Code != http.StatusNotFound {
+		t.Fatalf("expected completed session to be removed, got %d", rr.Code)
+	}
+
+	manifest := []byte(fmt.Sprintf(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json",`+
+		`"config":{"digest":%q,"size":%d},"layers":[{"digest":%q,"size":%d}]}`, configDigest, len(config), layerDigest, len(layer)))
+	rr = hostedRequest(inst, http.MethodPut, "/v2/team/app/manifests/"+tag, &param{name: "team/app", tag: tag}, manifest,
+		map[string]string{"Content-Type": "application/vnd.oci.image.manifest.v1+json"})
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("manifest push failed: %d %s", rr.Code, rr.Body.String())
+	}
+	return rr.Header().Get("Docker-Content-Digest"), manifest
+}
+
+func TestHostedRepositoryAcceptsPushes(t *testing.T) {
+	t.Parallel()
+	inst := newHostedInstanceForTest(t)
+	digest, manifest := pushTestImage(t, inst, "v1")
+
+	for _, reference := range []string{"v1", digest} {
+		rr := hostedRequest(inst, http.MethodGet, "/v2/team/app/manifests/"+reference, &param{name: "team/app", tag: reference}, nil, nil)
+		if rr.Code != http.StatusOK || rr.Body.String() != string(manifest) {
+			t.Fatalf("expected pushed manifest for %s, got %d %s", reference, rr.Code, rr.Body.String())
+		}
+		if rr.Header().Get("Content-Type") != "application/vnd.oci.image.manifest.v1+json" {
+			t.Fatalf("unexpected content type %q", rr.Header().Get("Content-Type"))
+		}
+	}
+	layerDigest := manifestDigest([]byte("layer-one-layer-two"))
+	rr := hostedRequest(inst, http.MethodGet, "/v2/team/app/blobs/"+layerDigest, &param{name: "team/app", digest: layerDigest}, nil, nil)
+	if rr.Code != http.StatusOK || rr.Body.String() != "layer-one-layer-two" {
+		t.Fatalf("expected assembled layer, got %d %s", rr.Code, rr.Body.String())
+	}
+	rr = hostedRequest(inst, http.MethodGet, "/v2/team/app/tags/list", &param{name: "team/app"}, nil, nil)
+	if rr.Code != http.StatusOK || rr.Body.String() != `{"name":"team/app","tags":["v1"]}` {
+		t.Fatalf("unexpected tag list: %d %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestHostedManifestPushValidatesContent(t *testing.T) {
+	t.Parallel()
+	inst := newHostedInstanceForTest(t)
+	missing := manifestDigest([]byte("never uploaded"))
+	manifest := []byte(fmt.Sprintf(`{"schemaVersion":2,"layers":[{"digest":%q}]}`, missing))
+	rr := hostedRequest(inst, http.MethodPut, "/v2/team/app/manifests/v1", &param{name: "team/app", tag: "v1"}, manifest, nil)
+	if rr.Code != http.StatusBadRequest || !strings.Contains(rr.Body.String(), "MANIFEST_BLOB_UNKNOWN") {
+		t.Fatalf("expected MANIFEST_BLOB_UNKNOWN, got %d %s", rr.Code, rr.Body.String())
+	}
+
+	wrong := manifestDigest([]byte("other"))
+	rr = hostedRequest(inst, http.MethodPut, "/v2/team/app/manifests/"+wrong, &param{name: "team/app", tag: wrong}, []byte(`{"schemaVersion":2}`), nil)
+	if rr.Code != http.StatusBadRequest || !strings.Contains(rr.Body.String(), "DIGEST_INVALID") {
+		t.Fatalf("expected DIGEST_INVALID, got %d %s", rr.Code, rr.Body.String())
+	}
+
+	rr = hostedRequest(inst, http.MethodPost, "/v2/team/app/blobs/uploads/?digest="+wrong, &param{name: "team/app"}, []byte("payload"), nil)
+	if rr.Code != http.StatusBadRequest || !strings.Contains(rr.Body.String(), "DIGEST_INVALID") {
+		t.Fatalf("expected DIGEST_INVALID for mismatched upload, got %d %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestHostedManifestDelete(t *testing.T) {
+	t.Parallel()
+	inst := newHostedInstanceForTest(t)
+	digest, _ := pushTestImage(t, inst, "v1")
+	pushTestImage(t, inst, "latest")
+
+	if rr := hostedRequest(inst, http.MethodDelete, "/v2/team/app/manifests/latest", &param{name: "team/app", tag: "latest"}, nil, nil); rr.Code != http.StatusAccepted {
+		t.Fatalf("expected 202 deleting tag, got %d", rr.Code)
+	}
+	if rr := hostedRequest(inst, http.MethodGet, "/v2/team/app/manifests/latest", &param{name: "team/app", tag: "latest"}, nil, nil); rr.Code != http.StatusNotFound {
+		t.Fatalf("expected deleted tag to be gone, got %d", rr.Code)
+	}
+	if rr := hostedRequest(inst, http.MethodGet, "/v2/team/app/manifests/v1", &param{name: "team/app", tag: "v1"}, nil, nil); rr.Code != http.StatusOK {
+		t.Fatalf("expected other tag to survive, got %d", rr.Code)
+	}
+
+	if rr := hostedRequest(inst, http.MethodDelete, "/v2/team/app/manifests/"+digest, &param{name: "team/app", tag: digest}, nil, nil); rr.Code != http.StatusAccepted {
+		t.Fatalf("expected 202 deleting digest, got %d", rr.Code)
+	}
+	for _, reference := range []string{"v1", digest} {
+		if rr := hostedRequest(inst, http.MethodGet, "/v2/team/app/manifests/"+reference, &param{name: "team/app", tag: reference}, nil, nil); rr.Code != http.StatusNotFound {
+			t.Fatalf("expected %s to be gone after digest delete, got %d", reference, rr.Code)
+		}
+	}
+	bindings, err := inst.storage.GetLabels(context.Background(), repo.Locator{Host: inst.upstreamHost(), Name: "team/app"})
+	if err != nil {
+		t.Fatalf("GetLabels failed: %v", err)
+	}
+	for label, history := range bindings.History {
+		if slices.Contains(history, digest) {
+			t.Fatalf("expected deleted digest to be dropped from the history of %s, got %v", label, history)
+		}
+	}
+}
+
+func TestHostedAbandonedUploadsAreSwept(t *testing.T) {
+	t.Parallel()
+	inst := newHostedInstanceForTest(t)
+	name := &param{name: "team/app"}
+	start := func() *param {
+		rr := hostedRequest(inst, http.MethodPost, "/v2/team/app/blobs/uploads/", name, nil, nil)
+		if rr.Code != http.StatusAccepted {
+			t.Fatalf("expected 202 starting upload, got %d", rr.Code)
+		}
+		session := &param{name: "team/app", uuid: rr.Header().Get("Docker-Upload-UUID")}
+		if rr := hostedRequest(inst, http.MethodPatch, "/v2/team/app/blobs/uploads/"+session.uuid, session, []byte("chunk"), nil); rr.Code != http.StatusAccepted {
+			t.Fatalf("expected 202 appending a chunk, got %d", rr.Code)
+		}
+		return session
+	}
+	abandoned, active := start(), start()
+
+	ctx := context.Background()
+	session := inst.readUploadSession(ctx, abandoned.uuid)
+	session.UpdatedAt = time.Now().Add(-uploadSessionTTL - time.Minute)
+	body, _ := json.Marshal(session)
+	if _, err := inst.storage.StoreFile(ctx, uploadSessionPath(abandoned.uuid), bytes.NewReader(body)); err != nil {
+		t.Fatalf("StoreFile failed: %v", err)
+	}
+	inst.sweepAbandonedUploads(ctx, time.Now())
+	if rr := hostedRequest(inst, http.MethodGet, "/v2/team/app/blobs/uploads/"+abandoned.uuid, abandoned, nil, nil); rr.Code != http.StatusNotFound {
+		t.Fatalf("expected the abandoned session to be removed, got %d", rr.Code)
+	}
+	if _, err := inst.storage.OpenFile(ctx, uploadChunkPath(abandoned.uuid, 0)); err == nil {
+		t.Fatalf("expected the chunks of the abandoned session to be removed")
+	}
+	if _, ok := inst.uploadLocks.Load(abandoned.uuid); ok {
+		t.Fatalf("expected the lock of the abandoned session to be dropped")
+	}
+	if rr := hostedRequest(inst, http.MethodGet, "/v2/team/app/blobs/uploads/"+active.uuid, active, nil, nil); rr.Code != http.StatusNoContent {
+		t.Fatalf("expected the active session to survive, got %d", rr.Code)
+	}
+}
+
+func TestPullThroughRepositoryRejectsPushes(t *testing.T) {
+	t.Parallel()
+	inst := newContainerInstanceForTest(t, "https://registry.test")
+	rr := hostedRequest(inst, http.MethodPost, "/v2/library/alpine/blobs/uploads/", &param{name: "library/alpine"}, nil, nil)
+	if rr.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("expected 405, got %d", rr.Code)
+	}
+	rr = hostedRequest(inst, http.MethodPut, "/v2/library/alpine/manifests/latest", &param{name: "library/alpine", tag: "latest"}, []byte("{}"), nil)
+	if rr.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("expected 405, got %d", rr.Code)
+	}
+}
+
+// uploadMountSourceForTest stores a layer for shared/base in a second hosted repository behind inst's factory and
+// returns the layer and its digest.
+func uploadMountSourceForTest(t *testing.T, inst *containerRegistryInstance) ([]byte, string) {
+	t.Helper()
+	ctx := context.Background()
+	commonFS, err := inst.storage.EnsureSub(ctx, "other")
+	if err != nil {
+		t.Fatalf("ensure sub: %v", err)
+	}
+	common, err := repo.NewCommonStorage(commonFS)
+	if err != nil {
+		t.Fatalf("common storage: %v", err)
+	}
+	other, err := inst.factory.NewRepository(ctx, common, &repo.Repo{Name: "other", Type: "container", Mode: repo.ModeHosted, Mappings: []string{"shared/*"}})
+	if err != nil {
+		t.Fatalf("new repo: %v", err)
+	}
+	source := other.(*containerRegistryInstance)
+	layer := []byte("shared layer")
+	digest := manifestDigest(layer)
+	if rr := hostedRequest(source, http.MethodPost, "/v2/shared/base/blobs/uploads/?digest="+digest, &param{name: "shared/base"}, layer, nil); rr.Code != http.StatusCreated {
+		t.Fatalf("upload to source failed: %d", rr.Code)
+	}
+	return layer, digest
+}
+
+func TestHostedCrossRepositoryMount(t *testing.T) {
+	t.Parallel()
+	inst := newHostedInstanceForTest(t)
+	layer, digest := uploadMountSourceForTest(t, inst)
+
+	missing := manifestDigest([]byte("not uploaded"))
+	rr := hostedRequest(inst, http.MethodPost, "/v2/team/app/blobs/uploads/?mount="+missing+"&from=shared/base", &param{name: "team/app"}, nil, nil)
+	if rr.Code != http.StatusAccepted || rr.Header().Get("Docker-Upload-UUID") == "" {
+		t.Fatalf("expected fallback upload session for unknown blob, got %d", rr.Code)
+	}
+
+	rr = hostedRequest(inst, http.MethodPost, "/v2/team/app/blobs/uploads/?mount="+digest+"&from=shared/base", &param{name: "team/app"}, nil, nil)
+	if rr.Code != http.StatusCreated || rr.Header().Get("Location") != "/v2/team/app/blobs/"+digest {
+		t.Fatalf("expected 201 mount, got %d location %q", rr.Code, rr.Header().Get("Location"))
+	}
+	rr = hostedRequest(inst, http.MethodGet, "/v2/team/app/blobs/"+digest, &param{name: "team/app", digest: digest}, nil, nil)
+	if rr.Code != http.StatusOK || rr.Body.String() != string(layer) {
+		t.Fatalf("expected mounted blob, got %d %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestHostedCrossRepositoryMountRequiresReadOnSource(t *testing.T) {
+	inst := newHostedInstanceForTest(t)
+	_, digest := uploadMountSourceForTest(t, inst)
+	if err := repo.EnableAccessControl(&repo.AccessControl{Grants: []repo.Grant{
+		{Principals: []string{"alice", "bob"}, Names: []string{"team/*"}, Actions: []string{repo.ActionWrite}},
+		{Principals: []string{"bob"}, Names: []string{"shared/*"}, Actions: []string{repo.ActionRead}},
+	}}); err != nil {
+		t.Fatalf("EnableAccessControl failed: %v", err)
+	}
+	defer func() { _ = repo.EnableAccessControl(nil) }()
+
+	mount := func(user string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/v2/team/app/blobs/uploads/?mount="+digest+"&from=shared/base", nil)
+		req = req.WithContext(auth.WithPrincipal(req.Context(), &auth.Principal{Name: user}))
+		rr := httptest.NewRecorder()
+		inst.HandleV2BlobUpload(&param{name: "team/app"}, rr, req)
+		return rr
+	}
+	if rr := mount("alice"); rr.Code != http.StatusAccepted || rr.Header().Get("Docker-Upload-UUID") == "" {
+		t.Fatalf("expected an upload session when the source is not readable, got %d", rr.Code)
+	}
+	if rr := hostedRequest(inst, http.MethodHead, "/v2/team/app/blobs/"+digest, &param{name: "team/app", digest: digest}, nil, nil); rr.Code != http.StatusNotFound {
+		t.Fatalf("expected the denied mount to leave the blob absent, got %d", rr.Code)
+	}
+	if rr := mount("bob"); rr.Code != http.StatusCreated {
+		t.Fatalf("expected 201 mount for a reader of the source, got %d", rr.Code)
+	}
+}
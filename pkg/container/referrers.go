@@ -0,0 +1,378 @@
+package container
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/davidjspooner/repoxy/pkg/observability"
+	"github.com/davidjspooner/repoxy/pkg/repo"
+)
+
+const referrerListKind = "registry.referrers"
+
+// referrerList mirrors referrers/<host>/<name>/<alg>-<hex>.json: the artifacts (signatures, SBOMs, attestations)
+// that refer to one subject manifest. Upstream holds the last list fetched from upstream; Local holds referrers
+// discovered in manifests stored by this repository, whether pulled through or pushed.
+type referrerList struct {
+	Kind      string               `json:"kind"`
+	Subject   string               `json:"subject"`
+	Upstream  []referrerDescriptor `json:"upstream,omitempty"`
+	Local     []referrerDescriptor `json:"local,omitempty"`
+	FetchedAt time.Time            `json:"fetchedAt,omitempty"`
+}
+
+type referrerDescriptor struct {
+	MediaType    string            `json:"mediaType"`
+	Digest       string            `json:"digest"`
+	Size         int64             `json:"size"`
+	ArtifactType string            `json:"artifactType,omitempty"`
+	Annotations  map[string]string `json:"annotations,omitempty"`
+}
+
+func referrersPath(host, name, subject string) string {
+	return path.Join("referrers", host, name, strings.Replace(subject, ":", "-", 1)+".json")
+}
+
+// tagSchemaSubject maps a referrers tag-schema tag back to its subject digest. "<alg>-<hex>" is the OCI fallback
+// index; "<alg>-<hex>.<suffix>" is a cosign signature, attestation or SBOM.
+func tagSchemaSubject(tag string) (subject string, index bool) {
+	base, suffix, dotted := strings.Cut(tag, ".")
+	algo, hex, ok := strings.Cut(base, "-")
+	if !ok || (dotted && suffix == "") {
+		return "", false
+	}
+	subject = algo + ":" + hex
+	if !validDigest(subject) {
+		return "", false
+	}
+	return subject, !dotted
+}
+
+// HandleV2Referrers answers GET /v2/<name>/referrers/<digest> with an OCI image index of the subject's referrers,
+// optionally filtered by `artifactType`. Upstream lists are cached under the repository freshness policy; registries
+// without the referrers API are queried through the tag schema.
+func (d *containerRegistryInstance) HandleV2Referrers(param *param, w http.ResponseWriter, r *http.Request) {
+	if d.HandledWriteMethodForReadOnlyRepo(w, r) || d.deniedByRules(param, w, r) {
+		return
+	}
+	if param == nil || !validDigest(param.digest) {
+		writeRegistryError(w, http.StatusBadRequest, "DIGEST_INVALID", "invalid subject digest")
+		return
+	}
+	ctx := r.Context()
+	freshness := d.config.Freshness
+	cached := d.loadReferrers(ctx, param.name, param.digest)
+	var fetchedAt time.Time
+	if cached != nil {
+		fetchedAt = cached.FetchedAt
+	}
+	now := time.Now()
+	switch d.config.UpstreamMode() {
+	case repo.ModeOffline, repo.ModeHosted:
+		d.serveReferrers(param, cached, w, r)
+		return
+	case repo.ModePreferCache:
+		if !fetchedAt.IsZero() {
+			d.recordCacheHit(observability.CacheReferrers)
+			d.serveReferrers(param, cached, w, r)
+			return
+		}
+	default:
+		switch freshness.State(fetchedAt, now) {
+		case repo.CacheFresh:
+			d.recordCacheHit(observability.CacheReferrers)
+			d.serveReferrers(param, cached, w, r)
+			return
+		case repo.CacheRevalidate:
+			d.recordCacheHit(observability.CacheReferrers)
+			d.serveReferrers(param, cached, w, r)
+			d.revalidateReferrers(param, r)
+			return
+		}
+	}
+	d.recordCacheMiss(observability.CacheReferrers)
+	list, err := d.fetchReferrers(ctx, param)
+	if err == nil {
+		d.serveReferrers(param, list, w, r)
+		return
+	}
+	if cached != nil && freshness.ServeStaleOnError(fetchedAt, now) {
+		slog.WarnContext(ctx, "serving cached referrers after upstream failure", "name", param.name, "subject", param.digest, "error", err)
+		d.recordCacheStale(observability.CacheReferrers)
+		d.serveReferrers(param, cached, w, r)
+		return
+	}
+	slog.ErrorContext(ctx, "failed to fetch referrers from upstream", "name", param.name, "subject", param.digest, "error", err)
+	w.WriteHeader(http.StatusBadGateway)
+}
+
+// serveReferrers writes the union of the upstream and local referrers of list as an image index.
+func (d *containerRegistryInstance) serveReferrers(param *param, list *referrerList, w http.ResponseWriter, r *http.Request) {
+	artifactType := r.URL.Query().Get("artifactType")
+	seen := map[string]bool{}
+	manifests := []referrerDescriptor{}
+	if list != nil {
+		for _, group := range [][]referrerDescriptor{list.Upstream, list.Local} {
+			for _, desc := range group {
+				if seen[desc.Digest] || (artifactType != "" && desc.ArtifactType != artifactType) {
+					continue
+				}
+				seen[desc.Digest] = true
+				manifests = append(manifests, desc)
+			}
+		}
+	}
+	sort.Slice(manifests, func(i, j int) bool { return manifests[i].Digest < manifests[j].Digest })
+	body, err := json.Marshal(map[string]any{"schemaVersion": 2, "mediaType": mediaTypeOCIIndex, "manifests": manifests})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if artifactType != "" {
+		w.Header().Set("OCI-Filters-Applied", "artifactType")
+	}
+	w.Header().Set("Content-Type", mediaTypeOCIIndex)
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(http.StatusOK)
+	if r.Method != http.MethodHead {
+		_, _ = w.Write(body)
+	}
+}
+
+func (d *containerRegistryInstance) loadReferrers(ctx context.Context, name, subject string) *referrerList {
+	if d.storage == nil {
+		return nil
+	}
+	reader, err := d.storage.OpenFile(ctx, referrersPath(d.upstreamHost(), name, subject))
+	if err != nil {
+		return nil
+	}
+	defer reader.Close()
+	var list referrerList
+	if err := json.NewDecoder(reader).Decode(&list); err != nil || list.Kind != referrerListKind {
+		return nil
+	}
+	return &list
+}
+
+func (d *containerRegistryInstance) storeReferrers(ctx context.Context, name string, list *referrerList) error {
+	body, err := json.Marshal(list)
+	if err != nil {
+		return err
+	}
+	n, err := d.storage.StoreFile(ctx, referrersPath(d.upstreamHost(), name, list.Subject), bytes.NewReader(body))
+	if err != nil {
+		d.recordCacheError(observability.CacheReferrers)
+		return err
+	}
+	d.recordCacheBytes(observability.CacheReferrers, "store", n)
+	return nil
+}
+
+// updateReferrers applies update to the stored referrer list of subject under the instance's referrers lock.
+func (d *containerRegistryInstance) updateReferrers(ctx context.Context, name, subject string, update func(list *referrerList)) (*referrerList, error) {
+	d.referrersMu.Lock()
+	defer d.referrersMu.Unlock()
+	list := d.loadReferrers(ctx, name, subject)
+	if list == nil {
+		list = &referrerList{Kind: referrerListKind, Subject: subject}
+	}
+	update(list)
+	return list, d.storeReferrers(ctx, name, list)
+}
+
+// fetchReferrers refreshes the upstream referrers of param.digest once for concurrent callers and caches the result.
+func (d *containerRegistryInstance) fetchReferrers(ctx context.Context, param *param) (*referrerList, error) {
+	val, err := d.flights.Do(ctx, "referrers:"+param.name+"@"+param.digest, func(ctx context.Context) (any, error) {
+		upstream, err := d.fetchUpstreamReferrers(ctx, param.name, param.digest)
+		if err != nil {
+			return nil, err
+		}
+		list, err := d.updateReferrers(ctx, param.name, param.digest, func(list *referrerList) {
+			list.Upstream = upstream
+			list.FetchedAt = time.Now().UTC()
+		})
+		if err != nil {
+			slog.ErrorContext(ctx, "failed to persist referrers", "error", err, "name", param.name, "subject", param.digest)
+		}
+		return list, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return val.(*referrerList), nil
+}
+
+// fetchUpstreamReferrers reads every page of the upstream referrers index, falling back to the tag schema when the
+// upstream registry does not implement the referrers API.
+func (d *containerRegistryInstance) fetchUpstreamReferrers(ctx context.Context, name, subject string) ([]referrerDescriptor, error) {
+	var referrers []referrerDescriptor
+	next := "/v2/" + name + "/referrers/" + subject
+	for page := 0; next != ""; page++ {
+		if page == maxUpstreamListPages {
+			return nil, fmt.Errorf("upstream referrers have more than %d pages", maxUpstreamListPages)
+		}
+		status, header, body, err := d.getUpstream(ctx, next, mediaTypeOCIIndex)
+		if err != nil {
+			return nil, err
+		}
+		if status != http.StatusOK {
+			if page == 0 && (status == http.StatusNotFound || status == http.StatusMethodNotAllowed || status == http.StatusBadRequest) {
+				return d.fetchTagSchemaReferrers(ctx, name, subject)
+			}
+			return nil, fmt.Errorf("upstream referrers returned %d", status)
+		}
+		var index struct {
+			Manifests []referrerDescriptor `json:"manifests"`
+		}
+		if err := json.Unmarshal(body, &index); err != nil {
+			return nil, err
+		}
+		referrers = append(referrers, index.Manifests...)
+		next = nextLink(header.Get("Link"))
+	}
+	return referrers, nil
+}
+
+// fetchTagSchemaReferrers reads the `<alg>-<hex>` fallback index; a missing tag means there are no referrers.
+func (d *containerRegistryInstance) fetchTagSchemaReferrers(ctx context.Context, name, subject string) ([]referrerDescriptor, error) {
+	status, _, body, err := d.getUpstream(ctx, "/v2/"+name+"/manifests/"+strings.Replace(subject, ":", "-", 1), mediaTypeOCIIndex)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case status == http.StatusNotFound:
+		return nil, nil
+	case status != http.StatusOK:
+		return nil, fmt.Errorf("upstream referrers tag returned %d", status)
+	}
+	var index struct {
+		Manifests []referrerDescriptor `json:"manifests"`
+	}
+	if err := json.Unmarshal(body, &index); err != nil {
+		return nil, err
+	}
+	return index.Manifests, nil
+}
+
+func (d *containerRegistryInstance) getUpstream(ctx context.Context, target, accept string) (int, http.Header, []byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	resp, err := d.roundTripUpstream(ctx, req)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	return resp.StatusCode, resp.Header, body, err
+}
+
+// revalidateReferrers refreshes the cached referrers in the background after an expired copy has been served.
+func (d *containerRegistryInstance) revalidateReferrers(param *param, r *http.Request) {
+	ctx := context.WithoutCancel(r.Context())
+	go func() {
+		if _, err := d.fetchReferrers(ctx, param); err != nil {
+			slog.WarnContext(ctx, "background revalidation of referrers failed", "name", param.name, "subject", param.digest, "error", err)
+		}
+	}()
+}
+
+// recordReferrer notes a stored manifest as a referrer of its subject: either the subject named in the manifest or,
+// for tag-schema tags, the digest encoded in the tag. It returns the subject, if any.
+func (d *containerRegistryInstance) recordReferrer(ctx context.Context, name, digest, mediaType string, body []byte, labels []string) string {
+	doc := parseManifest(body)
+	if doc == nil {
+		return ""
+	}
+	var descriptors []referrerDescriptor
+	subject := ""
+	if doc.Subject != nil && validDigest(doc.Subject.Digest) {
+		subject = doc.Subject.Digest
+	}
+	for _, label := range labels {
+		if subject != "" {
+			break
+		}
+		if tagSubject, index := tagSchemaSubject(label); tagSubject != "" {
+			subject = tagSubject
+			if index {
+				// The fallback index lists the referrers themselves.
+				var fallback struct {
+					Manifests []referrerDescriptor `json:"manifests"`
+				}
+				if err := json.Unmarshal(body, &fallback); err != nil {
+					return ""
+				}
+				descriptors = fallback.Manifests
+			}
+		}
+	}
+	if subject == "" {
+		return ""
+	}
+	if descriptors == nil {
+		if mediaType == "" {
+			mediaType = doc.MediaType
+		}
+		artifactType := doc.ArtifactType
+		if artifactType == "" && doc.Config != nil {
+			artifactType = doc.Config.MediaType
+		}
+		descriptors = []referrerDescriptor{{
+			MediaType:    mediaType,
+			Digest:       digest,
+			Size:         int64(len(body)),
+			ArtifactType: artifactType,
+			Annotations:  doc.Annotations,
+		}}
+	}
+	_, err := d.updateReferrers(ctx, name, subject, func(list *referrerList) {
+		for _, desc := range descriptors {
+			list.Local = removeReferrer(list.Local, desc.Digest)
+			list.Local = append(list.Local, desc)
+		}
+	})
+	if err != nil {
+		slog.WarnContext(ctx, "failed to record referrer", "name", name, "subject", subject, "digest", digest, "error", err)
+	}
+	return subject
+}
+
+// forgetReferrer drops a deleted manifest from its subject's local referrers.
+func (d *containerRegistryInstance) forgetReferrer(ctx context.Context, name, digest string, body []byte) {
+	doc := parseManifest(body)
+	if doc == nil || doc.Subject == nil || !validDigest(doc.Subject.Digest) {
+		return
+	}
+	_, err := d.updateReferrers(ctx, name, doc.Subject.Digest, func(list *referrerList) {
+		list.Local = removeReferrer(list.Local, digest)
+	})
+	if err != nil {
+		slog.WarnContext(ctx, "failed to drop referrer", "name", name, "digest", digest, "error", err)
+	}
+}
+
+func removeReferrer(list []referrerDescriptor, digest string) []referrerDescriptor {
+	kept := list[:0]
+	for _, desc := range list {
+		if desc.Digest != digest {
+			kept = append(kept, desc)
+		}
+	}
+	return kept
+}
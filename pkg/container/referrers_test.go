@@ -0,0 +1,149 @@
+package container
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/davidjspooner/repoxy/pkg/repo"
+)
+
+func getReferrers(inst *containerRegistryInstance, name, subject, query string) (*httptest.ResponseRecorder, []referrerDescriptor) {
+	req := httptest.NewRequest(http.MethodGet, "/v2/"+name+"/referrers/"+subject+query, nil)
+	rr := httptest.NewRecorder()
+	inst.HandleV2Referrers(&param{name: name, digest: subject}, rr, req)
+	var index struct {
+		Manifests []referrerDescriptor `json:"manifests"`
+	}
+	_ = json.Unmarshal(rr.Body.Bytes(), &index)
+	return rr, index.Manifests
+}
+
+func TestContainerReferrersCachedAndServedOffline(t *testing.T) {
+	t.Parallel()
+	subject := manifestDigest([]byte("subject"))
+	signature, sbom := manifestDigest([]byte("signature")), manifestDigest([]byte("sbom"))
+	var hits atomic.Int32
+	inst := newContainerInstanceForTest(t, "https://registry.test")
+	inst.config.Freshness = &repo.Freshness{TTL: time.Hour}
+	inst.httpClientFactory = newContainerClientFactory(func(req *http.Request) (*http.Response, error) {
+		if req.URL.Path != "/v2/library/alpine/referrers/"+subject {
+			return httpResponse(http.StatusNotFound, nil, nil), nil
+		}
+		hits.Add(1)
+		body := fmt.Sprintf(`{"schemaVersion":2,"mediaType":%q,"manifests":[`+
+			`{"mediaType":%q,"digest":%q,"size":10,"artifactType":"application/vnd.dev.cosign.simplesigning.v1+json"},`+
+			`{"mediaType":%q,"digest":%q,"size":20,"artifactType":"application/spdx+json"}]}`,
+			mediaTypeOCIIndex, mediaTypeOCIManifest, signature, mediaTypeOCIManifest, sbom)
+		return httpResponse(http.StatusOK, map[string]string{"Content-Type": mediaTypeOCIIndex}, []byte(body)), nil
+	})
+
+	if rr, refs := getReferrers(inst, "library/alpine", subject, ""); rr.Code != http.StatusOK || len(refs) != 2 ||
+		rr.Header().Get("Content-Type") != mediaTypeOCIIndex {
+		t.Fatalf("expected both upstream referrers, got %d %s", rr.Code, rr.Body.String())
+	}
+	if _, refs := getReferrers(inst, "library/alpine", subject, ""); len(refs) != 2 || hits.Load() != 1 {
+		t.Fatalf("expected cached referrers, got %d after %d upstream hits", len(refs), hits.Load())
+	}
+
+	inst.config.Mode = repo.ModeOffline
+	rr, refs := getReferrers(inst, "library/alpine", subject, "?artifactType=application/spdx%2Bjson")
+	if rr.Code != http.StatusOK || len(refs) != 1 || refs[0].Digest != sbom || rr.Header().Get("OCI-Filters-Applied") != "artifactType" {
+		t.Fatalf("expected filtered referrers offline, got %d %s", rr.Code, rr.Body.String())
+	}
+	if rr, refs := getReferrers(inst, "library/alpine", manifestDigest([]byte("unknown")), ""); rr.Code != http.StatusOK || len(refs) != 0 {
+		t.Fatalf("expected empty index for unknown subject, got %d %s", rr.Code, rr.Body.String())
+	}
+	if rr, _ := getReferrers(inst, "library/alpine", "latest", ""); rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for non-digest subject, got %d", rr.Code)
+	}
+}
+
+func TestContainerReferrersFallBackToTagSchema(t *testing.T) {
+	t.Parallel()
+	subject := manifestDigest([]byte("subject"))
+	tagSchema := strings.Replace(subject, ":", "-", 1)
+	attestation := manifestDigest([]byte("attestation"))
+	signatureBody := []byte(fmt.Sprintf(`{"schemaVersion":2,"mediaType":%q,"config":{"mediaType":"application/vnd.dev.cosign.simplesigning.v1+json","digest":"sha256:aa"},"layers":[]}`, mediaTypeOCIManifest))
+	signature := manifestDigest(signatureBody)
+	fallback := []byte(fmt.Sprintf(`{"schemaVersion":2,"mediaType":%q,"manifests":[{"mediaType":%q,"digest":%q,"size":5,"artifactType":"application/vnd.in-toto+json"}]}`,
+		mediaTypeOCIIndex, mediaTypeOCIManifest, attestation))
+
+	inst := newContainerInstanceForTest(t, "https://registry.test")
+	inst.httpClientFactory = newContainerClientFactory(func(req *http.Request) (*http.Response, error) {
+		switch req.URL.Path {
+		case "/v2/library/alpine/manifests/" + tagSchema:
+			return httpResponse(http.StatusOK, map[string]string{"Content-Type": mediaTypeOCIIndex}, fallback), nil
+		case "/v2/library/alpine/manifests/" + tagSchema + ".sig":
+			return httpResponse(http.StatusOK, map[string]string{"Content-Type": mediaTypeOCIManifest, "Docker-Content-Digest": signature}, signatureBody), nil
+		}
+		return httpResponse(http.StatusNotFound, nil, nil), nil
+	})
+
+	if _, refs := getReferrers(inst, "library/alpine", subject, ""); len(refs) != 1 || refs[0].Digest != attestation {
+		t.Fatalf("expected referrers from the tag schema, got %v", refs)
+	}
+	// Pulling a cosign signature through the proxy records it against the subject it signs.
+	if rr := getManifest(inst, tagSchema+".sig", mediaTypeOCIManifest); rr.Code != http.StatusOK {
+		t.Fatalf("expected signature manifest, got %d", rr.Code)
+	}
+
+	inst.config.Mode = repo.ModeOffline
+	if rr := getManifest(inst, tagSchema+".sig", mediaTypeOCIManifest); rr.Code != http.StatusOK || rr.Body.String() != string(signatureBody) {
+		t.Fatalf("expected cached signature offline, got %d", rr.Code)
+	}
+	_, refs := getReferrers(inst, "library/alpine", subject, "")
+	if len(refs) != 2 || (refs[0].Digest != attestation && refs[1].Digest != attestation) {
+		t.Fatalf("expected attestation and signature offline, got %v", refs)
+	}
+	for _, ref := range refs {
+		if ref.Digest == signature && ref.ArtifactType != "application/vnd.dev.cosign.simplesigning.v1+json" {
+			t.Fatalf("expected signature artifact type from its config, got %q", ref.ArtifactType)
+		}
+	}
+}
+
+func TestHostedReferrersFollowPushedSubjects(t *testing.T) {
+	t.Parallel()
+	inst := newHostedInstanceForTest(t)
+	subject, _ := pushTestImage(t, inst, "v1")
+	empty := []byte("{}")
+	emptyDigest := manifestDigest(empty)
+	if rr := hostedRequest(inst, http.MethodPost, "/v2/team/app/blobs/uploads/?digest="+emptyDigest, &param{name: "team/app"}, empty, nil); rr.Code != http.StatusCreated {
+		t.Fatalf("config upload failed: %d", rr.Code)
+	}
+	artifact := []byte(fmt.Sprintf(`{"schemaVersion":2,"mediaType":%q,"artifactType":"application/vnd.example.sbom",`+
+		`"config":{"mediaType":"application/vnd.oci.empty.v1+json","digest":%q,"size":2},"layers":[],`+
+		`"subject":{"mediaType":%q,"digest":%q,"size":1},"annotations":{"org.example":"yes"}}`, mediaTypeOCIManifest, emptyDigest, mediaTypeOCIManifest, subject))
+	artifactDigest := manifestDigest(artifact)
+	rr := hostedRequest(inst, http.MethodPut, "/v2/team/app/manifests/"+artifactDigest, &param{name: "team/app", tag: artifactDigest}, artifact,
+		map[string]string{"Content-Type": mediaTypeOCIManifest})
+	if rr.Code != http.StatusCreated || rr.Header().Get("OCI-Subject") != subject {
+		t.Fatalf("expected push acknowledging subject, got %d %q", rr.Code, rr.Header().Get("OCI-Subject"))
+	}
+
+	rr = hostedRequest(inst, http.MethodGet, "/v2/team/app/referrers/"+subject, &param{name: "team/app", digest: subject}, nil, nil)
+	var index struct {
+		Manifests []referrerDescriptor `json:"manifests"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &index); err != nil || len(index.Manifests) != 1 {
+		t.Fatalf("expected pushed referrer, got %d %s", rr.Code, rr.Body.String())
+	}
+	if ref := index.Manifests[0]; ref.Digest != artifactDigest || ref.ArtifactType != "application/vnd.example.sbom" ||
+		ref.Size != int64(len(artifact)) || ref.Annotations["org.example"] != "yes" {
+		t.Fatalf("unexpected referrer descriptor %+v", ref)
+	}
+
+	if rr := hostedRequest(inst, http.MethodDelete, "/v2/team/app/manifests/"+artifactDigest, &param{name: "team/app", tag: artifactDigest}, nil, nil); rr.Code != http.StatusAccepted {
+		t.Fatalf("delete failed: %d", rr.Code)
+	}
+	rr = hostedRequest(inst, http.MethodGet, "/v2/team/app/referrers/"+subject, &param{name: "team/app", digest: subject}, nil, nil)
+	if rr.Code != http.StatusOK || strings.Contains(rr.Body.String(), artifactDigest) {
+		t.Fatalf("expected deleted referrer to be dropped, got %s", rr.Body.String())
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"context"
 	"crypto/sha256"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -12,7 +13,9 @@ import (
 	"log/slog"
 	"net/http"
 	"net/url"
-	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/davidjspooner/go-http-client/pkg/client"
@@ -30,6 +33,13 @@ type containerRegistryInstance struct {
 	httpClientFactory func() client.Interface
 	tokenHTTP         client.Interface
 	auth              *containerUpstreamAuth
+	flights           repo.Coalescer   // collapses concurrent upstream fetches
+	uploadLocks       sync.Map         // upload UUID -> *sync.Mutex serialising writes to one session
+	lastUploadSweep   atomic.Int64     // UnixNano of the last sweep for abandoned uploads
+	referrersMu       sync.Mutex       // serialises read-modify-write of cached referrer lists
+	policy            *signaturePolicy // nil unless the repository has a policy block
+	platforms         sync.Map         // manifest digest -> "os/arch" from indexes seen, for platform rules
+	platform          manifestPlatform // served for tags on an index when the client does not accept indexes
 }
 
 // newContainerRegistryInstance creates a new Container repository instance.
@@ -38,11 +48,22 @@ func newContainerRegistryInstance(factory *factory, storage repo.CommonStorage,
 	if storage == nil {
 		return nil, fmt.Errorf("docker instance missing storage")
 	}
+	if config.UpstreamMode() == repo.ModeHosted && config.Retention != nil {
+		return nil, fmt.Errorf("%w: retention would evict the only copy of content in hosted repository %q", repo.ErrInvalidRepoConfig, config.Name)
+	}
 	instance := &containerRegistryInstance{
 		factory: factory,
 		storage: storage,
 		config:  *config,
 	}
+	platform := config.Upstream.Config["platform"]
+	if platform == "" {
+		platform = defaultPlatform
+	}
+	var err error
+	if instance.platform, err = parsePlatform(platform); err != nil {
+		return nil, fmt.Errorf("%w: repository %q: %v", repo.ErrInvalidRepoConfig, config.Name, err)
+	}
 	instance.nameMatchers.Set(config.Mappings)
 	instance.pipeline = append(instance.pipeline, client.WithAuthentication(instance))
 	instance.httpClientFactory = func() client.Interface {
@@ -54,6 +75,11 @@ func newContainerRegistryInstance(factory *factory, storage repo.CommonStorage,
 		return nil, err
 	}
 	instance.auth = auth
+	if config.Policy != nil {
+		if instance.policy, err = newSignaturePolicy(config.Policy); err != nil {
+			return nil, err
+		}
+	}
 	return instance, nil
 }
 
@@ -83,8 +109,11 @@ func (d *containerRegistryInstance) Describe() repo.InstanceMeta {
 }
 
 // HandledWriteMethodForReadOnlyRepo checks if the request is a write operation and returns a 405 if so.
-// Returns true if the request was handled (i.e., is not allowed), false otherwise.
+// Returns true if the request was handled (i.e., is not allowed), false otherwise. Hosted repositories accept writes.
 func (d *containerRegistryInstance) HandledWriteMethodForReadOnlyRepo(w http.ResponseWriter, r *http.Request) bool {
+	if d.config.UpstreamMode() == repo.ModeHosted {
+		return false
+	}
 	switch r.Method {
 	case http.MethodGet, http.MethodHead:
 		return false // Read operations are allowed
@@ -95,37 +124,166 @@ func (d *containerRegistryInstance) HandledWriteMethodForReadOnlyRepo(w http.Res
 	}
 }
 
-// HandleV2Tags handles container V2 tags requests. Returns a 405 for write operations.
-func (d *containerRegistryInstance) HandleV2Tags(param *param, w http.ResponseWriter, r *http.Request) {
-	if d.HandledWriteMethodForReadOnlyRepo(w, r) {
-		return
+// maxUpstreamListPages bounds how many upstream catalog, tag list or referrers pages are followed. A longer list is
+// reported as an error rather than cached incomplete.
+const maxUpstreamListPages = 1000
+
+// catalogNames lists repository names cached by this instance, merged with the upstream catalog
+// when `upstream.config.catalog` is "true" and the instance is allowed to contact upstream.
+// Names the repository rules refuse are left out.
+func (d *containerRegistryInstance) catalogNames(ctx context.Context) []string {
+	if d.storage == nil {
+		return nil
 	}
-	if err := d.proxyToUpstream(r.Context(), w, r); err != nil {
-		slog.ErrorContext(r.Context(), "failed to proxy docker tags request", "error", err)
-		w.WriteHeader(http.StatusBadGateway)
+	var names []string
+	hosts, err := d.storage.ListHosts(ctx)
+	if err != nil {
+		slog.WarnContext(ctx, "failed to list cached hosts", "error", err)
 	}
+	for _, host := range hosts {
+		hostNames, err := d.storage.ListNamesForHost(ctx, host)
+		if err != nil {
+			slog.WarnContext(ctx, "failed to list cached repositories", "host", host, "error", err)
+			continue
+		}
+		names = append(names, hostNames...)
+	}
+	if d.config.Upstream.Config["catalog"] == "true" && d.config.ContactsUpstream() {
+		upstreamNames, err := d.fetchUpstreamCatalog(ctx)
+		if err != nil {
+			slog.WarnContext(ctx, "failed to fetch upstream catalog", "error", err)
+		}
+		names = append(names, upstreamNames...)
+	}
+	if d.config.Rules != nil {
+		allowed := names[:0]
+		for _, name := range names {
+			if ok, _ := d.config.Rules.Evaluate(repo.RuleSubject{Name: name}); ok {
+				allowed = append(allowed, name)
+			}
+		}
+		names = allowed
+	}
+	return names
+}
+
+// fetchUpstreamCatalog returns every repository name listed by the upstream catalog.
+func (d *containerRegistryInstance) fetchUpstreamCatalog(ctx context.Context) ([]string, error) {
+	list, failed, err := d.fetchUpstreamList(ctx, "/v2/_catalog?n=1000")
+	if err == nil && failed != nil {
+		err = fmt.Errorf("upstream catalog returned %d", failed.status)
+	}
+	if list == nil {
+		return nil, err
+	}
+	return list.Repositories, err
+}
+
+// upstreamList accumulates the pages of an upstream catalog or tag list.
+type upstreamList struct {
+	Repositories []string `json:"repositories"`
+	Tags         []string `json:"tags"`
+}
+
+// fetchUpstreamList follows Link headers from first until the last page. A non-200 first page is returned as a
+// bufferedResponse so callers can relay upstream errors such as NAME_UNKNOWN unchanged.
+func (d *containerRegistryInstance) fetchUpstreamList(ctx context.Context, first string) (*upstreamList, *bufferedResponse, error) {
+	list := &upstreamList{}
+	next := first
+	for page := 0; next != ""; page++ {
+		if page == maxUpstreamListPages {
+			return list, nil, fmt.Errorf("upstream %s has more than %d pages", first, maxUpstreamListPages)
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, next, nil)
+		if err != nil {
+			return list, nil, err
+		}
+		resp, err := d.roundTripUpstream(ctx, req)
+		if err != nil {
+			return list, nil, err
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return list, nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			if page == 0 {
+				return nil, &bufferedResponse{status: resp.StatusCode, header: resp.Header, body: body}, nil
+			}
+			return list, nil, fmt.Errorf("upstream %s returned %s", next, resp.Status)
+		}
+		var payload upstreamList
+		if err := json.Unmarshal(body, &payload); err != nil {
+			return list, nil, err
+		}
+		list.Repositories = append(list.Repositories, payload.Repositories...)
+		list.Tags = append(list.Tags, payload.Tags...)
+		next = nextLink(resp.Header.Get("Link"))
+	}
+	return list, nil, nil
+}
+
+// nextLink extracts the path and query of a `<url>; rel="next"` Link header.
+func nextLink(header string) string {
+	start, end := strings.Index(header, "<"), strings.Index(header, ">")
+	if start < 0 || end <= start || !strings.Contains(header[end:], `rel="next"`) {
+		return ""
+	}
+	u, err := url.Parse(header[start+1 : end])
+	if err != nil {
+		return ""
+	}
+	return u.RequestURI()
+}
+
+// writeRegistryError writes an OCI distribution error document.
+func writeRegistryError(w http.ResponseWriter, status int, code, message string) {
+	body, _ := json.Marshal(map[string]any{
+		"errors": []map[string]string{{"code": code, "message": message}},
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write(body)
 }
 
 // HandleV2Manifest handles container V2 manifest requests. Returns a 405 for write operations.
 func (d *containerRegistryInstance) HandleV2Manifest(param *param, w http.ResponseWriter, r *http.Request) {
-	if d.HandledWriteMethodForReadOnlyRepo(w, r) {
+	if d.HandledWriteMethodForReadOnlyRepo(w, r) || d.deniedByRules(param, w, r) {
+		return
+	}
+	switch r.Method {
+	case http.MethodPut:
+		d.handleManifestPut(param, w, r)
+		return
+	case http.MethodDelete:
+		d.handleManifestDelete(param, w, r)
 		return
 	}
 	ctx := r.Context()
+	if d.config.UpstreamMode() != repo.ModeOnline {
+		if d.serveCachedManifest(param, w, r) {
+			return
+		}
+		if !d.config.ContactsUpstream() {
+			writeRegistryError(w, http.StatusNotFound, "MANIFEST_UNKNOWN", "manifest unknown to registry")
+			return
+		}
+	}
+	if r.Method == http.MethodGet || d.policy != nil {
+		// Verifying a signature policy needs the manifest, so HEAD is then answered like GET without the body.
+		d.handleManifestGet(param, w, r)
+		return
+	}
 	resp, err := d.roundTripUpstream(ctx, r)
 	if resp != nil && resp.Body != nil {
 		defer resp.Body.Close()
 	}
-	if err == nil && resp != nil && resp.StatusCode >= http.StatusOK && resp.StatusCode < 300 && resp.Body != nil && r.Method == http.MethodGet {
-		body, readErr := io.ReadAll(resp.Body)
-		if readErr == nil {
-			d.cacheManifest(ctx, param, resp.Header.Get("Docker-Content-Digest"), resp.Header.Get("Content-Type"), body)
-			d.writeHeadersFromResponse(w, resp)
-			w.WriteHeader(resp.StatusCode)
-			_, _ = w.Write(body)
+	if err == nil && resp.StatusCode >= http.StatusOK && resp.StatusCode < 300 {
+		if denied := d.refusedDigestByRules(ctx, param, resp.Header.Get("Docker-Content-Digest")); denied != nil {
+			d.writeRuleDenial(ctx, w, denied)
 			return
 		}
-		err = readErr
 	}
 	if d.serveCachedManifest(param, w, r) {
 		return
@@ -142,25 +300,118 @@ func (d *containerRegistryInstance) HandleV2Manifest(param *param, w http.Respon
 	}
 }
 
-// HandleV2BlobUpload handles container V2 blob upload requests. Returns a 405 for write operations.
+// bufferedResponse is an upstream response read fully so it can be shared between coalesced requests.
+type bufferedResponse struct {
+	status int
+	header http.Header
+	body   []byte
+}
+
+// handleManifestGet fetches a manifest once for concurrent clients asking for the same reference and media types,
+// falling back to the cached copy when the upstream fails. HEAD requests fetch the manifest too but get no body.
+func (d *containerRegistryInstance) handleManifestGet(param *param, w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	reference := ""
+	if param != nil {
+		reference = param.name + ":" + param.tag
+	}
+	upstream := r
+	if r.Method != http.MethodGet {
+		upstream = r.Clone(ctx)
+		upstream.Method = http.MethodGet
+		upstream.Body = http.NoBody
+	}
+	key := "manifest:" + reference + "|" + r.Header.Get("Accept")
+	val, err := d.flights.Do(ctx, key, func(ctx context.Context) (any, error) {
+		resp, err := d.roundTripUpstream(ctx, upstream)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode >= http.StatusOK && resp.StatusCode < 300 {
+			if denied := d.refusedDigestByRules(ctx, param, manifestDigest(body)); denied != nil {
+				return nil, denied
+			}
+			if denied := d.enforcePolicy(ctx, param, manifestDigest(body), body); denied != nil {
+				return nil, denied
+			}
+			d.cacheManifest(ctx, param, resp.Header.Get("Docker-Content-Digest"), resp.Header.Get("Content-Type"), body)
+		}
+		return &bufferedResponse{status: resp.StatusCode, header: resp.Header, body: body}, nil
+	})
+	var denied *policyError
+	if errors.As(err, &denied) {
+		d.writePolicyDenial(ctx, w, denied)
+		return
+	}
+	var refused *ruleError
+	if errors.As(err, &refused) {
+		d.writeRuleDenial(ctx, w, refused)
+		return
+	}
+	var result *bufferedResponse
+	if err == nil {
+		result = val.(*bufferedResponse)
+	}
+	if result != nil && result.status >= http.StatusOK && result.status < 300 {
+		d.writeBufferedResponse(w, r, result)
+		return
+	}
+	if d.serveCachedManifest(param, w, r) {
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to proxy manifest request to upstream", "error", err)
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	d.writeBufferedResponse(w, r, result)
+}
+
+func (d *containerRegistryInstance) writeBufferedResponse(w http.ResponseWriter, r *http.Request, result *bufferedResponse) {
+	for key, values := range result.header {
+		for _, value := range values {
+			w.Header().Add(key, value)
+		}
+	}
+	w.WriteHeader(result.status)
+	if r.Method != http.MethodHead {
+		_, _ = w.Write(result.body)
+	}
+}
+
+// HandleV2BlobUpload starts a blob upload in hosted repositories. Returns a 405 for other modes.
 func (d *containerRegistryInstance) HandleV2BlobUpload(param *param, w http.ResponseWriter, r *http.Request) {
-	if d.HandledWriteMethodForReadOnlyRepo(w, r) {
+	if d.HandledWriteMethodForReadOnlyRepo(w, r) || d.deniedByRules(param, w, r) {
 		return
 	}
-	http.Error(w, "Repository is read-only; uploads are not supported", http.StatusMethodNotAllowed)
+	d.handleUploadStart(param, w, r)
 }
 
-// HandleV2BlobUID handles container V2 blob UID requests. Returns a 405 for write operations.
+// HandleV2BlobUID reports, appends to, completes or cancels an upload session in hosted repositories.
+// Returns a 405 for other modes.
 func (d *containerRegistryInstance) HandleV2BlobUID(param *param, w http.ResponseWriter, r *http.Request) {
-	if d.HandledWriteMethodForReadOnlyRepo(w, r) {
+	if d.HandledWriteMethodForReadOnlyRepo(w, r) || d.deniedByRules(param, w, r) {
+		return
+	}
+	if d.config.UpstreamMode() != repo.ModeHosted {
+		http.Error(w, "Repository is read-only; uploads are not supported", http.StatusMethodNotAllowed)
 		return
 	}
-	http.Error(w, "Repository is read-only; uploads are not supported", http.StatusMethodNotAllowed)
+	d.handleUploadSession(param, w, r)
 }
 
 // HandleV2BlobByDigest handles container V2 blob digest requests. Returns a 405 for write operations.
 func (d *containerRegistryInstance) HandleV2BlobByDigest(param *param, w http.ResponseWriter, r *http.Request) {
-	if d.HandledWriteMethodForReadOnlyRepo(w, r) {
+	if d.HandledWriteMethodForReadOnlyRepo(w, r) || d.deniedByRules(param, w, r) {
+		return
+	}
+	if r.Method == http.MethodDelete {
+		writeRegistryError(w, http.StatusMethodNotAllowed, "UNSUPPORTED", "blobs are reclaimed by gc once no manifest references them")
 		return
 	}
 	if param == nil || param.digest == "" || d.storage == nil {
@@ -170,7 +421,17 @@ func (d *containerRegistryInstance) HandleV2BlobByDigest(param *param, w http.Re
 	if d.serveLocalBlob(param, w, r) {
 		return
 	}
-	if err := d.fetchAndStoreBlob(param, w, r); err != nil {
+	if !d.config.ContactsUpstream() {
+		writeRegistryError(w, http.StatusNotFound, "BLOB_UNKNOWN", "blob unknown to registry")
+		return
+	}
+	var err error
+	if r.Method == http.MethodGet {
+		err = d.fetchBlobCoalesced(param, w, r)
+	} else {
+		err = d.fetchAndStoreBlob(param, w, r, nil)
+	}
+	if err != nil {
 		slog.ErrorContext(r.Context(), "failed to proxy blob request", "error", err)
 	}
 }
@@ -219,6 +480,9 @@ func (d *containerRegistryInstance) roundTripUpstream(ctx context.Context, r *ht
 		return nil, err
 	}
 	req.Header = r.Header.Clone()
+	// The client's credentials are for this proxy; upstream credentials come from the pipeline.
+	req.Header.Del("Authorization")
+	req.Header.Del("Cookie")
 	observability.ApplyRequestIDHeader(req, observability.RequestIDFromRequest(r))
 	httpClient := d.httpClientFactory
 	var base client.Interface
@@ -255,26 +519,55 @@ func (d *containerRegistryInstance) serveLocalBlob(param *param, w http.Response
 		return false
 	}
 	d.recordCacheHit(observability.CacheBlobs)
+	d.storage.RecordBlobAccess(r.Context(), param.digest)
 	defer reader.Close()
-	if info, err := d.storage.StatBlob(r.Context(), param.digest); err == nil {
-		w.Header().Set("Content-Length", strconv.FormatInt(info.Size(), 10))
-		d.recordCacheBytes(observability.CacheBlobs, "serve", info.Size())
+	info, err := d.storage.StatBlob(r.Context(), param.digest)
+	if err != nil {
+		info = nil
 	}
 	w.Header().Set("Docker-Content-Digest", param.digest)
 	w.Header().Set("Content-Type", "application/octet-stream")
-	w.WriteHeader(http.StatusOK)
-	if r.Method == http.MethodHead {
-		return true
+	n := repo.ServeContent(w, r, reader, info, param.digest)
+	d.recordCacheBytes(observability.CacheBlobs, "serve", n)
+	return true
+}
+
+// sharedBlobFetchTimeout bounds a shared blob download once it no longer follows its leading client's request.
+const sharedBlobFetchTimeout = time.Hour
+
+// fetchBlobCoalesced lets the first request for a missing digest download it while concurrent requests tail the same stream.
+func (d *containerRegistryInstance) fetchBlobCoalesced(param *param, w http.ResponseWriter, r *http.Request) error {
+	flight, leader := d.flights.Join("blob:" + param.digest)
+	defer flight.Release()
+	if leader {
+		err := d.fetchAndStoreBlob(param, w, r, flight)
+		flight.Finish(err)
+		return err
 	}
-	if _, err := io.Copy(w, reader); err != nil {
-		slog.ErrorContext(r.Context(), "failed to stream cached blob", "error", err)
-		d.recordCacheError(observability.CacheBlobs)
+	ctx := r.Context()
+	status, header, err := flight.Wait(ctx)
+	if err != nil || status != http.StatusOK {
+		// The leader did not get the blob; fetch independently so this client sees its own upstream response.
+		return d.fetchAndStoreBlob(param, w, r, nil)
 	}
-	return true
+	for key, values := range header {
+		w.Header()[key] = values
+	}
+	w.WriteHeader(status)
+	n, err := io.Copy(w, flight.NewReader(ctx))
+	d.recordCacheBytes(observability.CacheBlobs, "serve", n)
+	return err
 }
 
-func (d *containerRegistryInstance) fetchAndStoreBlob(param *param, w http.ResponseWriter, r *http.Request) error {
+// fetchAndStoreBlob streams the blob from upstream to the client while storing it. A shared fetch outlives its leading
+// client, bounded by sharedBlobFetchTimeout, so followers and the cache still get the blob when the leader disconnects.
+func (d *containerRegistryInstance) fetchAndStoreBlob(param *param, w http.ResponseWriter, r *http.Request, flight *repo.Flight) error {
 	ctx := r.Context()
+	if flight != nil {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(context.WithoutCancel(ctx), sharedBlobFetchTimeout)
+		defer cancel()
+	}
 	resp, err := d.roundTripUpstream(ctx, r)
 	if err != nil {
 		return err
@@ -283,6 +576,9 @@ func (d *containerRegistryInstance) fetchAndStoreBlob(param *param, w http.Respo
 
 	d.writeHeadersFromResponse(w, resp)
 	w.Header().Set("Docker-Content-Digest", param.digest)
+	if flight != nil {
+		flight.Publish(resp.StatusCode, w.Header())
+	}
 	w.WriteHeader(resp.StatusCode)
 
 	if resp.Body == nil || r.Method == http.MethodHead {
@@ -294,10 +590,22 @@ func (d *containerRegistryInstance) fetchAndStoreBlob(param *param, w http.Respo
 	}
 
 	counter := &writeCounter{w: w}
-	tee := io.TeeReader(resp.Body, counter)
+	var sink io.Writer = counter
+	if flight != nil {
+		sink = &flightSink{flight: flight, client: counter, clientCtx: r.Context()}
+	}
+	tee := io.TeeReader(resp.Body, sink)
 	n, err := d.storage.PutBlob(ctx, param.digest, tee)
 	if err != nil {
-		d.recordCacheError(observability.CacheBlobs)
+		if repo.IsDigestMismatch(err) {
+			d.recordCacheDigestMismatch(observability.CacheBlobs)
+		} else {
+			d.recordCacheError(observability.CacheBlobs)
+		}
+		return err
+	}
+	// PutBlob does not read the body of a blob it already holds, but the client and followers still need it.
+	if _, err := io.Copy(io.Discard, tee); err != nil {
 		return err
 	}
 	if n == 0 {
@@ -307,6 +615,33 @@ func (d *containerRegistryInstance) fetchAndStoreBlob(param *param, w http.Respo
 	return nil
 }
 
+// FetchBlob re-populates blobKey for the image name from the upstream registry.
+func (d *containerRegistryInstance) FetchBlob(ctx context.Context, name, blobKey string) error {
+	r, err := http.NewRequestWithContext(ctx, http.MethodGet, "/v2/"+name+"/blobs/"+blobKey, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := d.roundTripUpstream(ctx, r)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("upstream returned %s for blob %s", resp.Status, blobKey)
+	}
+	n, err := d.storage.PutBlob(ctx, blobKey, resp.Body)
+	if err != nil {
+		if repo.IsDigestMismatch(err) {
+			d.recordCacheDigestMismatch(observability.CacheBlobs)
+		} else {
+			d.recordCacheError(observability.CacheBlobs)
+		}
+		return err
+	}
+	d.recordCacheBytes(observability.CacheBlobs, "store", n)
+	return nil
+}
+
 func (d *containerRegistryInstance) repoLabels() (string, string) {
 	repoType := d.config.Type
 	if repoType == "" {
@@ -334,6 +669,11 @@ func (d *containerRegistryInstance) recordCacheError(cache string) {
 	observability.RecordCacheError(repoType, repoName, cache)
 }
 
+func (d *containerRegistryInstance) recordCacheDigestMismatch(cache string) {
+	repoType, repoName := d.repoLabels()
+	observability.RecordCacheDigestMismatch(repoType, repoName, cache)
+}
+
 func (d *containerRegistryInstance) recordCacheBytes(cache, action string, n int64) {
 	if n <= 0 {
 		return
@@ -347,46 +687,99 @@ func (d *containerRegistryInstance) cacheManifest(ctx context.Context, param *pa
 		return
 	}
 	if digest == "" {
-		sum := sha256.Sum256(body)
-		digest = "sha256:" + hex.EncodeToString(sum[:])
-	}
-	if digest == "" {
-		return
-	}
-	if _, err := d.storage.PutBlob(ctx, digest, bytes.NewReader(body)); err != nil {
-		d.recordCacheError(observability.CacheManifests)
+		digest = manifestDigest(body)
+	}
+	labels := []string{param.tag}
+	if d.tagPinsIndexOf(ctx, param, digest) {
+		// A client that cannot handle indexes was given one platform's manifest; keep the tag on the index.
+		labels = nil
+	}
+	if err := d.storeManifest(ctx, param.name, digest, mediaType, body, labels...); err != nil {
+		if repo.IsDigestMismatch(err) {
+			slog.WarnContext(ctx, "upstream manifest does not match its digest", "name", param.name, "digest", digest)
+			d.recordCacheDigestMismatch(observability.CacheManifests)
+		} else {
+			d.recordCacheError(observability.CacheManifests)
+		}
 		return
 	}
 	d.recordCacheBytes(observability.CacheManifests, "store", int64(len(body)))
+}
+
+// tagPinsIndexOf reports whether param's tag currently points at a cached index that lists digest as a child.
+func (d *containerRegistryInstance) tagPinsIndexOf(ctx context.Context, param *param, digest string) bool {
+	if isDigestReference(param.tag) {
+		return false
+	}
+	loc, err := d.storage.ResolveLabel(ctx, repo.Locator{Host: d.upstreamHost(), Name: param.name, Label: param.tag})
+	if err != nil || loc.VersionID == digest {
+		return false
+	}
+	meta, err := d.storage.GetVersionMeta(ctx, loc)
+	if err != nil {
+		return false
+	}
+	for _, child := range meta.Links {
+		if child == digest {
+			return true
+		}
+	}
+	return false
+}
 
+// storeManifest stores body as the manifest blob and version digest of name and points each label at it.
+// The platform manifests of an index are recorded as links of its version.
+func (d *containerRegistryInstance) storeManifest(ctx context.Context, name, digest, mediaType string, body []byte, labels ...string) error {
+	if _, err := d.storage.PutBlob(ctx, digest, bytes.NewReader(body)); err != nil {
+		return err
+	}
+	fileName := digest
+	if len(labels) > 0 {
+		fileName = labels[0]
+	}
 	loc := repo.Locator{
 		Host:      d.upstreamHost(),
-		Name:      param.name,
+		Name:      name,
 		VersionID: digest,
 	}
 	meta := &repo.VersionMeta{
 		VersionID: digest,
 		Files: []repo.FileEntry{{
-			Name:      param.tag,
+			Name:      fileName,
 			BlobKey:   digest,
 			Size:      int64(len(body)),
 			MediaType: mediaType,
 		}},
 		Manifest: string(body),
 	}
+	if doc := parseManifest(body); doc != nil && doc.isIndex(mediaType) {
+		meta.Links = doc.childDigests()
+		d.notePlatforms(doc)
+	}
 	loc, err := d.storage.CreateVersion(ctx, loc, meta)
 	if err != nil && !errors.Is(err, fs.ErrExist) {
-		d.recordCacheError(observability.CacheManifests)
-		return
+		return err
 	}
 	loc.VersionID = digest
-	loc.Label = param.tag
-	if err := d.storage.SetLabel(ctx, loc); err != nil {
-		d.recordCacheError(observability.CacheManifests)
-		return
+	for _, label := range labels {
+		loc.Label = label
+		if err := d.storage.SetLabel(ctx, loc); err != nil {
+			return err
+		}
 	}
+	d.recordReferrer(ctx, name, digest, mediaType, body, labels)
+	return nil
 }
 
+// manifestDigest returns the sha256 digest of a manifest body.
+func manifestDigest(body []byte) string {
+	sum := sha256.Sum256(body)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// serveCachedManifest answers a manifest request from the cache. Tags resolve through labels and digests directly to
+// their version. When a tag points at an index whose media type the client does not accept, the cached default-platform
+// manifest is served instead; otherwise the request is treated as a miss.
 func (d *containerRegistryInstance) serveCachedManifest(param *param, w http.ResponseWriter, r *http.Request) bool {
 	if d.storage == nil || param == nil || param.tag == "" || param.name == "" {
 		return false
@@ -397,16 +790,48 @@ func (d *containerRegistryInstance) serveCachedManifest(param *param, w http.Res
 		Name:  param.name,
 		Label: param.tag,
 	}
-	loc, err := d.storage.ResolveLabel(ctx, loc)
-	if err != nil {
+	var err error
+	if isDigestReference(param.tag) {
+		loc.Label = ""
+		loc.VersionID = param.tag
+	} else if loc, err = d.storage.ResolveLabel(ctx, loc); err != nil {
 		d.recordCacheMiss(observability.CacheManifests)
 		return false
 	}
 	meta, err := d.storage.GetVersionMeta(ctx, loc)
 	if err != nil || meta == nil || len(meta.Files) == 0 {
-		d.recordCacheError(observability.CacheManifests)
+		if isDigestReference(param.tag) {
+			d.recordCacheMiss(observability.CacheManifests)
+		} else {
+			d.recordCacheError(observability.CacheManifests)
+		}
 		return false
 	}
+	if denied := d.refusedDigestByRules(ctx, param, meta.VersionID); denied != nil {
+		d.writeRuleDenial(ctx, w, denied)
+		return true
+	}
+	if denied := d.enforcePolicy(ctx, param, meta.VersionID, []byte(meta.Manifest)); denied != nil {
+		d.writePolicyDenial(ctx, w, denied)
+		return true
+	}
+	if meta.Links != nil {
+		d.notePlatforms(parseManifest([]byte(meta.Manifest)))
+	}
+	accept := r.Header.Values("Accept")
+	if !isDigestReference(param.tag) && !acceptsMediaType(accept, meta.Files[0].MediaType) {
+		child := d.cachedPlatformManifest(ctx, loc, meta, accept)
+		if child == nil {
+			d.recordCacheMiss(observability.CacheManifests)
+			return false
+		}
+		if denied := d.refusedDigestByRules(ctx, param, child.VersionID); denied != nil {
+			d.writeRuleDenial(ctx, w, denied)
+			return true
+		}
+		loc.VersionID = child.VersionID
+		meta = child
+	}
 	file := meta.Files[0]
 	manifest := []byte(meta.Manifest)
 	if len(manifest) == 0 {
@@ -423,10 +848,6 @@ func (d *containerRegistryInstance) serveCachedManifest(param *param, w http.Res
 		}
 	}
 
-	contentLength := int64(len(manifest))
-	if contentLength > 0 {
-		w.Header().Set("Content-Length", strconv.FormatInt(contentLength, 10))
-	}
 	if file.MediaType != "" {
 		w.Header().Set("Content-Type", file.MediaType)
 	} else {
@@ -435,22 +856,43 @@ func (d *containerRegistryInstance) serveCachedManifest(param *param, w http.Res
 	if file.BlobKey != "" {
 		w.Header().Set("Docker-Content-Digest", file.BlobKey)
 	}
-	w.WriteHeader(http.StatusOK)
-	if r.Method == http.MethodHead {
-		d.recordCacheHit(observability.CacheManifests)
-		return true
-	}
-	n, err := w.Write(manifest)
-	if err != nil {
-		d.recordCacheError(observability.CacheManifests)
-		return true
-	}
-	d.recordCacheBytes(observability.CacheManifests, "serve", int64(n))
+	d.storage.RecordVersionAccess(ctx, loc)
+	d.storage.RecordBlobAccess(ctx, file.BlobKey)
+	n := repo.ServeContent(w, r, bytes.NewReader(manifest), nil, file.BlobKey)
+	d.recordCacheBytes(observability.CacheManifests, "serve", n)
 	d.recordCacheHit(observability.CacheManifests)
 	return true
 }
 
+// cachedPlatformManifest returns the cached child for the repository platform of the index described by meta, or nil.
+func (d *containerRegistryInstance) cachedPlatformManifest(ctx context.Context, loc repo.Locator, meta *repo.VersionMeta, accept []string) *repo.VersionMeta {
+	doc := parseManifest([]byte(meta.Manifest))
+	if doc == nil || !doc.isIndex(meta.Files[0].MediaType) {
+		return nil
+	}
+	selected := doc.selectChild(d.platform, accept)
+	if selected == nil {
+		return nil
+	}
+	loc.VersionID = selected.Digest
+	child, err := d.storage.GetVersionMeta(ctx, loc)
+	if err != nil || child == nil || len(child.Files) == 0 {
+		return nil
+	}
+	return child
+}
+
+// EnforceRetention applies the repository retention policy to cached manifests and blobs. Tag lists, referrers and
+// upload sessions share the storage root but are not cached content, so they are left alone.
+func (d *containerRegistryInstance) EnforceRetention(ctx context.Context) (*repo.EvictionReport, error) {
+	return d.storage.EvictBlobs(ctx, d.config.Retention)
+}
+
+// upstreamHost returns the storage host for cached content; hosted repositories store their content under hostedHost.
 func (d *containerRegistryInstance) upstreamHost() string {
+	if d.config.UpstreamMode() == repo.ModeHosted {
+		return hostedHost
+	}
 	u, err := url.Parse(d.config.Upstream.URL)
 	if err != nil {
 		return ""
@@ -468,3 +910,25 @@ func (c *writeCounter) Write(p []byte) (int, error) {
 	c.n += int64(n)
 	return n, err
 }
+
+// flightSink feeds followers first and the leading client best-effort, so a disconnecting leader does not abort the shared download.
+type flightSink struct {
+	flight    *repo.Flight
+	client    io.Writer
+	clientCtx context.Context
+	clientErr error
+}
+
+func (s *flightSink) Write(p []byte) (int, error) {
+	n, err := s.flight.Write(p)
+	if err != nil {
+		return n, err
+	}
+	if s.clientErr == nil {
+		s.clientErr = s.clientCtx.Err()
+	}
+	if s.clientErr == nil {
+		_, s.clientErr = s.client.Write(p)
+	}
+	return n, nil
+}
@@ -10,6 +10,8 @@ import (
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -125,32 +127,168 @@ func TestContainerManifestAlwaysProxies(t *testing.T) {
 	}
 }
 
-func TestContainerTagsAlwaysProxy(t *testing.T) {
+func TestContainerUpstreamRequestsCarryNoClientCredentials(t *testing.T) {
 	t.Parallel()
-	hits := 0
 	inst := newContainerInstanceForTest(t, "https://registry.test")
+	var seen http.Header
 	inst.httpClientFactory = newContainerClientFactory(func(req *http.Request) (*http.Response, error) {
-		hits++
-		body := []byte(fmt.Sprintf(`{"seq":%d}`, hits))
+		seen = req.Header.Clone()
 		return httpResponse(http.StatusOK, map[string]string{
-			"Content-Type": "application/json",
-		}, body), nil
+			"Content-Type":          "application/vnd.docker.distribution.manifest.v2+json",
+			"Docker-Content-Digest": "sha256:deadbeef",
+		}, []byte(`{}`)), nil
 	})
-	param := &param{name: "library/alpine"}
-	for i := 0; i < 2; i++ {
-		req := httptest.NewRequest(http.MethodGet, "/v2/library/alpine/tags/list", nil)
+	req := httptest.NewRequest(http.MethodGet, "/v2/library/alpine/manifests/latest", nil)
+	req.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("alice:proxy-password")))
+	req.Header.Set("Cookie", "session=proxy-session")
+	rr := httptest.NewRecorder()
+	inst.HandleV2Manifest(&param{name: "library/alpine", tag: "latest"}, rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rr.Code)
+	}
+	if seen == nil || seen.Get("Authorization") != "" || seen.Get("Cookie") != "" {
+		t.Fatalf("client credentials were forwarded upstream: %v", seen)
+	}
+}
+
+func TestContainerTagsCachedUntilTTL(t *testing.T) {
+	t.Parallel()
+	var hits atomic.Int32
+	inst := newContainerInstanceForTest(t, "https://registry.test")
+	inst.config.Freshness = &repo.Freshness{TTL: time.Hour}
+	inst.httpClientFactory = newContainerClientFactory(func(req *http.Request) (*http.Response, error) {
+		hits.Add(1)
+		if req.URL.Query().Get("last") == "" {
+			return httpResponse(http.StatusOK, map[string]string{
+				"Link": `</v2/library/alpine/tags/list?last=3.18&n=1>; rel="next"`,
+			}, []byte(`{"name":"library/alpine","tags":["3.18"]}`)), nil
+		}
+		return httpResponse(http.StatusOK, nil, []byte(fmt.Sprintf(`{"name":"library/alpine","tags":["3.%d"]}`, 18+hits.Load()))), nil
+	})
+	tags := func(query string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/v2/library/alpine/tags/list"+query, nil)
 		rr := httptest.NewRecorder()
-		inst.HandleV2Tags(param, rr, req)
-		if rr.Code != http.StatusOK {
-			t.Fatalf("iteration %d: expected 200, got %d", i, rr.Code)
+		inst.HandleV2Tags(&param{name: "library/alpine"}, rr, req)
+		return rr
+	}
+
+	if rr := tags(""); rr.Code != http.StatusOK || rr.Body.String() != `{"name":"library/alpine","tags":["3.18","3.20"]}` {
+		t.Fatalf("expected every upstream page, got %d %s", rr.Code, rr.Body.String())
+	}
+	rr := tags("?n=1")
+	if rr.Body.String() != `{"name":"library/alpine","tags":["3.18"]}` || hits.Load() != 2 {
+		t.Fatalf("expected paginated cache hit, got %s after %d upstream hits", rr.Body.String(), hits.Load())
+	}
+	if link := rr.Header().Get("Link"); link != `</v2/library/alpine/tags/list?last=3.18&n=1>; rel="next"` {
+		t.Fatalf("unexpected Link header %q", link)
+	}
+
+	list := inst.loadTagList(context.Background(), &param{name: "library/alpine"})
+	list.FetchedAt = time.Now().Add(-2 * time.Hour)
+	inst.storeTagList(context.Background(), list)
+	if rr := tags(""); rr.Body.String() != `{"name":"library/alpine","tags":["3.18","3.22"]}` || hits.Load() != 4 {
+		t.Fatalf("expected expired tag list to be refetched, got %s after %d upstream hits", rr.Body.String(), hits.Load())
+	}
+}
+
+func TestContainerTagsFollowEveryUpstreamPage(t *testing.T) {
+	t.Parallel()
+	inst := newContainerInstanceForTest(t, "https://registry.test")
+	inst.httpClientFactory = newContainerClientFactory(func(req *http.Request) (*http.Response, error) {
+		var page int
+		_, _ = fmt.Sscanf(req.URL.Query().Get("last"), "tag-%03d", &page)
+		body := []byte(fmt.Sprintf(`{"name":"library/alpine","tags":["tag-%03d"]}`, page+1))
+		if page+1 == 25 {
+			return httpResponse(http.StatusOK, nil, body), nil
 		}
-		expectedBody := fmt.Sprintf(`{"seq":%d}`, i+1)
-		if rr.Body.String() != expectedBody {
-			t.Fatalf("iteration %d: expected %s, got %s", i, expectedBody, rr.Body.String())
+		return httpResponse(http.StatusOK, map[string]string{
+			"Link": fmt.Sprintf(`</v2/library/alpine/tags/list?last=tag-%03d&n=1>; rel="next"`, page+1),
+		}, body), nil
+	})
+	result, err := inst.fetchTagList(context.Background(), &param{name: "library/alpine"})
+	if err != nil {
+		t.Fatalf("fetchTagList failed: %v", err)
+	}
+	if result.list == nil || len(result.list.Tags) != 25 || result.list.Tags[24] != "tag-025" {
+		t.Fatalf("expected every upstream page, got %+v", result.list)
+	}
+}
+
+func TestContainerOfflineModeAnswersFromCache(t *testing.T) {
+	t.Parallel()
+	manifest := []byte(`{"schemaVersion":2}`)
+	sum := sha256.Sum256(manifest)
+	digest := "sha256:" + hex.EncodeToString(sum[:])
+	offline := false
+	inst := newContainerInstanceForTest(t, "https://registry.test")
+	inst.httpClientFactory = newContainerClientFactory(func(req *http.Request) (*http.Response, error) {
+		if offline {
+			t.Errorf("offline mode contacted upstream: %s", req.URL)
 		}
+		return httpResponse(http.StatusOK, map[string]string{
+			"Docker-Content-Digest": digest,
+			"Content-Type":          "application/vnd.docker.distribution.manifest.v2+json",
+		}, manifest), nil
+	})
+	for _, tag := range []string{"3.19", "latest"} {
+		req := httptest.NewRequest(http.MethodGet, "/v2/library/alpine/manifests/"+tag, nil)
+		inst.HandleV2Manifest(&param{name: "library/alpine", tag: tag}, httptest.NewRecorder(), req)
 	}
-	if hits != 2 {
-		t.Fatalf("expected upstream tags hit each time, got %d hits", hits)
+
+	offline = true
+	inst.config.Mode = repo.ModeOffline
+	req := httptest.NewRequest(http.MethodGet, "/v2/library/alpine/manifests/latest", nil)
+	rr := httptest.NewRecorder()
+	inst.HandleV2Manifest(&param{name: "library/alpine", tag: "latest"}, rr, req)
+	if rr.Code != http.StatusOK || rr.Body.String() != string(manifest) {
+		t.Fatalf("expected cached manifest, got %d %s", rr.Code, rr.Body.String())
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/v2/library/alpine/tags/list", nil)
+	rr = httptest.NewRecorder()
+	inst.HandleV2Tags(&param{name: "library/alpine"}, rr, req)
+	if rr.Code != http.StatusOK || rr.Body.String() != `{"name":"library/alpine","tags":["3.19","latest"]}` {
+		t.Fatalf("expected cached tag list, got %d %s", rr.Code, rr.Body.String())
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/v2/library/alpine/manifests/edge", nil)
+	rr = httptest.NewRecorder()
+	inst.HandleV2Manifest(&param{name: "library/alpine", tag: "edge"}, rr, req)
+	if rr.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for uncached manifest, got %d", rr.Code)
+	}
+
+	missing := "sha256:" + hex.EncodeToString(make([]byte, 32))
+	req = httptest.NewRequest(http.MethodGet, "/v2/library/alpine/blobs/"+missing, nil)
+	rr = httptest.NewRecorder()
+	inst.HandleV2BlobByDigest(&param{name: "library/alpine", digest: missing}, rr, req)
+	if rr.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for uncached blob, got %d", rr.Code)
+	}
+}
+
+func TestContainerTagsFallBackToCacheOnUpstreamError(t *testing.T) {
+	t.Parallel()
+	manifest := []byte(`{"schemaVersion":2}`)
+	sum := sha256.Sum256(manifest)
+	digest := "sha256:" + hex.EncodeToString(sum[:])
+	failing := false
+	inst := newContainerInstanceForTest(t, "https://registry.test")
+	inst.httpClientFactory = newContainerClientFactory(func(req *http.Request) (*http.Response, error) {
+		if failing {
+			return nil, fmt.Errorf("upstream unreachable")
+		}
+		return httpResponse(http.StatusOK, map[string]string{"Docker-Content-Digest": digest}, manifest), nil
+	})
+	req := httptest.NewRequest(http.MethodGet, "/v2/library/alpine/manifests/latest", nil)
+	inst.HandleV2Manifest(&param{name: "library/alpine", tag: "latest"}, httptest.NewRecorder(), req)
+
+	failing = true
+	req = httptest.NewRequest(http.MethodGet, "/v2/library/alpine/tags/list", nil)
+	rr := httptest.NewRecorder()
+	inst.HandleV2Tags(&param{name: "library/alpine"}, rr, req)
+	if rr.Code != http.StatusOK || rr.Body.String() != `{"name":"library/alpine","tags":["latest"]}` {
+		t.Fatalf("expected cached tag list during outage, got %d %s", rr.Code, rr.Body.String())
 	}
 }
 
@@ -343,6 +481,191 @@ func TestContainerBlobCaching(t *testing.T) {
 	}
 }
 
+func TestContainerFetchOfAlreadyStoredBlobStillServesBody(t *testing.T) {
+	t.Parallel()
+	layer := []byte("layer-data")
+	sum := sha256.Sum256(layer)
+	digest := "sha256:" + hex.EncodeToString(sum[:])
+	inst := newContainerInstanceForTest(t, "https://registry.test")
+	inst.httpClientFactory = newContainerClientFactory(func(req *http.Request) (*http.Response, error) {
+		return httpResponse(http.StatusOK, map[string]string{"Content-Length": "10"}, layer), nil
+	})
+	// Another request stored the blob after this one missed the cache.
+	if _, err := inst.storage.PutBlob(context.Background(), digest, bytes.NewReader(layer)); err != nil {
+		t.Fatalf("PutBlob failed: %v", err)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/v2/library/alpine/blobs/"+digest, nil)
+	rr := httptest.NewRecorder()
+	if err := inst.fetchAndStoreBlob(&param{name: "library/alpine", digest: digest}, rr, req, nil); err != nil {
+		t.Fatalf("fetchAndStoreBlob failed: %v", err)
+	}
+	if rr.Code != http.StatusOK || rr.Body.String() != string(layer) {
+		t.Fatalf("expected the upstream body, got %d %q", rr.Code, rr.Body.String())
+	}
+}
+
+func TestContainerCachedBlobSupportsRangeAndConditionalRequests(t *testing.T) {
+	t.Parallel()
+	layer := []byte("layer-data")
+	sum := sha256.Sum256(layer)
+	digest := "sha256:" + hex.EncodeToString(sum[:])
+	inst := newContainerInstanceForTest(t, "https://registry.test")
+	if _, err := inst.storage.PutBlob(context.Background(), digest, bytes.NewReader(layer)); err != nil {
+		t.Fatalf("PutBlob failed: %v", err)
+	}
+	blobParam := &param{name: "library/alpine", digest: digest}
+
+	req := httptest.NewRequest(http.MethodGet, "/v2/library/alpine/blobs/"+digest, nil)
+	req.Header.Set("Range", "bytes=6-")
+	rr := httptest.NewRecorder()
+	inst.HandleV2BlobByDigest(blobParam, rr, req)
+	if rr.Code != http.StatusPartialContent || rr.Body.String() != "data" {
+		t.Fatalf("expected resumed download, got %d %q", rr.Code, rr.Body.String())
+	}
+	if rr.Header().Get("Docker-Content-Digest") != digest || rr.Header().Get("ETag") != `"`+digest+`"` {
+		t.Fatalf("unexpected headers %v", rr.Header())
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/v2/library/alpine/blobs/"+digest, nil)
+	req.Header.Set("If-None-Match", `"`+digest+`"`)
+	rr = httptest.NewRecorder()
+	inst.HandleV2BlobByDigest(blobParam, rr, req)
+	if rr.Code != http.StatusNotModified || rr.Body.Len() != 0 {
+		t.Fatalf("expected 304 for matching digest, got %d", rr.Code)
+	}
+}
+
+func TestContainerConcurrentBlobMissesShareOneFetch(t *testing.T) {
+	t.Parallel()
+	layer := []byte("shared-layer-data")
+	sum := sha256.Sum256(layer)
+	digest := "sha256:" + hex.EncodeToString(sum[:])
+	var hits atomic.Int32
+	started := make(chan struct{})
+	body, bodyWriter := io.Pipe()
+	inst := newContainerInstanceForTest(t, "https://registry.test")
+	inst.httpClientFactory = newContainerClientFactory(func(req *http.Request) (*http.Response, error) {
+		if hits.Add(1) == 1 {
+			close(started)
+		}
+		resp := httpResponse(http.StatusOK, nil, nil)
+		resp.Body = body
+		resp.ContentLength = int64(len(layer))
+		return resp, nil
+	})
+	blobParam := &param{name: "library/alpine", digest: digest}
+
+	const clients = 4
+	var wg sync.WaitGroup
+	bodies := make([]string, clients)
+	fetch := func(i int) {
+		defer wg.Done()
+		req := httptest.NewRequest(http.MethodGet, "/v2/library/alpine/blobs/"+digest, nil)
+		rr := httptest.NewRecorder()
+		inst.HandleV2BlobByDigest(blobParam, rr, req)
+		bodies[i] = rr.Body.String()
+	}
+	wg.Add(clients)
+	go fetch(0)
+	<-started
+	for i := 1; i < clients; i++ {
+		go fetch(i)
+	}
+	time.Sleep(20 * time.Millisecond)
+	_, _ = bodyWriter.Write(layer[:6])
+	_, _ = bodyWriter.Write(layer[6:])
+	_ = bodyWriter.Close()
+	wg.Wait()
+
+	if n := hits.Load(); n != 1 {
+		t.Fatalf("expected a single upstream fetch, got %d", n)
+	}
+	for i, got := range bodies {
+		if got != string(layer) {
+			t.Fatalf("client %d received %q", i, got)
+		}
+	}
+}
+
+func TestContainerSharedBlobFetchSurvivesLeaderCancellation(t *testing.T) {
+	t.Parallel()
+	layer := []byte("shared-layer-data")
+	sum := sha256.Sum256(layer)
+	digest := "sha256:" + hex.EncodeToString(sum[:])
+	var hits atomic.Int32
+	started := make(chan struct{})
+	body, bodyWriter := io.Pipe()
+	inst := newContainerInstanceForTest(t, "https://registry.test")
+	inst.httpClientFactory = newContainerClientFactory(func(req *http.Request) (*http.Response, error) {
+		if hits.Add(1) == 1 {
+			close(started)
+		}
+		// Like a real transport, abort the body when the upstream request is cancelled.
+		context.AfterFunc(req.Context(), func() { _ = bodyWriter.CloseWithError(req.Context().Err()) })
+		resp := httpResponse(http.StatusOK, nil, nil)
+		resp.Body = body
+		resp.ContentLength = int64(len(layer))
+		return resp, nil
+	})
+	blobParam := &param{name: "library/alpine", digest: digest}
+
+	leaderCtx, cancelLeader := context.WithCancel(context.Background())
+	leaderDone := make(chan struct{})
+	go func() {
+		defer close(leaderDone)
+		req := httptest.NewRequest(http.MethodGet, "/v2/library/alpine/blobs/"+digest, nil).WithContext(leaderCtx)
+		inst.HandleV2BlobByDigest(blobParam, httptest.NewRecorder(), req)
+	}()
+	<-started
+	followerDone := make(chan string)
+	go func() {
+		req := httptest.NewRequest(http.MethodGet, "/v2/library/alpine/blobs/"+digest, nil)
+		rr := httptest.NewRecorder()
+		inst.HandleV2BlobByDigest(blobParam, rr, req)
+		followerDone <- rr.Body.String()
+	}()
+	_, _ = bodyWriter.Write(layer[:6])
+	cancelLeader()
+	time.Sleep(20 * time.Millisecond)
+	_, _ = bodyWriter.Write(layer[6:])
+	_ = bodyWriter.Close()
+	<-leaderDone
+
+	if got := <-followerDone; got != string(layer) {
+		t.Fatalf("follower received %q", got)
+	}
+	if n := hits.Load(); n != 1 {
+		t.Fatalf("expected a single upstream fetch, got %d", n)
+	}
+	if _, err := inst.storage.StatBlob(context.Background(), digest); err != nil {
+		t.Fatalf("expected the blob to be cached after the leader disconnected: %v", err)
+	}
+}
+
+func TestContainerBlobDigestMismatchIsNotCached(t *testing.T) {
+	t.Parallel()
+	layer := []byte("layer-data")
+	sum := sha256.Sum256(layer)
+	digest := "sha256:" + hex.EncodeToString(sum[:])
+	hits := 0
+	inst := newContainerInstanceForTest(t, "https://registry.test")
+	inst.httpClientFactory = newContainerClientFactory(func(req *http.Request) (*http.Response, error) {
+		hits++
+		return httpResponse(http.StatusOK, nil, []byte("tampered-layer")), nil
+	})
+	blobParam := &param{name: "library/alpine", digest: digest}
+	req := httptest.NewRequest(http.MethodGet, "/v2/library/alpine/blobs/"+digest, nil)
+	inst.HandleV2BlobByDigest(blobParam, httptest.NewRecorder(), req)
+	if _, err := inst.storage.StatBlob(context.Background(), digest); err == nil {
+		t.Fatalf("tampered blob must not be stored under %s", digest)
+	}
+	req2 := httptest.NewRequest(http.MethodGet, "/v2/library/alpine/blobs/"+digest, nil)
+	inst.HandleV2BlobByDigest(blobParam, httptest.NewRecorder(), req2)
+	if hits != 2 {
+		t.Fatalf("expected second request to refetch from upstream, got %d hits", hits)
+	}
+}
+
 func TestContainerManifestFallsBackToCacheOnUpstreamError(t *testing.T) {
 	t.Parallel()
 	inst := newContainerInstanceForTest(t, "https://registry.test")
@@ -0,0 +1,127 @@
+package container
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"slices"
+
+	"github.com/davidjspooner/repoxy/pkg/observability"
+	"github.com/davidjspooner/repoxy/pkg/repo"
+)
+
+// ruleSubject describes param for the repository rules. Platforms are only known for manifests listed in an index that
+// is cached by, or has passed through, this instance.
+func (d *containerRegistryInstance) ruleSubject(ctx context.Context, param *param) repo.RuleSubject {
+	subject := repo.RuleSubject{Name: param.name, Digest: param.digest}
+	if isDigestReference(param.tag) {
+		subject.Digest = param.tag
+		subject.Platform = d.platformOf(ctx, param.name, param.tag)
+	} else {
+		subject.Reference = param.tag
+		if platform, ok := d.platforms.Load(subject.Digest); ok {
+			subject.Platform = platform.(string)
+		}
+	}
+	return subject
+}
+
+// ruleError is returned when the repository rules refuse a subject.
+type ruleError struct {
+	subject repo.RuleSubject
+	reason  string
+}
+
+func (e *ruleError) Error() string {
+	return "manifest " + e.subject.Digest + " refused by repository rules: " + e.reason
+}
+
+// refusedByRules evaluates subject against the repository rules and returns nil when it is allowed.
+func (d *containerRegistryInstance) refusedByRules(subject repo.RuleSubject) *ruleError {
+	if d.config.Rules == nil {
+		return nil
+	}
+	if allowed, reason := d.config.Rules.Evaluate(subject); !allowed {
+		return &ruleError{subject: subject, reason: reason}
+	}
+	return nil
+}
+
+// refusedDigestByRules re-checks the rules once a manifest requested by tag has resolved to digest, so a digest or
+// platform deny rule cannot be bypassed by pulling the same manifest through a tag.
+func (d *containerRegistryInstance) refusedDigestByRules(ctx context.Context, param *param, digest string) *ruleError {
+	if d.config.Rules == nil || param == nil || digest == "" || isDigestReference(param.tag) {
+		return nil
+	}
+	return d.refusedByRules(repo.RuleSubject{
+		Name:      param.name,
+		Reference: param.tag,
+		Digest:    digest,
+		Platform:  d.platformOf(ctx, param.name, digest),
+	})
+}
+
+// writeRuleDenial answers a request refused by the repository rules.
+func (d *containerRegistryInstance) writeRuleDenial(ctx context.Context, w http.ResponseWriter, denied *ruleError) {
+	slog.InfoContext(ctx, "request denied by repository rules", "name", denied.subject.Name, "reference", denied.subject.Reference,
+		"digest", denied.subject.Digest, "platform", denied.subject.Platform, "reason", denied.reason)
+	d.recordDenied(denied.reason)
+	writeRegistryError(w, http.StatusForbidden, "DENIED", "requested access to the resource is denied by repository rules")
+}
+
+// deniedByRules refuses requests the repository rules do not allow, before anything is fetched from upstream, and
+// reports whether it did.
+func (d *containerRegistryInstance) deniedByRules(param *param, w http.ResponseWriter, r *http.Request) bool {
+	if d.config.Rules == nil || param == nil {
+		return false
+	}
+	denied := d.refusedByRules(d.ruleSubject(r.Context(), param))
+	if denied == nil {
+		return false
+	}
+	d.writeRuleDenial(r.Context(), w, denied)
+	return true
+}
+
+// platformOf returns the "os/arch" of the manifest digest, as listed by an index seen by this process or cached for
+// name, or "" when no such index is known.
+func (d *containerRegistryInstance) platformOf(ctx context.Context, name, digest string) string {
+	if platform, ok := d.platforms.Load(digest); ok {
+		return platform.(string)
+	}
+	if d.storage != nil {
+		loc := repo.Locator{Host: d.upstreamHost(), Name: name}
+		versions, _ := d.storage.ListVersions(ctx, loc)
+		for _, v := range versions {
+			loc.VersionID = v.VersionID
+			meta, err := d.storage.GetVersionMeta(ctx, loc)
+			if err != nil || !slices.Contains(meta.Links, digest) {
+				continue
+			}
+			d.notePlatforms(parseManifest([]byte(meta.Manifest)))
+			if platform, ok := d.platforms.Load(digest); ok {
+				return platform.(string)
+			}
+		}
+	}
+	// Remember the miss; notePlatforms replaces it when an index listing digest arrives.
+	platform, _ := d.platforms.LoadOrStore(digest, "")
+	return platform.(string)
+}
+
+// notePlatforms remembers the platform of each manifest listed in an index so rules can match it by digest.
+func (d *containerRegistryInstance) notePlatforms(doc *manifestDocument) {
+	if doc == nil || d.config.Rules == nil {
+		return
+	}
+	for _, child := range doc.Manifests {
+		if child.Platform != nil && child.Platform.OS != "" {
+			d.platforms.Store(child.Digest, child.Platform.OS+"/"+child.Platform.Architecture)
+		}
+	}
+}
+
+func (d *containerRegistryInstance) recordDenied(reason string) {
+	repoType, repoName := d.repoLabels()
+	observability.RecordDenied(repoType, repoName, reason)
+}
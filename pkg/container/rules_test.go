@@ -0,0 +1,103 @@
+package container
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/davidjspooner/repoxy/pkg/repo"
+)
+
+func TestContainerRulesDenyBeforeUpstreamFetch(t *testing.T) {
+	t.Parallel()
+	arm64 := []byte(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","config":{"digest":"sha256:bb"},"layers":[]}`)
+	arm64Digest := manifestDigest(arm64)
+	index := []byte(fmt.Sprintf(`{"schemaVersion":2,"mediaType":%q,"manifests":[{"mediaType":%q,"digest":%q,"platform":{"architecture":"arm64","os":"linux"}}]}`,
+		mediaTypeOCIIndex, mediaTypeOCIManifest, arm64Digest))
+	inst := newContainerInstanceFromConfig(t, &repo.Repo{
+		Name:     "mirror",
+		Type:     "container",
+		Upstream: repo.Upstream{URL: "https://registry.test"},
+		Mappings: []string{"library/*"},
+		Rules: &repo.Rules{
+			Allow: []repo.Rule{{Name: "library/alpine"}},
+			Deny:  []repo.Rule{{Tag: "latest"}, {Platform: "linux/arm64"}},
+		},
+	})
+	var fetched []string
+	inst.httpClientFactory = newContainerClientFactory(func(req *http.Request) (*http.Response, error) {
+		fetched = append(fetched, req.URL.Path)
+		return httpResponse(http.StatusOK, map[string]string{"Content-Type": mediaTypeOCIIndex}, index), nil
+	})
+
+	if rr := getManifest(inst, "latest", ""); rr.Code != http.StatusForbidden || !containsDenied(rr) {
+		t.Fatalf("expected latest to be denied, got %d %s", rr.Code, rr.Body.String())
+	}
+	req := httptest.NewRequest(http.MethodGet, "/v2/library/busybox/tags/list", nil)
+	rr := httptest.NewRecorder()
+	inst.HandleV2Tags(&param{name: "library/busybox"}, rr, req)
+	if rr.Code != http.StatusForbidden || !containsDenied(rr) {
+		t.Fatalf("expected name outside the allow list to be denied, got %d", rr.Code)
+	}
+	if len(fetched) != 0 {
+		t.Fatalf("denied requests reached upstream: %v", fetched)
+	}
+
+	if rr := getManifest(inst, "3.20", mediaTypeOCIIndex); rr.Code != http.StatusOK {
+		t.Fatalf("expected allowed tag to be served, got %d", rr.Code)
+	}
+	if rr := getManifest(inst, arm64Digest, ""); rr.Code != http.StatusForbidden {
+		t.Fatalf("expected platform listed in the index to be denied, got %d", rr.Code)
+	}
+	if len(fetched) != 1 {
+		t.Fatalf("expected only the index fetched upstream, got %v", fetched)
+	}
+}
+
+func TestContainerRulesRecheckResolvedDigestAndCachedPlatform(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	denied := []byte(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","config":{"digest":"sha256:cc"},"layers":[]}`)
+	deniedDigest := manifestDigest(denied)
+	arm64 := []byte(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","config":{"digest":"sha256:bb"},"layers":[]}`)
+	arm64Digest := manifestDigest(arm64)
+	index := []byte(fmt.Sprintf(`{"schemaVersion":2,"mediaType":%q,"manifests":[{"mediaType":%q,"digest":%q,"platform":{"architecture":"arm64","os":"linux"}}]}`,
+		mediaTypeOCIIndex, mediaTypeOCIManifest, arm64Digest))
+	inst := newContainerInstanceFromConfig(t, &repo.Repo{
+		Name:     "mirror",
+		Type:     "container",
+		Upstream: repo.Upstream{URL: "https://registry.test"},
+		Mappings: []string{"library/*"},
+		Rules:    &repo.Rules{Deny: []repo.Rule{{Digest: deniedDigest}, {Platform: "linux/arm64"}}},
+	})
+	inst.httpClientFactory = newContainerClientFactory(func(req *http.Request) (*http.Response, error) {
+		return httpResponse(http.StatusOK, map[string]string{"Content-Type": mediaTypeOCIManifest}, denied), nil
+	})
+
+	if rr := getManifest(inst, "3.19", ""); rr.Code != http.StatusForbidden || !containsDenied(rr) {
+		t.Fatalf("expected the denied digest to be refused by tag, got %d %s", rr.Code, rr.Body.String())
+	}
+	if err := inst.storeManifest(ctx, "library/alpine", deniedDigest, mediaTypeOCIManifest, denied, "3.19"); err != nil {
+		t.Fatalf("storeManifest failed: %v", err)
+	}
+	if err := inst.storeManifest(ctx, "library/alpine", arm64Digest, mediaTypeOCIManifest, arm64); err != nil {
+		t.Fatalf("storeManifest failed: %v", err)
+	}
+	if err := inst.storeManifest(ctx, "library/alpine", manifestDigest(index), mediaTypeOCIIndex, index, "3.20"); err != nil {
+		t.Fatalf("storeManifest failed: %v", err)
+	}
+	inst.platforms.Clear() // as after a restart
+	inst.config.Mode = repo.ModeOffline
+	if rr := getManifest(inst, "3.19", ""); rr.Code != http.StatusForbidden || !containsDenied(rr) {
+		t.Fatalf("expected the cached denied digest to be refused by tag, got %d %s", rr.Code, rr.Body.String())
+	}
+	if rr := getManifest(inst, arm64Digest, ""); rr.Code != http.StatusForbidden || !containsDenied(rr) {
+		t.Fatalf("expected the platform of the cached index to be denied, got %d %s", rr.Code, rr.Body.String())
+	}
+}
+
+func containsDenied(rr *httptest.ResponseRecorder) bool {
+	return rr.Body.String() == `{"errors":[{"code":"DENIED","message":"requested access to the resource is denied by repository rules"}]}`
+}
@@ -0,0 +1,278 @@
+package container
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"time"
+)
+
+const (
+	cosignSignatureAnnotation = "dev.cosignproject.cosign/signature"
+	notationArtifactType      = "application/vnd.cncf.notary.signature"
+	notationJWSMediaType      = "application/jose+json"
+	notationCOSEMediaType     = "application/cose"
+
+	cosignSimpleSigningMediaType = "application/vnd.dev.cosign.simplesigning.v1+json"
+	dsseEnvelopeMediaType        = "application/vnd.dsse.envelope.v1+json" // cosign attestations
+)
+
+// trustedKeys are the public keys and certificates a signature policy accepts signatures from.
+type trustedKeys struct {
+	keys  []crypto.PublicKey
+	roots *x509.CertPool // nil when no certificates were configured
+}
+
+// loadTrustedKeys reads PEM files of PUBLIC KEY, RSA PUBLIC KEY and CERTIFICATE blocks.
+func loadTrustedKeys(files []string) (*trustedKeys, error) {
+	trusted := &trustedKeys{}
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read trusted key: %w", err)
+		}
+		found := false
+		for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+			switch block.Type {
+			case "PUBLIC KEY":
+				key, err := x509.ParsePKIXPublicKey(block.Bytes)
+				if err != nil {
+					return nil, fmt.Errorf("invalid public key in %s: %w", file, err)
+				}
+				trusted.keys = append(trusted.keys, key)
+			case "RSA PUBLIC KEY":
+				key, err := x509.ParsePKCS1PublicKey(block.Bytes)
+				if err != nil {
+					return nil, fmt.Errorf("invalid public key in %s: %w", file, err)
+				}
+				trusted.keys = append(trusted.keys, key)
+			case "CERTIFICATE":
+				cert, err := x509.ParseCertificate(block.Bytes)
+				if err != nil {
+					return nil, fmt.Errorf("invalid certificate in %s: %w", file, err)
+				}
+				if trusted.roots == nil {
+					trusted.roots = x509.NewCertPool()
+				}
+				trusted.roots.AddCert(cert)
+				trusted.keys = append(trusted.keys, cert.PublicKey)
+			default:
+				continue
+			}
+			found = true
+		}
+		if !found {
+			return nil, fmt.Errorf("no public key or certificate found in %s", file)
+		}
+	}
+	return trusted, nil
+}
+
+// trusts reports whether key is one of the configured keys.
+func (t *trustedKeys) trusts(key crypto.PublicKey) bool {
+	for _, candidate := range t.keys {
+		if equal, ok := candidate.(interface{ Equal(crypto.PublicKey) bool }); ok && equal.Equal(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// cosignPayload is the simple signing payload a cosign signature covers.
+type cosignPayload struct {
+	Critical struct {
+		Image struct {
+			DockerManifestDigest string `json:"docker-manifest-digest"`
+		} `json:"image"`
+	} `json:"critical"`
+}
+
+// verifyCosign checks a base64 cosign signature over payload with the trusted keys and that payload names digest.
+func (t *trustedKeys) verifyCosign(payload []byte, signature, digest string) error {
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return fmt.Errorf("malformed cosign signature: %w", err)
+	}
+	verified := false
+	for _, key := range t.keys {
+		if verifySignature(key, payload, sig) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return errors.New("cosign signature does not match any trusted key")
+	}
+	var doc cosignPayload
+	if err := json.Unmarshal(payload, &doc); err != nil {
+		return fmt.Errorf("malformed cosign payload: %w", err)
+	}
+	if doc.Critical.Image.DockerManifestDigest != digest {
+		return fmt.Errorf("cosign signature is for %s", doc.Critical.Image.DockerManifestDigest)
+	}
+	return nil
+}
+
+// verifySignature checks a cosign blob signature: ASN.1 ECDSA or RSA PKCS#1 v1.5 over SHA-256, or plain Ed25519.
+func verifySignature(key crypto.PublicKey, payload, sig []byte) bool {
+	sum := sha256.Sum256(payload)
+	switch key := key.(type) {
+	case *ecdsa.PublicKey:
+		return ecdsa.VerifyASN1(key, sum[:], sig)
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, sum[:], sig) == nil ||
+			rsa.VerifyPSS(key, crypto.SHA256, sum[:], sig, nil) == nil
+	case ed25519.PublicKey:
+		return ed25519.Verify(key, payload, sig)
+	default:
+		return false
+	}
+}
+
+// notationEnvelope is a Notation JWS signature in JSON serialization.
+type notationEnvelope struct {
+	Payload   string `json:"payload"`
+	Protected string `json:"protected"`
+	Header    struct {
+		X5C [][]byte `json:"x5c"`
+	} `json:"header"`
+	Signature string `json:"signature"`
+}
+
+type notationProtectedHeader struct {
+	Alg         string `json:"alg"`
+	SigningTime string `json:"io.cncf.notary.signingTime"`
+	Expiry      string `json:"io.cncf.notary.expiry"`
+}
+
+type notationPayload struct {
+	TargetArtifact struct {
+		Digest string `json:"digest"`
+	} `json:"targetArtifact"`
+}
+
+// verifyNotation checks a Notation JWS envelope: the signing certificate must be a trusted key or chain to a trusted
+// certificate, the signature must verify with it, and the payload must name digest.
+func (t *trustedKeys) verifyNotation(envelope []byte, digest string, now time.Time) error {
+	var env notationEnvelope
+	if err := json.Unmarshal(envelope, &env); err != nil {
+		return fmt.Errorf("malformed notation envelope: %w", err)
+	}
+	protected, err := base64.RawURLEncoding.DecodeString(env.Protected)
+	if err != nil {
+		return fmt.Errorf("malformed notation header: %w", err)
+	}
+	var header notationProtectedHeader
+	if err := json.Unmarshal(protected, &header); err != nil {
+		return fmt.Errorf("malformed notation header: %w", err)
+	}
+	if len(env.Header.X5C) == 0 {
+		return errors.New("notation signature has no certificate chain")
+	}
+	chain := make([]*x509.Certificate, 0, len(env.Header.X5C))
+	for _, der := range env.Header.X5C {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return fmt.Errorf("malformed notation certificate: %w", err)
+		}
+		chain = append(chain, cert)
+	}
+	signingTime := now
+	if header.SigningTime != "" {
+		if signingTime, err = time.Parse(time.RFC3339, header.SigningTime); err != nil {
+			return fmt.Errorf("malformed notation signing time: %w", err)
+		}
+	}
+	if header.Expiry != "" {
+		expiry, err := time.Parse(time.RFC3339, header.Expiry)
+		if err != nil || now.After(expiry) {
+			return errors.New("notation signature has expired")
+		}
+	}
+	if !t.trustsChain(chain, signingTime) {
+		return errors.New("notation certificate is not trusted")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(env.Signature)
+	if err != nil {
+		return fmt.Errorf("malformed notation signature: %w", err)
+	}
+	if err := verifyJWS(header.Alg, chain[0].PublicKey, []byte(env.Protected+"."+env.Payload), sig); err != nil {
+		return err
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(env.Payload)
+	if err != nil {
+		return fmt.Errorf("malformed notation payload: %w", err)
+	}
+	var doc notationPayload
+	if err := json.Unmarshal(payload, &doc); err != nil {
+		return fmt.Errorf("malformed notation payload: %w", err)
+	}
+	if doc.TargetArtifact.Digest != digest {
+		return fmt.Errorf("notation signature is for %s", doc.TargetArtifact.Digest)
+	}
+	return nil
+}
+
+// trustsChain accepts a leaf whose key is trusted outright or that chains to a trusted certificate at signingTime.
+func (t *trustedKeys) trustsChain(chain []*x509.Certificate, signingTime time.Time) bool {
+	if t.trusts(chain[0].PublicKey) {
+		return true
+	}
+	if t.roots == nil {
+		return false
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range chain[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := chain[0].Verify(x509.VerifyOptions{
+		Roots:         t.roots,
+		Intermediates: intermediates,
+		CurrentTime:   signingTime,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	return err == nil
+}
+
+// verifyJWS checks a JWS signature for the PS* and ES* algorithms Notation signs with.
+func verifyJWS(alg string, key crypto.PublicKey, input, sig []byte) error {
+	var hash crypto.Hash
+	switch alg {
+	case "PS256", "ES256":
+		hash = crypto.SHA256
+	case "PS384", "ES384":
+		hash = crypto.SHA384
+	case "PS512", "ES512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("unsupported notation signature algorithm %q", alg)
+	}
+	h := hash.New()
+	h.Write(input)
+	sum := h.Sum(nil)
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if alg[0] == 'P' && rsa.VerifyPSS(key, hash, sum, sig, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash}) == nil {
+			return nil
+		}
+	case *ecdsa.PublicKey:
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if alg[0] == 'E' && len(sig) == 2*size {
+			r, s := new(big.Int).SetBytes(sig[:size]), new(big.Int).SetBytes(sig[size:])
+			if ecdsa.Verify(key, sum, r, s) {
+				return nil
+			}
+		}
+	}
+	return errors.New("notation signature does not verify")
+}
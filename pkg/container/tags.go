@@ -0,0 +1,210 @@
+package container
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/davidjspooner/repoxy/pkg/observability"
+	"github.com/davidjspooner/repoxy/pkg/repo"
+)
+
+// tagList is the cached upstream tag list for one repository name.
+type tagList struct {
+	Kind      string    `json:"kind"`
+	Name      string    `json:"name"`
+	Tags      []string  `json:"tags"`
+	FetchedAt time.Time `json:"fetchedAt"`
+}
+
+const tagListKind = "registry.tags"
+
+// tagListResult is the outcome of one coalesced upstream tag list fetch; failed holds a non-200 upstream reply.
+type tagListResult struct {
+	list   *tagList
+	failed *bufferedResponse
+}
+
+func tagListPath(host, name string) string {
+	return path.Join("tags", host, name, "list.json")
+}
+
+// HandleV2Tags handles container V2 tags requests. Returns a 405 for write operations.
+// Upstream tag lists are cached per name under the repository freshness policy and merged with locally known tags.
+func (d *containerRegistryInstance) HandleV2Tags(param *param, w http.ResponseWriter, r *http.Request) {
+	if d.HandledWriteMethodForReadOnlyRepo(w, r) || d.deniedByRules(param, w, r) {
+		return
+	}
+	ctx := r.Context()
+	freshness := d.config.Freshness
+	cached := d.loadTagList(ctx, param)
+	var fetchedAt time.Time
+	if cached != nil {
+		fetchedAt = cached.FetchedAt
+	}
+	now := time.Now()
+	switch d.config.UpstreamMode() {
+	case repo.ModeOffline, repo.ModeHosted:
+		if !d.serveTags(param, cached, w, r) {
+			writeRegistryError(w, http.StatusNotFound, "NAME_UNKNOWN", "repository name not known to registry")
+		}
+		return
+	case repo.ModePreferCache:
+		if d.serveTags(param, cached, w, r) {
+			return
+		}
+	default:
+		switch freshness.State(fetchedAt, now) {
+		case repo.CacheFresh:
+			d.recordCacheHit(observability.CacheTags)
+			d.serveTags(param, cached, w, r)
+			return
+		case repo.CacheRevalidate:
+			d.recordCacheHit(observability.CacheTags)
+			d.serveTags(param, cached, w, r)
+			d.revalidateTags(param, r)
+			return
+		}
+	}
+	d.recordCacheMiss(observability.CacheTags)
+	result, err := d.fetchTagList(ctx, param)
+	if err == nil && result.failed == nil {
+		d.serveTags(param, result.list, w, r)
+		return
+	}
+	if err != nil || result.failed.status >= http.StatusInternalServerError {
+		if !freshness.ServeStaleOnError(fetchedAt, now) {
+			cached = nil
+		}
+		if d.serveTags(param, cached, w, r) {
+			slog.WarnContext(ctx, "serving cached docker tags after upstream failure", "name", param.name, "fetched_at", fetchedAt, "error", err)
+			d.recordCacheStale(observability.CacheTags)
+			return
+		}
+		if err != nil {
+			slog.ErrorContext(ctx, "failed to fetch docker tags from upstream", "error", err)
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+	}
+	d.writeBufferedResponse(w, r, result.failed)
+}
+
+// serveTags answers a tag list from list merged with the labels recorded for cached manifests, paginated per the
+// distribution spec. It reports false when neither source knows any tags.
+func (d *containerRegistryInstance) serveTags(param *param, list *tagList, w http.ResponseWriter, r *http.Request) bool {
+	if param == nil || param.name == "" {
+		return false
+	}
+	seen := map[string]bool{}
+	if list != nil {
+		for _, tag := range list.Tags {
+			seen[tag] = true
+		}
+	}
+	if d.storage != nil {
+		if bindings, err := d.storage.GetLabels(r.Context(), repo.Locator{Host: d.upstreamHost(), Name: param.name}); err == nil {
+			for label := range bindings.Labels {
+				if !strings.Contains(label, ":") { // digest references are stored as labels too
+					seen[label] = true
+				}
+			}
+		}
+	}
+	if list == nil && len(seen) == 0 {
+		return false
+	}
+	tags := make([]string, 0, len(seen))
+	for tag := range seen {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	tags = paginate(w, r, tags)
+	body, err := json.Marshal(map[string]any{"name": param.name, "tags": tags})
+	if err != nil {
+		return false
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(http.StatusOK)
+	if r.Method != http.MethodHead {
+		_, _ = w.Write(body)
+	}
+	return true
+}
+
+// loadTagList returns the cached upstream tag list for param, or nil when none is stored.
+func (d *containerRegistryInstance) loadTagList(ctx context.Context, param *param) *tagList {
+	if d.storage == nil || param == nil || param.name == "" {
+		return nil
+	}
+	reader, err := d.storage.OpenFile(ctx, tagListPath(d.upstreamHost(), param.name))
+	if err != nil {
+		return nil
+	}
+	defer reader.Close()
+	var list tagList
+	if err := json.NewDecoder(reader).Decode(&list); err != nil || list.Kind != tagListKind {
+		return nil
+	}
+	return &list
+}
+
+// fetchTagList fetches every page of the upstream tag list once for concurrent callers and caches a successful result.
+func (d *containerRegistryInstance) fetchTagList(ctx context.Context, param *param) (*tagListResult, error) {
+	val, err := d.flights.Do(ctx, "tags:"+param.name, func(ctx context.Context) (any, error) {
+		upstream, failed, err := d.fetchUpstreamList(ctx, "/v2/"+param.name+"/tags/list")
+		if err != nil {
+			return nil, err
+		}
+		if failed != nil {
+			return &tagListResult{failed: failed}, nil
+		}
+		list := &tagList{Kind: tagListKind, Name: param.name, Tags: upstream.Tags, FetchedAt: time.Now().UTC()}
+		d.storeTagList(ctx, list)
+		return &tagListResult{list: list}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return val.(*tagListResult), nil
+}
+
+func (d *containerRegistryInstance) storeTagList(ctx context.Context, list *tagList) {
+	if d.storage == nil {
+		return
+	}
+	body, err := json.Marshal(list)
+	if err != nil {
+		return
+	}
+	n, err := d.storage.StoreFile(ctx, tagListPath(d.upstreamHost(), list.Name), bytes.NewReader(body))
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to persist docker tag list", "error", err, "name", list.Name)
+		d.recordCacheError(observability.CacheTags)
+		return
+	}
+	d.recordCacheBytes(observability.CacheTags, "store", n)
+}
+
+// revalidateTags refreshes the cached tag list in the background after an expired copy has been served.
+func (d *containerRegistryInstance) revalidateTags(param *param, r *http.Request) {
+	ctx := context.WithoutCancel(r.Context())
+	go func() {
+		if _, err := d.fetchTagList(ctx, param); err != nil {
+			slog.WarnContext(ctx, "background revalidation of docker tags failed", "name", param.name, "error", err)
+		}
+	}()
+}
+
+func (d *containerRegistryInstance) recordCacheStale(cache string) {
+	repoType, repoName := d.repoLabels()
+	observability.RecordCacheStale(repoType, repoName, cache)
+}
@@ -71,6 +71,13 @@ func HTTPLogger() handler.Middleware {
 	})
 }
 
+// SetRequestUser records the authenticated user of r so HTTPLogger logs it in the user field.
+func SetRequestUser(r *http.Request, user string) *http.Request {
+	observed, r := handler.GetObservation(r)
+	observed.Request.User = user
+	return r
+}
+
 func EnsureRequestID(r *http.Request, w http.ResponseWriter, observation *handler.Observation) *http.Request {
 	if observation == nil {
 		var obs *handler.Observation
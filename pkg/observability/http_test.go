@@ -1,8 +1,11 @@
 package observability
 
 import (
+	"bytes"
+	"log/slog"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 
 	"github.com/davidjspooner/go-http-server/pkg/handler"
@@ -54,3 +57,21 @@ func TestRequestIDFromRequestFallsBackToObservation(t *testing.T) {
 		t.Fatalf("expected observation id, got %q", got)
 	}
 }
+
+func TestHTTPLoggerLogsRequestUser(t *testing.T) {
+	var logs bytes.Buffer
+	previous := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&logs, nil)))
+	defer slog.SetDefault(previous)
+
+	mw := HTTPLogger()
+	handler := mw.WrapHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		SetRequestUser(r, "alice")
+		w.WriteHeader(http.StatusOK)
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/v2/", nil))
+
+	if !strings.Contains(logs.String(), `"user":"alice"`) {
+		t.Fatalf("expected request log to include the user, got %s", logs.String())
+	}
+}
@@ -14,6 +14,8 @@ const (
 	CachePackages  = "packages"
 	CacheBlobs     = "blobs"
 	CacheManifests = "manifests"
+	CacheTags      = "tags"
+	CacheReferrers = "referrers"
 )
 
 var (
@@ -21,6 +23,7 @@ var (
 	cacheBytes        *metric.CounterVector
 	upstreamRequests  *metric.CounterVector
 	upstreamDurations *metric.HistogramVector
+	deniedRequests    *metric.CounterVector
 	metricsMu         sync.Mutex
 	registeredMetrics []metric.Metric
 )
@@ -50,11 +53,17 @@ func resetMetricsLocked() {
 		Help:      "Latency of upstream requests",
 		LabelKeys: []string{"type", "repo", "target", "status"},
 	}, nil)
+	deniedRequests = metric.MustNewCounterVector(&metric.MetaData{
+		Name:      "repoxy_denied_requests_total",
+		Help:      "Requests refused by repository rules or signature policy",
+		LabelKeys: []string{"type", "repo", "reason"},
+	})
 	registeredMetrics = []metric.Metric{
 		cacheEvents,
 		cacheBytes,
 		upstreamRequests,
 		upstreamDurations,
+		deniedRequests,
 	}
 }
 
@@ -84,6 +93,16 @@ func RecordCacheError(repoType, repoName, cache string) {
 	recordCacheEvent(repoType, repoName, cache, "error")
 }
 
+// RecordCacheDigestMismatch increments the counter for upstream content rejected by digest verification.
+func RecordCacheDigestMismatch(repoType, repoName, cache string) {
+	recordCacheEvent(repoType, repoName, cache, "digest_mismatch")
+}
+
+// RecordCacheStale increments the counter for expired entries served because upstream could not be reached.
+func RecordCacheStale(repoType, repoName, cache string) {
+	recordCacheEvent(repoType, repoName, cache, "stale")
+}
+
 func recordCacheEvent(repoType, repoName, cache, result string) {
 	if cacheEvents == nil {
 		return
@@ -99,6 +118,14 @@ func RecordCacheBytes(repoType, repoName, cache, action string, n int64) {
 	_ = cacheBytes.IncN(n, normalize(repoType, "unknown"), normalize(repoName, "shared"), normalize(cache, "unknown"), normalize(action, "unknown"))
 }
 
+// RecordDenied counts a request refused by repository rules or signature policy for reason.
+func RecordDenied(repoType, repoName, reason string) {
+	if deniedRequests == nil {
+		return
+	}
+	_ = deniedRequests.Inc(normalize(repoType, "unknown"), normalize(repoName, "shared"), normalize(reason, "unknown"))
+}
+
 // ObserveUpstreamRequest records an upstream request result and latency.
 func ObserveUpstreamRequest(repoType, repoName, target string, statusCode int, err error, elapsed time.Duration) {
 	if upstreamRequests == nil {
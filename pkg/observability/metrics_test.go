@@ -79,3 +79,18 @@ func TestRecordCacheMetrics(t *testing.T) {
 		t.Fatalf("expected 1 failed upstream request, got %v", got)
 	}
 }
+
+func TestRecordDenied(t *testing.T) {
+	ResetForTests()
+	RecordDenied("container", "dockerhub", "deny_rule")
+	RecordDenied("container", "dockerhub", "deny_rule")
+	RecordDenied("terraform", "", "not_allowed")
+
+	metrics := snapshotMetrics(t)
+	if got := metrics[`repoxy_denied_requests_total|type="container",repo="dockerhub",reason="deny_rule"`]; got != 2 {
+		t.Fatalf("expected 2 denied requests, got %v", got)
+	}
+	if got := metrics[`repoxy_denied_requests_total|type="terraform",repo="shared",reason="not_allowed"`]; got != 1 {
+		t.Fatalf("expected 1 request outside the allow list, got %v", got)
+	}
+}
@@ -0,0 +1,193 @@
+package repo
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/davidjspooner/repoxy/pkg/auth"
+)
+
+// Access actions. Each action includes the ones before it: write includes read and admin includes both.
+const (
+	// ActionRead covers pulls, downloads, listings and the UI.
+	ActionRead = "read"
+	// ActionWrite covers pushes to hosted repositories.
+	ActionWrite = "write"
+	// ActionAdmin covers deletes and administrative endpoints.
+	ActionAdmin = "admin"
+)
+
+// Principal selectors accepted in Grant.Principals besides user names and "group:<name>".
+const (
+	// PrincipalAuthenticated matches every authenticated client.
+	PrincipalAuthenticated = "*"
+	// PrincipalAnonymous matches clients that did not authenticate. It is only accepted without an auth block, since
+	// auth requires every client to authenticate.
+	PrincipalAnonymous = "anonymous"
+)
+
+// AccessDenied is the reason recorded in repoxy_denied_requests_total for requests refused by access control.
+const AccessDenied = "rbac"
+
+// AccessControl grants principals actions on repositories. Once configured, requests not covered by a grant are
+// refused.
+type AccessControl struct {
+	// Groups lists the members of each group, in addition to any groups reported by the identity provider.
+	Groups map[string][]string `yaml:"groups,omitempty"`
+	Grants []Grant             `yaml:"grants"`
+}
+
+// Grant allows its principals the listed actions on names in the matching repositories.
+type Grant struct {
+	// Principals are user or token names, "group:<name>", "*" (any authenticated client) or "anonymous".
+	Principals []string `yaml:"principals"`
+	// Repos are repository names as path.Match globs; empty matches every repository.
+	Repos []string `yaml:"repos,omitempty"`
+	// Names are patterns in the form of Mappings (e.g. "library/*"); empty matches every name.
+	Names []string `yaml:"names,omitempty"`
+	// Actions are read, write or admin.
+	Actions []string `yaml:"actions"`
+}
+
+var accessControl *AccessControl // guarded by rTypeLock; nil allows every request
+
+// EnableAccessControl makes every later authorization check consult config. A nil config allows every request.
+func EnableAccessControl(config *AccessControl) error {
+	if err := config.Validate(); err != nil {
+		return err
+	}
+	rTypeLock.Lock()
+	defer rTypeLock.Unlock()
+	accessControl = config
+	return nil
+}
+
+// Validate reports configuration errors in the rbac block.
+func (a *AccessControl) Validate() error {
+	if a == nil {
+		return nil
+	}
+	for i, grant := range a.Grants {
+		if len(grant.Principals) == 0 {
+			return fmt.Errorf("%w: rbac grant %d has no principals", ErrInvalidRepoConfig, i+1)
+		}
+		if len(grant.Actions) == 0 {
+			return fmt.Errorf("%w: rbac grant %d has no actions", ErrInvalidRepoConfig, i+1)
+		}
+		for _, action := range grant.Actions {
+			if actionRank(action) == 0 {
+				return fmt.Errorf("%w: unknown rbac action %q", ErrInvalidRepoConfig, action)
+			}
+		}
+		for _, pattern := range grant.Repos {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("%w: invalid rbac repo pattern %q", ErrInvalidRepoConfig, pattern)
+			}
+		}
+	}
+	return nil
+}
+
+// grantsAnonymous reports whether any grant names PrincipalAnonymous.
+func (a *AccessControl) grantsAnonymous() bool {
+	if a == nil {
+		return false
+	}
+	for _, grant := range a.Grants {
+		if slices.Contains(grant.Principals, PrincipalAnonymous) {
+			return true
+		}
+	}
+	return false
+}
+
+// Authorized reports whether the client of ctx may perform action on name in the repository configured by config.
+// An empty name asks whether the client may perform action on any name in the repository.
+func Authorized(ctx context.Context, config *Repo, name, action string) bool {
+	rTypeLock.RLock()
+	control := accessControl
+	rTypeLock.RUnlock()
+	if control == nil || config == nil {
+		return true
+	}
+	return control.Allows(auth.PrincipalFromContext(ctx), config.Name, name, action)
+}
+
+// Allows reports whether a grant lets principal (nil when anonymous) perform action on name in repoName.
+func (a *AccessControl) Allows(principal *auth.Principal, repoName, name, action string) bool {
+	if a == nil {
+		return true
+	}
+	need := actionRank(action)
+	for _, grant := range a.Grants {
+		if grant.rank() >= need && grant.matchesRepo(repoName) && grant.matchesName(name) && a.matchesPrincipal(grant, principal) {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *AccessControl) matchesPrincipal(grant Grant, principal *auth.Principal) bool {
+	for _, selector := range grant.Principals {
+		switch {
+		case selector == PrincipalAnonymous:
+			if principal == nil {
+				return true
+			}
+		case principal == nil:
+		case selector == PrincipalAuthenticated, selector == principal.Name:
+			return true
+		case strings.HasPrefix(selector, "group:"):
+			group := strings.TrimPrefix(selector, "group:")
+			if slices.Contains(principal.Groups, group) || slices.Contains(a.Groups[group], principal.Name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (g Grant) matchesRepo(repoName string) bool {
+	if len(g.Repos) == 0 {
+		return true
+	}
+	for _, pattern := range g.Repos {
+		if ok, _ := path.Match(pattern, repoName); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (g Grant) matchesName(name string) bool {
+	if len(g.Names) == 0 || name == "" {
+		return true
+	}
+	var names NameMatchers
+	_ = names.Set(g.Names)
+	return names.GetMatchWeight(strings.Split(name, "/")) > 0
+}
+
+func (g Grant) rank() int {
+	best := 0
+	for _, action := range g.Actions {
+		best = max(best, actionRank(action))
+	}
+	return best
+}
+
+func actionRank(action string) int {
+	switch action {
+	case ActionRead:
+		return 1
+	case ActionWrite:
+		return 2
+	case ActionAdmin:
+		return 3
+	default:
+		return 0
+	}
+}
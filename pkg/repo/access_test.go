@@ -0,0 +1,84 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/davidjspooner/repoxy/pkg/auth"
+)
+
+func TestAccessControlAllows(t *testing.T) {
+	t.Parallel()
+	control := &AccessControl{
+		Groups: map[string][]string{"platform": {"bob"}},
+		Grants: []Grant{
+			{Principals: []string{PrincipalAnonymous}, Repos: []string{"public"}, Actions: []string{ActionRead}},
+			{Principals: []string{PrincipalAuthenticated}, Repos: []string{"docker*"}, Names: []string{"library/*"}, Actions: []string{ActionRead}},
+			{Principals: []string{"group:platform"}, Repos: []string{"hosted"}, Actions: []string{ActionWrite}},
+			{Principals: []string{"alice"}, Actions: []string{ActionAdmin}},
+		},
+	}
+	alice := &auth.Principal{Name: "alice"}
+	bob := &auth.Principal{Name: "bob"}
+	carol := &auth.Principal{Name: "carol", Groups: []string{"platform"}}
+	dave := &auth.Principal{Name: "dave"}
+
+	cases := []struct {
+		principal *auth.Principal
+		repo      string
+		name      string
+		action    string
+		want      bool
+	}{
+		{nil, "public", "library/alpine", ActionRead, true},
+		{nil, "public", "library/alpine", ActionWrite, false},
+		{nil, "dockerhub", "library/alpine", ActionRead, false},
+		{dave, "dockerhub", "library/alpine", ActionRead, true},
+		{dave, "dockerhub", "bitnami/redis", ActionRead, false},
+		{dave, "dockerhub", "", ActionRead, true},
+		{dave, "public", "library/alpine", ActionRead, false},
+		{bob, "hosted", "team/app", ActionWrite, true},
+		{bob, "hosted", "team/app", ActionRead, true},
+		{bob, "hosted", "team/app", ActionAdmin, false},
+		{carol, "hosted", "team/app", ActionWrite, true},
+		{alice, "anything", "any/name", ActionAdmin, true},
+	}
+	for _, tc := range cases {
+		if got := control.Allows(tc.principal, tc.repo, tc.name, tc.action); got != tc.want {
+			t.Fatalf("Allows(%+v, %q, %q, %q) = %v, want %v", tc.principal, tc.repo, tc.name, tc.action, got, tc.want)
+		}
+	}
+}
+
+func TestAuthorizedUsesEnabledAccessControl(t *testing.T) {
+	config := &Repo{Name: "dockerhub"}
+	ctx := auth.WithPrincipal(context.Background(), &auth.Principal{Name: "dave"})
+	if !Authorized(ctx, config, "library/alpine", ActionAdmin) {
+		t.Fatalf("expected every request to be allowed without access control")
+	}
+	if err := EnableAccessControl(&AccessControl{Grants: []Grant{{Principals: []string{"dave"}, Actions: []string{ActionRead}}}}); err != nil {
+		t.Fatalf("EnableAccessControl failed: %v", err)
+	}
+	defer func() { _ = EnableAccessControl(nil) }()
+	if !Authorized(ctx, config, "library/alpine", ActionRead) || Authorized(ctx, config, "library/alpine", ActionWrite) {
+		t.Fatalf("expected dave to have read access only")
+	}
+	if Authorized(context.Background(), config, "library/alpine", ActionRead) {
+		t.Fatalf("expected anonymous request to be refused")
+	}
+}
+
+func TestAccessControlValidate(t *testing.T) {
+	t.Parallel()
+	for name, control := range map[string]*AccessControl{
+		"no principals":  {Grants: []Grant{{Actions: []string{ActionRead}}}},
+		"no actions":     {Grants: []Grant{{Principals: []string{"alice"}}}},
+		"unknown action": {Grants: []Grant{{Principals: []string{"alice"}, Actions: []string{"pull"}}}},
+		"bad pattern":    {Grants: []Grant{{Principals: []string{"alice"}, Repos: []string{"["}, Actions: []string{ActionRead}}}},
+	} {
+		if err := control.Validate(); !errors.Is(err, ErrInvalidRepoConfig) {
+			t.Fatalf("%s: expected ErrInvalidRepoConfig, got %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,328 @@
+package repo
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/davidjspooner/go-fs/pkg/storage"
+)
+
+const (
+	sharedRootDir = "shared"
+	blobRefsDir   = "refs"
+	blobRefKind   = "blobpool.ref"
+)
+
+// BlobPool is a content-addressed blob store at shared/ in the storage root that every repository writes into when
+// shared blobs are enabled. shared/refs/<blob path>/<storage root> records which storage roots hold each blob, so a blob
+// is only removed once no root references it.
+type BlobPool struct {
+	fs      storage.WritableFS
+	mu      sync.Mutex // orders reference changes against blob deletion
+	pathMu  sync.Mutex
+	blobsFS storage.WritableFS
+}
+
+// blobRef is the marker written for each storage root holding a pooled blob.
+type blobRef struct {
+	Kind      string    `json:"kind"`
+	Holder    string    `json:"holder"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+var sharedPool *BlobPool // guarded by rTypeLock
+
+// EnableSharedBlobs makes repositories created after this call store their blobs in the pool at shared/ in root.
+func EnableSharedBlobs(ctx context.Context, root storage.WritableFS) error {
+	pool, err := OpenBlobPool(ctx, root)
+	if err != nil {
+		return err
+	}
+	rTypeLock.Lock()
+	defer rTypeLock.Unlock()
+	sharedPool = pool
+	return nil
+}
+
+// OpenBlobPool opens the blob pool at shared/ in root, creating it if needed.
+func OpenBlobPool(ctx context.Context, root storage.WritableFS) (*BlobPool, error) {
+	if root == nil {
+		return nil, fmt.Errorf("blob pool requires a storage root")
+	}
+	sub, err := root.EnsureSub(ctx, sharedRootDir)
+	if err != nil {
+		return nil, fmt.Errorf("ensure blob pool: %w", err)
+	}
+	return &BlobPool{fs: sub}, nil
+}
+
+// findBlobPool returns the pool in root, or nil when shared blobs were never enabled there.
+func findBlobPool(ctx context.Context, root storage.WritableFS) (*BlobPool, error) {
+	dirs, err := readDirNames(ctx, root, "", true)
+	if err != nil {
+		return nil, err
+	}
+	for _, dir := range dirs {
+		if dir == sharedRootDir {
+			return OpenBlobPool(ctx, root)
+		}
+	}
+	return nil, nil
+}
+
+func (p *BlobPool) blobs(ctx context.Context) (storage.WritableFS, error) {
+	p.pathMu.Lock()
+	defer p.pathMu.Unlock()
+	if p.blobsFS != nil {
+		return p.blobsFS, nil
+	}
+	blobsFS, err := p.fs.EnsureSub(ctx, blobsRootDir)
+	if err != nil {
+		return nil, fmt.Errorf("ensure blob pool blobs: %w", err)
+	}
+	p.blobsFS = blobsFS
+	return p.blobsFS, nil
+}
+
+func (p *BlobPool) statBlob(ctx context.Context, blobKey string) (storage.FileMetaData, error) {
+	rel, err := blobRelativePath(blobKey)
+	if err != nil {
+		return nil, err
+	}
+	blobsFS, err := p.blobs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return blobsFS.Stat(ctx, rel)
+}
+
+func blobRefsRel(blobKey string) (string, error) {
+	rel, err := blobRelativePath(blobKey)
+	if err != nil {
+		return "", err
+	}
+	return path.Join(blobRefsDir, rel), nil
+}
+
+// AddRef records that the storage root holder references blobKey, refreshing the marker if it already exists.
+func (p *BlobPool) AddRef(ctx context.Context, blobKey, holder string) error {
+	dir, err := blobRefsRel(blobKey)
+	if err != nil {
+		return err
+	}
+	rel := path.Join(dir, holder)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := ensureParentDir(ctx, p.fs, rel); err != nil {
+		return err
+	}
+	return writeJSONAtomic(ctx, p.fs, rel, &blobRef{Kind: blobRefKind, Holder: holder, UpdatedAt: time.Now().UTC()})
+}
+
+// Holders lists the storage roots that reference blobKey.
+func (p *BlobPool) Holders(ctx context.Context, blobKey string) ([]string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.holdersLocked(ctx, blobKey)
+}
+
+func (p *BlobPool) holdersLocked(ctx context.Context, blobKey string) ([]string, error) {
+	dir, err := blobRefsRel(blobKey)
+	if err != nil {
+		return nil, err
+	}
+	var holders []string
+	err = walkFiles(ctx, p.fs, dir, func(rel string) error {
+		holders = append(holders, strings.TrimPrefix(rel, dir+"/"))
+		return nil
+	})
+	if err != nil && !isNotFoundError(err) {
+		return nil, err
+	}
+	sort.Strings(holders)
+	return holders, nil
+}
+
+// holds reports whether holder has a reference marker for blobKey.
+func (p *BlobPool) holds(ctx context.Context, blobKey, holder string) bool {
+	dir, err := blobRefsRel(blobKey)
+	if err != nil {
+		return false
+	}
+	_, err = p.fs.Stat(ctx, path.Join(dir, holder))
+	return err == nil
+}
+
+// Release drops holder's reference to blobKey and deletes the blob once no storage root holds it.
+// It reports whether the blob itself was deleted.
+func (p *BlobPool) Release(ctx context.Context, blobKey, holder string) (bool, error) {
+	dir, err := blobRefsRel(blobKey)
+	if err != nil {
+		return false, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.fs.Delete(ctx, path.Join(dir, holder), nil); err != nil && !isNotFoundError(err) {
+		return false, err
+	}
+	holders, err := p.holdersLocked(ctx, blobKey)
+	if err != nil || len(holders) > 0 {
+		return false, err
+	}
+	return true, p.deleteBlobLocked(ctx, blobKey)
+}
+
+func (p *BlobPool) deleteBlobLocked(ctx context.Context, blobKey string) error {
+	rel, err := blobRelativePath(blobKey)
+	if err != nil {
+		return err
+	}
+	blobsFS, err := p.blobs(ctx)
+	if err != nil {
+		return err
+	}
+	if err := blobsFS.Delete(ctx, rel, nil); err != nil && !isNotFoundError(err) {
+		return err
+	}
+	if err := p.fs.Delete(ctx, path.Join(blobRefsDir, rel), &storage.DeleteOptions{Recursive: true}); err != nil && !isNotFoundError(err) {
+		return err
+	}
+	return nil
+}
+
+// collectGarbage drops markers of storage roots whose versions no longer use a blob, then deletes pooled blobs that no
+// root references. referenced maps each storage root to the blob keys its versions reference.
+func (p *BlobPool) collectGarbage(ctx context.Context, referenced map[string]map[string]struct{}, opts GCOptions) (*GCReport, error) {
+	report := &GCReport{Roots: 1, DryRun: opts.DryRun}
+	blobsFS, err := p.blobs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	cutoff := opts.cutoff()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	err = walkBlobs(ctx, blobsFS, func(blobKey, rel string) error {
+		if strings.Contains(rel, ".tmp-") {
+			return nil
+		}
+		report.Scanned++
+		inUse := false
+		for _, keys := range referenced {
+			if _, ok := keys[blobKey]; ok {
+				inUse = true
+				break
+			}
+		}
+		holders, err := p.holdersLocked(ctx, blobKey)
+		if err != nil {
+			return err
+		}
+		dir, _ := blobRefsRel(blobKey)
+		remaining := 0
+		for _, holder := range holders {
+			if _, ok := referenced[holder][blobKey]; ok {
+				remaining++
+				continue
+			}
+			info, err := p.fs.Stat(ctx, path.Join(dir, holder))
+			if err != nil || info.ModTime().After(cutoff) {
+				remaining++
+				continue
+			}
+			if !opts.DryRun {
+				if err := p.fs.Delete(ctx, path.Join(dir, holder), nil); err != nil && !isNotFoundError(err) {
+					return err
+				}
+			}
+		}
+		if inUse {
+			report.Retained++
+			recordPoolGC("referenced")
+			return nil
+		}
+		info, err := blobsFS.Stat(ctx, rel)
+		if err != nil {
+			if isNotFoundError(err) {
+				return nil
+			}
+			return err
+		}
+		if remaining > 0 || info.ModTime().After(cutoff) {
+			report.Retained++
+			recordPoolGC("grace")
+			return nil
+		}
+		report.Deleted++
+		report.DeletedBytes += info.Size()
+		report.DeletedKeys = append(report.DeletedKeys, blobKey)
+		if opts.DryRun {
+			recordPoolGC("dry_run")
+			return nil
+		}
+		if err := p.deleteBlobLocked(ctx, blobKey); err != nil {
+			recordPoolGC("error")
+			return err
+		}
+		recordPoolGC("deleted")
+		if info.Size() > 0 {
+			_ = gcBytes.IncN(info.Size(), sharedRootDir, "pool")
+		}
+		return nil
+	})
+	return report, err
+}
+
+func recordPoolGC(result string) {
+	_ = gcBlobs.Inc(sharedRootDir, "pool", result)
+}
+
+// check re-hashes every pooled blob and reports blobs that no storage root references.
+func (p *BlobPool) check(ctx context.Context, referenced map[string]struct{}, opts FsckOptions) (*FsckReport, error) {
+	report := &FsckReport{Roots: 1}
+	blobsFS, err := p.blobs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var orphans []string
+	err = walkBlobs(ctx, blobsFS, func(blobKey, rel string) error {
+		if strings.Contains(rel, ".tmp-") {
+			return nil
+		}
+		report.Blobs++
+		actual, err := hashBlob(ctx, blobsFS, blobKey, rel)
+		if err != nil {
+			return err
+		}
+		if actual != blobKey {
+			repaired := false
+			if opts.Repair {
+				p.mu.Lock()
+				err := p.deleteBlobLocked(ctx, blobKey)
+				p.mu.Unlock()
+				if err != nil {
+					return err
+				}
+				repaired = true
+			}
+			report.issue(FsckCorruptBlob, path.Join(blobsRootDir, rel), "content hashes to "+actual, repaired)
+			return nil
+		}
+		if _, ok := referenced[blobKey]; !ok {
+			orphans = append(orphans, blobKey)
+		}
+		return nil
+	})
+	if err != nil {
+		return report, err
+	}
+	for _, blobKey := range orphans {
+		rel, _ := blobRelativePath(blobKey)
+		report.issue(FsckOrphanBlob, path.Join(blobsRootDir, rel), blobKey, false)
+	}
+	return report, nil
+}
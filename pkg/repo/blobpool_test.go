@@ -0,0 +1,199 @@
+package repo
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/davidjspooner/go-fs/pkg/storage"
+)
+
+// newPoolFixture opens a mem storage root with a blob pool and two repository roots that share it.
+func newPoolFixture(t *testing.T) (storage.WritableFS, *BlobPool, CommonStorage, CommonStorage) {
+	t.Helper()
+	ctx := context.Background()
+	fsRO, err := storage.OpenFileSystemFromString(ctx, "mem://", storage.Config{})
+	if err != nil {
+		t.Fatalf("failed to open mem fs: %v", err)
+	}
+	root, ok := fsRO.(storage.WritableFS)
+	if !ok {
+		t.Fatalf("mem fs is not writable")
+	}
+	pool, err := OpenBlobPool(ctx, root)
+	if err != nil {
+		t.Fatalf("OpenBlobPool failed: %v", err)
+	}
+	stores := make([]CommonStorage, 0, 2)
+	for _, rel := range []string{"type/container/hub", "type/container/internal"} {
+		repoFS, err := root.EnsureSub(ctx, rel)
+		if err != nil {
+			t.Fatalf("ensure repo fs: %v", err)
+		}
+		metricType, metricRepo := storageRootLabels(rel)
+		store, err := NewCommonStorageWithLabels(repoFS, metricType, metricRepo)
+		if err != nil {
+			t.Fatalf("failed to construct common storage: %v", err)
+		}
+		store.(*CommonStorageImpl).usePool(pool, rel)
+		stores = append(stores, store)
+	}
+	return root, pool, stores[0], stores[1]
+}
+
+func TestBlobPoolSharesContentAcrossRepositories(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	_, pool, hub, internal := newPoolFixture(t)
+
+	if n, err := hub.PutBlob(ctx, layerDigest, bytes.NewReader(layerPayload)); err != nil || n != int64(len(layerPayload)) {
+		t.Fatalf("PutBlob returned %d, %v", n, err)
+	}
+	if n, err := internal.PutBlob(ctx, layerDigest, bytes.NewReader(layerPayload)); err != nil || n != 0 {
+		t.Fatalf("expected second PutBlob to deduplicate, got %d, %v", n, err)
+	}
+	holders, err := pool.Holders(ctx, layerDigest)
+	if err != nil {
+		t.Fatalf("Holders failed: %v", err)
+	}
+	if len(holders) != 2 || holders[0] != "type/container/hub" || holders[1] != "type/container/internal" {
+		t.Fatalf("unexpected holders %v", holders)
+	}
+	reader, err := internal.OpenBlob(ctx, layerDigest)
+	if err != nil {
+		t.Fatalf("OpenBlob failed: %v", err)
+	}
+	defer reader.Close()
+	if body, _ := io.ReadAll(reader); !bytes.Equal(body, layerPayload) {
+		t.Fatalf("unexpected pooled content %q", body)
+	}
+
+	if deleted, err := pool.Release(ctx, layerDigest, "type/container/hub"); err != nil || deleted {
+		t.Fatalf("expected blob to survive first release, got %v, %v", deleted, err)
+	}
+	if _, err := internal.StatBlob(ctx, layerDigest); err != nil {
+		t.Fatalf("expected blob still held by internal: %v", err)
+	}
+	if deleted, err := pool.Release(ctx, layerDigest, "type/container/internal"); err != nil || !deleted {
+		t.Fatalf("expected last release to delete blob, got %v, %v", deleted, err)
+	}
+	if _, err := hub.StatBlob(ctx, layerDigest); err == nil {
+		t.Fatalf("expected blob to be gone after last release")
+	}
+}
+
+func TestBlobPoolMountRecordsReference(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	_, pool, hub, internal := newPoolFixture(t)
+	if _, err := hub.PutBlob(ctx, layerDigest, bytes.NewReader(layerPayload)); err != nil {
+		t.Fatalf("PutBlob failed: %v", err)
+	}
+	if err := internal.MountBlob(ctx, layerDigest, hub); err != nil {
+		t.Fatalf("MountBlob failed: %v", err)
+	}
+	if holders, _ := pool.Holders(ctx, layerDigest); len(holders) != 2 {
+		t.Fatalf("expected mount to add a reference, got %v", holders)
+	}
+	if err := internal.MountBlob(ctx, orphanDigest, hub); err == nil {
+		t.Fatalf("expected mounting an unknown blob to fail")
+	}
+}
+
+func TestBlobPoolHidesBlobsOtherRepositoriesHold(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	_, pool, hub, internal := newPoolFixture(t)
+	if _, err := internal.PutBlob(ctx, layerDigest, bytes.NewReader(layerPayload)); err != nil {
+		t.Fatalf("PutBlob failed: %v", err)
+	}
+	if _, err := hub.StatBlob(ctx, layerDigest); err == nil {
+		t.Fatalf("expected a blob held only by internal to be invisible to hub")
+	}
+	if _, err := hub.OpenBlob(ctx, layerDigest); err == nil {
+		t.Fatalf("expected a blob held only by internal not to open through hub")
+	}
+	if err := internal.MountBlob(ctx, layerDigest, hub); err == nil {
+		t.Fatalf("expected mounting from a repository that does not hold the blob to fail")
+	}
+	if _, err := hub.PutBlob(ctx, layerDigest, bytes.NewReader([]byte("forged"))); err == nil {
+		t.Fatalf("expected a reference to need the blob's content")
+	}
+	if holders, _ := pool.Holders(ctx, layerDigest); len(holders) != 1 {
+		t.Fatalf("expected internal to stay the only holder, got %v", holders)
+	}
+	if n, err := hub.PutBlob(ctx, layerDigest, bytes.NewReader(layerPayload)); err != nil || n != 0 {
+		t.Fatalf("expected verified content to deduplicate, got %d, %v", n, err)
+	}
+	if _, err := hub.StatBlob(ctx, layerDigest); err != nil {
+		t.Fatalf("expected blob to be visible once held: %v", err)
+	}
+}
+
+func TestCollectGarbageKeepsPooledBlobsReferencedByAnyRepository(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	root, pool, hub, internal := newPoolFixture(t)
+	for _, store := range []CommonStorage{hub, internal} {
+		for _, payload := range [][]byte{layerPayload, orphanPayload} {
+			if _, err := store.PutBlob(ctx, digestOf(payload), bytes.NewReader(payload)); err != nil {
+				t.Fatalf("PutBlob failed: %v", err)
+			}
+		}
+	}
+	_, err := internal.CreateVersion(ctx, Locator{Host: "local", Name: "team/app"}, &VersionMeta{
+		Files: []FileEntry{{Name: "layer", BlobKey: layerDigest, Size: int64(len(layerPayload))}},
+	})
+	if err != nil {
+		t.Fatalf("CreateVersion failed: %v", err)
+	}
+
+	later := GCOptions{Now: func() time.Time { return time.Now().Add(time.Hour) }}
+	report, err := CollectGarbage(ctx, root, later)
+	if err != nil {
+		t.Fatalf("CollectGarbage failed: %v", err)
+	}
+	if report.Deleted != 1 || report.DeletedKeys[0] != orphanDigest {
+		t.Fatalf("expected only the unreferenced pooled blob deleted, got %+v", report)
+	}
+	if _, err := internal.StatBlob(ctx, layerDigest); err != nil {
+		t.Fatalf("expected referenced blob to survive: %v", err)
+	}
+	if holders, _ := pool.Holders(ctx, layerDigest); len(holders) != 1 || holders[0] != "type/container/internal" {
+		t.Fatalf("expected stale hub reference dropped, got %v", holders)
+	}
+
+	fsck, err := CheckStorage(ctx, root, FsckOptions{})
+	if err != nil {
+		t.Fatalf("CheckStorage failed: %v", err)
+	}
+	if len(fsck.Issues) != 0 {
+		t.Fatalf("expected clean fsck with pooled blobs, got %+v", fsck.Issues)
+	}
+}
+
+func TestEvictReleasesPooledBlobs(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	_, pool, hub, internal := newPoolFixture(t)
+	for _, store := range []CommonStorage{hub, internal} {
+		if _, err := store.PutBlob(ctx, layerDigest, bytes.NewReader(layerPayload)); err != nil {
+			t.Fatalf("PutBlob failed: %v", err)
+		}
+	}
+	report, err := hub.Evict(ctx, &Retention{MaxBytes: 1})
+	if err != nil {
+		t.Fatalf("Evict failed: %v", err)
+	}
+	if report.Blobs != 1 {
+		t.Fatalf("expected pooled blob evicted from hub, got %+v", report)
+	}
+	if holders, _ := pool.Holders(ctx, layerDigest); len(holders) != 1 || holders[0] != "type/container/internal" {
+		t.Fatalf("expected only internal to hold the blob, got %v", holders)
+	}
+	if _, err := internal.StatBlob(ctx, layerDigest); err != nil {
+		t.Fatalf("expected blob to remain for internal: %v", err)
+	}
+}
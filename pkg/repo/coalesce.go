@@ -0,0 +1,246 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/davidjspooner/go-http-server/pkg/metric"
+)
+
+// Coalescer collapses concurrent upstream fetches for the same key so only one request reaches the upstream.
+// The zero value is ready to use; keys are scoped to the Coalescer, so each instance should own one.
+type Coalescer struct {
+	mu      sync.Mutex
+	calls   map[string]*coalescedCall
+	flights map[string]*Flight
+}
+
+type coalescedCall struct {
+	done chan struct{}
+	val  any
+	err  error
+}
+
+var coalescedRequests = metric.MustNewCounterVector(&metric.MetaData{
+	Name:      "repoxy_coalesced_requests_total",
+	Help:      "Upstream fetches grouped by whether the caller led or joined an in-flight request",
+	LabelKeys: []string{"role"},
+})
+
+// Do runs fn once for concurrent callers sharing key and hands every caller its result.
+// Followers whose leader was cancelled retry with their own context rather than inheriting the cancellation.
+func (c *Coalescer) Do(ctx context.Context, key string, fn func(ctx context.Context) (any, error)) (any, error) {
+	for {
+		c.mu.Lock()
+		if c.calls == nil {
+			c.calls = map[string]*coalescedCall{}
+		}
+		if call, ok := c.calls[key]; ok {
+			c.mu.Unlock()
+			_ = coalescedRequests.Inc("follower")
+			select {
+			case <-call.done:
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+			if errors.Is(call.err, context.Canceled) && ctx.Err() == nil {
+				continue
+			}
+			return call.val, call.err
+		}
+		call := &coalescedCall{done: make(chan struct{})}
+		c.calls[key] = call
+		c.mu.Unlock()
+		_ = coalescedRequests.Inc("leader")
+
+		call.val, call.err = fn(ctx)
+		c.mu.Lock()
+		delete(c.calls, key)
+		c.mu.Unlock()
+		close(call.done)
+		return call.val, call.err
+	}
+}
+
+// Join returns the in-flight stream for key and whether the caller leads it.
+// The leader must Publish, Write and Finish the flight; every caller must Release it.
+func (c *Coalescer) Join(key string) (*Flight, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.flights == nil {
+		c.flights = map[string]*Flight{}
+	}
+	if f, ok := c.flights[key]; ok {
+		f.mu.Lock()
+		f.refs++
+		f.mu.Unlock()
+		_ = coalescedRequests.Inc("follower")
+		return f, false
+	}
+	f := &Flight{owner: c, key: key, refs: 1}
+	f.cond = sync.NewCond(&f.mu)
+	c.flights[key] = f
+	_ = coalescedRequests.Inc("leader")
+	return f, true
+}
+
+// Flight is a single in-progress upstream response that followers can tail while the leader streams it.
+// The body is spooled to a temporary file so followers never hold the payload in memory.
+type Flight struct {
+	owner *Coalescer
+	key   string
+
+	mu        sync.Mutex
+	cond      *sync.Cond
+	published bool
+	status    int
+	header    http.Header
+	spool     *os.File
+	size      int64
+	done      bool
+	err       error
+	refs      int
+}
+
+// Publish records the upstream status and headers for followers.
+func (f *Flight) Publish(status int, header http.Header) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.status = status
+	f.header = header.Clone()
+	f.published = true
+	f.cond.Broadcast()
+}
+
+// Write appends p to the spooled body and wakes tailing followers.
+func (f *Flight) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	spool := f.spool
+	f.mu.Unlock()
+	if spool == nil {
+		created, err := os.CreateTemp("", "repoxy-flight-*")
+		if err != nil {
+			return 0, err
+		}
+		f.mu.Lock()
+		f.spool = created
+		f.mu.Unlock()
+		spool = created
+	}
+	n, err := spool.Write(p)
+	f.mu.Lock()
+	f.size += int64(n)
+	f.cond.Broadcast()
+	f.mu.Unlock()
+	return n, err
+}
+
+// Finish marks the flight complete; err is returned to followers still tailing the body.
+func (f *Flight) Finish(err error) {
+	f.owner.mu.Lock()
+	if f.owner.flights[f.key] == f {
+		delete(f.owner.flights, f.key)
+	}
+	f.owner.mu.Unlock()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.done = true
+	f.err = err
+	f.cond.Broadcast()
+	f.removeSpoolLocked()
+}
+
+// Release drops the caller's reference and removes the spool once the flight is finished and unused.
+func (f *Flight) Release() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.refs--
+	f.removeSpoolLocked()
+}
+
+func (f *Flight) removeSpoolLocked() {
+	if f.refs > 0 || !f.done || f.spool == nil {
+		return
+	}
+	name := f.spool.Name()
+	_ = f.spool.Close()
+	_ = os.Remove(name)
+	f.spool = nil
+}
+
+// Wait blocks until the leader has published a response or finished without one.
+func (f *Flight) Wait(ctx context.Context) (int, http.Header, error) {
+	stop := context.AfterFunc(ctx, f.wake)
+	defer stop()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for !f.published && !f.done {
+		if err := ctx.Err(); err != nil {
+			return 0, nil, err
+		}
+		f.cond.Wait()
+	}
+	if !f.published {
+		if f.err == nil {
+			return 0, nil, errors.New("upstream fetch finished without a response")
+		}
+		return 0, nil, f.err
+	}
+	return f.status, f.header.Clone(), nil
+}
+
+// NewReader tails the spooled body from the start, blocking for more data until the leader finishes.
+func (f *Flight) NewReader(ctx context.Context) io.Reader {
+	return &flightReader{ctx: ctx, flight: f}
+}
+
+func (f *Flight) wake() {
+	f.mu.Lock()
+	f.cond.Broadcast()
+	f.mu.Unlock()
+}
+
+type flightReader struct {
+	ctx    context.Context
+	flight *Flight
+	offset int64
+}
+
+func (r *flightReader) Read(p []byte) (int, error) {
+	f := r.flight
+	stop := context.AfterFunc(r.ctx, f.wake)
+	defer stop()
+	f.mu.Lock()
+	for r.offset >= f.size && !f.done {
+		if err := r.ctx.Err(); err != nil {
+			f.mu.Unlock()
+			return 0, err
+		}
+		f.cond.Wait()
+	}
+	available := f.size - r.offset
+	spool := f.spool
+	finished, finishErr := f.done, f.err
+	f.mu.Unlock()
+
+	if available <= 0 {
+		if finished && finishErr != nil {
+			return 0, finishErr
+		}
+		return 0, io.EOF
+	}
+	if int64(len(p)) > available {
+		p = p[:available]
+	}
+	n, err := spool.ReadAt(p, r.offset)
+	r.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
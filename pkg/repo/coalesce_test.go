@@ -0,0 +1,125 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"testing"
+)
+
+func TestCoalescerDoSharesInFlightResult(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	var c Coalescer
+	call := &coalescedCall{done: make(chan struct{})}
+	c.calls = map[string]*coalescedCall{"key": call}
+
+	result := make(chan any, 1)
+	go func() {
+		val, err := c.Do(ctx, "key", func(context.Context) (any, error) {
+			t.Errorf("follower must not run its own fetch")
+			return nil, nil
+		})
+		if err != nil {
+			t.Errorf("Do failed: %v", err)
+		}
+		result <- val
+	}()
+	call.val = "shared"
+	close(call.done)
+	if val := <-result; val != "shared" {
+		t.Fatalf("expected leader result, got %v", val)
+	}
+}
+
+func TestCoalescerDoRetriesAfterCancelledLeader(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	var c Coalescer
+	call := &coalescedCall{done: make(chan struct{})}
+	c.calls = map[string]*coalescedCall{"key": call}
+
+	type outcome struct {
+		val any
+		err error
+	}
+	result := make(chan outcome, 1)
+	go func() {
+		val, err := c.Do(ctx, "key", func(context.Context) (any, error) {
+			return "own", nil
+		})
+		result <- outcome{val, err}
+	}()
+	call.err = context.Canceled
+	c.mu.Lock()
+	delete(c.calls, "key")
+	c.mu.Unlock()
+	close(call.done)
+	if got := <-result; got.err != nil || got.val != "own" {
+		t.Fatalf("expected an independent fetch after the leader was cancelled, got %v, %v", got.val, got.err)
+	}
+}
+
+func TestFlightFollowersTailLeaderStream(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	var c Coalescer
+	leader, isLeader := c.Join("blob")
+	follower, isFollowerLeader := c.Join("blob")
+	if !isLeader || isFollowerLeader || leader != follower {
+		t.Fatalf("expected second Join to follow the first")
+	}
+
+	leader.Publish(http.StatusOK, http.Header{"Content-Type": []string{"application/octet-stream"}})
+	status, header, err := follower.Wait(ctx)
+	if err != nil || status != http.StatusOK || header.Get("Content-Type") != "application/octet-stream" {
+		t.Fatalf("unexpected published response: %d %v %v", status, header, err)
+	}
+	if _, err := leader.Write([]byte("hello ")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	reader := follower.NewReader(ctx)
+	buf := make([]byte, 6)
+	if _, err := io.ReadFull(reader, buf); err != nil || string(buf) != "hello " {
+		t.Fatalf("expected partial body, got %q (%v)", buf, err)
+	}
+
+	done := make(chan string, 1)
+	go func() {
+		rest, err := io.ReadAll(reader)
+		if err != nil {
+			t.Errorf("ReadAll failed: %v", err)
+		}
+		done <- string(rest)
+	}()
+	if _, err := leader.Write([]byte("world")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	leader.Finish(nil)
+	if rest := <-done; rest != "world" {
+		t.Fatalf("expected remainder of body, got %q", rest)
+	}
+	leader.Release()
+	follower.Release()
+
+	if _, isLeader := c.Join("blob"); !isLeader {
+		t.Fatalf("expected a finished flight to be replaced by a new leader")
+	}
+}
+
+func TestFlightFollowersSeeLeaderFailure(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	var c Coalescer
+	leader, _ := c.Join("blob")
+	follower, _ := c.Join("blob")
+	defer leader.Release()
+	defer follower.Release()
+
+	boom := errors.New("upstream unavailable")
+	leader.Finish(boom)
+	if _, _, err := follower.Wait(ctx); !errors.Is(err, boom) {
+		t.Fatalf("expected leader error, got %v", err)
+	}
+}
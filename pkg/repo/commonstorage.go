@@ -4,10 +4,14 @@ import (
 	"bytes"
 	"context"
 	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
 	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"io/fs"
 	"os"
@@ -26,14 +30,23 @@ const (
 	metadataIndexDir = "index"
 	blobsRootDir     = "blobs"
 	labelsFileName   = "labels.json"
+	accessFileName   = "access.json"
 	versionsDirName  = "versions"
+	touchedDirName   = "touched"
 
 	labelKind   = "registry.labels"
 	versionKind = "registry.version"
+	accessKind  = "registry.access"
+	touchKind   = "registry.touch"
+
+	labelHistoryLimit = 64 // previous versions remembered per label
 
 	gregorianUnixOffset = 122192928000000000 // 100-ns intervals between 1582-10-15 and 1970-01-01
 )
 
+// ErrDigestMismatch is reported when blob content does not hash to its blob key.
+var ErrDigestMismatch = errors.New("blob digest mismatch")
+
 // Locator identifies a logical object within the registry abstraction.
 type Locator struct {
 	Host      string
@@ -60,15 +73,19 @@ type VersionMeta struct {
 	CreatedAt time.Time   `json:"createdAt"`
 	Files     []FileEntry `json:"files"`
 	Manifest  string      `json:"manifest,omitempty"`
+	// Links lists the versions this version depends on, such as the platform manifests of a multi-arch index.
+	Links []string `json:"links,omitempty"`
 }
 
 // LabelBindings mirrors labels.json on disk.
 type LabelBindings struct {
-	Kind      string            `json:"kind"`
-	Host      string            `json:"host"`
-	Name      string            `json:"name"`
-	Labels    map[string]string `json:"labels"`
-	UpdatedAt time.Time         `json:"updatedAt"`
+	Kind   string            `json:"kind"`
+	Host   string            `json:"host"`
+	Name   string            `json:"name"`
+	Labels map[string]string `json:"labels"`
+	// History lists the versions each label previously pointed at, most recent first.
+	History   map[string][]string `json:"history,omitempty"`
+	UpdatedAt time.Time           `json:"updatedAt"`
 }
 
 // VersionSummary is a lightweight view for listing.
@@ -88,6 +105,7 @@ type CommonStorage interface {
 	OpenBlob(ctx context.Context, blobKey string) (io.ReadCloser, error)
 	StatBlob(ctx context.Context, blobKey string) (storage.FileMetaData, error)
 	PutBlob(ctx context.Context, blobKey string, r io.Reader) (int64, error)
+	MountBlob(ctx context.Context, blobKey string, from CommonStorage) error
 	CreateVersion(ctx context.Context, loc Locator, meta *VersionMeta) (Locator, error)
 	SetLabel(ctx context.Context, loc Locator) error
 	DeleteLabel(ctx context.Context, loc Locator) error
@@ -96,6 +114,11 @@ type CommonStorage interface {
 	OpenFile(ctx context.Context, rel string) (io.ReadCloser, error)
 	StatFile(ctx context.Context, rel string) (storage.FileMetaData, error)
 	EnsureSub(ctx context.Context, rel string) (storage.WritableFS, error)
+	RecordBlobAccess(ctx context.Context, blobKey string)
+	RecordVersionAccess(ctx context.Context, loc Locator)
+	RecordFileAccess(ctx context.Context, rel string)
+	Evict(ctx context.Context, policy *Retention) (*EvictionReport, error)
+	EvictBlobs(ctx context.Context, policy *Retention) (*EvictionReport, error)
 }
 
 // CommonStorageImpl implements CommonStorage using a WritableFS.
@@ -107,6 +130,13 @@ type CommonStorageImpl struct {
 	blobsFS    storage.WritableFS
 	metricType string
 	metricRepo string
+
+	accessMu           sync.Mutex
+	access             *accessLog
+	accessFlushPending bool
+
+	pool       *BlobPool // shared blob pool, when enabled
+	poolHolder string    // this root's path within the storage root, used for pool references
 }
 
 var (
@@ -145,6 +175,29 @@ func NewCommonStorageWithLabels(fs storage.WritableFS, metricType, metricRepo st
 	}, nil
 }
 
+// NewSubStorage constructs a CommonStorage rooted at rel within parent that shares parent's blob pool, if any.
+func NewSubStorage(ctx context.Context, parent CommonStorage, rel, metricType, metricRepo string) (CommonStorage, error) {
+	sub, err := parent.EnsureSub(ctx, rel)
+	if err != nil {
+		return nil, err
+	}
+	common, err := NewCommonStorageWithLabels(sub, metricType, metricRepo)
+	if err != nil {
+		return nil, err
+	}
+	if impl, ok := parent.(*CommonStorageImpl); ok && impl.pool != nil {
+		common.(*CommonStorageImpl).usePool(impl.pool, path.Join(impl.poolHolder, rel))
+	}
+	return common, nil
+}
+
+// usePool directs blob writes to pool, recording references under holder. Blobs already stored under this root's
+// blobs/ directory remain readable.
+func (s *CommonStorageImpl) usePool(pool *BlobPool, holder string) {
+	s.pool = pool
+	s.poolHolder = holder
+}
+
 // ListHosts returns all known hosts in ascending lexicographic order.
 func (s *CommonStorageImpl) ListHosts(ctx context.Context) ([]string, error) {
 	metaFS, err := s.metadataIndexFS(ctx)
@@ -317,6 +370,16 @@ func (s *CommonStorageImpl) OpenBlob(ctx context.Context, blobKey string) (io.Re
 	if err != nil {
 		return nil, err
 	}
+	if s.holdsPooled(ctx, blobKey) {
+		poolFS, err := s.pool.blobs(ctx)
+		if err != nil {
+			return nil, err
+		}
+		reader, err := poolFS.Open(ctx, rel)
+		if err == nil || !isNotFoundError(err) {
+			return reader, err
+		}
+	}
 	blobsFS, err := s.blobsRoot(ctx)
 	if err != nil {
 		return nil, err
@@ -330,6 +393,16 @@ func (s *CommonStorageImpl) StatBlob(ctx context.Context, blobKey string) (stora
 	if err != nil {
 		return nil, err
 	}
+	if s.holdsPooled(ctx, blobKey) {
+		poolFS, err := s.pool.blobs(ctx)
+		if err != nil {
+			return nil, err
+		}
+		info, err := poolFS.Stat(ctx, rel)
+		if err == nil || !isNotFoundError(err) {
+			return info, err
+		}
+	}
 	blobsFS, err := s.blobsRoot(ctx)
 	if err != nil {
 		return nil, err
@@ -337,7 +410,31 @@ func (s *CommonStorageImpl) StatBlob(ctx context.Context, blobKey string) (stora
 	return blobsFS.Stat(ctx, rel)
 }
 
+// holdsPooled reports whether this root holds a reference to blobKey in the shared pool. Roots only see the pooled
+// blobs they hold, so knowing a digest does not give access to content another repository stored.
+func (s *CommonStorageImpl) holdsPooled(ctx context.Context, blobKey string) bool {
+	return s.pool != nil && s.pool.holds(ctx, blobKey, s.poolHolder)
+}
+
+// MountBlob makes blobKey, already stored in from, available in s. When both share a blob pool and from holds the
+// blob only a reference is recorded; otherwise the content is copied and verified.
+func (s *CommonStorageImpl) MountBlob(ctx context.Context, blobKey string, from CommonStorage) error {
+	if other, ok := from.(*CommonStorageImpl); ok && s.pool != nil && other.pool == s.pool && other.holdsPooled(ctx, blobKey) {
+		if _, err := s.pool.statBlob(ctx, blobKey); err == nil {
+			return s.pool.AddRef(ctx, blobKey, s.poolHolder)
+		}
+	}
+	reader, err := from.OpenBlob(ctx, blobKey)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	_, err = s.PutBlob(ctx, blobKey, reader)
+	return err
+}
+
 // PutBlob stores blob content if it does not already exist and returns bytes written.
+// The stream is hashed while it is written and the blob is discarded with an EDIGEST error if it does not match blobKey.
 func (s *CommonStorageImpl) PutBlob(ctx context.Context, blobKey string, r io.Reader) (int64, error) {
 	if r == nil {
 		s.recordOp("put_blob", "error")
@@ -348,13 +445,46 @@ func (s *CommonStorageImpl) PutBlob(ctx context.Context, blobKey string, r io.Re
 		s.recordOp("put_blob", "error")
 		return 0, err
 	}
+	algo, expected, err := splitDigest(blobKey)
+	if err != nil {
+		s.recordOp("put_blob", "error")
+		return 0, err
+	}
+	hasher, err := newDigestHash(algo)
+	if err != nil {
+		s.recordOp("put_blob", "error")
+		return 0, err
+	}
 	blobsFS, err := s.blobsRoot(ctx)
+	if s.pool != nil && err == nil {
+		blobsFS, err = s.pool.blobs(ctx)
+	}
 	// Acquire stats first to avoid unnecessary writes.
 	if err != nil {
 		s.recordOp("put_blob", "error")
 		return 0, err
 	}
 	if _, err := blobsFS.Stat(ctx, rel); err == nil {
+		if s.pool != nil && !s.holdsPooled(ctx, blobKey) {
+			// A reference gives access to the pooled copy, so the caller has to prove it has the content.
+			if _, err := io.Copy(hasher, r); err != nil {
+				s.recordOp("put_blob", "error")
+				return 0, err
+			}
+			if actual := hex.EncodeToString(hasher.Sum(nil)); actual != expected {
+				s.recordOp("put_blob", "digest_mismatch")
+				return 0, storage.Errorf(blobsFS, rel, "EDIGEST", ErrDigestMismatch).WithMessage("blob digest mismatch: expected %s, computed %s:%s", blobKey, algo, actual)
+			}
+		}
+		if s.pool != nil {
+			err = s.addPoolRef(ctx, blobKey)
+		} else {
+			err = s.touchBlob(ctx, rel)
+		}
+		if err != nil {
+			s.recordOp("put_blob", "error")
+			return 0, err
+		}
 		s.recordOp("put_blob", "success")
 		s.recordBytes("put_blob", 0)
 		return 0, nil
@@ -366,27 +496,45 @@ func (s *CommonStorageImpl) PutBlob(ctx context.Context, blobKey string, r io.Re
 		s.recordOp("put_blob", "error")
 		return 0, err
 	}
-	w := storage.NewWriter(ctx, blobsFS, rel, nil)
+	tmp := fmt.Sprintf("%s.tmp-%d", rel, time.Now().UnixNano())
+	w := storage.NewWriter(ctx, blobsFS, tmp, nil)
 	defer func() {
 		if w != nil {
 			_ = w.CloseWithError(fmt.Errorf("aborted"))
 		}
 	}()
-	n, err := io.Copy(w, r)
+	n, err := io.Copy(io.MultiWriter(w, hasher), r)
 	if err != nil {
 		_ = w.CloseWithError(err)
 		w = nil
+		_ = blobsFS.Delete(ctx, tmp, nil)
 		s.recordBytes("put_blob", 0)
 		s.recordOp("put_blob", "error")
 		return n, err
 	}
 	if err := w.Close(); err != nil {
 		w = nil
+		_ = blobsFS.Delete(ctx, tmp, nil)
 		s.recordBytes("put_blob", 0)
 		s.recordOp("put_blob", "error")
 		return n, err
 	}
 	w = nil
+	actual := hex.EncodeToString(hasher.Sum(nil))
+	if actual != expected {
+		_ = blobsFS.Delete(ctx, tmp, nil)
+		s.recordOp("put_blob", "digest_mismatch")
+		return n, storage.Errorf(blobsFS, rel, "EDIGEST", ErrDigestMismatch).WithMessage("blob digest mismatch: expected %s, computed %s:%s", blobKey, algo, actual)
+	}
+	if err := blobsFS.Rename(ctx, tmp, rel); err != nil {
+		_ = blobsFS.Delete(ctx, tmp, nil)
+		s.recordOp("put_blob", "error")
+		return n, err
+	}
+	if err := s.addPoolRef(ctx, blobKey); err != nil {
+		s.recordOp("put_blob", "error")
+		return n, err
+	}
 	s.recordBytes("put_blob", n)
 	s.recordOp("put_blob", "success")
 	return n, nil
@@ -473,6 +621,9 @@ func (s *CommonStorageImpl) SetLabel(ctx context.Context, loc Locator) error {
 	labelDoc.Kind = labelKind
 	labelDoc.Host = host
 	labelDoc.Name = name
+	if previous := labelDoc.Labels[loc.Label]; previous != "" && previous != versionID {
+		labelDoc.pushHistory(loc.Label, previous)
+	}
 	labelDoc.Labels[loc.Label] = versionID
 	labelDoc.UpdatedAt = time.Now().UTC()
 
@@ -503,15 +654,18 @@ func (s *CommonStorageImpl) DeleteLabel(ctx context.Context, loc Locator) error
 		}
 		return err
 	}
-	if _, exists := labelDoc.Labels[loc.Label]; !exists {
+	previous, exists := labelDoc.Labels[loc.Label]
+	if !exists {
 		return nil
 	}
+	labelDoc.pushHistory(loc.Label, previous)
 	delete(labelDoc.Labels, loc.Label)
 	labelDoc.UpdatedAt = time.Now().UTC()
 	return s.writeLabels(ctx, metaFS, host, name, labelDoc)
 }
 
-// DeleteVersion removes a version metadata file, leaving blobs for a later GC pass.
+// DeleteVersion removes a version metadata file and drops the version from label bindings and histories, leaving
+// blobs for a later CollectGarbage pass.
 func (s *CommonStorageImpl) DeleteVersion(ctx context.Context, loc Locator) error {
 	host, name, err := sanitizeLocator(loc)
 	if err != nil {
@@ -534,7 +688,8 @@ func (s *CommonStorageImpl) DeleteVersion(ctx context.Context, loc Locator) erro
 	if err != nil && !isNotFoundError(err) {
 		return err
 	}
-	return nil
+	s.forgetAccess(func(log *accessLog) map[string]*AccessRecord { return log.Versions }, versionAccessKey(host, name, versionID))
+	return s.pruneLabelsLocked(ctx, metaFS, host, name, map[string]string{versionID: ""})
 }
 
 // StoreFile writes a file relative to the CommonStorage root, creating parent directories as needed.
@@ -637,7 +792,30 @@ func (s *CommonStorageImpl) metadataIndexFS(ctx context.Context) (storage.Writab
 	return s.metadataFS, nil
 }
 
-// blobsRoot returns the writable FS rooted at blobs/.
+// addPoolRef records this root as a holder of a pooled blob.
+func (s *CommonStorageImpl) addPoolRef(ctx context.Context, blobKey string) error {
+	if s.pool == nil {
+		return nil
+	}
+	return s.pool.AddRef(ctx, blobKey, s.poolHolder)
+}
+
+// blobTouch mirrors metadata/touched/<blob path>, written when PutBlob finds the blob already stored. Its modification
+// time restarts the blob's gc grace period, so a blob uploaded again for a version not recorded yet is not swept.
+type blobTouch struct {
+	Kind      string    `json:"kind"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+func (s *CommonStorageImpl) touchBlob(ctx context.Context, rel string) error {
+	marker := path.Join(metadataRootDir, touchedDirName, rel)
+	if err := ensureParentDir(ctx, s.fs, marker); err != nil {
+		return err
+	}
+	return writeJSONAtomic(ctx, s.fs, marker, &blobTouch{Kind: touchKind, UpdatedAt: time.Now().UTC()})
+}
+
+// blobsRoot returns the writable FS rooted at this root's own blobs/ directory.
 func (s *CommonStorageImpl) blobsRoot(ctx context.Context) (storage.WritableFS, error) {
 	s.pathMu.Lock()
 	defer s.pathMu.Unlock()
@@ -705,6 +883,26 @@ func (s *CommonStorageImpl) writeLabels(ctx context.Context, metaFS storage.Writ
 	return writeJSONAtomic(ctx, nameFS, labelsFileName, bindings)
 }
 
+// pushHistory records versionID as the most recent previous binding of label.
+func (b *LabelBindings) pushHistory(label, versionID string) {
+	if versionID == "" {
+		return
+	}
+	if b.History == nil {
+		b.History = map[string][]string{}
+	}
+	history := []string{versionID}
+	for _, id := range b.History[label] {
+		if id != versionID {
+			history = append(history, id)
+		}
+	}
+	if len(history) > labelHistoryLimit {
+		history = history[:labelHistoryLimit]
+	}
+	b.History[label] = history
+}
+
 func (s *CommonStorageImpl) readVersionMeta(ctx context.Context, metaFS storage.WritableFS, rel string) (*VersionMeta, error) {
 	var meta VersionMeta
 	if err := readJSONFile(ctx, metaFS, rel, &meta); err != nil {
@@ -780,6 +978,33 @@ func splitDigest(digest string) (algo, hex string, err error) {
 	return algo, hex, nil
 }
 
+// newDigestHash returns the hash implementation for a supported digest algorithm.
+func newDigestHash(algo string) (hash.Hash, error) {
+	switch algo {
+	case "sha256":
+		return sha256.New(), nil
+	case "sha512":
+		return sha512.New(), nil
+	default:
+		return nil, fmt.Errorf("unsupported digest algorithm %q", algo)
+	}
+}
+
+// IsDigestMismatch reports whether err was caused by content not matching its digest.
+func IsDigestMismatch(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, ErrDigestMismatch) {
+		return true
+	}
+	var serr *storage.Error
+	if errors.As(err, &serr) {
+		return serr.Code == "EDIGEST" || errors.Is(serr.Inner, ErrDigestMismatch)
+	}
+	return false
+}
+
 func ensureParentDir(ctx context.Context, fs storage.WritableFS, rel string) error {
 	dir := path.Dir(rel)
 	if dir == "." || dir == "/" {
@@ -3,6 +3,9 @@ package repo
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
 	"io"
 	"testing"
 
@@ -12,6 +15,11 @@ import (
 
 const sampleDigest = "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcd"
 
+func digestOf(payload []byte) string {
+	sum := sha256.Sum256(payload)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
 func newCommonStorage(t *testing.T) CommonStorage {
 	t.Helper()
 	fsRO, err := storage.OpenFileSystemFromString(context.Background(), "mem://", storage.Config{})
@@ -45,14 +53,15 @@ func TestCommonStorageBlobLifecycle(t *testing.T) {
 	store := newCommonStorage(t)
 
 	payload := []byte("hello blob")
-	n, err := store.PutBlob(ctx, sampleDigest, bytes.NewReader(payload))
+	digest := digestOf(payload)
+	n, err := store.PutBlob(ctx, digest, bytes.NewReader(payload))
 	if err != nil {
 		t.Fatalf("PutBlob failed: %v", err)
 	}
 	if n != int64(len(payload)) {
 		t.Fatalf("expected %d bytes written, got %d", len(payload), n)
 	}
-	rc, err := store.OpenBlob(ctx, sampleDigest)
+	rc, err := store.OpenBlob(ctx, digest)
 	if err != nil {
 		t.Fatalf("OpenBlob failed: %v", err)
 	}
@@ -64,7 +73,7 @@ func TestCommonStorageBlobLifecycle(t *testing.T) {
 	if !bytes.Equal(data, payload) {
 		t.Fatalf("expected %q, got %q", payload, data)
 	}
-	info, err := store.StatBlob(ctx, sampleDigest)
+	info, err := store.StatBlob(ctx, digest)
 	if err != nil {
 		t.Fatalf("StatBlob failed: %v", err)
 	}
@@ -72,7 +81,7 @@ func TestCommonStorageBlobLifecycle(t *testing.T) {
 		t.Fatalf("expected size %d, got %d", len(payload), info.Size())
 	}
 	// Second write should be a no-op without error.
-	n, err = store.PutBlob(ctx, sampleDigest, bytes.NewReader(payload))
+	n, err = store.PutBlob(ctx, digest, bytes.NewReader(payload))
 	if err != nil {
 		t.Fatalf("second PutBlob failed: %v", err)
 	}
@@ -81,6 +90,42 @@ func TestCommonStorageBlobLifecycle(t *testing.T) {
 	}
 }
 
+func TestCommonStoragePutBlobRejectsDigestMismatch(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	store := newCommonStorage(t)
+
+	_, err := store.PutBlob(ctx, sampleDigest, bytes.NewReader([]byte("tampered")))
+	if err == nil {
+		t.Fatalf("expected digest mismatch error")
+	}
+	if !IsDigestMismatch(err) {
+		t.Fatalf("expected IsDigestMismatch, got %v", err)
+	}
+	if _, err := store.StatBlob(ctx, sampleDigest); err == nil {
+		t.Fatalf("mismatched blob must not be stored")
+	}
+	if _, err := store.PutBlob(ctx, "md5:0123456789abcdef", bytes.NewReader([]byte("x"))); err == nil {
+		t.Fatalf("expected unsupported algorithm error")
+	}
+}
+
+func TestCommonStoragePutBlobSupportsSHA512(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	store := newCommonStorage(t)
+
+	payload := []byte("sha512 payload")
+	sum := sha512.Sum512(payload)
+	digest := "sha512:" + hex.EncodeToString(sum[:])
+	if _, err := store.PutBlob(ctx, digest, bytes.NewReader(payload)); err != nil {
+		t.Fatalf("PutBlob failed: %v", err)
+	}
+	if _, err := store.StatBlob(ctx, digest); err != nil {
+		t.Fatalf("StatBlob failed: %v", err)
+	}
+}
+
 func TestCommonStorageStoreFile(t *testing.T) {
 	t.Parallel()
 	ctx := context.Background()
@@ -7,6 +7,7 @@ import (
 
 	"github.com/davidjspooner/go-fs/pkg/storage"
 	"github.com/davidjspooner/go-http-server/pkg/listener"
+	"github.com/davidjspooner/repoxy/pkg/auth"
 	"gopkg.in/yaml.v3"
 )
 
@@ -36,6 +37,55 @@ type Repo struct {
 	Description string   `yaml:"description,omitempty"`
 	Upstream    Upstream `yaml:"upstream"`
 	Mappings    []string `yaml:"mappings"`
+	// Retention optionally bounds the cached content kept for this repository.
+	Retention *Retention `yaml:"retention,omitempty"`
+	// Freshness controls how long mutable upstream metadata is served from cache.
+	Freshness *Freshness `yaml:"freshness,omitempty"`
+	// Mode selects when upstream is contacted: online (default), prefer-cache, offline or hosted.
+	Mode string `yaml:"mode,omitempty"`
+	// Policy optionally requires signed content before it is cached or served.
+	Policy *Policy `yaml:"policy,omitempty"`
+	// Rules optionally allow or deny requests by name, tag or version, digest and platform.
+	Rules *Rules `yaml:"rules,omitempty"`
+}
+
+// Upstream access modes for Repo.Mode.
+const (
+	// ModeOnline always asks upstream first and falls back to cache when it fails.
+	ModeOnline = "online"
+	// ModePreferCache answers from cache when possible and only contacts upstream on a miss.
+	ModePreferCache = "prefer-cache"
+	// ModeOffline never contacts upstream.
+	ModeOffline = "offline"
+	// ModeHosted never contacts upstream and accepts pushes; the repository is the origin of its content.
+	ModeHosted = "hosted"
+)
+
+// UpstreamMode returns the configured upstream access mode, defaulting to ModeOnline.
+func (r *Repo) UpstreamMode() string {
+	if r == nil || r.Mode == "" {
+		return ModeOnline
+	}
+	return r.Mode
+}
+
+// ContactsUpstream reports whether the configured mode ever sends requests to upstream.
+func (r *Repo) ContactsUpstream() bool {
+	switch r.UpstreamMode() {
+	case ModeOffline, ModeHosted:
+		return false
+	default:
+		return true
+	}
+}
+
+func (r *Repo) validateMode() error {
+	switch r.UpstreamMode() {
+	case ModeOnline, ModePreferCache, ModeOffline, ModeHosted:
+		return nil
+	default:
+		return fmt.Errorf("%w: unknown mode %q", ErrInvalidRepoConfig, r.Mode)
+	}
 }
 
 // Storage represents the storage configuration for the proxy.
@@ -45,6 +95,8 @@ type Repo struct {
 type Storage struct {
 	URL    string         `yaml:"url"`
 	Config storage.Config `yaml:"config"`
+	// SharedBlobs stores blobs from every repository in one content-addressed pool at shared/ in the storage root.
+	SharedBlobs bool `yaml:"shared_blobs,omitempty"`
 }
 
 // ConfigFile represents the overall configuration for repoxy
@@ -52,6 +104,11 @@ type ConfigFile struct {
 	Server       *listener.Group `yaml:"server"`
 	Storage      *Storage        `yaml:"storage"`
 	Repositories []*Repo         `yaml:"repos"`
+	GC           *GCConfig       `yaml:"gc,omitempty"`
+	// Auth optionally requires the proxy's own clients to authenticate.
+	Auth *auth.Config `yaml:"auth,omitempty"`
+	// Access optionally restricts which principals may read, write or administer each repository.
+	Access *AccessControl `yaml:"rbac,omitempty"`
 }
 
 func loadConfig(filename string) (*ConfigFile, error) {
@@ -106,6 +163,24 @@ func LoadConfigs(fileglobs ...string) (*ConfigFile, error) {
 				}
 				mergedConfig.Storage = cfg.Storage // shallow copy
 			}
+			if cfg.GC != nil {
+				if mergedConfig.GC != nil {
+					return nil, fmt.Errorf("multiple gc configurations found")
+				}
+				mergedConfig.GC = cfg.GC // shallow copy
+			}
+			if cfg.Auth != nil {
+				if mergedConfig.Auth != nil {
+					return nil, fmt.Errorf("multiple auth configurations found")
+				}
+				mergedConfig.Auth = cfg.Auth // shallow copy
+			}
+			if cfg.Access != nil {
+				if mergedConfig.Access != nil {
+					return nil, fmt.Errorf("multiple rbac configurations found")
+				}
+				mergedConfig.Access = cfg.Access // shallow copy
+			}
 			mergedConfig.Repositories = append(mergedConfig.Repositories, cfg.Repositories...)
 		}
 	}
@@ -118,5 +193,9 @@ func LoadConfigs(fileglobs ...string) (*ConfigFile, error) {
 	if mergedConfig.Storage == nil {
 		return nil, fmt.Errorf("no storage configuration found in configuration files	")
 	}
+	if mergedConfig.Auth != nil && mergedConfig.Access.grantsAnonymous() {
+		// With auth configured every client must authenticate, so such a grant would silently never apply.
+		return nil, fmt.Errorf("%w: rbac grants to %q cannot be used with auth", ErrInvalidRepoConfig, PrincipalAnonymous)
+	}
 	return mergedConfig, nil
 }
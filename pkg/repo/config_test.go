@@ -1,6 +1,7 @@
 package repo
 
 import (
+	"errors"
 	"os"
 	"path/filepath"
 	"strings"
@@ -57,3 +58,43 @@ repos:
 		t.Fatalf("unexpected repo name %q", cfg.Repositories[0].Name)
 	}
 }
+
+func TestLoadConfigsRejectsAnonymousGrantsWithAuth(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	base := `
+server:
+  listeners:
+    - url: http://127.0.0.1
+      port: 8080
+storage:
+  url: mem://
+  config: {}
+repos:
+  - name: alpine
+    type: container
+    mode: offline
+rbac:
+  grants:
+    - principals: [anonymous]
+      actions: [read]
+`
+	withAuth := base + `
+auth:
+  tokens:
+    - name: ci
+      token: secret
+`
+	for name, config := range map[string]string{"without-auth.yaml": base, "with-auth.yaml": withAuth} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(config), 0o644); err != nil {
+			t.Fatalf("failed to write config: %v", err)
+		}
+	}
+	if _, err := LoadConfigs(filepath.Join(dir, "without-auth.yaml")); err != nil {
+		t.Fatalf("expected anonymous grants without auth to load, got %v", err)
+	}
+	if _, err := LoadConfigs(filepath.Join(dir, "with-auth.yaml")); !errors.Is(err, ErrInvalidRepoConfig) {
+		t.Fatalf("expected anonymous grants with auth to be rejected, got %v", err)
+	}
+}
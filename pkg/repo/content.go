@@ -0,0 +1,86 @@
+package repo
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/davidjspooner/go-fs/pkg/storage"
+)
+
+// ServeContent writes cached content honouring Range, If-Range, If-None-Match and If-Modified-Since. etag is the
+// unquoted entity tag (usually the content digest) and may be empty; info supplies the size and modification time and
+// may be nil. Seekable content is served through http.ServeContent, which answers single and multi-range requests with
+// 206; other content only gets the conditional checks and is always sent whole. Callers set Content-Type and any
+// protocol headers beforehand. It returns the number of body bytes written.
+func ServeContent(w http.ResponseWriter, r *http.Request, content io.Reader, info storage.FileMetaData, etag string) int64 {
+	if etag != "" {
+		w.Header().Set("ETag", strconv.Quote(etag))
+	}
+	var modTime time.Time
+	if info != nil {
+		modTime = info.ModTime()
+	}
+	cw := &countingWriter{ResponseWriter: w}
+	if seeker, ok := content.(io.ReadSeeker); ok {
+		http.ServeContent(cw, r, "", modTime, seeker)
+		return cw.n
+	}
+	if !modTime.IsZero() {
+		w.Header().Set("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+	}
+	if notModified(r, etag, modTime) {
+		w.Header().Del("Content-Type")
+		w.Header().Del("Content-Length")
+		w.WriteHeader(http.StatusNotModified)
+		return 0
+	}
+	if info != nil {
+		w.Header().Set("Content-Length", strconv.FormatInt(info.Size(), 10))
+	}
+	w.WriteHeader(http.StatusOK)
+	if r.Method == http.MethodHead {
+		return 0
+	}
+	_, _ = io.Copy(cw, content)
+	return cw.n
+}
+
+// notModified evaluates If-None-Match (preferred) or If-Modified-Since for a GET or HEAD request.
+func notModified(r *http.Request, etag string, modTime time.Time) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		if etag == "" {
+			return false
+		}
+		for _, candidate := range strings.Split(inm, ",") {
+			candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+			if candidate == "*" || candidate == strconv.Quote(etag) {
+				return true
+			}
+		}
+		return false
+	}
+	ims := r.Header.Get("If-Modified-Since")
+	if ims == "" || modTime.IsZero() {
+		return false
+	}
+	since, err := http.ParseTime(ims)
+	return err == nil && !modTime.Truncate(time.Second).After(since)
+}
+
+// countingWriter records how many body bytes reach the client.
+type countingWriter struct {
+	http.ResponseWriter
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.ResponseWriter.Write(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,86 @@
+package repo
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func serveContent(t *testing.T, content io.Reader, headers map[string]string) *httptest.ResponseRecorder {
+	t.Helper()
+	ctx := context.Background()
+	store := newCommonStorage(t)
+	if _, err := store.StoreFile(ctx, "content", strings.NewReader("0123456789")); err != nil {
+		t.Fatalf("StoreFile failed: %v", err)
+	}
+	info, err := store.StatFile(ctx, "content")
+	if err != nil {
+		t.Fatalf("StatFile failed: %v", err)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/blob", nil)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	rr := httptest.NewRecorder()
+	rr.Header().Set("Content-Type", "application/octet-stream")
+	ServeContent(rr, req, content, info, "sha256:abc")
+	return rr
+}
+
+func TestServeContentHonoursRanges(t *testing.T) {
+	t.Parallel()
+	payload := []byte("0123456789")
+	rr := serveContent(t, bytes.NewReader(payload), map[string]string{"Range": "bytes=4-"})
+	if rr.Code != http.StatusPartialContent || rr.Body.String() != "456789" || rr.Header().Get("Content-Range") != "bytes 4-9/10" {
+		t.Fatalf("unexpected range response: %d %q %q", rr.Code, rr.Body.String(), rr.Header().Get("Content-Range"))
+	}
+	if rr.Header().Get("ETag") != `"sha256:abc"` {
+		t.Fatalf("unexpected etag %q", rr.Header().Get("ETag"))
+	}
+
+	rr = serveContent(t, bytes.NewReader(payload), map[string]string{"Range": "bytes=0-1,8-9"})
+	if rr.Code != http.StatusPartialContent || !strings.HasPrefix(rr.Header().Get("Content-Type"), "multipart/byteranges") {
+		t.Fatalf("expected multipart range response, got %d %q", rr.Code, rr.Header().Get("Content-Type"))
+	}
+
+	rr = serveContent(t, bytes.NewReader(payload), map[string]string{"Range": "bytes=4-", "If-Range": `"sha256:other"`})
+	if rr.Code != http.StatusOK || rr.Body.String() != string(payload) {
+		t.Fatalf("expected full body when If-Range does not match, got %d", rr.Code)
+	}
+
+	rr = serveContent(t, bytes.NewReader(payload), map[string]string{"Range": "bytes=20-"})
+	if rr.Code != http.StatusRequestedRangeNotSatisfiable {
+		t.Fatalf("expected 416, got %d", rr.Code)
+	}
+}
+
+func TestServeContentConditionalRequests(t *testing.T) {
+	t.Parallel()
+	for _, seekable := range []bool{true, false} {
+		content := func() io.Reader {
+			if seekable {
+				return bytes.NewReader([]byte("0123456789"))
+			}
+			return io.MultiReader(strings.NewReader("0123456789"))
+		}
+		if rr := serveContent(t, content(), map[string]string{"If-None-Match": `"sha256:abc"`}); rr.Code != http.StatusNotModified || rr.Body.Len() != 0 {
+			t.Fatalf("seekable=%v: expected 304 for matching etag, got %d", seekable, rr.Code)
+		}
+		if rr := serveContent(t, content(), map[string]string{"If-Modified-Since": time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)}); rr.Code != http.StatusNotModified {
+			t.Fatalf("seekable=%v: expected 304 for unmodified content, got %d", seekable, rr.Code)
+		}
+		rr := serveContent(t, content(), map[string]string{"If-None-Match": `"sha256:old"`})
+		if rr.Code != http.StatusOK || rr.Body.String() != "0123456789" || rr.Header().Get("Last-Modified") == "" {
+			t.Fatalf("seekable=%v: expected full body, got %d %q", seekable, rr.Code, rr.Body.String())
+		}
+	}
+	rr := serveContent(t, io.MultiReader(strings.NewReader("0123456789")), map[string]string{"Range": "bytes=4-"})
+	if rr.Code != http.StatusOK || rr.Body.String() != "0123456789" {
+		t.Fatalf("expected non-seekable content to ignore Range, got %d", rr.Code)
+	}
+}
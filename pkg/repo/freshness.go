@@ -0,0 +1,86 @@
+package repo
+
+import (
+	"fmt"
+	"time"
+)
+
+// Default freshness windows for mutable upstream metadata.
+const (
+	DefaultMetadataTTL          = time.Hour
+	DefaultMetadataStaleIfError = 7 * 24 * time.Hour
+)
+
+// Freshness controls how long mutable upstream metadata (tag lists, version lists, manifests) is served from cache.
+type Freshness struct {
+	// TTL is how long a cached entry is served without contacting upstream.
+	TTL time.Duration `yaml:"ttl,omitempty"`
+	// StaleWhileRevalidate serves an expired entry for this long past TTL while it is refreshed in the background.
+	StaleWhileRevalidate time.Duration `yaml:"stale_while_revalidate,omitempty"`
+	// StaleIfError serves an expired entry for this long past TTL when upstream is unreachable or failing.
+	StaleIfError time.Duration `yaml:"stale_if_error,omitempty"`
+}
+
+// CacheState classifies a cached entry against a Freshness policy.
+type CacheState int
+
+const (
+	// CacheMissing means there is no usable cached entry.
+	CacheMissing CacheState = iota
+	// CacheFresh entries are served without contacting upstream.
+	CacheFresh
+	// CacheRevalidate entries are served while a background refresh runs.
+	CacheRevalidate
+	// CacheStale entries must be refetched and are only served if upstream fails.
+	CacheStale
+)
+
+// Validate reports configuration errors in the freshness block.
+func (f *Freshness) Validate() error {
+	if f == nil {
+		return nil
+	}
+	if f.TTL < 0 || f.StaleWhileRevalidate < 0 || f.StaleIfError < 0 {
+		return fmt.Errorf("%w: freshness windows must not be negative", ErrInvalidRepoConfig)
+	}
+	return nil
+}
+
+func (f *Freshness) ttl() time.Duration {
+	if f == nil || f.TTL <= 0 {
+		return DefaultMetadataTTL
+	}
+	return f.TTL
+}
+
+func (f *Freshness) staleIfError() time.Duration {
+	if f == nil || f.StaleIfError <= 0 {
+		return DefaultMetadataStaleIfError
+	}
+	return f.StaleIfError
+}
+
+// State classifies an entry fetched at fetchedAt. A zero fetchedAt is treated as missing.
+func (f *Freshness) State(fetchedAt, now time.Time) CacheState {
+	if fetchedAt.IsZero() {
+		return CacheMissing
+	}
+	age := now.Sub(fetchedAt)
+	ttl := f.ttl()
+	switch {
+	case age < ttl:
+		return CacheFresh
+	case f != nil && age < ttl+f.StaleWhileRevalidate:
+		return CacheRevalidate
+	default:
+		return CacheStale
+	}
+}
+
+// ServeStaleOnError reports whether an entry fetched at fetchedAt may stand in for a failed upstream fetch.
+func (f *Freshness) ServeStaleOnError(fetchedAt, now time.Time) bool {
+	if fetchedAt.IsZero() {
+		return false
+	}
+	return now.Sub(fetchedAt) < f.ttl()+f.staleIfError()
+}
@@ -0,0 +1,463 @@
+package repo
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/davidjspooner/go-fs/pkg/storage"
+)
+
+// DefaultFsckTempGrace protects temporary files that may still be written by a running server.
+const DefaultFsckTempGrace = time.Hour
+
+// Fsck issue kinds.
+const (
+	FsckTempFile       = "temp_file"
+	FsckCorruptBlob    = "corrupt_blob"
+	FsckOrphanBlob     = "orphan_blob"
+	FsckInvalidVersion = "invalid_version"
+	FsckMissingBlob    = "missing_blob"
+	FsckUncachedBlob   = "uncached_blob"
+	FsckInvalidLabels  = "invalid_labels"
+	FsckDanglingLabel  = "dangling_label"
+)
+
+// FsckOptions tunes a storage integrity check.
+type FsckOptions struct {
+	// Repair removes temp files and corrupt blobs, drops dangling labels and re-fetches missing blobs when Fetch is set.
+	Repair bool
+	// TempGrace is the minimum age of a temp file before it is reported.
+	TempGrace time.Duration
+	// Fetch re-populates a missing blob for the storage root at root (relative to the storage root).
+	Fetch func(ctx context.Context, root string, loc Locator, blobKey string) error
+	// Now overrides the clock used to evaluate TempGrace.
+	Now func() time.Time
+
+	root string // storage root being checked, passed to Fetch
+}
+
+// FsckIssue describes a single integrity problem.
+type FsckIssue struct {
+	Root     string `json:"root"`
+	Kind     string `json:"kind"`
+	Path     string `json:"path,omitempty"`
+	Detail   string `json:"detail,omitempty"`
+	Repaired bool   `json:"repaired"`
+}
+
+// FsckReport summarises an integrity check.
+type FsckReport struct {
+	Roots    int         `json:"roots"`
+	Blobs    int         `json:"blobs"`
+	Versions int         `json:"versions"`
+	Labels   int         `json:"labels"`
+	Repaired int         `json:"repaired"`
+	Issues   []FsckIssue `json:"issues"`
+}
+
+// Unresolved counts issues that were neither repaired nor merely informational (orphans are left to CollectGarbage and
+// digests named only inside an inline manifest, such as layers never pulled, are fetched on demand).
+func (r *FsckReport) Unresolved() int {
+	n := 0
+	for _, issue := range r.Issues {
+		if !issue.Repaired && issue.Kind != FsckOrphanBlob && issue.Kind != FsckUncachedBlob {
+			n++
+		}
+	}
+	return n
+}
+
+func (r *FsckReport) add(root string, other *FsckReport) {
+	if other == nil {
+		return
+	}
+	r.Roots += other.Roots
+	r.Blobs += other.Blobs
+	r.Versions += other.Versions
+	r.Labels += other.Labels
+	r.Repaired += other.Repaired
+	for _, issue := range other.Issues {
+		issue.Root = root
+		r.Issues = append(r.Issues, issue)
+	}
+}
+
+func (r *FsckReport) issue(kind, rel, detail string, repaired bool) {
+	r.Issues = append(r.Issues, FsckIssue{Kind: kind, Path: rel, Detail: detail, Repaired: repaired})
+	if repaired {
+		r.Repaired++
+	}
+}
+
+func (o FsckOptions) tempCutoff() time.Time {
+	now := time.Now
+	if o.Now != nil {
+		now = o.Now
+	}
+	grace := o.TempGrace
+	if grace <= 0 {
+		grace = DefaultFsckTempGrace
+	}
+	return now().Add(-grace)
+}
+
+// CheckStorage verifies every CommonStorage root beneath type/ in the storage root, followed by the shared blob pool
+// when one exists.
+func CheckStorage(ctx context.Context, root storage.WritableFS, opts FsckOptions) (*FsckReport, error) {
+	if root == nil {
+		return nil, fmt.Errorf("fsck requires a storage root")
+	}
+	roots, err := findStorageRoots(ctx, root, "type")
+	if err != nil {
+		return nil, err
+	}
+	pool, err := findBlobPool(ctx, root)
+	if err != nil {
+		return nil, err
+	}
+	report := &FsckReport{}
+	referenced := map[string]struct{}{}
+	for _, rel := range roots {
+		sub, err := root.EnsureSub(ctx, rel)
+		if err != nil {
+			return report, err
+		}
+		metricType, metricRepo := storageRootLabels(rel)
+		common, err := NewCommonStorageWithLabels(sub, metricType, metricRepo)
+		if err != nil {
+			return report, err
+		}
+		impl := common.(*CommonStorageImpl)
+		if pool != nil {
+			impl.usePool(pool, rel)
+		}
+		rootOpts := opts
+		rootOpts.root = rel
+		rootReport, keys, err := impl.check(ctx, rootOpts)
+		if err != nil {
+			return report, fmt.Errorf("check %s: %w", rel, err)
+		}
+		report.add(rel, rootReport)
+		for blobKey := range keys {
+			referenced[blobKey] = struct{}{}
+		}
+	}
+	if pool == nil {
+		return report, nil
+	}
+	poolReport, err := pool.check(ctx, referenced, opts)
+	if err != nil {
+		return report, fmt.Errorf("check %s: %w", sharedRootDir, err)
+	}
+	report.add(sharedRootDir, poolReport)
+	return report, nil
+}
+
+// BlobFetcher is implemented by instances that can re-populate a blob from their upstream.
+type BlobFetcher interface {
+	FetchBlob(ctx context.Context, name, blobKey string) error
+}
+
+// FetchRegisteredBlob re-fetches a missing blob through the registered instance that owns the storage root at root.
+func FetchRegisteredBlob(ctx context.Context, root string, loc Locator, blobKey string) error {
+	repoType, repoName := storageRootLabels(root)
+	rTypeLock.RLock()
+	var instance Instance
+	if td, ok := rTypeDetails[repoType]; ok {
+		if inst, ok := td.instances[repoName]; ok && inst != nil {
+			instance = inst.instance
+		}
+	}
+	rTypeLock.RUnlock()
+	fetcher, ok := instance.(BlobFetcher)
+	if !ok {
+		return fmt.Errorf("no instance able to fetch blobs for %s", root)
+	}
+	return fetcher.FetchBlob(ctx, loc.Name, blobKey)
+}
+
+// Check verifies blob digests, version and label documents, and reports temp files, orphans and dangling references.
+func (s *CommonStorageImpl) Check(ctx context.Context, opts FsckOptions) (*FsckReport, error) {
+	report, _, err := s.check(ctx, opts)
+	return report, err
+}
+
+// check runs Check and also returns the blob keys referenced by this root's versions.
+func (s *CommonStorageImpl) check(ctx context.Context, opts FsckOptions) (*FsckReport, map[string]struct{}, error) {
+	report := &FsckReport{Roots: 1}
+	if err := s.checkTempFiles(ctx, "", opts, report); err != nil {
+		return report, nil, err
+	}
+	present, err := s.checkBlobs(ctx, opts, report)
+	if err != nil {
+		return report, nil, err
+	}
+	referenced, err := s.checkIndex(ctx, present, opts, report)
+	if err != nil {
+		return report, nil, err
+	}
+	orphans := make([]string, 0, len(present))
+	for blobKey := range present {
+		if _, ok := referenced[blobKey]; !ok {
+			orphans = append(orphans, blobKey)
+		}
+	}
+	sort.Strings(orphans)
+	for _, blobKey := range orphans {
+		report.issue(FsckOrphanBlob, path.Join(blobsRootDir, present[blobKey]), blobKey, false)
+	}
+	return report, referenced, nil
+}
+
+// checkTempFiles reports (and optionally removes) stale .tmp-<nanos> files anywhere beneath rel.
+func (s *CommonStorageImpl) checkTempFiles(ctx context.Context, rel string, opts FsckOptions, report *FsckReport) error {
+	files, err := readDirNames(ctx, s.fs, rel, false)
+	if err != nil {
+		return err
+	}
+	cutoff := opts.tempCutoff()
+	for _, name := range files {
+		if !strings.Contains(name, ".tmp-") {
+			continue
+		}
+		filePath := path.Join(rel, name)
+		info, err := s.fs.Stat(ctx, filePath)
+		if err != nil {
+			if isNotFoundError(err) {
+				continue
+			}
+			return err
+		}
+		if info.ModTime().After(cutoff) {
+			continue
+		}
+		repaired := false
+		if opts.Repair {
+			if err := s.fs.Delete(ctx, filePath, nil); err != nil && !isNotFoundError(err) {
+				return err
+			}
+			repaired = true
+		}
+		report.issue(FsckTempFile, filePath, "", repaired)
+	}
+	dirs, err := readDirNames(ctx, s.fs, rel, true)
+	if err != nil {
+		return err
+	}
+	for _, dir := range dirs {
+		if err := s.checkTempFiles(ctx, path.Join(rel, dir), opts, report); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkBlobs re-hashes every blob against its key and returns the intact blobs by key.
+func (s *CommonStorageImpl) checkBlobs(ctx context.Context, opts FsckOptions, report *FsckReport) (map[string]string, error) {
+	blobsFS, err := s.blobsRoot(ctx)
+	if err != nil {
+		return nil, err
+	}
+	present := map[string]string{}
+	err = walkBlobs(ctx, blobsFS, func(blobKey, rel string) error {
+		if strings.Contains(rel, ".tmp-") {
+			return nil
+		}
+		report.Blobs++
+		actual, err := hashBlob(ctx, blobsFS, blobKey, rel)
+		if err != nil {
+			return err
+		}
+		if actual == blobKey {
+			present[blobKey] = rel
+			return nil
+		}
+		repaired := false
+		if opts.Repair {
+			if err := blobsFS.Delete(ctx, rel, nil); err != nil && !isNotFoundError(err) {
+				return err
+			}
+			repaired = true
+		} else {
+			present[blobKey] = rel
+		}
+		report.issue(FsckCorruptBlob, path.Join(blobsRootDir, rel), "content hashes to "+actual, repaired)
+		return nil
+	})
+	return present, err
+}
+
+func hashBlob(ctx context.Context, blobsFS storage.WritableFS, blobKey, rel string) (string, error) {
+	algo, _, err := splitDigest(blobKey)
+	if err != nil {
+		return "", err
+	}
+	hasher, err := newDigestHash(algo)
+	if err != nil {
+		return "", err
+	}
+	reader, err := blobsFS.Open(ctx, rel)
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+	if _, err := io.Copy(hasher, reader); err != nil {
+		return "", err
+	}
+	return algo + ":" + hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// checkIndex validates versions/*.json and labels.json for every host/name and returns the blob keys they reference.
+func (s *CommonStorageImpl) checkIndex(ctx context.Context, present map[string]string, opts FsckOptions, report *FsckReport) (map[string]struct{}, error) {
+	referenced := map[string]struct{}{}
+	hosts, err := s.ListHosts(ctx)
+	if err != nil {
+		return nil, err
+	}
+	metaFS, err := s.metadataIndexFS(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, host := range hosts {
+		names, err := s.ListNamesForHost(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			versions, err := s.checkVersions(ctx, metaFS, host, name, present, referenced, opts, report)
+			if err != nil {
+				return nil, err
+			}
+			if err := s.checkLabels(ctx, metaFS, host, name, versions, opts, report); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return referenced, nil
+}
+
+func (s *CommonStorageImpl) checkVersions(ctx context.Context, metaFS storage.WritableFS, host, name string, present map[string]string, referenced map[string]struct{}, opts FsckOptions, report *FsckReport) (map[string]struct{}, error) {
+	versionDir := path.Join(host, name, versionsDirName)
+	files, err := readDirNames(ctx, metaFS, versionDir, false)
+	if err != nil {
+		return nil, err
+	}
+	versions := map[string]struct{}{}
+	for _, file := range files {
+		if !strings.HasSuffix(file, ".json") {
+			continue
+		}
+		report.Versions++
+		rel := path.Join(metadataRootDir, metadataIndexDir, versionDir, file)
+		meta, err := s.readVersionMeta(ctx, metaFS, path.Join(versionDir, file))
+		if err != nil {
+			report.issue(FsckInvalidVersion, rel, err.Error(), false)
+			continue
+		}
+		if problem := validateVersionMeta(meta, strings.TrimSuffix(file, ".json")); problem != "" {
+			report.issue(FsckInvalidVersion, rel, problem, false)
+			continue
+		}
+		versions[meta.VersionID] = struct{}{}
+		required := map[string]struct{}{}
+		for _, blobKey := range fileBlobKeys(meta) {
+			required[blobKey] = struct{}{}
+		}
+		for _, blobKey := range versionBlobKeys(meta) {
+			referenced[blobKey] = struct{}{}
+			if _, ok := present[blobKey]; ok {
+				continue
+			}
+			if s.pool != nil {
+				if _, err := s.pool.statBlob(ctx, blobKey); err == nil {
+					continue
+				}
+			}
+			if _, ok := required[blobKey]; !ok {
+				report.issue(FsckUncachedBlob, rel, blobKey, false)
+				continue
+			}
+			repaired := false
+			if opts.Repair && opts.Fetch != nil {
+				loc := Locator{Host: host, Name: name, VersionID: meta.VersionID}
+				if err := opts.Fetch(ctx, opts.root, loc, blobKey); err == nil {
+					repaired = true
+					present[blobKey] = ""
+				}
+			}
+			report.issue(FsckMissingBlob, rel, blobKey, repaired)
+		}
+	}
+	return versions, nil
+}
+
+func validateVersionMeta(meta *VersionMeta, versionID string) string {
+	if meta.Kind != "" && meta.Kind != versionKind {
+		return fmt.Sprintf("unexpected kind %q", meta.Kind)
+	}
+	if meta.VersionID != versionID {
+		return fmt.Sprintf("versionId %q does not match file name", meta.VersionID)
+	}
+	for _, f := range meta.Files {
+		if f.BlobKey == "" {
+			continue
+		}
+		if _, _, err := splitDigest(f.BlobKey); err != nil {
+			return fmt.Sprintf("file %q: %v", f.Name, err)
+		}
+	}
+	return ""
+}
+
+func (s *CommonStorageImpl) checkLabels(ctx context.Context, metaFS storage.WritableFS, host, name string, versions map[string]struct{}, opts FsckOptions, report *FsckReport) error {
+	rel := path.Join(metadataRootDir, metadataIndexDir, host, name, labelsFileName)
+	bindings, err := s.readLabels(ctx, metaFS, host, name)
+	if err != nil {
+		if isNotFoundError(err) {
+			return nil
+		}
+		report.issue(FsckInvalidLabels, rel, err.Error(), false)
+		return nil
+	}
+	if bindings.Kind != "" && bindings.Kind != labelKind {
+		report.issue(FsckInvalidLabels, rel, fmt.Sprintf("unexpected kind %q", bindings.Kind), false)
+		return nil
+	}
+	report.Labels += len(bindings.Labels)
+	// Several labels may point at the same missing version, so each dangling binding is reported on its own.
+	var dangling []string
+	danglingIDs := map[string]string{}
+	for label, versionID := range bindings.Labels {
+		if _, ok := versions[versionID]; !ok {
+			dangling = append(dangling, label+" -> "+versionID)
+			danglingIDs[versionID] = label
+		}
+	}
+	for label, history := range bindings.History {
+		for _, versionID := range history {
+			if _, ok := versions[versionID]; !ok && bindings.Labels[label] != versionID {
+				dangling = append(dangling, "history "+label+" -> "+versionID)
+				danglingIDs[versionID] = label
+			}
+		}
+	}
+	if len(dangling) == 0 {
+		return nil
+	}
+	if opts.Repair {
+		if err := s.pruneLabels(ctx, host, name, danglingIDs); err != nil {
+			return err
+		}
+	}
+	sort.Strings(dangling)
+	for _, detail := range dangling {
+		report.issue(FsckDanglingLabel, rel, detail, opts.Repair)
+	}
+	return nil
+}
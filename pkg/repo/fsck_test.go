@@ -0,0 +1,112 @@
+package repo
+
+import (
+	"bytes"
+	"context"
+	"path"
+	"testing"
+	"time"
+)
+
+func newFsckFixture(t *testing.T) (*FsckOptions, CommonStorage, string) {
+	t.Helper()
+	ctx := context.Background()
+	_, store := newGCFixture(t)
+
+	if _, err := store.StoreFile(ctx, "metadata/index/registry.test/labels.json.tmp-42", bytes.NewReader([]byte("{"))); err != nil {
+		t.Fatalf("StoreFile failed: %v", err)
+	}
+	for _, label := range []string{"stale", "old"} {
+		if err := store.SetLabel(ctx, Locator{Host: "registry.test", Name: "library/alpine", Label: label, VersionID: "deleted-version"}); err != nil {
+			t.Fatalf("SetLabel failed: %v", err)
+		}
+	}
+	// The manifest blob is required by its version; the layer is only named inside the inline manifest.
+	for _, digest := range []string{manifestDigest, layerDigest} {
+		rel, _ := blobRelativePath(digest)
+		if err := store.(*CommonStorageImpl).fs.Delete(ctx, path.Join(blobsRootDir, rel), nil); err != nil {
+			t.Fatalf("delete blob %s: %v", digest, err)
+		}
+	}
+	corruptDigest := digestOf([]byte("expected"))
+	corruptRel, _ := blobRelativePath(corruptDigest)
+	if _, err := store.StoreFile(ctx, path.Join(blobsRootDir, corruptRel), bytes.NewReader([]byte("tampered"))); err != nil {
+		t.Fatalf("StoreFile failed: %v", err)
+	}
+	opts := &FsckOptions{Now: func() time.Time { return time.Now().Add(2 * time.Hour) }}
+	return opts, store, corruptDigest
+}
+
+func fsckKinds(report *FsckReport) map[string]int {
+	kinds := map[string]int{}
+	for _, issue := range report.Issues {
+		kinds[issue.Kind]++
+	}
+	return kinds
+}
+
+func TestCheckReportsIntegrityIssues(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	opts, store, _ := newFsckFixture(t)
+
+	report, err := store.(*CommonStorageImpl).Check(ctx, *opts)
+	if err != nil {
+		t.Fatalf("Check failed: %v", err)
+	}
+	kinds := fsckKinds(report)
+	for _, kind := range []string{FsckTempFile, FsckCorruptBlob, FsckMissingBlob, FsckUncachedBlob, FsckDanglingLabel, FsckOrphanBlob} {
+		if kinds[kind] == 0 {
+			t.Fatalf("expected %s issue, got %+v", kind, report.Issues)
+		}
+	}
+	if kinds[FsckMissingBlob] != 1 || kinds[FsckDanglingLabel] != 2 {
+		t.Fatalf("expected one missing blob and both dangling labels, got %+v", report.Issues)
+	}
+	if report.Repaired != 0 || report.Unresolved() == 0 {
+		t.Fatalf("expected unrepaired issues, got %+v", report)
+	}
+}
+
+func TestCheckRepairsIntegrityIssues(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	opts, store, corruptDigest := newFsckFixture(t)
+	opts.Repair = true
+	opts.Fetch = func(ctx context.Context, _ string, loc Locator, blobKey string) error {
+		if blobKey != manifestDigest {
+			t.Fatalf("unexpected fetch of %s", blobKey)
+		}
+		_, err := store.PutBlob(ctx, blobKey, bytes.NewReader(manifestPayload))
+		return err
+	}
+
+	report, err := store.(*CommonStorageImpl).Check(ctx, *opts)
+	if err != nil {
+		t.Fatalf("Check failed: %v", err)
+	}
+	if unresolved := report.Unresolved(); unresolved != 0 {
+		t.Fatalf("expected every issue to be repaired, got %+v", report.Issues)
+	}
+	if _, err := store.StatBlob(ctx, manifestDigest); err != nil {
+		t.Fatalf("expected missing manifest to be re-fetched: %v", err)
+	}
+	if _, err := store.StatBlob(ctx, corruptDigest); err == nil {
+		t.Fatalf("expected corrupt blob to be removed")
+	}
+	bindings, err := store.GetLabels(ctx, Locator{Host: "registry.test", Name: "library/alpine"})
+	if err != nil {
+		t.Fatalf("GetLabels failed: %v", err)
+	}
+	if len(bindings.Labels) != 0 {
+		t.Fatalf("expected dangling labels to be dropped, got %v", bindings.Labels)
+	}
+
+	report, err = store.(*CommonStorageImpl).Check(ctx, *opts)
+	if err != nil {
+		t.Fatalf("second Check failed: %v", err)
+	}
+	if kinds := fsckKinds(report); len(kinds) != 2 || kinds[FsckOrphanBlob] != 1 || kinds[FsckUncachedBlob] != 1 {
+		t.Fatalf("expected only the orphan blob and the uncached layer after repair, got %+v", report.Issues)
+	}
+}
@@ -0,0 +1,452 @@
+package repo
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/davidjspooner/go-fs/pkg/storage"
+	"github.com/davidjspooner/go-http-server/pkg/metric"
+)
+
+// DefaultGCGracePeriod protects freshly written blobs whose version metadata may not exist yet.
+const DefaultGCGracePeriod = 24 * time.Hour
+
+// GCConfig controls the optional background garbage collector started by `serve`.
+type GCConfig struct {
+	Interval    time.Duration `yaml:"interval"`
+	GracePeriod time.Duration `yaml:"grace_period,omitempty"`
+	DryRun      bool          `yaml:"dry_run,omitempty"`
+}
+
+// GCOptions tunes a single garbage collection pass.
+type GCOptions struct {
+	// GracePeriod is the minimum age of an unreferenced blob before it is deleted.
+	GracePeriod time.Duration
+	// DryRun reports what would be deleted without removing anything.
+	DryRun bool
+	// Now overrides the clock used to evaluate the grace period.
+	Now func() time.Time
+}
+
+// GCReport summarises the outcome of a garbage collection pass.
+type GCReport struct {
+	Roots        int      `json:"roots"`
+	Versions     int      `json:"versions"`
+	Referenced   int      `json:"referenced"`
+	Scanned      int      `json:"scanned"`
+	Retained     int      `json:"retained"`
+	Deleted      int      `json:"deleted"`
+	DeletedBytes int64    `json:"deletedBytes"`
+	DeletedKeys  []string `json:"deletedKeys,omitempty"`
+	DryRun       bool     `json:"dryRun"`
+}
+
+var (
+	gcBlobs = metric.MustNewCounterVector(&metric.MetaData{
+		Name:      "repoxy_gc_blobs_total",
+		Help:      "Blobs visited by the garbage collector grouped by outcome",
+		LabelKeys: []string{"type", "repo", "result"},
+	})
+	gcBytes = metric.MustNewCounterVector(&metric.MetaData{
+		Name:      "repoxy_gc_bytes_deleted_total",
+		Help:      "Bytes reclaimed by the garbage collector",
+		LabelKeys: []string{"type", "repo"},
+	})
+)
+
+func (o GCOptions) cutoff() time.Time {
+	now := time.Now
+	if o.Now != nil {
+		now = o.Now
+	}
+	return now().Add(-o.GracePeriod)
+}
+
+func (r *GCReport) add(other *GCReport) {
+	if other == nil {
+		return
+	}
+	r.Roots += other.Roots
+	r.Versions += other.Versions
+	r.Referenced += other.Referenced
+	r.Scanned += other.Scanned
+	r.Retained += other.Retained
+	r.Deleted += other.Deleted
+	r.DeletedBytes += other.DeletedBytes
+	r.DeletedKeys = append(r.DeletedKeys, other.DeletedKeys...)
+}
+
+// CollectGarbage runs a mark-and-sweep pass over every CommonStorage root beneath type/ in the storage root, followed by
+// the shared blob pool when one exists.
+func CollectGarbage(ctx context.Context, root storage.WritableFS, opts GCOptions) (*GCReport, error) {
+	if root == nil {
+		return nil, fmt.Errorf("garbage collection requires a storage root")
+	}
+	roots, err := findStorageRoots(ctx, root, "type")
+	if err != nil {
+		return nil, err
+	}
+	report := &GCReport{DryRun: opts.DryRun}
+	referenced := make(map[string]map[string]struct{}, len(roots))
+	for _, rel := range roots {
+		sub, err := root.EnsureSub(ctx, rel)
+		if err != nil {
+			return report, err
+		}
+		metricType, metricRepo := storageRootLabels(rel)
+		common, err := NewCommonStorageWithLabels(sub, metricType, metricRepo)
+		if err != nil {
+			return report, err
+		}
+		rootReport, keys, err := common.(*CommonStorageImpl).collectGarbage(ctx, opts)
+		if err != nil {
+			return report, fmt.Errorf("collect garbage in %s: %w", rel, err)
+		}
+		report.add(rootReport)
+		referenced[rel] = keys
+	}
+	pool, err := findBlobPool(ctx, root)
+	if err != nil || pool == nil {
+		return report, err
+	}
+	poolReport, err := pool.collectGarbage(ctx, referenced, opts)
+	if err != nil {
+		return report, fmt.Errorf("collect garbage in %s: %w", sharedRootDir, err)
+	}
+	report.add(poolReport)
+	return report, nil
+}
+
+// CollectGarbage marks every blob referenced by a version under metadata/index and deletes unreferenced blobs older than the grace period.
+func (s *CommonStorageImpl) CollectGarbage(ctx context.Context, opts GCOptions) (*GCReport, error) {
+	report, _, err := s.collectGarbage(ctx, opts)
+	return report, err
+}
+
+// collectGarbage sweeps this root's own blobs and also returns the blob keys its versions reference.
+func (s *CommonStorageImpl) collectGarbage(ctx context.Context, opts GCOptions) (*GCReport, map[string]struct{}, error) {
+	report := &GCReport{Roots: 1, DryRun: opts.DryRun}
+	referenced, versions, err := s.referencedBlobKeys(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	report.Versions = versions
+	report.Referenced = len(referenced)
+
+	blobsFS, err := s.blobsRoot(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	cutoff := opts.cutoff()
+	err = walkBlobs(ctx, blobsFS, func(blobKey, rel string) error {
+		report.Scanned++
+		if _, ok := referenced[blobKey]; ok {
+			report.Retained++
+			s.recordGC("referenced")
+			return nil
+		}
+		info, err := blobsFS.Stat(ctx, rel)
+		if err != nil {
+			if isNotFoundError(err) {
+				return nil
+			}
+			return err
+		}
+		if info.ModTime().After(cutoff) || s.touchedSince(ctx, rel, cutoff) {
+			report.Retained++
+			s.recordGC("grace")
+			return nil
+		}
+		report.Deleted++
+		report.DeletedBytes += info.Size()
+		report.DeletedKeys = append(report.DeletedKeys, blobKey)
+		if opts.DryRun {
+			s.recordGC("dry_run")
+			return nil
+		}
+		if err := blobsFS.Delete(ctx, rel, nil); err != nil && !isNotFoundError(err) {
+			s.recordGC("error")
+			return err
+		}
+		s.recordGC("deleted")
+		if info.Size() > 0 {
+			_ = gcBytes.IncN(info.Size(), s.metricType, s.metricRepo)
+		}
+		return nil
+	})
+	if err != nil {
+		return report, nil, err
+	}
+	if !opts.DryRun {
+		if err := s.dropStaleTouches(ctx, cutoff); err != nil {
+			return report, nil, err
+		}
+	}
+	return report, referenced, nil
+}
+
+// touchedSince reports whether PutBlob found the blob at rel already stored after cutoff.
+func (s *CommonStorageImpl) touchedSince(ctx context.Context, rel string, cutoff time.Time) bool {
+	info, err := s.fs.Stat(ctx, path.Join(metadataRootDir, touchedDirName, rel))
+	return err == nil && info.ModTime().After(cutoff)
+}
+
+// dropStaleTouches removes touch markers older than cutoff; by then their blob is either referenced or swept.
+func (s *CommonStorageImpl) dropStaleTouches(ctx context.Context, cutoff time.Time) error {
+	touchedRel := path.Join(metadataRootDir, touchedDirName)
+	if _, err := s.fs.Stat(ctx, touchedRel); err != nil {
+		return nil
+	}
+	touchedFS, err := s.fs.EnsureSub(ctx, touchedRel)
+	if err != nil {
+		return err
+	}
+	return walkFiles(ctx, touchedFS, "", func(rel string) error {
+		info, err := touchedFS.Stat(ctx, rel)
+		if err != nil || info.ModTime().After(cutoff) {
+			return nil
+		}
+		if err := touchedFS.Delete(ctx, rel, nil); err != nil && !isNotFoundError(err) {
+			return err
+		}
+		return nil
+	})
+}
+
+// StartGarbageCollector runs CollectGarbage on the configured interval until ctx is cancelled.
+func StartGarbageCollector(ctx context.Context, root storage.WritableFS, cfg *GCConfig) {
+	if cfg == nil || cfg.Interval <= 0 {
+		return
+	}
+	opts := GCOptions{GracePeriod: cfg.GracePeriod, DryRun: cfg.DryRun}
+	if opts.GracePeriod <= 0 {
+		opts.GracePeriod = DefaultGCGracePeriod
+	}
+	go func() {
+		ticker := time.NewTicker(cfg.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			start := time.Now()
+			report, err := CollectGarbage(ctx, root, opts)
+			if err != nil {
+				slog.ErrorContext(ctx, "garbage collection failed", "error", err)
+				continue
+			}
+			slog.InfoContext(ctx, "garbage collection completed",
+				"roots", report.Roots,
+				"scanned", report.Scanned,
+				"deleted", report.Deleted,
+				"deleted_bytes", report.DeletedBytes,
+				"dry_run", report.DryRun,
+				"duration", time.Since(start).Seconds(),
+			)
+		}
+	}()
+}
+
+func (s *CommonStorageImpl) recordGC(result string) {
+	_ = gcBlobs.Inc(s.metricType, s.metricRepo, result)
+}
+
+// referencedBlobKeys collects blob keys from every versions/*.json document, including digests embedded in inline manifests.
+func (s *CommonStorageImpl) referencedBlobKeys(ctx context.Context) (map[string]struct{}, int, error) {
+	metaFS, err := s.metadataIndexFS(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	hosts, err := metaFS.ReadDir(ctx, "")
+	if err != nil {
+		if isNotFoundError(err) {
+			return map[string]struct{}{}, 0, nil
+		}
+		return nil, 0, err
+	}
+	referenced := map[string]struct{}{}
+	versions := 0
+	for _, hostEntry := range hosts {
+		if !hostEntry.IsDir() {
+			continue
+		}
+		host := hostEntry.Name()
+		var names []string
+		if err := s.collectNames(ctx, metaFS, host, "", &names); err != nil {
+			return nil, 0, err
+		}
+		for _, name := range names {
+			versionDir := path.Join(host, name, versionsDirName)
+			entries, err := metaFS.ReadDir(ctx, versionDir)
+			if err != nil {
+				if isNotFoundError(err) {
+					continue
+				}
+				return nil, 0, err
+			}
+			for _, entry := range entries {
+				if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+					continue
+				}
+				meta, err := s.readVersionMeta(ctx, metaFS, path.Join(versionDir, entry.Name()))
+				if err != nil {
+					return nil, 0, fmt.Errorf("read %s: %w", path.Join(versionDir, entry.Name()), err)
+				}
+				versions++
+				for _, key := range versionBlobKeys(meta) {
+					referenced[key] = struct{}{}
+				}
+			}
+		}
+	}
+	return referenced, versions, nil
+}
+
+// versionBlobKeys returns the file blob keys of meta plus any "digest" values found in its inline manifest,
+// so container layers and config blobs stay reachable through their manifest.
+func versionBlobKeys(meta *VersionMeta) []string {
+	if meta == nil {
+		return nil
+	}
+	keys := fileBlobKeys(meta)
+	if meta.Manifest == "" {
+		return keys
+	}
+	var doc any
+	if err := json.Unmarshal([]byte(meta.Manifest), &doc); err != nil {
+		return keys
+	}
+	collectDigests(doc, &keys)
+	return keys
+}
+
+// fileBlobKeys returns the blob keys of meta's files, which must be stored for the version to be served.
+func fileBlobKeys(meta *VersionMeta) []string {
+	var keys []string
+	for _, f := range meta.Files {
+		if f.BlobKey != "" {
+			keys = append(keys, strings.ToLower(f.BlobKey))
+		}
+	}
+	return keys
+}
+
+func collectDigests(node any, out *[]string) {
+	switch v := node.(type) {
+	case map[string]any:
+		for key, value := range v {
+			if s, ok := value.(string); ok && key == "digest" {
+				if _, _, err := splitDigest(s); err == nil {
+					*out = append(*out, strings.ToLower(s))
+				}
+				continue
+			}
+			collectDigests(value, out)
+		}
+	case []any:
+		for _, item := range v {
+			collectDigests(item, out)
+		}
+	}
+}
+
+// walkBlobs visits every blob stored as <algo>/<aa>/<bb>/<hex> beneath blobsFS.
+func walkBlobs(ctx context.Context, blobsFS storage.WritableFS, visit func(blobKey, rel string) error) error {
+	algos, err := readDirNames(ctx, blobsFS, "", true)
+	if err != nil {
+		return err
+	}
+	for _, algo := range algos {
+		level1, err := readDirNames(ctx, blobsFS, algo, true)
+		if err != nil {
+			return err
+		}
+		for _, l1 := range level1 {
+			level2, err := readDirNames(ctx, blobsFS, path.Join(algo, l1), true)
+			if err != nil {
+				return err
+			}
+			for _, l2 := range level2 {
+				dir := path.Join(algo, l1, l2)
+				files, err := readDirNames(ctx, blobsFS, dir, false)
+				if err != nil {
+					return err
+				}
+				for _, hexValue := range files {
+					if !strings.HasPrefix(hexValue, l1+l2) {
+						continue
+					}
+					if err := visit(algo+":"+hexValue, path.Join(dir, hexValue)); err != nil {
+						return err
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// readDirNames returns the sorted names of directories (dirs=true) or files (dirs=false) within rel.
+func readDirNames(ctx context.Context, fs storage.WritableFS, rel string, dirs bool) ([]string, error) {
+	entries, err := fs.ReadDir(ctx, rel)
+	if err != nil {
+		if isNotFoundError(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() == dirs {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// findStorageRoots returns every directory beneath rel that holds a CommonStorage layout (metadata/ or blobs/).
+func findStorageRoots(ctx context.Context, root storage.WritableFS, rel string) ([]string, error) {
+	dirs, err := readDirNames(ctx, root, rel, true)
+	if err != nil {
+		return nil, err
+	}
+	var roots []string
+	isRoot := false
+	for _, dir := range dirs {
+		if dir == metadataRootDir || dir == blobsRootDir {
+			isRoot = true
+			continue
+		}
+		children, err := findStorageRoots(ctx, root, path.Join(rel, dir))
+		if err != nil {
+			return nil, err
+		}
+		roots = append(roots, children...)
+	}
+	if isRoot {
+		roots = append([]string{rel}, roots...)
+	}
+	return roots, nil
+}
+
+// storageRootLabels derives metric labels from a type/<type>/<repo>/... path.
+func storageRootLabels(rel string) (string, string) {
+	parts := strings.Split(rel, "/")
+	if len(parts) >= 3 && parts[0] == "type" {
+		return parts[1], parts[2]
+	}
+	return "", ""
+}
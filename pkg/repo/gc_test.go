@@ -0,0 +1,139 @@
+package repo
+
+import (
+	"bytes"
+	"context"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/davidjspooner/go-fs/pkg/storage"
+)
+
+var (
+	manifestPayload = []byte(`{"schemaVersion":2}`)
+	orphanPayload   = []byte("orphan layer")
+	layerPayload    = []byte("referenced layer")
+	orphanDigest    = digestOf(orphanPayload)
+	layerDigest     = digestOf(layerPayload)
+	manifestDigest  = digestOf(manifestPayload)
+)
+
+func newGCFixture(t *testing.T) (storage.WritableFS, CommonStorage) {
+	t.Helper()
+	ctx := context.Background()
+	fsRO, err := storage.OpenFileSystemFromString(ctx, "mem://", storage.Config{})
+	if err != nil {
+		t.Fatalf("failed to open mem fs: %v", err)
+	}
+	root, ok := fsRO.(storage.WritableFS)
+	if !ok {
+		t.Fatalf("mem fs is not writable")
+	}
+	repoFS, err := root.EnsureSub(ctx, "type/container/mirror")
+	if err != nil {
+		t.Fatalf("ensure repo fs: %v", err)
+	}
+	store, err := NewCommonStorageWithLabels(repoFS, "container", "mirror")
+	if err != nil {
+		t.Fatalf("failed to construct common storage: %v", err)
+	}
+	for _, payload := range [][]byte{manifestPayload, orphanPayload, layerPayload} {
+		if _, err := store.PutBlob(ctx, digestOf(payload), bytes.NewReader(payload)); err != nil {
+			t.Fatalf("PutBlob %s failed: %v", digestOf(payload), err)
+		}
+	}
+	_, err = store.CreateVersion(ctx, Locator{Host: "registry.test", Name: "library/alpine"}, &VersionMeta{
+		Files: []FileEntry{
+			{Name: "latest", BlobKey: manifestDigest, Size: 10, MediaType: "application/json"},
+		},
+		Manifest: `{"schemaVersion":2,"layers":[{"digest":"` + layerDigest + `"}]}`,
+	})
+	if err != nil {
+		t.Fatalf("CreateVersion failed: %v", err)
+	}
+	return root, store
+}
+
+func TestCollectGarbageDeletesUnreferencedBlobs(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	root, store := newGCFixture(t)
+
+	report, err := CollectGarbage(ctx, root, GCOptions{Now: func() time.Time { return time.Now().Add(time.Hour) }})
+	if err != nil {
+		t.Fatalf("CollectGarbage failed: %v", err)
+	}
+	if report.Roots != 1 || report.Versions != 1 {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+	if report.Deleted != 1 || len(report.DeletedKeys) != 1 || report.DeletedKeys[0] != orphanDigest {
+		t.Fatalf("expected only orphan deleted, got %+v", report)
+	}
+	if _, err := store.StatBlob(ctx, orphanDigest); err == nil {
+		t.Fatalf("expected orphan blob to be removed")
+	}
+	for _, digest := range []string{manifestDigest, layerDigest} {
+		if _, err := store.StatBlob(ctx, digest); err != nil {
+			t.Fatalf("expected referenced blob %s to survive: %v", digest, err)
+		}
+	}
+}
+
+func TestCollectGarbageKeepsBlobsUploadedAgain(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	root, store := newGCFixture(t)
+	time.Sleep(10 * time.Millisecond)
+	stored := time.Now()
+	time.Sleep(10 * time.Millisecond)
+
+	// Uploading the orphan again, e.g. for a version about to be recorded, restarts its grace period.
+	if n, err := store.PutBlob(ctx, orphanDigest, bytes.NewReader(orphanPayload)); err != nil || n != 0 {
+		t.Fatalf("expected duplicate PutBlob to write nothing, got %d, %v", n, err)
+	}
+	report, err := CollectGarbage(ctx, root, GCOptions{GracePeriod: time.Hour, Now: func() time.Time { return stored.Add(time.Hour) }})
+	if err != nil {
+		t.Fatalf("CollectGarbage failed: %v", err)
+	}
+	if report.Deleted != 0 {
+		t.Fatalf("expected the blob uploaded again to be retained, got %+v", report)
+	}
+
+	report, err = CollectGarbage(ctx, root, GCOptions{Now: func() time.Time { return time.Now().Add(time.Hour) }})
+	if err != nil {
+		t.Fatalf("CollectGarbage failed: %v", err)
+	}
+	if report.Deleted != 1 || report.DeletedKeys[0] != orphanDigest {
+		t.Fatalf("expected the orphan to be deleted once its grace period passed, got %+v", report)
+	}
+	rel, _ := blobRelativePath(orphanDigest)
+	if _, err := store.(*CommonStorageImpl).fs.Stat(ctx, path.Join(metadataRootDir, touchedDirName, rel)); err == nil {
+		t.Fatalf("expected the stale touch marker to be removed")
+	}
+}
+
+func TestCollectGarbageHonoursDryRunAndGracePeriod(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	root, store := newGCFixture(t)
+
+	report, err := CollectGarbage(ctx, root, GCOptions{GracePeriod: time.Hour})
+	if err != nil {
+		t.Fatalf("CollectGarbage failed: %v", err)
+	}
+	if report.Deleted != 0 {
+		t.Fatalf("expected young blobs to be retained, got %+v", report)
+	}
+
+	report, err = CollectGarbage(ctx, root, GCOptions{DryRun: true, Now: func() time.Time { return time.Now().Add(time.Hour) }})
+	if err != nil {
+		t.Fatalf("CollectGarbage dry run failed: %v", err)
+	}
+	if report.Deleted != 1 || !report.DryRun {
+		t.Fatalf("expected dry run to report orphan, got %+v", report)
+	}
+	if _, err := store.StatBlob(ctx, orphanDigest); err != nil {
+		t.Fatalf("dry run must not delete blobs: %v", err)
+	}
+}
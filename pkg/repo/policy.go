@@ -0,0 +1,57 @@
+package repo
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Signature formats accepted by Policy.Signatures.
+const (
+	SignatureCosign   = "cosign"
+	SignatureNotation = "notation"
+)
+
+// Policy requires content to carry a signature made with a trusted key before it is cached or served.
+type Policy struct {
+	// Signatures lists the accepted signature formats of container repositories: cosign and/or notation. Defaults to
+	// both.
+	Signatures []string `yaml:"signatures,omitempty"`
+	// Keys lists PEM files holding trusted public keys or certificates for container repositories; certificates also
+	// anchor notation chains. Terraform repositories take armored OpenPGP public keys trusted to sign provider
+	// SHA256SUMS files instead of the keys announced by the registry.
+	Keys []string `yaml:"keys"`
+}
+
+// Validate reports configuration errors in the policy block.
+func (p *Policy) Validate() error {
+	if p == nil {
+		return nil
+	}
+	if len(p.Keys) == 0 {
+		return fmt.Errorf("%w: policy requires at least one trusted key", ErrInvalidRepoConfig)
+	}
+	for _, format := range p.Signatures {
+		switch strings.ToLower(format) {
+		case SignatureCosign, SignatureNotation:
+		default:
+			return fmt.Errorf("%w: unknown signature format %q", ErrInvalidRepoConfig, format)
+		}
+	}
+	return nil
+}
+
+// Accepts reports whether signatures in format satisfy the policy.
+func (p *Policy) Accepts(format string) bool {
+	if p == nil {
+		return false
+	}
+	if len(p.Signatures) == 0 {
+		return true
+	}
+	for _, accepted := range p.Signatures {
+		if strings.EqualFold(accepted, format) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,27 @@
+package repo
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestPolicyValidate(t *testing.T) {
+	t.Parallel()
+	var unset *Policy
+	if err := unset.Validate(); err != nil || unset.Accepts(SignatureCosign) {
+		t.Fatalf("expected nil policy to be valid and accept nothing, got %v", err)
+	}
+	if err := (&Policy{}).Validate(); !errors.Is(err, ErrInvalidRepoConfig) {
+		t.Fatalf("expected missing keys to be rejected, got %v", err)
+	}
+	if err := (&Policy{Keys: []string{"k.pub"}, Signatures: []string{"gpg"}}).Validate(); !errors.Is(err, ErrInvalidRepoConfig) {
+		t.Fatalf("expected unknown format to be rejected, got %v", err)
+	}
+	policy := &Policy{Keys: []string{"k.pub"}, Signatures: []string{"Notation"}}
+	if err := policy.Validate(); err != nil || !policy.Accepts(SignatureNotation) || policy.Accepts(SignatureCosign) {
+		t.Fatalf("unexpected notation-only policy behaviour: %v", err)
+	}
+	if !(&Policy{Keys: []string{"k.pub"}}).Accepts(SignatureCosign) {
+		t.Fatalf("expected both formats accepted by default")
+	}
+}
@@ -0,0 +1,744 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/davidjspooner/go-fs/pkg/storage"
+	"github.com/davidjspooner/go-http-server/pkg/metric"
+)
+
+// Retention policy names.
+const (
+	RetentionLRU = "lru"
+	RetentionLFU = "lfu"
+
+	defaultRetentionInterval = time.Hour
+	accessFlushDelay         = time.Minute
+)
+
+// Retention bounds how much cached content a repository keeps.
+type Retention struct {
+	// Policy selects which content is evicted first when MaxBytes is exceeded: lru (default) or lfu.
+	Policy string `yaml:"policy,omitempty"`
+	// MaxBytes caps the total size of cached blobs and files.
+	MaxBytes int64 `yaml:"max_bytes,omitempty"`
+	// MaxAge evicts content and versions that have not been served for this long.
+	MaxAge time.Duration `yaml:"max_age,omitempty"`
+	// KeepVersions keeps only the N most recent versions each label has pointed at.
+	KeepVersions int `yaml:"keep_versions,omitempty"`
+	// Interval controls how often the policy is enforced while serving.
+	Interval time.Duration `yaml:"interval,omitempty"`
+}
+
+// Validate reports configuration errors in the retention block.
+func (r *Retention) Validate() error {
+	if r == nil {
+		return nil
+	}
+	switch strings.ToLower(r.Policy) {
+	case "", RetentionLRU, RetentionLFU:
+	default:
+		return fmt.Errorf("%w: unknown retention policy %q", ErrInvalidRepoConfig, r.Policy)
+	}
+	if r.MaxBytes < 0 || r.MaxAge < 0 || r.KeepVersions < 0 || r.Interval < 0 {
+		return fmt.Errorf("%w: retention limits must not be negative", ErrInvalidRepoConfig)
+	}
+	return nil
+}
+
+func (r *Retention) interval() time.Duration {
+	if r == nil || r.Interval <= 0 {
+		return defaultRetentionInterval
+	}
+	return r.Interval
+}
+
+// AccessRecord tracks how recently and how often cached content was served.
+type AccessRecord struct {
+	LastAccess time.Time `json:"lastAccess"`
+	Count      int64     `json:"count"`
+}
+
+// accessLog mirrors metadata/access.json on disk.
+type accessLog struct {
+	Kind      string                   `json:"kind"`
+	Blobs     map[string]*AccessRecord `json:"blobs"`
+	Versions  map[string]*AccessRecord `json:"versions"`
+	Files     map[string]*AccessRecord `json:"files"`
+	UpdatedAt time.Time                `json:"updatedAt"`
+	dirty     bool
+}
+
+// EvictionReport summarises the outcome of a retention pass.
+type EvictionReport struct {
+	Versions      int   `json:"versions"`
+	Blobs         int   `json:"blobs"`
+	Files         int   `json:"files"`
+	EvictedBytes  int64 `json:"evictedBytes"`
+	RetainedBytes int64 `json:"retainedBytes"`
+}
+
+// RetentionEnforcer is implemented by instances that can apply their retention policy to cached content.
+type RetentionEnforcer interface {
+	EnforceRetention(ctx context.Context) (*EvictionReport, error)
+}
+
+var (
+	evictions = metric.MustNewCounterVector(&metric.MetaData{
+		Name:      "repoxy_evictions_total",
+		Help:      "Cached entries evicted by retention policies",
+		LabelKeys: []string{"type", "repo", "kind", "reason"},
+	})
+	evictedBytes = metric.MustNewCounterVector(&metric.MetaData{
+		Name:      "repoxy_evicted_bytes_total",
+		Help:      "Bytes reclaimed by retention policies",
+		LabelKeys: []string{"type", "repo"},
+	})
+)
+
+// StartRetention enforces the retention policy of every registered instance that declares one until ctx is cancelled.
+func StartRetention(ctx context.Context) {
+	type target struct {
+		name     string
+		enforcer RetentionEnforcer
+		interval time.Duration
+	}
+	var targets []target
+	rTypeLock.RLock()
+	for _, td := range rTypeDetails {
+		for name, inst := range td.instances {
+			if inst == nil || inst.config == nil || inst.config.Retention == nil {
+				continue
+			}
+			enforcer, ok := inst.instance.(RetentionEnforcer)
+			if !ok {
+				continue
+			}
+			targets = append(targets, target{name: name, enforcer: enforcer, interval: inst.config.Retention.interval()})
+		}
+	}
+	rTypeLock.RUnlock()
+
+	for _, t := range targets {
+		go func() {
+			ticker := time.NewTicker(t.interval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+				}
+				report, err := t.enforcer.EnforceRetention(ctx)
+				if err != nil {
+					slog.ErrorContext(ctx, "retention pass failed", "repo", t.name, "error", err)
+					continue
+				}
+				slog.InfoContext(ctx, "retention pass completed",
+					"repo", t.name,
+					"versions", report.Versions,
+					"blobs", report.Blobs,
+					"files", report.Files,
+					"evicted_bytes", report.EvictedBytes,
+					"retained_bytes", report.RetainedBytes,
+				)
+			}
+		}()
+	}
+}
+
+// RecordBlobAccess notes that blobKey was served.
+func (s *CommonStorageImpl) RecordBlobAccess(ctx context.Context, blobKey string) {
+	if blobKey == "" {
+		return
+	}
+	s.recordAccess(ctx, func(log *accessLog) map[string]*AccessRecord { return log.Blobs }, strings.ToLower(blobKey))
+}
+
+// RecordVersionAccess notes that the version identified by loc was served.
+func (s *CommonStorageImpl) RecordVersionAccess(ctx context.Context, loc Locator) {
+	host, name, err := sanitizeLocator(loc)
+	if err != nil || loc.VersionID == "" {
+		return
+	}
+	s.recordAccess(ctx, func(log *accessLog) map[string]*AccessRecord { return log.Versions }, versionAccessKey(host, name, loc.VersionID))
+}
+
+// RecordFileAccess notes that the file at rel (relative to the CommonStorage root) was served.
+func (s *CommonStorageImpl) RecordFileAccess(ctx context.Context, rel string) {
+	rel = strings.Trim(path.Clean(rel), "/")
+	if rel == "" || rel == "." {
+		return
+	}
+	s.recordAccess(ctx, func(log *accessLog) map[string]*AccessRecord { return log.Files }, rel)
+}
+
+// Evict applies policy to the versions, blobs and files held by this CommonStorage root. Blobs referenced by a version
+// that survives are never evicted.
+func (s *CommonStorageImpl) Evict(ctx context.Context, policy *Retention) (*EvictionReport, error) {
+	return s.evict(ctx, policy, true)
+}
+
+// EvictBlobs is Evict for roots whose files are bookkeeping, such as tag lists or upload sessions, rather than cached
+// content; only versions and blobs are evicted.
+func (s *CommonStorageImpl) EvictBlobs(ctx context.Context, policy *Retention) (*EvictionReport, error) {
+	return s.evict(ctx, policy, false)
+}
+
+func (s *CommonStorageImpl) evict(ctx context.Context, policy *Retention, files bool) (*EvictionReport, error) {
+	report := &EvictionReport{}
+	if policy == nil {
+		return report, nil
+	}
+	if err := policy.Validate(); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if policy.KeepVersions > 0 || policy.MaxAge > 0 {
+		if err := s.evictVersions(ctx, policy, now, report); err != nil {
+			return report, err
+		}
+	}
+	entries, err := s.contentEntries(ctx, files)
+	if err != nil {
+		return report, err
+	}
+	referenced, _, err := s.referencedBlobKeys(ctx)
+	if err != nil {
+		return report, err
+	}
+	var total int64
+	remaining := entries[:0]
+	for _, entry := range entries {
+		if _, ok := referenced[entry.key]; ok && entry.blob {
+			total += entry.size
+			continue
+		}
+		if policy.MaxAge > 0 && now.Sub(entry.lastAccess) > policy.MaxAge {
+			if err := s.evictEntry(ctx, entry, "age", report); err != nil {
+				return report, err
+			}
+			continue
+		}
+		total += entry.size
+		remaining = append(remaining, entry)
+	}
+	if policy.MaxBytes > 0 && total > policy.MaxBytes {
+		sortForEviction(remaining, policy.Policy)
+		for _, entry := range remaining {
+			if total <= policy.MaxBytes {
+				break
+			}
+			if err := s.evictEntry(ctx, entry, "size", report); err != nil {
+				return report, err
+			}
+			total -= entry.size
+		}
+	}
+	report.RetainedBytes = total
+	if err := s.flushAccess(ctx); err != nil {
+		return report, err
+	}
+	return report, nil
+}
+
+type contentEntry struct {
+	blob       bool
+	pooled     bool   // blob lives in the shared pool; evicting it releases this root's reference
+	key        string // blob key or file path
+	rel        string // path within the owning filesystem
+	size       int64
+	lastAccess time.Time
+	count      int64
+}
+
+func sortForEviction(entries []contentEntry, policy string) {
+	lfu := strings.EqualFold(policy, RetentionLFU)
+	sort.SliceStable(entries, func(i, j int) bool {
+		if lfu && entries[i].count != entries[j].count {
+			return entries[i].count < entries[j].count
+		}
+		if !entries[i].lastAccess.Equal(entries[j].lastAccess) {
+			return entries[i].lastAccess.Before(entries[j].lastAccess)
+		}
+		return entries[i].key < entries[j].key
+	})
+}
+
+// evictVersions drops versions that fall outside each label's keep window or have not been served within MaxAge.
+func (s *CommonStorageImpl) evictVersions(ctx context.Context, policy *Retention, now time.Time, report *EvictionReport) error {
+	hosts, err := s.ListHosts(ctx)
+	if err != nil {
+		return err
+	}
+	for _, host := range hosts {
+		names, err := s.ListNamesForHost(ctx, host)
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			loc := Locator{Host: host, Name: name}
+			bindings, err := s.GetLabels(ctx, loc)
+			if err != nil {
+				if !isNotFoundError(err) {
+					return err
+				}
+				bindings = &LabelBindings{Labels: map[string]string{}}
+			}
+			versions, err := s.ListVersions(ctx, loc)
+			if err != nil {
+				return err
+			}
+			evicted := map[string]string{}
+			if policy.KeepVersions > 0 {
+				for versionID := range versionsOutsideKeepWindow(bindings, policy.KeepVersions) {
+					evicted[versionID] = "keep_versions"
+				}
+			}
+			if policy.MaxAge > 0 {
+				for _, v := range versions {
+					last := v.CreatedAt
+					if rec := s.accessRecord(ctx, func(log *accessLog) map[string]*AccessRecord { return log.Versions }, versionAccessKey(host, name, v.VersionID)); rec != nil {
+						last = rec.LastAccess
+					}
+					if now.Sub(last) > policy.MaxAge {
+						evicted[v.VersionID] = "age"
+					}
+				}
+			}
+			if len(evicted) == 0 {
+				continue
+			}
+			if err := s.keepLinkedVersions(ctx, loc, versions, evicted); err != nil {
+				return err
+			}
+			for _, v := range versions {
+				reason, ok := evicted[v.VersionID]
+				if !ok {
+					continue
+				}
+				if err := s.DeleteVersion(ctx, Locator{Host: host, Name: name, VersionID: v.VersionID}); err != nil {
+					return err
+				}
+				report.Versions++
+				_ = evictions.Inc(s.metricType, s.metricRepo, "version", reason)
+			}
+		}
+	}
+	return nil
+}
+
+// keepLinkedVersions removes from evicted every version linked from a version that survives, so the platform manifests
+// of a retained index stay available.
+func (s *CommonStorageImpl) keepLinkedVersions(ctx context.Context, loc Locator, versions []VersionSummary, evicted map[string]string) error {
+	for changed := true; changed; {
+		changed = false
+		for _, v := range versions {
+			if _, ok := evicted[v.VersionID]; ok {
+				continue
+			}
+			loc.VersionID = v.VersionID
+			meta, err := s.GetVersionMeta(ctx, loc)
+			if err != nil {
+				if isNotFoundError(err) {
+					continue
+				}
+				return err
+			}
+			for _, link := range meta.Links {
+				if _, ok := evicted[link]; ok {
+					delete(evicted, link)
+					changed = true
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// versionsOutsideKeepWindow returns versions remembered by a label's history that are older than its newest keep entries.
+func versionsOutsideKeepWindow(bindings *LabelBindings, keep int) map[string]struct{} {
+	retained := map[string]struct{}{}
+	candidates := map[string]struct{}{}
+	labels := map[string]struct{}{}
+	for label := range bindings.Labels {
+		labels[label] = struct{}{}
+	}
+	for label := range bindings.History {
+		labels[label] = struct{}{}
+	}
+	for label := range labels {
+		var window []string
+		if current := bindings.Labels[label]; current != "" {
+			window = append(window, current)
+		}
+		window = append(window, bindings.History[label]...)
+		for i, versionID := range window {
+			if i < keep {
+				retained[versionID] = struct{}{}
+			} else {
+				candidates[versionID] = struct{}{}
+			}
+		}
+	}
+	for versionID := range retained {
+		delete(candidates, versionID)
+	}
+	return candidates
+}
+
+// pruneLabels removes evicted versions from label bindings and histories.
+func (s *CommonStorageImpl) pruneLabels(ctx context.Context, host, name string, evicted map[string]string) error {
+	metaFS, err := s.metadataIndexFS(ctx)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.pruneLabelsLocked(ctx, metaFS, host, name, evicted)
+}
+
+// pruneLabelsLocked is pruneLabels for callers holding s.mu.
+func (s *CommonStorageImpl) pruneLabelsLocked(ctx context.Context, metaFS storage.WritableFS, host, name string, evicted map[string]string) error {
+	labelDoc, err := s.readLabels(ctx, metaFS, host, name)
+	if err != nil {
+		if isNotFoundError(err) {
+			return nil
+		}
+		return err
+	}
+	changed := false
+	for label, versionID := range labelDoc.Labels {
+		if _, ok := evicted[versionID]; ok {
+			delete(labelDoc.Labels, label)
+			changed = true
+		}
+	}
+	for label, history := range labelDoc.History {
+		kept := history[:0]
+		for _, versionID := range history {
+			if _, ok := evicted[versionID]; ok {
+				changed = true
+				continue
+			}
+			kept = append(kept, versionID)
+		}
+		if len(kept) == 0 {
+			delete(labelDoc.History, label)
+		} else {
+			labelDoc.History[label] = kept
+		}
+	}
+	if !changed {
+		return nil
+	}
+	labelDoc.UpdatedAt = time.Now().UTC()
+	return s.writeLabels(ctx, metaFS, host, name, labelDoc)
+}
+
+// contentEntries lists every blob (including pooled blobs this root holds) and, when files is set, every file outside
+// metadata/ and blobs/ with its size and last access time.
+func (s *CommonStorageImpl) contentEntries(ctx context.Context, files bool) ([]contentEntry, error) {
+	blobsFS, err := s.blobsRoot(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var entries []contentEntry
+	seen := map[string]struct{}{}
+	blobVisitor := func(blobsFS storage.WritableFS, pooled bool) func(blobKey, rel string) error {
+		return func(blobKey, rel string) error {
+			if strings.Contains(rel, ".tmp-") {
+				return nil
+			}
+			if _, ok := seen[blobKey]; ok {
+				return nil
+			}
+			if pooled && !s.pool.holds(ctx, blobKey, s.poolHolder) {
+				return nil
+			}
+			info, err := blobsFS.Stat(ctx, rel)
+			if err != nil {
+				if isNotFoundError(err) {
+					return nil
+				}
+				return err
+			}
+			seen[blobKey] = struct{}{}
+			entry := contentEntry{blob: true, pooled: pooled, key: blobKey, rel: rel, size: info.Size(), lastAccess: info.ModTime()}
+			if rec := s.accessRecord(ctx, func(log *accessLog) map[string]*AccessRecord { return log.Blobs }, blobKey); rec != nil {
+				entry.lastAccess = rec.LastAccess
+				entry.count = rec.Count
+			}
+			entries = append(entries, entry)
+			return nil
+		}
+	}
+	if err := walkBlobs(ctx, blobsFS, blobVisitor(blobsFS, false)); err != nil {
+		return nil, err
+	}
+	if s.pool != nil {
+		poolFS, err := s.pool.blobs(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if err := walkBlobs(ctx, poolFS, blobVisitor(poolFS, true)); err != nil {
+			return nil, err
+		}
+	}
+	if !files {
+		return entries, nil
+	}
+	err = walkFiles(ctx, s.fs, "", func(rel string) error {
+		info, err := s.fs.Stat(ctx, rel)
+		if err != nil {
+			if isNotFoundError(err) {
+				return nil
+			}
+			return err
+		}
+		entry := contentEntry{key: rel, rel: rel, size: info.Size(), lastAccess: info.ModTime()}
+		if rec := s.accessRecord(ctx, func(log *accessLog) map[string]*AccessRecord { return log.Files }, rel); rec != nil {
+			entry.lastAccess = rec.LastAccess
+			entry.count = rec.Count
+		}
+		entries = append(entries, entry)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+func (s *CommonStorageImpl) evictEntry(ctx context.Context, entry contentEntry, reason string, report *EvictionReport) error {
+	kind := "file"
+	var target storage.WritableFS = s.fs
+	if entry.blob {
+		kind = "blob"
+		blobsFS, err := s.blobsRoot(ctx)
+		if err != nil {
+			return err
+		}
+		target = blobsFS
+	}
+	if entry.pooled {
+		if _, err := s.pool.Release(ctx, entry.key, s.poolHolder); err != nil {
+			return err
+		}
+	} else if err := target.Delete(ctx, entry.rel, nil); err != nil && !isNotFoundError(err) {
+		return err
+	}
+	s.forgetAccess(func(log *accessLog) map[string]*AccessRecord {
+		if entry.blob {
+			return log.Blobs
+		}
+		return log.Files
+	}, entry.key)
+	if entry.blob {
+		report.Blobs++
+	} else {
+		report.Files++
+	}
+	report.EvictedBytes += entry.size
+	_ = evictions.Inc(s.metricType, s.metricRepo, kind, reason)
+	if entry.size > 0 {
+		_ = evictedBytes.IncN(entry.size, s.metricType, s.metricRepo)
+	}
+	return nil
+}
+
+// walkFiles visits every regular file beneath rel, skipping the metadata and blob areas and temporary files.
+func walkFiles(ctx context.Context, fs storage.WritableFS, rel string, visit func(rel string) error) error {
+	dirs, err := readDirNames(ctx, fs, rel, true)
+	if err != nil {
+		return err
+	}
+	files, err := readDirNames(ctx, fs, rel, false)
+	if err != nil {
+		return err
+	}
+	for _, name := range files {
+		if name == accessFileName || strings.Contains(name, ".tmp-") {
+			continue
+		}
+		if err := visit(path.Join(rel, name)); err != nil {
+			return err
+		}
+	}
+	for _, dir := range dirs {
+		if rel == "" && (dir == metadataRootDir || dir == blobsRootDir) {
+			continue
+		}
+		if err := walkFiles(ctx, fs, path.Join(rel, dir), visit); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func versionAccessKey(host, name, versionID string) string {
+	return host + "/" + name + "@" + versionID
+}
+
+func (s *CommonStorageImpl) recordAccess(ctx context.Context, table func(*accessLog) map[string]*AccessRecord, key string) {
+	s.accessMu.Lock()
+	defer s.accessMu.Unlock()
+	log := s.accessLogLocked(ctx)
+	records := table(log)
+	rec, ok := records[key]
+	if !ok {
+		rec = &AccessRecord{}
+		records[key] = rec
+	}
+	rec.LastAccess = time.Now().UTC()
+	rec.Count++
+	log.dirty = true
+	if !s.accessFlushPending {
+		s.accessFlushPending = true
+		pendingAccessLogs.add(s)
+		time.AfterFunc(accessFlushDelay, func() {
+			if err := s.flushAccess(context.WithoutCancel(ctx)); err != nil {
+				slog.WarnContext(ctx, "failed to persist access log", "error", err)
+			}
+		})
+	}
+}
+
+func (s *CommonStorageImpl) accessRecord(ctx context.Context, table func(*accessLog) map[string]*AccessRecord, key string) *AccessRecord {
+	s.accessMu.Lock()
+	defer s.accessMu.Unlock()
+	rec, ok := table(s.accessLogLocked(ctx))[key]
+	if !ok {
+		return nil
+	}
+	copied := *rec
+	return &copied
+}
+
+func (s *CommonStorageImpl) forgetAccess(table func(*accessLog) map[string]*AccessRecord, key string) {
+	s.accessMu.Lock()
+	defer s.accessMu.Unlock()
+	if s.access == nil {
+		return
+	}
+	records := table(s.access)
+	if _, ok := records[key]; ok {
+		delete(records, key)
+		s.access.dirty = true
+	}
+}
+
+// accessLogLocked lazily loads metadata/access.json; callers must hold accessMu.
+func (s *CommonStorageImpl) accessLogLocked(ctx context.Context) *accessLog {
+	if s.access != nil {
+		return s.access
+	}
+	log := &accessLog{}
+	if err := readJSONFile(ctx, s.fs, path.Join(metadataRootDir, accessFileName), log); err != nil && !isNotFoundError(err) {
+		slog.WarnContext(ctx, "ignoring unreadable access log", "error", err)
+		log = &accessLog{}
+	}
+	log.Kind = accessKind
+	if log.Blobs == nil {
+		log.Blobs = map[string]*AccessRecord{}
+	}
+	if log.Versions == nil {
+		log.Versions = map[string]*AccessRecord{}
+	}
+	if log.Files == nil {
+		log.Files = map[string]*AccessRecord{}
+	}
+	s.access = log
+	return log
+}
+
+// accessLogSet tracks the CommonStorage roots with access records that have not been persisted yet.
+type accessLogSet struct {
+	mu    sync.Mutex
+	roots map[*CommonStorageImpl]struct{}
+}
+
+var pendingAccessLogs = &accessLogSet{roots: map[*CommonStorageImpl]struct{}{}}
+
+func (a *accessLogSet) add(s *CommonStorageImpl) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.roots[s] = struct{}{}
+}
+
+func (a *accessLogSet) remove(s *CommonStorageImpl) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.roots, s)
+}
+
+// FlushAccessLogs persists every access log with unsaved records. Access logs are otherwise written a minute after
+// they change, so callers should flush them before the process exits.
+func FlushAccessLogs(ctx context.Context) error {
+	pendingAccessLogs.mu.Lock()
+	roots := make([]*CommonStorageImpl, 0, len(pendingAccessLogs.roots))
+	for s := range pendingAccessLogs.roots {
+		roots = append(roots, s)
+	}
+	pendingAccessLogs.mu.Unlock()
+
+	var errs []error
+	for _, s := range roots {
+		if err := s.flushAccess(ctx); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// flushAccess persists the access log when it has changed since the last flush.
+func (s *CommonStorageImpl) flushAccess(ctx context.Context) error {
+	s.accessMu.Lock()
+	s.accessFlushPending = false
+	pendingAccessLogs.remove(s)
+	if s.access == nil || !s.access.dirty {
+		s.accessMu.Unlock()
+		return nil
+	}
+	s.access.UpdatedAt = time.Now().UTC()
+	snapshot := &accessLog{
+		Kind:      s.access.Kind,
+		Blobs:     copyAccessRecords(s.access.Blobs),
+		Versions:  copyAccessRecords(s.access.Versions),
+		Files:     copyAccessRecords(s.access.Files),
+		UpdatedAt: s.access.UpdatedAt,
+	}
+	s.access.dirty = false
+	s.accessMu.Unlock()
+
+	metaFS, err := s.fs.EnsureSub(ctx, metadataRootDir)
+	if err == nil {
+		err = writeJSONAtomic(ctx, metaFS, accessFileName, snapshot)
+	}
+	if err != nil {
+		// Keep the records pending so the next flush retries them.
+		s.accessMu.Lock()
+		s.access.dirty = true
+		s.accessMu.Unlock()
+		pendingAccessLogs.add(s)
+	}
+	return err
+}
+
+func copyAccessRecords(in map[string]*AccessRecord) map[string]*AccessRecord {
+	out := make(map[string]*AccessRecord, len(in))
+	for k, v := range in {
+		copied := *v
+		out[k] = &copied
+	}
+	return out
+}
@@ -0,0 +1,288 @@
+package repo
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func putRetentionBlobs(t *testing.T, store CommonStorage, payloads ...[]byte) []string {
+	t.Helper()
+	ctx := context.Background()
+	keys := make([]string, 0, len(payloads))
+	for _, payload := range payloads {
+		key := digestOf(payload)
+		if _, err := store.PutBlob(ctx, key, bytes.NewReader(payload)); err != nil {
+			t.Fatalf("PutBlob failed: %v", err)
+		}
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func setBlobAccess(t *testing.T, store CommonStorage, key string, last time.Time, count int64) {
+	t.Helper()
+	impl := store.(*CommonStorageImpl)
+	impl.RecordBlobAccess(context.Background(), key)
+	impl.accessMu.Lock()
+	defer impl.accessMu.Unlock()
+	impl.access.Blobs[key].LastAccess = last
+	impl.access.Blobs[key].Count = count
+}
+
+func TestEvictLRURemovesLeastRecentlyUsedBlobs(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	store := newCommonStorage(t)
+	keys := putRetentionBlobs(t, store, []byte("aaaa"), []byte("bbbb"), []byte("cccc"))
+	now := time.Now()
+	setBlobAccess(t, store, keys[0], now.Add(-3*time.Minute), 10)
+	setBlobAccess(t, store, keys[1], now.Add(-1*time.Minute), 1)
+	setBlobAccess(t, store, keys[2], now.Add(-2*time.Minute), 5)
+
+	report, err := store.Evict(ctx, &Retention{MaxBytes: 8})
+	if err != nil {
+		t.Fatalf("Evict failed: %v", err)
+	}
+	if report.Blobs != 1 || report.EvictedBytes != 4 || report.RetainedBytes != 8 {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+	if _, err := store.StatBlob(ctx, keys[0]); err == nil {
+		t.Fatalf("expected least recently used blob to be evicted")
+	}
+	for _, key := range keys[1:] {
+		if _, err := store.StatBlob(ctx, key); err != nil {
+			t.Fatalf("expected blob %s to survive: %v", key, err)
+		}
+	}
+}
+
+func TestEvictLFURemovesLeastFrequentlyUsedBlobs(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	store := newCommonStorage(t)
+	keys := putRetentionBlobs(t, store, []byte("aaaa"), []byte("bbbb"), []byte("cccc"))
+	now := time.Now()
+	setBlobAccess(t, store, keys[0], now.Add(-3*time.Minute), 10)
+	setBlobAccess(t, store, keys[1], now.Add(-1*time.Minute), 1)
+	setBlobAccess(t, store, keys[2], now.Add(-2*time.Minute), 5)
+
+	report, err := store.Evict(ctx, &Retention{Policy: RetentionLFU, MaxBytes: 8})
+	if err != nil {
+		t.Fatalf("Evict failed: %v", err)
+	}
+	if report.Blobs != 1 {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+	if _, err := store.StatBlob(ctx, keys[1]); err == nil {
+		t.Fatalf("expected least frequently used blob to be evicted")
+	}
+}
+
+func TestEvictMaxAgeRemovesIdleFiles(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	store := newCommonStorage(t)
+	for _, rel := range []string{"pkgs/old.zip", "pkgs/new.zip"} {
+		if _, err := store.StoreFile(ctx, rel, bytes.NewReader([]byte(rel))); err != nil {
+			t.Fatalf("StoreFile failed: %v", err)
+		}
+		store.RecordFileAccess(ctx, rel)
+	}
+	impl := store.(*CommonStorageImpl)
+	impl.accessMu.Lock()
+	impl.access.Files["pkgs/old.zip"].LastAccess = time.Now().Add(-48 * time.Hour)
+	impl.accessMu.Unlock()
+
+	report, err := store.Evict(ctx, &Retention{MaxAge: 24 * time.Hour})
+	if err != nil {
+		t.Fatalf("Evict failed: %v", err)
+	}
+	if report.Files != 1 {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+	if _, err := store.StatFile(ctx, "pkgs/old.zip"); err == nil {
+		t.Fatalf("expected idle file to be evicted")
+	}
+	if _, err := store.StatFile(ctx, "pkgs/new.zip"); err != nil {
+		t.Fatalf("expected recent file to survive: %v", err)
+	}
+	if _, err := store.StatFile(ctx, "metadata/"+accessFileName); err != nil {
+		t.Fatalf("expected access log to be persisted: %v", err)
+	}
+}
+
+func TestEvictKeepVersionsTrimsLabelHistory(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	store := newCommonStorage(t)
+	loc := Locator{Host: "registry.test", Name: "sample/app"}
+
+	var ids []string
+	for i := 0; i < 3; i++ {
+		created, err := store.CreateVersion(ctx, loc, &VersionMeta{
+			Files: []FileEntry{{Name: "latest", BlobKey: sampleDigest, Size: 10}},
+		})
+		if err != nil {
+			t.Fatalf("CreateVersion failed: %v", err)
+		}
+		if err := store.SetLabel(ctx, Locator{Host: loc.Host, Name: loc.Name, Label: "latest", VersionID: created.VersionID}); err != nil {
+			t.Fatalf("SetLabel failed: %v", err)
+		}
+		ids = append(ids, created.VersionID)
+	}
+
+	report, err := store.Evict(ctx, &Retention{KeepVersions: 2})
+	if err != nil {
+		t.Fatalf("Evict failed: %v", err)
+	}
+	if report.Versions != 1 {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+	versions, err := store.ListVersions(ctx, loc)
+	if err != nil {
+		t.Fatalf("ListVersions failed: %v", err)
+	}
+	if len(versions) != 2 {
+		t.Fatalf("expected 2 versions to remain, got %d", len(versions))
+	}
+	for _, v := range versions {
+		if v.VersionID == ids[0] {
+			t.Fatalf("expected oldest version %s to be evicted", ids[0])
+		}
+	}
+	bindings, err := store.GetLabels(ctx, loc)
+	if err != nil {
+		t.Fatalf("GetLabels failed: %v", err)
+	}
+	if bindings.Labels["latest"] != ids[2] {
+		t.Fatalf("expected latest to stay on newest version, got %q", bindings.Labels["latest"])
+	}
+	if history := bindings.History["latest"]; len(history) != 1 || history[0] != ids[1] {
+		t.Fatalf("unexpected label history: %v", history)
+	}
+}
+
+func TestEvictMaxAgeKeepsVersionsLinkedFromSurvivors(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	store := newCommonStorage(t)
+	impl := store.(*CommonStorageImpl)
+	loc := Locator{Host: "registry.test", Name: "sample/app"}
+	create := func(links ...string) string {
+		created, err := store.CreateVersion(ctx, loc, &VersionMeta{
+			Files: []FileEntry{{Name: "manifest", BlobKey: sampleDigest, Size: 10}},
+			Links: links,
+		})
+		if err != nil {
+			t.Fatalf("CreateVersion failed: %v", err)
+		}
+		return created.VersionID
+	}
+	linked := create()
+	idle := create()
+	index := create(linked)
+	for versionID, last := range map[string]time.Time{linked: time.Now().Add(-48 * time.Hour), idle: time.Now().Add(-48 * time.Hour), index: time.Now()} {
+		impl.RecordVersionAccess(ctx, Locator{Host: loc.Host, Name: loc.Name, VersionID: versionID})
+		impl.accessMu.Lock()
+		impl.access.Versions[versionAccessKey(loc.Host, loc.Name, versionID)].LastAccess = last
+		impl.accessMu.Unlock()
+	}
+
+	report, err := store.Evict(ctx, &Retention{MaxAge: time.Hour})
+	if err != nil {
+		t.Fatalf("Evict failed: %v", err)
+	}
+	if report.Versions != 1 {
+		t.Fatalf("expected only the unlinked idle version evicted, got %+v", report)
+	}
+	for _, versionID := range []string{linked, index} {
+		if _, err := store.GetVersionMeta(ctx, Locator{Host: loc.Host, Name: loc.Name, VersionID: versionID}); err != nil {
+			t.Fatalf("expected version %s to survive: %v", versionID, err)
+		}
+	}
+}
+
+func TestEvictKeepsBlobsReferencedBySurvivingVersions(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	store := newCommonStorage(t)
+	keys := putRetentionBlobs(t, store, []byte("aaaa"), []byte("bbbb"))
+	now := time.Now()
+	setBlobAccess(t, store, keys[0], now.Add(-48*time.Hour), 1)
+	setBlobAccess(t, store, keys[1], now.Add(-48*time.Hour), 1)
+	loc := Locator{Host: "registry.test", Name: "sample/app"}
+	if _, err := store.CreateVersion(ctx, loc, &VersionMeta{
+		Files: []FileEntry{{Name: "manifest", BlobKey: keys[0], Size: 4}},
+	}); err != nil {
+		t.Fatalf("CreateVersion failed: %v", err)
+	}
+
+	report, err := store.Evict(ctx, &Retention{MaxBytes: 1, MaxAge: 24 * time.Hour, KeepVersions: 1})
+	if err != nil {
+		t.Fatalf("Evict failed: %v", err)
+	}
+	if report.Blobs != 1 || report.RetainedBytes != 4 {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+	if _, err := store.StatBlob(ctx, keys[0]); err != nil {
+		t.Fatalf("expected referenced blob to survive: %v", err)
+	}
+	if _, err := store.StatBlob(ctx, keys[1]); err == nil {
+		t.Fatalf("expected unreferenced blob to be evicted")
+	}
+}
+
+func TestEvictBlobsLeavesFiles(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	store := newCommonStorage(t)
+	keys := putRetentionBlobs(t, store, []byte("aaaa"))
+	setBlobAccess(t, store, keys[0], time.Now().Add(-48*time.Hour), 1)
+	if _, err := store.StoreFile(ctx, "tags/registry.test/sample/app/list.json", bytes.NewReader([]byte("{}"))); err != nil {
+		t.Fatalf("StoreFile failed: %v", err)
+	}
+
+	report, err := store.EvictBlobs(ctx, &Retention{MaxAge: time.Hour, MaxBytes: 1})
+	if err != nil {
+		t.Fatalf("EvictBlobs failed: %v", err)
+	}
+	if report.Blobs != 1 || report.Files != 0 {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+	if _, err := store.StatFile(ctx, "tags/registry.test/sample/app/list.json"); err != nil {
+		t.Fatalf("expected tag list to survive: %v", err)
+	}
+}
+
+func TestFlushAccessLogsPersistsPendingRecords(t *testing.T) {
+	ctx := context.Background()
+	store := newCommonStorage(t)
+	keys := putRetentionBlobs(t, store, []byte("aaaa"))
+	store.RecordBlobAccess(ctx, keys[0])
+	if _, err := store.StatFile(ctx, "metadata/"+accessFileName); err == nil {
+		t.Fatalf("expected the access log to be written lazily")
+	}
+
+	if err := FlushAccessLogs(ctx); err != nil {
+		t.Fatalf("FlushAccessLogs failed: %v", err)
+	}
+	reopened, err := NewCommonStorage(store.(*CommonStorageImpl).fs)
+	if err != nil {
+		t.Fatalf("NewCommonStorage failed: %v", err)
+	}
+	rec := reopened.(*CommonStorageImpl).accessRecord(ctx, func(log *accessLog) map[string]*AccessRecord { return log.Blobs }, keys[0])
+	if rec == nil || rec.Count != 1 {
+		t.Fatalf("expected the access record to be persisted, got %+v", rec)
+	}
+}
+
+func TestRetentionValidateRejectsUnknownPolicy(t *testing.T) {
+	t.Parallel()
+	err := (&Retention{Policy: "fifo"}).Validate()
+	if !errors.Is(err, ErrInvalidRepoConfig) {
+		t.Fatalf("expected ErrInvalidRepoConfig, got %v", err)
+	}
+}
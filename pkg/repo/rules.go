@@ -0,0 +1,257 @@
+package repo
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Rules allows or denies requests beyond the routing done by Mappings. A request matching any deny rule is refused;
+// when allow rules are present, a request must also match one of them.
+type Rules struct {
+	Allow []Rule `yaml:"allow,omitempty"`
+	Deny  []Rule `yaml:"deny,omitempty"`
+}
+
+// Rule matches requests on every field it sets. Name, Tag, Digest and Platform are path.Match globs ("*" stays within
+// one path segment); Version is a constraint such as ">= 1.2, < 2.0" or "~> 5.0".
+type Rule struct {
+	// Name matches the repository name (container), namespace/type (terraform provider) or namespace/name/provider
+	// (terraform module).
+	Name string `yaml:"name,omitempty"`
+	// Tag matches the container tag or terraform provider version as written.
+	Tag string `yaml:"tag,omitempty"`
+	// Version constrains the tag or provider version read as a version number.
+	Version string `yaml:"version,omitempty"`
+	// Digest matches the requested manifest or blob digest.
+	Digest string `yaml:"digest,omitempty"`
+	// Platform matches os/arch, e.g. "linux/*".
+	Platform string `yaml:"platform,omitempty"`
+}
+
+// RuleSubject describes a request for rule evaluation. Fields a request does not carry are left empty.
+type RuleSubject struct {
+	Name      string
+	Reference string // tag or version
+	Digest    string
+	Platform  string // os/arch
+}
+
+// Rule decision reasons returned by Rules.Evaluate and used as metric labels.
+const (
+	RuleDenied     = "deny_rule"
+	RuleNotAllowed = "not_allowed"
+)
+
+// Validate reports configuration errors in the rules block.
+func (r *Rules) Validate() error {
+	if r == nil {
+		return nil
+	}
+	for _, rule := range append(append([]Rule{}, r.Allow...), r.Deny...) {
+		for _, pattern := range []string{rule.Name, rule.Tag, rule.Digest, rule.Platform} {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("%w: invalid rule pattern %q", ErrInvalidRepoConfig, pattern)
+			}
+		}
+		if rule.Version != "" {
+			if _, err := parseVersionConstraint(rule.Version); err != nil {
+				return fmt.Errorf("%w: %v", ErrInvalidRepoConfig, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Evaluate reports whether subject may be served and, if not, why (RuleDenied or RuleNotAllowed).
+// A deny rule only matches when the request carries every field the rule sets, so `tag: latest` does not block blob
+// fetches. An allow rule ignores the fields the request does not carry.
+func (r *Rules) Evaluate(subject RuleSubject) (bool, string) {
+	if r == nil {
+		return true, ""
+	}
+	for _, rule := range r.Deny {
+		if rule.matches(subject, false) {
+			return false, RuleDenied
+		}
+	}
+	if len(r.Allow) == 0 {
+		return true, ""
+	}
+	for _, rule := range r.Allow {
+		if rule.matches(subject, true) {
+			return true, ""
+		}
+	}
+	return false, RuleNotAllowed
+}
+
+// matches checks each field the rule sets; unknown reports how a field missing from the subject is treated.
+func (r Rule) matches(subject RuleSubject, unknown bool) bool {
+	check := func(pattern, value string, match func(string, string) bool) bool {
+		if pattern == "" {
+			return true
+		}
+		if value == "" {
+			return unknown
+		}
+		return match(pattern, value)
+	}
+	glob := func(pattern, value string) bool {
+		ok, _ := path.Match(pattern, value)
+		return ok
+	}
+	version := func(constraint, value string) bool {
+		c, err := parseVersionConstraint(constraint)
+		return err == nil && c.allows(value)
+	}
+	return check(r.Name, subject.Name, glob) &&
+		check(r.Tag, subject.Reference, glob) &&
+		check(r.Version, subject.Reference, version) &&
+		check(r.Digest, subject.Digest, glob) &&
+		check(r.Platform, subject.Platform, glob)
+}
+
+// VersionAllowed reports whether version satisfies constraint, written as in Rule.Version.
+func VersionAllowed(constraint, version string) (bool, error) {
+	c, err := parseVersionConstraint(constraint)
+	if err != nil {
+		return false, err
+	}
+	return c.allows(version), nil
+}
+
+// CompareVersions orders a and b as version numbers. Strings that are not versions sort before all versions.
+func CompareVersions(a, b string) int {
+	av, aPre, aOK := parseVersion(a)
+	bv, bPre, bOK := parseVersion(b)
+	switch {
+	case !aOK && !bOK:
+		return strings.Compare(a, b)
+	case !aOK:
+		return -1
+	case !bOK:
+		return 1
+	}
+	return compareVersions(av, aPre, bv, bPre)
+}
+
+// versionConstraint is a comma-separated list of comparisons that must all hold.
+type versionConstraint []versionComparison
+
+type versionComparison struct {
+	op      string
+	version []int
+	pre     string
+	upper   []int // exclusive upper bound for "~>"
+}
+
+func parseVersionConstraint(s string) (versionConstraint, error) {
+	var c versionConstraint
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		op := "="
+		for _, candidate := range []string{"~>", ">=", "<=", "!=", ">", "<", "="} {
+			if strings.HasPrefix(part, candidate) {
+				op = candidate
+				part = strings.TrimSpace(part[len(candidate):])
+				break
+			}
+		}
+		version, pre, ok := parseVersion(part)
+		if !ok {
+			return nil, fmt.Errorf("invalid version constraint %q", s)
+		}
+		cmp := versionComparison{op: op, version: version, pre: pre}
+		if op == "~>" {
+			// ~> 1.2 allows 1.x from 1.2; ~> 1.2.3 allows 1.2.x from 1.2.3.
+			if len(version) < 2 {
+				return nil, fmt.Errorf("invalid version constraint %q: ~> needs major.minor", s)
+			}
+			cmp.upper = append([]int{}, version[:len(version)-1]...)
+			cmp.upper[len(cmp.upper)-1]++
+		}
+		c = append(c, cmp)
+	}
+	return c, nil
+}
+
+func (c versionConstraint) allows(s string) bool {
+	version, pre, ok := parseVersion(s)
+	if !ok {
+		return false
+	}
+	for _, cmp := range c {
+		order := compareVersions(version, pre, cmp.version, cmp.pre)
+		var holds bool
+		switch cmp.op {
+		case "=":
+			holds = order == 0
+		case "!=":
+			holds = order != 0
+		case ">":
+			holds = order > 0
+		case ">=":
+			holds = order >= 0
+		case "<":
+			holds = order < 0
+		case "<=":
+			holds = order <= 0
+		case "~>":
+			holds = order >= 0 && compareVersions(version, pre, cmp.upper, "") < 0
+		}
+		if !holds {
+			return false
+		}
+	}
+	return true
+}
+
+// parseVersion reads "v1.2.3-pre+build" as numeric components and a pre-release label.
+func parseVersion(s string) ([]int, string, bool) {
+	s = strings.TrimPrefix(strings.TrimSpace(s), "v")
+	s, _, _ = strings.Cut(s, "+")
+	s, pre, _ := strings.Cut(s, "-")
+	if s == "" {
+		return nil, "", false
+	}
+	var version []int
+	for _, field := range strings.Split(s, ".") {
+		n, err := strconv.Atoi(field)
+		if err != nil || n < 0 {
+			return nil, "", false
+		}
+		version = append(version, n)
+	}
+	return version, pre, true
+}
+
+// compareVersions orders versions numerically, treating missing components as 0 and pre-releases as lower.
+func compareVersions(a []int, aPre string, b []int, bPre string) int {
+	for i := 0; i < len(a) || i < len(b); i++ {
+		var x, y int
+		if i < len(a) {
+			x = a[i]
+		}
+		if i < len(b) {
+			y = b[i]
+		}
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	switch {
+	case aPre == bPre:
+		return 0
+	case aPre == "":
+		return 1
+	case bPre == "":
+		return -1
+	default:
+		return strings.Compare(aPre, bPre)
+	}
+}
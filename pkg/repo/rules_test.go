@@ -0,0 +1,109 @@
+package repo
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestRulesEvaluate(t *testing.T) {
+	t.Parallel()
+	rules := &Rules{
+		Allow: []Rule{{Name: "library/*"}, {Name: "hashicorp/aws", Version: "~> 5.0"}},
+		Deny: []Rule{
+			{Tag: "latest"},
+			{Digest: "sha256:bad*"},
+			{Name: "library/*", Platform: "*/arm64"},
+		},
+	}
+	for _, tc := range []struct {
+		subject RuleSubject
+		allowed bool
+		reason  string
+	}{
+		{RuleSubject{Name: "library/alpine", Reference: "3.20"}, true, ""},
+		{RuleSubject{Name: "library/alpine", Reference: "latest"}, false, RuleDenied},
+		{RuleSubject{Name: "library/alpine", Digest: "sha256:abc"}, true, ""},
+		{RuleSubject{Name: "library/alpine", Digest: "sha256:bad0"}, false, RuleDenied},
+		{RuleSubject{Name: "library/alpine", Digest: "sha256:abc", Platform: "linux/arm64"}, false, RuleDenied},
+		{RuleSubject{Name: "team/app"}, false, RuleNotAllowed},
+		{RuleSubject{Name: "hashicorp/aws"}, true, ""}, // the version is not known for a version list
+		{RuleSubject{Name: "hashicorp/aws", Reference: "5.31.0"}, true, ""},
+		{RuleSubject{Name: "hashicorp/aws", Reference: "6.0.0"}, false, RuleNotAllowed},
+		{RuleSubject{Name: "hashicorp/aws", Reference: "4.67.0"}, false, RuleNotAllowed},
+	} {
+		allowed, reason := rules.Evaluate(tc.subject)
+		if allowed != tc.allowed || reason != tc.reason {
+			t.Errorf("%+v: got %v %q, want %v %q", tc.subject, allowed, reason, tc.allowed, tc.reason)
+		}
+	}
+	var unset *Rules
+	if allowed, _ := unset.Evaluate(RuleSubject{Name: "anything"}); !allowed {
+		t.Fatalf("expected nil rules to allow everything")
+	}
+}
+
+func TestVersionConstraints(t *testing.T) {
+	t.Parallel()
+	for _, tc := range []struct {
+		constraint string
+		version    string
+		allowed    bool
+	}{
+		{">= 1.2, < 2.0", "1.2.0", true},
+		{">= 1.2, < 2.0", "v1.10.3", true},
+		{">= 1.2, < 2.0", "2.0.0", false},
+		{">= 1.2, < 2.0", "2.0.0-rc1", true},
+		{"~> 1.2.3", "1.2.9", true},
+		{"~> 1.2.3", "1.3.0", false},
+		{"!= 3.0.0", "3.0.0", false},
+		{"1.0", "1.0.0", true},
+		{"> 1.0", "nightly", false},
+	} {
+		c, err := parseVersionConstraint(tc.constraint)
+		if err != nil {
+			t.Fatalf("%q: %v", tc.constraint, err)
+		}
+		if got := c.allows(tc.version); got != tc.allowed {
+			t.Errorf("%q allows %q = %v, want %v", tc.constraint, tc.version, got, tc.allowed)
+		}
+	}
+}
+
+func TestCompareVersions(t *testing.T) {
+	t.Parallel()
+	for _, tc := range []struct {
+		a, b string
+		want int
+	}{
+		{"1.10.0", "1.9.0", 1},
+		{"v2.0", "2.0.0", 0},
+		{"2.0.0-rc1", "2.0.0", -1},
+		{"nightly", "0.0.1", -1},
+	} {
+		if got := CompareVersions(tc.a, tc.b); got != tc.want {
+			t.Errorf("CompareVersions(%q, %q) = %d, want %d", tc.a, tc.b, got, tc.want)
+		}
+	}
+	if ok, err := VersionAllowed("~> 5.0", "5.31.0"); !ok || err != nil {
+		t.Fatalf("expected 5.31.0 to satisfy ~> 5.0, got %v %v", ok, err)
+	}
+	if _, err := VersionAllowed("~> 5", "5.31.0"); err == nil {
+		t.Fatalf("expected invalid constraint to be rejected")
+	}
+}
+
+func TestRulesValidate(t *testing.T) {
+	t.Parallel()
+	for _, rules := range []*Rules{
+		{Deny: []Rule{{Name: "library/[a"}}},
+		{Allow: []Rule{{Version: ">= one"}}},
+		{Allow: []Rule{{Version: "~> 2"}}},
+	} {
+		if err := rules.Validate(); !errors.Is(err, ErrInvalidRepoConfig) {
+			t.Errorf("expected %+v to be rejected, got %v", rules, err)
+		}
+	}
+	if err := (&Rules{Deny: []Rule{{Tag: "latest", Version: ">= 2.0"}}}).Validate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
@@ -3,6 +3,7 @@ package repo
 import (
 	"context"
 	"errors"
+	"path"
 	"strings"
 	"sync"
 
@@ -34,6 +35,7 @@ type InstanceDetails struct {
 	name     string
 	common   CommonStorage
 	instance Instance
+	config   *Repo
 }
 
 // TypeMeta captures human-friendly labels for UI use.
@@ -95,6 +97,21 @@ func NewRepository(ctx context.Context, config *Repo) (Instance, error) {
 	if repoName == "" {
 		repoName = "default"
 	}
+	if err := config.Retention.Validate(); err != nil {
+		return nil, err
+	}
+	if err := config.Freshness.Validate(); err != nil {
+		return nil, err
+	}
+	if err := config.validateMode(); err != nil {
+		return nil, err
+	}
+	if err := config.Policy.Validate(); err != nil {
+		return nil, err
+	}
+	if err := config.Rules.Validate(); err != nil {
+		return nil, err
+	}
 	existing, ok := rTypeDetail.instances[repoName]
 	if ok && existing != nil && existing.instance != nil {
 		return existing.instance, nil
@@ -111,6 +128,9 @@ func NewRepository(ctx context.Context, config *Repo) (Instance, error) {
 	if err != nil {
 		return nil, err
 	}
+	if sharedPool != nil {
+		common.(*CommonStorageImpl).usePool(sharedPool, path.Join("type", config.Type, repoName))
+	}
 	repo, err := rTypeDetail.rType.NewRepository(ctx, common, config)
 	if err != nil {
 		return nil, err
@@ -119,6 +139,7 @@ func NewRepository(ctx context.Context, config *Repo) (Instance, error) {
 		name:     repoName,
 		common:   common,
 		instance: repo,
+		config:   config,
 	}
 	return repo, nil
 }
@@ -86,7 +86,7 @@ func handleListRepositoriesForType(w http.ResponseWriter, r *http.Request) {
 	}
 	var repos []InstanceMeta
 	for _, inst := range td.instances {
-		if inst == nil || inst.instance == nil {
+		if inst == nil || inst.instance == nil || !Authorized(r.Context(), inst.config, "", ActionRead) {
 			continue
 		}
 		repoMeta := inst.instance.Describe()
@@ -108,9 +108,8 @@ func handleListRepositoriesForType(w http.ResponseWriter, r *http.Request) {
 
 func handleListItems(w http.ResponseWriter, r *http.Request) {
 	repoID := r.PathValue("repoId")
-	inst := getInstanceByRepoID(repoID)
-	if inst == nil || inst.common == nil {
-		writeError(w, http.StatusNotFound, "NOT_FOUND", "repository not found")
+	inst := lookupReadable(w, r, repoID, "")
+	if inst == nil {
 		return
 	}
 	store := inst.common
@@ -128,6 +127,9 @@ func handleListItems(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		for _, name := range names {
+			if !Authorized(ctx, inst.config, name, ActionRead) {
+				continue
+			}
 			id := repoID + ":" + host + "/" + name
 			items = append(items, map[string]any{
 				"id":     id,
@@ -152,9 +154,8 @@ func handleListVersions(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusBadRequest, "INVALID_ARGUMENT", err.Error())
 		return
 	}
-	inst := getInstanceByRepoID(repoID)
-	if inst == nil || inst.common == nil {
-		writeError(w, http.StatusNotFound, "NOT_FOUND", "repository not found")
+	inst := lookupReadable(w, r, repoID, name)
+	if inst == nil {
 		return
 	}
 	ctx := r.Context()
@@ -221,9 +222,8 @@ func handleListFiles(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusBadRequest, "INVALID_ARGUMENT", err.Error())
 		return
 	}
-	inst := getInstanceByRepoID(repoID)
-	if inst == nil || inst.common == nil {
-		writeError(w, http.StatusNotFound, "NOT_FOUND", "repository not found")
+	inst := lookupReadable(w, r, repoID, name)
+	if inst == nil {
 		return
 	}
 	ctx := r.Context()
@@ -260,9 +260,8 @@ func handleFileDetail(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusBadRequest, "INVALID_ARGUMENT", err.Error())
 		return
 	}
-	inst := getInstanceByRepoID(repoID)
-	if inst == nil || inst.common == nil {
-		writeError(w, http.StatusNotFound, "NOT_FOUND", "repository not found")
+	inst := lookupReadable(w, r, repoID, name)
+	if inst == nil {
 		return
 	}
 	ctx := r.Context()
@@ -409,6 +408,21 @@ func getTypeByID(typeID string) *TypeDetails {
 	return nil
 }
 
+// lookupReadable returns the instance for repoID if the client may read name in it (any name when empty). Otherwise
+// it answers r itself and returns nil.
+func lookupReadable(w http.ResponseWriter, r *http.Request, repoID, name string) *InstanceDetails {
+	inst := getInstanceByRepoID(repoID)
+	if inst == nil || inst.common == nil {
+		writeError(w, http.StatusNotFound, "NOT_FOUND", "repository not found")
+		return nil
+	}
+	if !Authorized(r.Context(), inst.config, name, ActionRead) {
+		writeError(w, http.StatusForbidden, "PERMISSION_DENIED", "access to the repository is denied")
+		return nil
+	}
+	return inst
+}
+
 func getInstanceByRepoID(repoID string) *InstanceDetails {
 	rTypeLock.RLock()
 	defer rTypeLock.RUnlock()
@@ -0,0 +1,284 @@
+package tf
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/davidjspooner/go-http-client/pkg/client"
+	"github.com/davidjspooner/repoxy/pkg/repo"
+)
+
+// tfUpstreamAuth holds the bearer token Terraform would send to a private registry host. Like Terraform, the token
+// is only sent to that host, so archive downloads redirected to other hosts do not see it.
+type tfUpstreamAuth struct {
+	host   string
+	source tokenSource
+}
+
+type tokenSource interface {
+	// Token returns the current token, or a new one when refresh is set because upstream rejected the last.
+	Token(ctx context.Context, refresh bool) (string, error)
+}
+
+type staticToken string
+
+func (s staticToken) Token(context.Context, bool) (string, error) {
+	return string(s), nil
+}
+
+// newTFUpstreamAuth returns the credentials configured by upstream.auth, or nil when there are none. Providers are
+// token (a static API token, like a credentials block in .terraformrc), credentials-file (a token from a
+// credentials.tfrc.json written by terraform login) and login (a token obtained with the password grant of the
+// OAuth server the registry announces as login.v1).
+func newTFUpstreamAuth(httpClient func() client.Interface, upstream repo.Upstream) (*tfUpstreamAuth, error) {
+	if upstream.Auth == nil {
+		return nil, nil
+	}
+	u, err := url.Parse(upstream.URL)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("terraform upstream auth requires an upstream url")
+	}
+	auth := &tfUpstreamAuth{host: u.Host}
+	cfg := upstream.Auth.Config
+	if host := cfg["hostname"]; host != "" {
+		auth.host = host
+	}
+	switch strings.ToLower(upstream.Auth.Provider) {
+	case "token", "bearer":
+		if cfg["token"] == "" {
+			return nil, fmt.Errorf("token upstream auth requires token")
+		}
+		auth.source = staticToken(cfg["token"])
+	case "credentials-file":
+		token, err := readCredentialsFile(cfg["path"], auth.host)
+		if err != nil {
+			return nil, err
+		}
+		auth.source = staticToken(token)
+	case "login":
+		if cfg["username"] == "" || cfg["password"] == "" {
+			return nil, fmt.Errorf("login upstream auth requires username and password")
+		}
+		auth.source = &loginTokenSource{
+			client:    httpClient,
+			discovery: u.Scheme + "://" + auth.host + "/.well-known/terraform.json",
+			username:  cfg["username"],
+			password:  cfg["password"],
+			now:       time.Now,
+		}
+	default:
+		return nil, fmt.Errorf("unsupported upstream auth provider %q", upstream.Auth.Provider)
+	}
+	return auth, nil
+}
+
+// readCredentialsFile returns the token for host in a credentials.tfrc.json. path defaults to the file terraform login
+// writes for the current user.
+func readCredentialsFile(path, host string) (string, error) {
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", fmt.Errorf("credentials-file upstream auth requires path: %w", err)
+		}
+		path = filepath.Join(home, ".terraform.d", "credentials.tfrc.json")
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("read terraform credentials: %w", err)
+	}
+	var file struct {
+		Credentials map[string]struct {
+			Token string `json:"token"`
+		} `json:"credentials"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return "", fmt.Errorf("parse terraform credentials %s: %w", path, err)
+	}
+	for name, creds := range file.Credentials {
+		if strings.EqualFold(name, host) && creds.Token != "" {
+			return creds.Token, nil
+		}
+	}
+	return "", fmt.Errorf("%s has no token for %s", path, host)
+}
+
+// errLoginUnsupported reports a registry whose login.v1 service cannot issue tokens to the login provider.
+var errLoginUnsupported = errors.New("login upstream auth is not supported by the registry")
+
+// validate checks at configuration time that the registry can issue tokens to the login provider, whose login.v1
+// service must support the password grant. A registry that cannot be reached is only logged, so an upstream outage
+// does not stop the proxy from starting.
+func (a *tfUpstreamAuth) validate(ctx context.Context) error {
+	login, ok := a.source.(*loginTokenSource)
+	if !ok {
+		return nil
+	}
+	_, err := login.discover(ctx)
+	if errors.Is(err, errLoginUnsupported) {
+		return err
+	}
+	if err != nil {
+		slog.WarnContext(ctx, "could not check terraform upstream login", "discovery", login.discovery, "error", err)
+	}
+	return nil
+}
+
+// middleware adds the bearer token to requests for the registry host that do not carry credentials already.
+func (a *tfUpstreamAuth) middleware(next client.Interface) client.Interface {
+	return client.Func(func(req *http.Request) (*http.Response, error) {
+		if !strings.EqualFold(req.URL.Host, a.host) || req.Header.Get("Authorization") != "" {
+			return next.Do(req)
+		}
+		token, err := a.source.Token(req.Context(), false)
+		if err != nil {
+			return nil, fmt.Errorf("terraform upstream auth: %w", err)
+		}
+		req = req.Clone(req.Context())
+		req.Header.Set("Authorization", "Bearer "+token)
+		return next.Do(req)
+	})
+}
+
+// authorization returns the header to retry a request upstream answered with 401, or "" when a retry cannot help.
+func (a *tfUpstreamAuth) authorization(resp *http.Response) (string, error) {
+	if resp == nil || resp.Request == nil || !strings.EqualFold(resp.Request.URL.Host, a.host) {
+		return "", nil
+	}
+	token, err := a.source.Token(resp.Request.Context(), true)
+	if err != nil {
+		return "", err
+	}
+	header := "Bearer " + token
+	if header == resp.Request.Header.Get("Authorization") {
+		return "", nil
+	}
+	return header, nil
+}
+
+// loginTokenSource obtains tokens from the OAuth server of the login.v1 service in the registry's discovery document.
+type loginTokenSource struct {
+	client    func() client.Interface
+	discovery string
+	username  string
+	password  string
+	now       func() time.Time
+	flights   repo.Coalescer // one token exchange at a time, without holding mu
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time // zero when the token does not expire
+}
+
+func (s *loginTokenSource) Token(ctx context.Context, refresh bool) (string, error) {
+	s.mu.Lock()
+	token := s.token
+	fresh := token != "" && (s.expires.IsZero() || s.now().Before(s.expires.Add(-10*time.Second)))
+	s.mu.Unlock()
+	if fresh && !refresh {
+		return token, nil
+	}
+	val, err := s.flights.Do(ctx, "token", s.login)
+	if err != nil {
+		return "", err
+	}
+	return val.(string), nil
+}
+
+// login exchanges the configured username and password for a new token.
+func (s *loginTokenSource) login(ctx context.Context) (any, error) {
+	login, err := s.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+	form := url.Values{
+		"grant_type": {"password"},
+		"client_id":  {login.Client},
+		"username":   {s.username},
+		"password":   {s.password},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, login.Token, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	var payload struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := s.getJSON(req, &payload); err != nil {
+		return nil, fmt.Errorf("login.v1 token request: %w", err)
+	}
+	if payload.AccessToken == "" {
+		return nil, fmt.Errorf("login.v1 token response missing access_token")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.token = payload.AccessToken
+	s.expires = time.Time{}
+	if payload.ExpiresIn > 0 {
+		s.expires = s.now().Add(time.Duration(payload.ExpiresIn) * time.Second)
+	}
+	return s.token, nil
+}
+
+type loginService struct {
+	Client     string   `json:"client"`
+	Token      string   `json:"token"`
+	GrantTypes []string `json:"grant_types"`
+}
+
+// discover reads the login.v1 service from the registry's .well-known/terraform.json.
+func (s *loginTokenSource) discover(ctx context.Context) (*loginService, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.discovery, nil)
+	if err != nil {
+		return nil, err
+	}
+	var services struct {
+		Login *loginService `json:"login.v1"`
+	}
+	if err := s.getJSON(req, &services); err != nil {
+		return nil, fmt.Errorf("service discovery: %w", err)
+	}
+	login := services.Login
+	if login == nil || login.Client == "" || login.Token == "" {
+		return nil, fmt.Errorf("%w: %s does not announce login.v1", errLoginUnsupported, s.discovery)
+	}
+	if !slices.Contains(login.GrantTypes, "password") {
+		return nil, fmt.Errorf("%w: login.v1 of %s only supports %s, not the password grant; use the token or "+
+			"credentials-file provider with a token from terraform login", errLoginUnsupported, s.discovery, strings.Join(login.GrantTypes, ", "))
+	}
+	// The token endpoint may be relative to the discovery document.
+	base, _ := url.Parse(s.discovery)
+	tokenURL, err := base.Parse(login.Token)
+	if err != nil {
+		return nil, fmt.Errorf("invalid login.v1 token url %q: %w", login.Token, err)
+	}
+	login.Token = tokenURL.String()
+	return login, nil
+}
+
+func (s *loginTokenSource) getJSON(req *http.Request, v any) error {
+	req.Header.Set("Accept", "application/json")
+	resp, err := s.client().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 2048))
+		return fmt.Errorf("%s returned %s: %s", req.URL, resp.Status, string(body))
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
@@ -0,0 +1,221 @@
+package tf
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/davidjspooner/go-http-client/pkg/client"
+	"github.com/davidjspooner/repoxy/pkg/repo"
+)
+
+// withUpstreamAuth configures inst with upstream credentials, as NewInstance does for upstream.auth.
+func withUpstreamAuth(t *testing.T, inst *tfInstance, provider string, config map[string]string) {
+	t.Helper()
+	inst.config.Upstream.Auth = &repo.UpstreamAuth{Provider: provider, Config: config}
+	auth, err := newTFUpstreamAuth(func() client.Interface { return inst.httpClientFactory() }, inst.config.Upstream)
+	if err != nil {
+		t.Fatalf("newTFUpstreamAuth: %v", err)
+	}
+	inst.auth = auth
+	inst.pipeline = append(inst.pipeline, auth.middleware)
+}
+
+// recordedAuth collects the Authorization header upstream saw for each host and path.
+type recordedAuth struct {
+	mu   sync.Mutex
+	seen map[string]string
+}
+
+func (a *recordedAuth) record(req *http.Request) string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.seen == nil {
+		a.seen = map[string]string{}
+	}
+	header := req.Header.Get("Authorization")
+	a.seen[req.URL.Host+req.URL.Path] = header
+	return header
+}
+
+func (a *recordedAuth) get(target string) string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.seen[target]
+}
+
+func TestUpstreamTokenAuth(t *testing.T) {
+	t.Parallel()
+	archive := providerZip(t)
+	var seen recordedAuth
+	inst := newTFInstanceForTest(t, nil, func(req *http.Request) (*http.Response, error) {
+		if seen.record(req) == "" && req.URL.Host == "registry.test" {
+			return tfResponse(http.StatusUnauthorized, `{"errors":["unauthorized"]}`), nil
+		}
+		switch req.URL.Host + req.URL.Path {
+		case "registry.test/api/registry/v1/providers/corp/internal/versions":
+			return tfResponse(http.StatusOK, `{"versions":[{"version":"1.0.0"}]}`), nil
+		case "registry.test/api/registry/v1/providers/corp/internal/1.0.0/download/linux/amd64":
+			return tfResponse(http.StatusOK, `{"filename":"terraform-provider-internal_1.0.0_linux_amd64.zip",`+
+				`"download_url":"https://archivist.test/terraform-provider-internal_1.0.0_linux_amd64.zip"}`), nil
+		case "archivist.test/terraform-provider-internal_1.0.0_linux_amd64.zip":
+			return tfResponse(http.StatusOK, string(archive)), nil
+		}
+		return tfResponse(http.StatusNotFound, `{"errors":["not found"]}`), nil
+	})
+	inst.config.Upstream.URL = "https://registry.test/api/registry"
+	withUpstreamAuth(t, inst, "token", map[string]string{"token": "upstream-secret"})
+	inst.nameMatchers.Set([]string{"corp/*"})
+
+	// The client's credentials for the proxy are replaced by the upstream token.
+	req := httptest.NewRequest(http.MethodGet, "/v1/providers/corp/internal/versions", nil)
+	req.Header.Set("Authorization", "Bearer proxy-credential")
+	rr := httptest.NewRecorder()
+	inst.HandleV1VersionList(&param{namespace: "corp", name: "internal"}, rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected version list, got %d %s", rr.Code, rr.Body.String())
+	}
+	if got := seen.get("registry.test/api/registry/v1/providers/corp/internal/versions"); got != "Bearer upstream-secret" {
+		t.Fatalf("expected upstream token, got %q", got)
+	}
+
+	rr = httptest.NewRecorder()
+	p := &param{namespace: "corp", name: "internal", version: "1.0.0", tail: "download/linux/amd64"}
+	inst.HandleV1VersionDownload(p, rr, httptest.NewRequest(http.MethodGet, "/v1/providers/corp/internal/1.0.0/download/linux/amd64", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected download metadata, got %d %s", rr.Code, rr.Body.String())
+	}
+	// Like terraform, the token is only sent to the registry host.
+	if got := seen.get("archivist.test/terraform-provider-internal_1.0.0_linux_amd64.zip"); got != "" {
+		t.Fatalf("expected archive download without credentials, got %q", got)
+	}
+}
+
+func TestUpstreamCredentialsFile(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "credentials.tfrc.json")
+	if err := os.WriteFile(path, []byte(`{"credentials":{"app.terraform.io":{"token":"tfc-token"}}}`), 0o600); err != nil {
+		t.Fatalf("write credentials: %v", err)
+	}
+	auth, err := newTFUpstreamAuth(nil, repo.Upstream{
+		URL:  "https://app.terraform.io/api/registry",
+		Auth: &repo.UpstreamAuth{Provider: "credentials-file", Config: map[string]string{"path": path}},
+	})
+	if err != nil {
+		t.Fatalf("newTFUpstreamAuth: %v", err)
+	}
+	if token, _ := auth.source.Token(t.Context(), false); token != "tfc-token" || auth.host != "app.terraform.io" {
+		t.Fatalf("unexpected credentials %q for %s", token, auth.host)
+	}
+	if _, err := newTFUpstreamAuth(nil, repo.Upstream{
+		URL:  "https://tfe.corp.test",
+		Auth: &repo.UpstreamAuth{Provider: "credentials-file", Config: map[string]string{"path": path}},
+	}); err == nil || !strings.Contains(err.Error(), "no token for tfe.corp.test") {
+		t.Fatalf("expected missing host to be rejected, got %v", err)
+	}
+}
+
+func TestUpstreamLoginAuth(t *testing.T) {
+	t.Parallel()
+	var mu sync.Mutex
+	var issued []string
+	inst := newTFInstanceForTest(t, nil, func(req *http.Request) (*http.Response, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch req.URL.Path {
+		case "/.well-known/terraform.json":
+			return tfResponse(http.StatusOK, `{"providers.v1":"/v1/providers/","login.v1":{"client":"terraform-cli",`+
+				`"authz":"/oauth/authorization","token":"/oauth/token","grant_types":["authz_code","password"]}}`), nil
+		case "/oauth/token":
+			_ = req.ParseForm()
+			if req.Form.Get("grant_type") != "password" || req.Form.Get("client_id") != "terraform-cli" ||
+				req.Form.Get("username") != "mirror" || req.Form.Get("password") != "hunter2" {
+				return tfResponse(http.StatusBadRequest, `{"error":"invalid_grant"}`), nil
+			}
+			issued = append(issued, "token-"+string(rune('a'+len(issued))))
+			return tfResponse(http.StatusOK, `{"access_token":"`+issued[len(issued)-1]+`","token_type":"bearer"}`), nil
+		case "/v1/providers/corp/internal/versions":
+			// The first token is revoked, so the proxy has to log in again.
+			if len(issued) < 2 || req.Header.Get("Authorization") != "Bearer "+issued[len(issued)-1] {
+				return tfResponse(http.StatusUnauthorized, `{"errors":["unauthorized"]}`), nil
+			}
+			return tfResponse(http.StatusOK, `{"versions":[{"version":"1.0.0"}]}`), nil
+		}
+		return tfResponse(http.StatusNotFound, `{"errors":["not found"]}`), nil
+	})
+	withUpstreamAuth(t, inst, "login", map[string]string{"username": "mirror", "password": "hunter2"})
+
+	rr := httptest.NewRecorder()
+	inst.HandleV1VersionList(&param{namespace: "corp", name: "internal"}, rr,
+		httptest.NewRequest(http.MethodGet, "/v1/providers/corp/internal/versions", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected version list, got %d %s", rr.Code, rr.Body.String())
+	}
+	if len(issued) != 2 {
+		t.Fatalf("expected a login and a refresh after 401, got %v", issued)
+	}
+
+	withUpstreamAuth(t, inst, "login", map[string]string{"username": "mirror", "password": "wrong"})
+	if _, err := inst.auth.source.Token(t.Context(), false); err == nil || !strings.Contains(err.Error(), "invalid_grant") {
+		t.Fatalf("expected rejected login, got %v", err)
+	}
+}
+
+func TestUpstreamLoginAuthRequiresPasswordGrant(t *testing.T) {
+	t.Parallel()
+	discovery := `{"login.v1":{"client":"terraform-cli","authz":"/app/oauth2/authorize","token":"/oauth/token","grant_types":["authz_code"]}}`
+	var exchanges atomic.Int32
+	release := make(chan struct{})
+	inst := newTFInstanceForTest(t, nil, func(req *http.Request) (*http.Response, error) {
+		switch req.URL.Path {
+		case "/.well-known/terraform.json":
+			return tfResponse(http.StatusOK, discovery), nil
+		case "/oauth/token":
+			exchanges.Add(1)
+			<-release
+			return tfResponse(http.StatusOK, `{"access_token":"token-a","token_type":"bearer"}`), nil
+		}
+		return tfResponse(http.StatusBadGateway, `{"errors":["unavailable"]}`), nil
+	})
+	withUpstreamAuth(t, inst, "login", map[string]string{"username": "mirror", "password": "hunter2"})
+
+	// Terraform Cloud only announces authz_code, which the login provider cannot use.
+	if err := inst.auth.validate(t.Context()); !errors.Is(err, errLoginUnsupported) || !strings.Contains(err.Error(), "authz_code") {
+		t.Fatalf("expected an unsupported login.v1 to be rejected, got %v", err)
+	}
+
+	// Concurrent callers share one token exchange, which does not block readers of the current token.
+	discovery = `{"login.v1":{"client":"terraform-cli","token":"/oauth/token","grant_types":["authz_code","password"]}}`
+	if err := inst.auth.validate(t.Context()); err != nil {
+		t.Fatalf("validate: %v", err)
+	}
+	source := inst.auth.source.(*loginTokenSource)
+	var wg sync.WaitGroup
+	tokens := make([]string, 3)
+	for i := range tokens {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			tokens[i], _ = source.Token(t.Context(), false)
+		}()
+	}
+	for exchanges.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if !source.mu.TryLock() {
+		t.Fatalf("expected the token exchange to run without holding the lock")
+	}
+	source.mu.Unlock()
+	close(release)
+	wg.Wait()
+	if exchanges.Load() != 1 || tokens[0] != "token-a" || tokens[1] != "token-a" || tokens[2] != "token-a" {
+		t.Fatalf("expected one shared exchange, got %d exchanges and tokens %v", exchanges.Load(), tokens)
+	}
+}
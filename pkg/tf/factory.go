@@ -11,6 +11,7 @@ import (
 	"strings"
 
 	"github.com/davidjspooner/go-http-server/pkg/mux"
+	"github.com/davidjspooner/repoxy/pkg/observability"
 	"github.com/davidjspooner/repoxy/pkg/repo"
 )
 
@@ -20,9 +21,12 @@ type tfType struct {
 	instances      []*tfInstance // List of registered Terraform/Tofu instances
 }
 
+// registered is the type serving both terraform and tofu repositories.
+var registered = &tfType{}
+
 // init registers the Terraform and Tofu factories.
 func init() {
-	repo.MustRegisterType("terraform|tofu", &tfType{})
+	repo.MustRegisterType("terraform|tofu", registered)
 }
 
 // Ensure factory implements repo.Type.
@@ -41,27 +45,15 @@ func (f *tfType) NewRepository(ctx context.Context, common repo.CommonStorage, c
 	if common == nil {
 		return nil, errors.New("tf type not initialized")
 	}
-	proxyFS, err := common.EnsureSub(ctx, path.Join("proxies", config.Name))
-	if err != nil {
-		return nil, err
-	}
-	proxyStore, err := repo.NewCommonStorageWithLabels(proxyFS, config.Type, config.Name)
-	if err != nil {
-		return nil, err
-	}
-	refsFS, err := proxyStore.EnsureSub(ctx, "refs")
-	if err != nil {
-		return nil, err
-	}
-	refsStore, err := repo.NewCommonStorageWithLabels(refsFS, config.Type, config.Name)
+	proxyStore, err := repo.NewSubStorage(ctx, common, path.Join("proxies", config.Name), config.Type, config.Name)
 	if err != nil {
 		return nil, err
 	}
-	packagesFS, err := proxyStore.EnsureSub(ctx, "packages")
+	refsStore, err := repo.NewSubStorage(ctx, proxyStore, "refs", config.Type, config.Name)
 	if err != nil {
 		return nil, err
 	}
-	packagesStore, err := repo.NewCommonStorageWithLabels(packagesFS, config.Type, fmt.Sprintf("%s-packages", config.Name))
+	packagesStore, err := repo.NewSubStorage(ctx, proxyStore, "packages", config.Type, fmt.Sprintf("%s-packages", config.Name))
 	if err != nil {
 		return nil, err
 	}
@@ -69,6 +61,11 @@ func (f *tfType) NewRepository(ctx context.Context, common repo.CommonStorage, c
 	if err != nil {
 		return nil, err
 	}
+	if instance.auth != nil {
+		if err := instance.auth.validate(ctx); err != nil {
+			return nil, fmt.Errorf("%w: %v", repo.ErrInvalidRepoConfig, err)
+		}
+	}
 	f.instances = append(f.instances, instance)
 	if config.Type == "tofu" {
 		instance.tofu = true // Set tofu flag for Tofu instances
@@ -86,8 +83,14 @@ func (f *tfType) Initialize(ctx context.Context, typeName string, mux *mux.Serve
 	f.muxOnetimeDone = true
 	mux.HandleFunc("GET /.well-known/terraform.json", f.HandleWellKnownTerraform)
 	mux.HandleFunc("GET /v1/providers/{namespace}/{name}/versions", f.HandleV1VersionList)
-	mux.HandleFunc("GET /v1/providers/{namespace}/{name}/{version}", f.HandleV1Version)
+	mux.HandleFunc("GET|PUT|DELETE /v1/providers/{namespace}/{name}/{version}", f.HandleV1Version)
 	mux.HandleFunc("GET /v1/providers/{namespace}/{name}/{version}/{tail...}", f.HandleV1VersionDownload)
+	mux.HandleFunc("GET /v1/modules/{namespace}/{name}/{provider}/versions", f.HandleV1ModuleVersionList)
+	mux.HandleFunc("GET /v1/modules/{namespace}/{name}/{provider}/{version}/download", f.HandleV1ModuleDownload)
+	mux.HandleFunc("GET /v1/modules/{namespace}/{name}/{provider}/{version}/archive/{file}", f.HandleV1ModuleArchive)
+	mux.HandleFunc("GET "+MirrorPath+"{hostname}/{namespace}/{name}/{file}", f.HandleMirror)
+	mux.HandleFunc("GET "+MirrorPath+"{hostname}/{namespace}/{name}/{version}/{tail...}", f.HandleMirrorDownload)
+	mux.HandleFunc("POST "+PrefetchPath, f.HandlePrefetch)
 	return nil
 }
 
@@ -95,6 +98,7 @@ func (f *tfType) Initialize(ctx context.Context, typeName string, mux *mux.Serve
 func (f *tfType) HandleWellKnownTerraform(w http.ResponseWriter, r *http.Request) {
 	resp := map[string]string{
 		"providers.v1": fmt.Sprintf("%s://%s/v1/providers/", detectScheme(r), r.Host),
+		"modules.v1":   fmt.Sprintf("%s://%s/v1/modules/", detectScheme(r), r.Host),
 	}
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(resp); err != nil {
@@ -102,32 +106,72 @@ func (f *tfType) HandleWellKnownTerraform(w http.ResponseWriter, r *http.Request
 	}
 }
 
-// lookupParam extracts the provider reference from the request path.
-func (f *tfType) lookupParam(r *http.Request) (*tfInstance, *param) {
+// lookupParam extracts the provider reference from the request path and checks the client may perform the request.
+// When no instance maps the provider or access is denied it answers r itself and returns a nil instance.
+func (f *tfType) lookupParam(w http.ResponseWriter, r *http.Request) (*tfInstance, *param) {
 	ref := &param{
 		namespace: r.PathValue("namespace"),
 		name:      r.PathValue("name"),
 		version:   r.PathValue("version"),
 		tail:      r.PathValue("tail"),
 	}
+	return f.lookupInstance(w, r, ref, "")
+}
+
+// lookupInstance picks the instance that maps ref best, restricted to instances whose upstream is hostname unless it
+// is empty, and checks the client may perform the request there.
+func (f *tfType) lookupInstance(w http.ResponseWriter, r *http.Request, ref *param, hostname string) (*tfInstance, *param) {
+	bestInstance := f.instanceFor(ref, hostname)
+	if bestInstance == nil {
+		f.HandleNotFound(w, r)
+		return nil, ref
+	}
+	if action := requiredAction(r); !repo.Authorized(r.Context(), &bestInstance.config, ref.path(), action) {
+		slog.InfoContext(r.Context(), "request denied by access control", "name", ref.path(), "action", action)
+		repoType, repoName := bestInstance.repoLabels()
+		observability.RecordDenied(repoType, repoName, repo.AccessDenied)
+		writeErrors(w, http.StatusForbidden, "access to "+ref.path()+" is denied")
+		return nil, ref
+	}
+	return bestInstance, ref
+}
+
+// instanceFor returns the instance that maps ref best, restricted to instances whose upstream is hostname unless it
+// is empty, or nil when none does.
+func (f *tfType) instanceFor(ref *param, hostname string) *tfInstance {
 	var bestInstance *tfInstance
 	var bestScore int
-	nameParts := []string{ref.namespace, ref.name}
+	nameParts := ref.parts()
 	for _, instance := range f.instances {
+		if hostname != "" && !strings.EqualFold(instance.upstreamHost(), hostname) {
+			continue
+		}
 		score := instance.GetMatchWeight(nameParts)
 		if score > bestScore {
 			bestScore = score
 			bestInstance = instance
 		}
 	}
-	return bestInstance, ref
+	return bestInstance
+}
+
+// requiredAction maps a registry request to the access control action it needs: reads, publishing a provider version
+// writes and deleting one is an admin action.
+func requiredAction(r *http.Request) string {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		return repo.ActionRead
+	case http.MethodDelete:
+		return repo.ActionAdmin
+	default:
+		return repo.ActionWrite
+	}
 }
 
 // HandleV1VersionList handles requests for the list of provider versions.
 func (f *tfType) HandleV1VersionList(w http.ResponseWriter, r *http.Request) {
-	instance, param := f.lookupParam(r)
+	instance, param := f.lookupParam(w, r)
 	if instance == nil {
-		f.HandleNotFound(w, r)
 		return
 	}
 	instance.HandleV1VersionList(param, w, r)
@@ -135,20 +179,100 @@ func (f *tfType) HandleV1VersionList(w http.ResponseWriter, r *http.Request) {
 
 // HandleV1Version handles requests for a specific provider version.
 func (f *tfType) HandleV1Version(w http.ResponseWriter, r *http.Request) {
-	instance, param := f.lookupParam(r)
+	instance, param := f.lookupParam(w, r)
 	if instance == nil {
-		f.HandleNotFound(w, r)
 		return
 	}
 	instance.HandleV1Version(param, w, r)
 }
 
 func (f *tfType) HandleV1VersionDownload(w http.ResponseWriter, r *http.Request) {
-	instance, param := f.lookupParam(r)
+	instance, param := f.lookupParam(w, r)
+	if instance == nil {
+		return
+	}
+	instance.HandleV1VersionDownload(param, w, r)
+}
+
+// lookupModuleParam is lookupParam for module registry requests.
+func (f *tfType) lookupModuleParam(w http.ResponseWriter, r *http.Request) (*tfInstance, *param) {
+	ref := &param{
+		namespace: r.PathValue("namespace"),
+		name:      r.PathValue("name"),
+		provider:  r.PathValue("provider"),
+		version:   r.PathValue("version"),
+		tail:      r.PathValue("file"),
+	}
+	instance, ref := f.lookupInstance(w, r, ref, "")
+	if instance != nil && instance.hosted() {
+		writeErrors(w, http.StatusNotFound, "hosted repositories do not serve modules")
+		return nil, ref
+	}
+	return instance, ref
+}
+
+// HandleV1ModuleVersionList handles requests for the list of module versions.
+func (f *tfType) HandleV1ModuleVersionList(w http.ResponseWriter, r *http.Request) {
+	instance, param := f.lookupModuleParam(w, r)
+	if instance == nil {
+		return
+	}
+	instance.HandleV1ModuleVersionList(param, w, r)
+}
+
+// HandleV1ModuleDownload handles requests for the source of a module version.
+func (f *tfType) HandleV1ModuleDownload(w http.ResponseWriter, r *http.Request) {
+	instance, param := f.lookupModuleParam(w, r)
 	if instance == nil {
+		return
+	}
+	instance.HandleV1ModuleDownload(param, w, r)
+}
+
+// HandleV1ModuleArchive serves cached module archives.
+func (f *tfType) HandleV1ModuleArchive(w http.ResponseWriter, r *http.Request) {
+	instance, param := f.lookupModuleParam(w, r)
+	if instance == nil {
+		return
+	}
+	instance.HandleV1ModuleArchive(param, w, r)
+}
+
+// HandleMirror handles the index.json and <version>.json documents of the provider network mirror protocol.
+func (f *tfType) HandleMirror(w http.ResponseWriter, r *http.Request) {
+	file := r.PathValue("file")
+	version, ok := strings.CutSuffix(file, ".json")
+	if !ok || version == "" {
 		f.HandleNotFound(w, r)
 		return
 	}
+	if file == "index.json" {
+		version = ""
+	}
+	ref := &param{namespace: r.PathValue("namespace"), name: r.PathValue("name"), version: version}
+	instance, param := f.lookupInstance(w, r, ref, r.PathValue("hostname"))
+	if instance == nil {
+		return
+	}
+	if param.version == "" {
+		instance.HandleMirrorIndex(param, w, r)
+		return
+	}
+	instance.HandleMirrorVersion(param, w, r)
+}
+
+// HandleMirrorDownload serves the archives linked from the mirror's <version>.json documents.
+func (f *tfType) HandleMirrorDownload(w http.ResponseWriter, r *http.Request) {
+	ref := &param{
+		namespace: r.PathValue("namespace"),
+		name:      r.PathValue("name"),
+		version:   r.PathValue("version"),
+		tail:      r.PathValue("tail"),
+	}
+	instance, param := f.lookupInstance(w, r, ref, r.PathValue("hostname"))
+	if instance == nil {
+		return
+	}
 	instance.HandleV1VersionDownload(param, w, r)
 }
 
@@ -28,4 +28,7 @@ func TestHandleWellKnownTerraform(t *testing.T) {
 	if payload["providers.v1"] != want {
 		t.Fatalf("expected providers.v1=%s, got %s", want, payload["providers.v1"])
 	}
+	if want := "https://repoxy.test/v1/modules/"; payload["modules.v1"] != want {
+		t.Fatalf("expected modules.v1=%s, got %s", want, payload["modules.v1"])
+	}
 }
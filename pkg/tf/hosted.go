@@ -0,0 +1,432 @@
+package tf
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/davidjspooner/repoxy/pkg/auth"
+	"github.com/davidjspooner/repoxy/pkg/repo"
+)
+
+// maxPublishBytes bounds the multipart body of a provider upload.
+const maxPublishBytes = 4 << 30
+
+// hostedHost is the storage host under which hosted repositories record published provider versions.
+const hostedHost = "local"
+
+// semverPattern matches the versions terraform accepts for providers.
+var semverPattern = regexp.MustCompile(`^[0-9]+\.[0-9]+\.[0-9]+(-[0-9A-Za-z.-]+)?(\+[0-9A-Za-z.-]+)?$`)
+
+// hostedManifest is the VersionMeta.Manifest of a published provider version.
+type hostedManifest struct {
+	Protocols []string         `json:"protocols"`
+	Platforms []hostedPlatform `json:"platforms"`
+}
+
+type hostedPlatform struct {
+	OS       string `json:"os"`
+	Arch     string `json:"arch"`
+	Filename string `json:"filename"`
+	Shasum   string `json:"shasum"`
+}
+
+// hosted reports whether the repository is the origin of its providers rather than a cache of an upstream registry.
+func (d *tfInstance) hosted() bool {
+	return d.config.UpstreamMode() == repo.ModeHosted
+}
+
+// gpgPublicKeys renders keyring as the signing_keys.gpg_public_keys of download metadata.
+func gpgPublicKeys(keyring openpgp.EntityList) ([]any, error) {
+	keys := make([]any, 0, len(keyring))
+	for _, entity := range keyring {
+		var buf bytes.Buffer
+		w, err := armor.Encode(&buf, openpgp.PublicKeyType, nil)
+		if err != nil {
+			return nil, err
+		}
+		if err := entity.Serialize(w); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		keys = append(keys, map[string]any{
+			"key_id":      strings.ToUpper(entity.PrimaryKey.KeyIdString()),
+			"ascii_armor": buf.String(),
+		})
+	}
+	return keys, nil
+}
+
+func (d *tfInstance) hostedLocator(param *param) repo.Locator {
+	return repo.Locator{Host: hostedHost, Name: param.path(), VersionID: param.version}
+}
+
+// hostedVersion returns the published version param refers to.
+func (d *tfInstance) hostedVersion(r *http.Request, param *param) (*repo.VersionMeta, *hostedManifest, error) {
+	meta, err := d.storage.GetVersionMeta(r.Context(), d.hostedLocator(param))
+	if err != nil {
+		return nil, nil, err
+	}
+	var manifest hostedManifest
+	if err := json.Unmarshal([]byte(meta.Manifest), &manifest); err != nil {
+		return nil, nil, fmt.Errorf("invalid manifest for %s %s: %w", param.path(), param.version, err)
+	}
+	return meta, &manifest, nil
+}
+
+// versionEntry is the entry of a published version in the registry's version list.
+func (m *hostedManifest) versionEntry(version string) map[string]any {
+	platforms := make([]any, 0, len(m.Platforms))
+	for _, p := range m.Platforms {
+		platforms = append(platforms, map[string]any{"os": p.OS, "arch": p.Arch})
+	}
+	return map[string]any{"version": version, "protocols": m.Protocols, "platforms": platforms}
+}
+
+// serveHostedVersionList lists the published versions of a provider, without those the rules refuse.
+func (d *tfInstance) serveHostedVersionList(param *param, w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	summaries, err := d.storage.ListVersions(ctx, d.hostedLocator(param))
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to list hosted provider versions", "name", param.path(), "error", err)
+		writeErrors(w, http.StatusInternalServerError, "failed to list provider versions")
+		return
+	}
+	if len(summaries) == 0 {
+		writeErrors(w, http.StatusNotFound, "provider "+param.path()+" not found")
+		return
+	}
+	versions := make([]any, 0, len(summaries))
+	for _, summary := range summaries {
+		ref := *param
+		ref.version = summary.VersionID
+		_, manifest, err := d.hostedVersion(r, &ref)
+		if err != nil {
+			slog.WarnContext(ctx, "skipping unreadable hosted provider version", "name", param.path(), "version", ref.version, "error", err)
+			continue
+		}
+		versions = append(versions, manifest.versionEntry(ref.version))
+	}
+	body, err := json.Marshal(map[string]any{"versions": versions})
+	if err == nil && d.config.Rules != nil {
+		body, err = d.filterVersionList(param, body)
+	}
+	if err != nil {
+		writeErrors(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(body)
+}
+
+// serveHostedVersion describes one published version.
+func (d *tfInstance) serveHostedVersion(param *param, w http.ResponseWriter, r *http.Request) {
+	_, manifest, err := d.hostedVersion(r, param)
+	if err != nil {
+		writeErrors(w, http.StatusNotFound, "provider "+param.path()+" "+param.version+" not found")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(manifest.versionEntry(param.version))
+}
+
+// serveHostedDownload answers the download metadata of a published platform, and its archive, SHA256SUMS and
+// signature, which are all served below the platform's archive path.
+func (d *tfInstance) serveHostedDownload(req *downloadRequest, w http.ResponseWriter, r *http.Request) {
+	meta, manifest, err := d.hostedVersion(r, req.param)
+	if err != nil {
+		writeErrors(w, http.StatusNotFound, "provider "+req.param.path()+" "+req.param.version+" not found")
+		return
+	}
+	var platform *hostedPlatform
+	for i := range manifest.Platforms {
+		if manifest.Platforms[i].OS == req.OS && manifest.Platforms[i].Arch == req.Arch {
+			platform = &manifest.Platforms[i]
+		}
+	}
+	if platform == nil {
+		writeErrors(w, http.StatusNotFound, "provider "+req.param.path()+" "+req.param.version+" has no "+req.OS+"/"+req.Arch+" package")
+		return
+	}
+	if req.IsArchive {
+		d.serveHostedFile(meta, req.Filename, w, r)
+		return
+	}
+	sums := shasumsFilename(req.param)
+	payload := map[string]any{
+		"protocols":             manifest.Protocols,
+		"os":                    platform.OS,
+		"arch":                  platform.Arch,
+		"filename":              platform.Filename,
+		"shasum":                platform.Shasum,
+		"shasums_url":           d.localDownloadURL(r, req, sums),
+		"shasums_signature_url": d.localDownloadURL(r, req, sums+".sig"),
+		"signing_keys":          map[string]any{"gpg_public_keys": d.hostedKeys},
+	}
+	if _, err := d.writeDownloadMetadataResponse(payload, req, platform.Filename, w, r); err != nil {
+		slog.ErrorContext(r.Context(), "failed to write hosted download metadata", "error", err)
+	}
+}
+
+func (d *tfInstance) serveHostedFile(meta *repo.VersionMeta, filename string, w http.ResponseWriter, r *http.Request) {
+	for _, file := range meta.Files {
+		if file.Name != filename {
+			continue
+		}
+		reader, err := d.storage.OpenBlob(r.Context(), file.BlobKey)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "failed to open hosted provider file", "file", filename, "error", err)
+			writeErrors(w, http.StatusInternalServerError, "failed to open "+filename)
+			return
+		}
+		defer reader.Close()
+		info, _ := d.storage.StatBlob(r.Context(), file.BlobKey)
+		d.storage.RecordBlobAccess(r.Context(), file.BlobKey)
+		w.Header().Set("Content-Type", file.MediaType)
+		if file.MediaType == "application/zip" {
+			w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+		}
+		repo.ServeContent(w, r, reader, info, file.BlobKey)
+		return
+	}
+	writeErrors(w, http.StatusNotFound, filename+" not found")
+}
+
+// shasumsFilename is the name of a release's SHA256SUMS file, as published by the HashiCorp release tooling.
+func shasumsFilename(param *param) string {
+	return "terraform-provider-" + param.name + "_" + param.version + "_SHA256SUMS"
+}
+
+// errUpload reports an invalid provider upload.
+var errUpload = errors.New("invalid provider upload")
+
+// stagedFile is an uploaded file held until the whole upload has been checked.
+type stagedFile struct {
+	name   string
+	body   io.ReadSeekCloser
+	size   int64
+	shasum string
+}
+
+// handlePublish publishes a provider version from a multipart upload of its platform zips, named
+// terraform-provider-<name>_<version>_<os>_<arch>.zip, its SHA256SUMS file and the SHA256SUMS signature. The signature
+// must verify with the repository policy keys and every zip must match its SHA256SUMS entry. Published versions are
+// immutable.
+func (d *tfInstance) handlePublish(param *param, w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if !semverPattern.MatchString(param.version) {
+		writeErrors(w, http.StatusBadRequest, "version "+param.version+" is not a semantic version")
+		return
+	}
+	if d.versionExists(w, r, param) {
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxPublishBytes)
+	files, protocols, err := stageUpload(r)
+	defer func() {
+		for _, file := range files {
+			file.body.Close()
+		}
+	}()
+	if err == nil {
+		err = d.checkUpload(param, files)
+	}
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		switch {
+		case errors.As(err, &tooLarge):
+			writeErrors(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("upload exceeds %d bytes", tooLarge.Limit))
+			return
+		case errors.Is(err, errUpload):
+			writeErrors(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		slog.ErrorContext(ctx, "failed to receive provider upload", "name", param.path(), "version", param.version, "error", err)
+		writeErrors(w, http.StatusInternalServerError, "failed to receive upload")
+		return
+	}
+	manifest := hostedManifest{Protocols: protocols}
+	meta := &repo.VersionMeta{VersionID: param.version}
+	prefix := "terraform-provider-" + param.name + "_" + param.version + "_"
+	for _, file := range files {
+		blobKey := "sha256:" + file.shasum
+		if _, err := d.storage.PutBlob(ctx, blobKey, file.body); err != nil {
+			slog.ErrorContext(ctx, "failed to store provider upload", "file", file.name, "error", err)
+			writeErrors(w, http.StatusInternalServerError, "failed to store "+file.name)
+			return
+		}
+		mediaType := "text/plain; charset=utf-8"
+		switch {
+		case strings.HasSuffix(file.name, ".zip"):
+			mediaType = "application/zip"
+			goos, arch, _ := strings.Cut(strings.TrimSuffix(strings.TrimPrefix(file.name, prefix), ".zip"), "_")
+			manifest.Platforms = append(manifest.Platforms, hostedPlatform{OS: goos, Arch: arch, Filename: file.name, Shasum: file.shasum})
+		case strings.HasSuffix(file.name, ".sig"):
+			mediaType = "application/pgp-signature"
+		}
+		meta.Files = append(meta.Files, repo.FileEntry{Name: file.name, BlobKey: blobKey, Size: file.size, MediaType: mediaType})
+	}
+	body, err := json.Marshal(manifest)
+	if err != nil {
+		writeErrors(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	meta.Manifest = string(body)
+	// Uploads are staged and stored concurrently; only recording the version is serialised.
+	d.publishMu.Lock()
+	defer d.publishMu.Unlock()
+	if d.versionExists(w, r, param) {
+		return
+	}
+	if _, err := d.storage.CreateVersion(ctx, d.hostedLocator(param), meta); err != nil {
+		slog.ErrorContext(ctx, "failed to record provider version", "name", param.path(), "version", param.version, "error", err)
+		writeErrors(w, http.StatusInternalServerError, "failed to record provider version")
+		return
+	}
+	slog.InfoContext(ctx, "published terraform provider", "name", param.path(), "version", param.version, "platforms", len(manifest.Platforms))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(manifest.versionEntry(param.version))
+}
+
+// versionExists answers r with 409 and reports true when param's version has already been published.
+func (d *tfInstance) versionExists(w http.ResponseWriter, r *http.Request, param *param) bool {
+	if _, err := d.storage.GetVersionMeta(r.Context(), d.hostedLocator(param)); err != nil {
+		return false
+	}
+	writeErrors(w, http.StatusConflict, "provider "+param.path()+" "+param.version+" already exists")
+	return true
+}
+
+// refuseAnonymousWrite answers r with 401 and reports true unless the client authenticated. Without client
+// authentication anyone could publish or delete the providers of a hosted repository.
+func (d *tfInstance) refuseAnonymousWrite(w http.ResponseWriter, r *http.Request) bool {
+	if auth.PrincipalFromContext(r.Context()) != nil {
+		return false
+	}
+	writeErrors(w, http.StatusUnauthorized, "changing "+d.config.Name+" requires an authenticated client")
+	return true
+}
+
+// stageUpload spools the files of a multipart provider upload to temporary files. The protocols field lists the
+// plugin protocol versions the provider speaks and defaults to 5.0.
+func stageUpload(r *http.Request) ([]*stagedFile, []string, error) {
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", errUpload, err)
+	}
+	var files []*stagedFile
+	protocols := []string{"5.0"}
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return files, protocols, nil
+		}
+		if err != nil {
+			return files, nil, fmt.Errorf("%w: %w", errUpload, err)
+		}
+		if part.FileName() == "" {
+			if part.FormName() == "protocols" {
+				value, _ := io.ReadAll(io.LimitReader(part, 1024))
+				protocols = strings.Split(strings.ReplaceAll(string(value), " ", ""), ",")
+			}
+			continue
+		}
+		file, err := stageFile(part)
+		if err != nil {
+			return files, nil, err
+		}
+		files = append(files, file)
+	}
+}
+
+func stageFile(part *multipart.Part) (*stagedFile, error) {
+	f, err := os.CreateTemp("", "repoxy-upload-*")
+	if err != nil {
+		return nil, err
+	}
+	tmp := &tempFile{File: f}
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(tmp, h), part)
+	if err == nil {
+		_, err = tmp.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	return &stagedFile{name: part.FileName(), body: tmp, size: n, shasum: hex.EncodeToString(h.Sum(nil))}, nil
+}
+
+// checkUpload verifies the SHA256SUMS signature with the policy keys, that every zip is a platform package of the
+// version listed in SHA256SUMS, and that at least one was uploaded.
+func (d *tfInstance) checkUpload(param *param, files []*stagedFile) error {
+	sumsName := shasumsFilename(param)
+	prefix := "terraform-provider-" + param.name + "_" + param.version + "_"
+	var sums, sig []byte
+	zips := 0
+	for _, file := range files {
+		switch {
+		case file.name == sumsName:
+			sums, _ = io.ReadAll(io.LimitReader(file.body, maxShasumsBytes))
+		case file.name == sumsName+".sig":
+			sig, _ = io.ReadAll(io.LimitReader(file.body, maxShasumsBytes))
+		case strings.HasPrefix(file.name, prefix) && strings.HasSuffix(file.name, ".zip") &&
+			strings.Count(strings.TrimPrefix(file.name, prefix), "_") == 1:
+			zips++
+		default:
+			return fmt.Errorf("%w: unexpected file %q, expected %s<os>_<arch>.zip, %s or %s.sig", errUpload, file.name, prefix, sumsName, sumsName)
+		}
+		if _, err := file.body.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+	}
+	if sums == nil || sig == nil {
+		return fmt.Errorf("%w: %s and %s.sig are required", errUpload, sumsName, sumsName)
+	}
+	if zips == 0 {
+		return fmt.Errorf("%w: no platform packages uploaded", errUpload)
+	}
+	if _, err := openpgp.CheckDetachedSignature(d.keyring, bytes.NewReader(sums), bytes.NewReader(sig), nil); err != nil {
+		return fmt.Errorf("%w: SHA256SUMS signature does not verify with the policy keys: %v", errUpload, err)
+	}
+	for _, file := range files {
+		if !strings.HasSuffix(file.name, ".zip") {
+			continue
+		}
+		if listed := shasumFor(sums, file.name); listed != file.shasum {
+			return fmt.Errorf("%w: %s does not match SHA256SUMS", errUpload, file.name)
+		}
+	}
+	return nil
+}
+
+// handleHostedDelete removes a published version. Its files are reclaimed by gc.
+func (d *tfInstance) handleHostedDelete(param *param, w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if _, err := d.storage.GetVersionMeta(ctx, d.hostedLocator(param)); err != nil {
+		writeErrors(w, http.StatusNotFound, "provider "+param.path()+" "+param.version+" not found")
+		return
+	}
+	if err := d.storage.DeleteVersion(ctx, d.hostedLocator(param)); err != nil {
+		slog.ErrorContext(ctx, "failed to delete provider version", "name", param.path(), "version", param.version, "error", err)
+		writeErrors(w, http.StatusInternalServerError, "failed to delete provider version")
+		return
+	}
+	slog.InfoContext(ctx, "deleted terraform provider", "name", param.path(), "version", param.version)
+	w.WriteHeader(http.StatusNoContent)
+}
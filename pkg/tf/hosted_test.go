@@ -0,0 +1,227 @@
+package tf
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/davidjspooner/go-http-server/pkg/mux"
+	"github.com/davidjspooner/repoxy/pkg/auth"
+	"github.com/davidjspooner/repoxy/pkg/repo"
+)
+
+// providerUpload builds the multipart body publishing the files, keyed by name.
+func providerUpload(t *testing.T, files map[string][]byte) (*bytes.Buffer, string) {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for name, content := range files {
+		fw, err := mw.CreateFormFile("file", name)
+		if err != nil {
+			t.Fatalf("create form file: %v", err)
+		}
+		_, _ = fw.Write(content)
+	}
+	if err := mw.Close(); err != nil {
+		t.Fatalf("close multipart: %v", err)
+	}
+	return &body, mw.FormDataContentType()
+}
+
+// signedRelease returns the files of a release of corp/internal 1.0.0 for two platforms, signed by signer.
+func signedRelease(t *testing.T, signer *openpgp.Entity) map[string][]byte {
+	t.Helper()
+	archive := providerZip(t)
+	sum := sha256.Sum256(archive)
+	files := map[string][]byte{
+		"terraform-provider-internal_1.0.0_linux_amd64.zip":  archive,
+		"terraform-provider-internal_1.0.0_darwin_arm64.zip": archive,
+	}
+	var sums bytes.Buffer
+	for name := range files {
+		sums.WriteString(hex.EncodeToString(sum[:]) + "  " + name + "\n")
+	}
+	files["terraform-provider-internal_1.0.0_SHA256SUMS"] = sums.Bytes()
+	files["terraform-provider-internal_1.0.0_SHA256SUMS.sig"] = detachSign(t, signer, sums.Bytes())
+	return files
+}
+
+func newHostedInstanceForTest(t *testing.T, armoredKey string) *tfInstance {
+	t.Helper()
+	keyFile := filepath.Join(t.TempDir(), "release.asc")
+	if err := os.WriteFile(keyFile, []byte(armoredKey), 0o600); err != nil {
+		t.Fatalf("write key: %v", err)
+	}
+	stores := newTestStores(t)
+	inst, err := NewInstance(&repo.Repo{
+		Name:     "private",
+		Type:     "terraform",
+		Mode:     repo.ModeHosted,
+		Mappings: []string{"corp/*"},
+		Policy:   &repo.Policy{Keys: []string{keyFile}},
+	}, stores[0], stores[1], stores[2])
+	if err != nil {
+		t.Fatalf("NewInstance failed: %v", err)
+	}
+	return inst
+}
+
+func TestHostedProviderRegistry(t *testing.T) {
+	t.Parallel()
+	signer, armored := newSigningKey(t, "release")
+	inst := newHostedInstanceForTest(t, armored)
+	m := mux.NewServeMux()
+	if err := (&tfType{instances: []*tfInstance{inst}}).Initialize(context.Background(), "terraform", m); err != nil {
+		t.Fatalf("Initialize failed: %v", err)
+	}
+	do := func(method, path string, files map[string][]byte) *httptest.ResponseRecorder {
+		var req *http.Request
+		if files != nil {
+			body, contentType := providerUpload(t, files)
+			req = httptest.NewRequest(method, "https://repoxy.test"+path, body)
+			req.Header.Set("Content-Type", contentType)
+		} else {
+			req = httptest.NewRequest(method, "https://repoxy.test"+path, nil)
+		}
+		req.Header.Set("X-Forwarded-Proto", "https")
+		req = req.WithContext(auth.WithPrincipal(req.Context(), &auth.Principal{Name: "ci"}))
+		rr := httptest.NewRecorder()
+		m.ServeHTTP(rr, req)
+		return rr
+	}
+	release := signedRelease(t, signer)
+
+	// Without client authentication nobody may change the repository.
+	for _, method := range []string{http.MethodPut, http.MethodDelete} {
+		body, contentType := providerUpload(t, release)
+		req := httptest.NewRequest(method, "https://repoxy.test/v1/providers/corp/internal/1.0.0", body)
+		req.Header.Set("Content-Type", contentType)
+		rr := httptest.NewRecorder()
+		m.ServeHTTP(rr, req)
+		if rr.Code != http.StatusUnauthorized {
+			t.Fatalf("expected anonymous %s to be refused, got %d %s", method, rr.Code, rr.Body.String())
+		}
+	}
+
+	// Uploads that fail verification are refused and leave nothing behind.
+	mallory, _ := newSigningKey(t, "mallory")
+	tampered := signedRelease(t, signer)
+	tampered["terraform-provider-internal_1.0.0_linux_amd64.zip"] = append(bytes.Clone(release["terraform-provider-internal_1.0.0_linux_amd64.zip"]), 0)
+	for name, files := range map[string]map[string][]byte{
+		"untrusted signature": signedRelease(t, mallory),
+		"tampered package":    tampered,
+		"missing signature":   {"terraform-provider-internal_1.0.0_linux_amd64.zip": release["terraform-provider-internal_1.0.0_linux_amd64.zip"]},
+	} {
+		if rr := do(http.MethodPut, "/v1/providers/corp/internal/1.0.0", files); rr.Code != http.StatusBadRequest {
+			t.Fatalf("%s: expected 400, got %d %s", name, rr.Code, rr.Body.String())
+		}
+	}
+	if rr := do(http.MethodGet, "/v1/providers/corp/internal/versions", nil); rr.Code != http.StatusNotFound {
+		t.Fatalf("expected no versions after refused uploads, got %d %s", rr.Code, rr.Body.String())
+	}
+
+	if rr := do(http.MethodPut, "/v1/providers/corp/internal/1.0.0", release); rr.Code != http.StatusCreated {
+		t.Fatalf("expected publish to succeed, got %d %s", rr.Code, rr.Body.String())
+	}
+	if rr := do(http.MethodPut, "/v1/providers/corp/internal/1.0.0", release); rr.Code != http.StatusConflict {
+		t.Fatalf("expected republishing to conflict, got %d", rr.Code)
+	}
+	meta, err := inst.storage.GetVersionMeta(context.Background(), repo.Locator{Host: hostedHost, Name: "corp/internal", VersionID: "1.0.0"})
+	if err != nil || len(meta.Files) != 4 {
+		t.Fatalf("expected a version with four files, got %+v, %v", meta, err)
+	}
+
+	var list struct {
+		Versions []struct {
+			Version   string              `json:"version"`
+			Protocols []string            `json:"protocols"`
+			Platforms []map[string]string `json:"platforms"`
+		} `json:"versions"`
+	}
+	rr := do(http.MethodGet, "/v1/providers/corp/internal/versions", nil)
+	if err := json.Unmarshal(rr.Body.Bytes(), &list); err != nil || len(list.Versions) != 1 ||
+		list.Versions[0].Version != "1.0.0" || len(list.Versions[0].Platforms) != 2 || list.Versions[0].Protocols[0] != "5.0" {
+		t.Fatalf("unexpected version list: %d %s", rr.Code, rr.Body.String())
+	}
+
+	// The download metadata carries everything terraform needs to verify the package itself.
+	rr = do(http.MethodGet, "/v1/providers/corp/internal/1.0.0/download/linux/amd64", nil)
+	payload := map[string]any{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &payload); err != nil || rr.Code != http.StatusOK {
+		t.Fatalf("unexpected download metadata: %d %s", rr.Code, rr.Body.String())
+	}
+	fetch := func(field string) []byte {
+		u, err := url.Parse(stringField(payload, field))
+		if err != nil || u.Host != "repoxy.test" {
+			t.Fatalf("%s: unexpected url %q", field, stringField(payload, field))
+		}
+		rr := do(http.MethodGet, u.Path, nil)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("%s: got %d %s", field, rr.Code, rr.Body.String())
+		}
+		return rr.Body.Bytes()
+	}
+	if !bytes.Equal(fetch("download_url"), release["terraform-provider-internal_1.0.0_linux_amd64.zip"]) {
+		t.Fatalf("unexpected archive")
+	}
+	keyring, err := metadataKeyring(payload)
+	if err != nil {
+		t.Fatalf("metadataKeyring: %v", err)
+	}
+	sums := fetch("shasums_url")
+	if _, err := openpgp.CheckDetachedSignature(keyring, bytes.NewReader(sums), bytes.NewReader(fetch("shasums_signature_url")), nil); err != nil {
+		t.Fatalf("served SHA256SUMS does not verify with the announced key: %v", err)
+	}
+	if got := shasumFor(sums, stringField(payload, "filename")); got != stringField(payload, "shasum") {
+		t.Fatalf("expected shasum %s to be listed, got %q", stringField(payload, "shasum"), got)
+	}
+	if rr := do(http.MethodGet, "/v1/providers/corp/internal/1.0.0/download/windows/amd64", nil); rr.Code != http.StatusNotFound {
+		t.Fatalf("expected unpublished platform to be 404, got %d", rr.Code)
+	}
+	if rr := do(http.MethodGet, "/v1/modules/corp/internal/aws/versions", nil); rr.Code != http.StatusNotFound {
+		t.Fatalf("expected modules to be 404 in a hosted repository, got %d", rr.Code)
+	}
+
+	if rr := do(http.MethodDelete, "/v1/providers/corp/internal/1.0.0", nil); rr.Code != http.StatusNoContent {
+		t.Fatalf("expected delete to succeed, got %d", rr.Code)
+	}
+	if rr := do(http.MethodGet, "/v1/providers/corp/internal/1.0.0/download/linux/amd64", nil); rr.Code != http.StatusNotFound {
+		t.Fatalf("expected deleted version to be 404, got %d", rr.Code)
+	}
+}
+
+func TestHostedProviderConfig(t *testing.T) {
+	t.Parallel()
+	stores := newTestStores(t)
+	if _, err := NewInstance(&repo.Repo{Name: "private", Type: "terraform", Mode: repo.ModeHosted}, stores[0], stores[1], stores[2]); !errors.Is(err, repo.ErrInvalidRepoConfig) {
+		t.Fatalf("expected hosted repository without policy keys to be rejected, got %v", err)
+	}
+	for _, mode := range []string{repo.ModePreferCache, repo.ModeOffline} {
+		if _, err := NewInstance(&repo.Repo{Name: "mirror", Type: "terraform", Mode: mode}, stores[0], stores[1], stores[2]); !errors.Is(err, repo.ErrInvalidRepoConfig) {
+			t.Fatalf("expected mode %s to be rejected, got %v", mode, err)
+		}
+	}
+
+	// Proxy repositories stay read-only.
+	inst := newTFInstanceForTest(t, nil, func(*http.Request) (*http.Response, error) {
+		t.Fatalf("unexpected upstream request")
+		return nil, nil
+	})
+	rr := httptest.NewRecorder()
+	inst.HandleV1Version(&param{namespace: "hashicorp", name: "aws", version: "5.1.0"}, rr,
+		httptest.NewRequest(http.MethodPut, "/v1/providers/hashicorp/aws/5.1.0", nil))
+	if rr.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("expected 405, got %d", rr.Code)
+	}
+}
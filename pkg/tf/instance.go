@@ -12,8 +12,10 @@ import (
 	"path"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/ProtonMail/go-crypto/openpgp"
 	"github.com/davidjspooner/go-http-client/pkg/client"
 	"github.com/davidjspooner/repoxy/pkg/observability"
 	"github.com/davidjspooner/repoxy/pkg/repo"
@@ -27,6 +29,14 @@ type tfInstance struct {
 	nameMatchers repo.NameMatchers // Matchers for repository names
 	refs         repo.CommonStorage
 	packages     repo.CommonStorage
+	flights      repo.Coalescer     // collapses concurrent upstream fetches
+	keyring      openpgp.EntityList // policy keys trusted to sign SHA256SUMS; nil trusts the registry's keys
+	auth         *tfUpstreamAuth    // credentials for a private upstream registry; nil when anonymous
+	hostedKeys   []any              // signing_keys.gpg_public_keys announced by a hosted repository
+	moduleHosts  []string           // hosts module archives are fetched from
+	publishMu    sync.Mutex         // serialises publishing to a hosted repository
+
+	httpClientFactory func() client.Interface
 }
 
 type downloadRequest struct {
@@ -57,7 +67,44 @@ func NewInstance(config *repo.Repo, storage repo.CommonStorage, refs repo.Common
 		packages: packages,
 	}
 	instance.nameMatchers.Set(config.Mappings)
+	instance.moduleHosts = moduleHosts(config)
+	if config.Policy != nil {
+		keyring, err := loadKeyring(config.Policy.Keys)
+		if err != nil {
+			return nil, err
+		}
+		instance.keyring = keyring
+	}
+	switch config.UpstreamMode() {
+	case repo.ModePreferCache, repo.ModeOffline:
+		// Provider and module metadata is always looked up upstream; freshness controls how cached copies are used.
+		return nil, fmt.Errorf("%w: mode %q is not supported by terraform repository %q", repo.ErrInvalidRepoConfig, config.UpstreamMode(), config.Name)
+	}
+	if instance.hosted() {
+		if config.Retention != nil {
+			return nil, fmt.Errorf("%w: retention would evict the only copy of content in hosted repository %q", repo.ErrInvalidRepoConfig, config.Name)
+		}
+		if len(instance.keyring) == 0 {
+			return nil, fmt.Errorf("%w: hosted terraform repository %q needs policy.keys to verify and announce the keys signing SHA256SUMS", repo.ErrInvalidRepoConfig, config.Name)
+		}
+		keys, err := gpgPublicKeys(instance.keyring)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", repo.ErrInvalidRepoConfig, err)
+		}
+		instance.hostedKeys = keys
+	}
 	instance.pipeline = append(instance.pipeline, client.WithAuthentication(instance))
+	instance.httpClientFactory = func() client.Interface {
+		return &http.Client{}
+	}
+	auth, err := newTFUpstreamAuth(func() client.Interface { return instance.httpClientFactory() }, config.Upstream)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", repo.ErrInvalidRepoConfig, err)
+	}
+	if auth != nil {
+		instance.auth = auth
+		instance.pipeline = append(instance.pipeline, auth.middleware)
+	}
 	return instance, nil
 }
 
@@ -83,24 +130,53 @@ func (d *tfInstance) HandleV1VersionList(param *param, w http.ResponseWriter, r
 		http.Error(w, "missing namespace or name", http.StatusBadRequest)
 		return
 	}
-	if d.serveCachedJSON(d.versionsRelPath(param), w, r) {
+	if d.deniedByRules(ruleSubject(param, ""), w, r) {
 		return
 	}
-	if err := d.fetchAndStoreVersionList(param, w, r); err != nil {
+	if d.hosted() {
+		d.serveHostedVersionList(param, w, r)
+		return
+	}
+	serve := func() error { return d.serveMetadataJSON(d.versionsRelPath(param), w, r) }
+	if d.config.Rules != nil {
+		serve = func() error { return d.serveFilteredVersionList(param, w, r) }
+	}
+	if err := serve(); err != nil {
 		slog.ErrorContext(r.Context(), "failed to fetch terraform version list", "error", err)
 		w.WriteHeader(http.StatusBadGateway)
 	}
 }
 
+// HandleV1Version describes a provider version. Hosted repositories also accept PUT to publish the version and
+// DELETE to remove it; other repositories are read-only.
 func (d *tfInstance) HandleV1Version(param *param, w http.ResponseWriter, r *http.Request) {
 	if param == nil || param.version == "" {
 		http.Error(w, "missing version", http.StatusBadRequest)
 		return
 	}
-	if d.serveCachedJSON(d.manifestRelPath(param), w, r) {
+	if d.deniedByRules(ruleSubject(param, ""), w, r) {
 		return
 	}
-	if err := d.fetchAndStoreManifest(param, w, r); err != nil {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead && !d.hosted() {
+		writeErrors(w, http.StatusMethodNotAllowed, "repository is read-only")
+		return
+	}
+	if d.hosted() {
+		switch r.Method {
+		case http.MethodPut:
+			if !d.refuseAnonymousWrite(w, r) {
+				d.handlePublish(param, w, r)
+			}
+		case http.MethodDelete:
+			if !d.refuseAnonymousWrite(w, r) {
+				d.handleHostedDelete(param, w, r)
+			}
+		default:
+			d.serveHostedVersion(param, w, r)
+		}
+		return
+	}
+	if err := d.serveMetadataJSON(d.manifestRelPath(param), w, r); err != nil {
 		slog.ErrorContext(r.Context(), "failed to fetch terraform manifest", "error", err)
 		w.WriteHeader(http.StatusBadGateway)
 	}
@@ -113,8 +189,18 @@ func (d *tfInstance) HandleV1VersionDownload(param *param, w http.ResponseWriter
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	if d.deniedByRules(ruleSubject(param, downloadReq.OS+"/"+downloadReq.Arch), w, r) {
+		return
+	}
+	if d.hosted() {
+		d.serveHostedDownload(downloadReq, w, r)
+		return
+	}
 	if downloadReq.IsArchive {
 		if err := d.servePackageArchive(downloadReq, w, r); err != nil {
+			if d.deniedByVerification(err, w, r) {
+				return
+			}
 			slog.ErrorContext(r.Context(), "failed to serve terraform provider archive", "error", err)
 			http.Error(w, "failed to download provider", http.StatusBadGateway)
 		}
@@ -124,32 +210,56 @@ func (d *tfInstance) HandleV1VersionDownload(param *param, w http.ResponseWriter
 		return
 	}
 	if err := d.handleDownloadMetadata(downloadReq, w, r); err != nil {
+		if d.deniedByVerification(err, w, r) {
+			return
+		}
 		slog.ErrorContext(r.Context(), "failed to build terraform download metadata", "error", err)
 		http.Error(w, "failed to prepare download metadata", http.StatusBadGateway)
 	}
 }
 
+// Authenticate answers a 401 from the upstream registry with fresh credentials, if any are configured.
 func (d *tfInstance) Authenticate(response *http.Response) string {
-	// TODO : Implement the logic to authenticate the request according to selected upstream
-	slog.DebugContext(response.Request.Context(), "TODO: Implement the logic to authenticate the request according to selected upstream")
-	return ""
+	if response == nil || d.auth == nil {
+		return ""
+	}
+	header, err := d.auth.authorization(response)
+	if err != nil {
+		slog.ErrorContext(response.Request.Context(), "failed to build upstream auth header", "error", err)
+		return ""
+	}
+	return header
 }
 
-func (d *tfInstance) roundTripUpstream(ctx context.Context, r *http.Request) (*http.Response, error) {
+// upstreamURL returns the upstream location of a registry API path. The path is appended to the path of the
+// upstream URL, so registries serving their API below a prefix, such as https://app.terraform.io/api/registry, work.
+func (d *tfInstance) upstreamURL(ref *url.URL) (*url.URL, error) {
 	u, err := url.Parse(d.config.Upstream.URL)
 	if err != nil {
 		return nil, err
 	}
-	u.Path = r.URL.Path
-	u.RawQuery = r.URL.RawQuery
+	u.Path = strings.TrimSuffix(u.Path, "/") + ref.Path
+	u.RawPath = ""
+	u.RawQuery = ref.RawQuery
+	return u, nil
+}
+
+func (d *tfInstance) roundTripUpstream(ctx context.Context, r *http.Request) (*http.Response, error) {
+	u, err := d.upstreamURL(r.URL)
+	if err != nil {
+		return nil, err
+	}
 
 	req, err := http.NewRequestWithContext(ctx, r.Method, u.String(), r.Body)
 	if err != nil {
 		return nil, err
 	}
 	req.Header = r.Header.Clone()
+	// The client's credentials are for this proxy; upstream credentials come from the pipeline.
+	req.Header.Del("Authorization")
+	req.Header.Del("Cookie")
 	observability.ApplyRequestIDHeader(req, observability.RequestIDFromRequest(r))
-	var c client.Interface = &http.Client{}
+	c := d.httpClientFactory()
 	c = d.pipeline.WrapClient(c)
 	start := time.Now()
 	resp, err := c.Do(req)
@@ -171,14 +281,6 @@ func (d *tfInstance) writeHeadersFromResponse(w http.ResponseWriter, resp *http.
 	}
 }
 
-func (d *tfInstance) fetchAndStoreManifest(param *param, w http.ResponseWriter, r *http.Request) error {
-	return d.fetchAndStoreJSON(d.manifestRelPath(param), w, r)
-}
-
-func (d *tfInstance) fetchAndStoreVersionList(param *param, w http.ResponseWriter, r *http.Request) error {
-	return d.fetchAndStoreJSON(d.versionsRelPath(param), w, r)
-}
-
 func (d *tfInstance) manifestRelPath(param *param) string {
 	if param == nil {
 		return ""
@@ -218,35 +320,136 @@ func (d *tfInstance) serveCachedJSON(relPath string, w http.ResponseWriter, r *h
 	return true
 }
 
-func (d *tfInstance) fetchAndStoreJSON(relPath string, w http.ResponseWriter, r *http.Request) error {
-	resp, err := d.roundTripUpstream(r.Context(), r)
+// upstreamJSON is an upstream metadata response shared between coalesced requests.
+type upstreamJSON struct {
+	status int
+	header http.Header
+	body   []byte
+}
+
+// fetchRecord is stored beside each cached metadata document to remember when it was fetched.
+type fetchRecord struct {
+	Kind      string    `json:"kind"`
+	FetchedAt time.Time `json:"fetchedAt"`
+}
+
+const fetchRecordKind = "registry.fetch"
+
+func fetchRecordPath(relPath string) string {
+	return relPath + ".fetch.json"
+}
+
+// serveMetadataJSON answers a mutable metadata request from cache or upstream according to the repository freshness policy.
+func (d *tfInstance) serveMetadataJSON(relPath string, w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	freshness := d.config.Freshness
+	fetchedAt := d.jsonFetchedAt(ctx, relPath)
+	now := time.Now()
+	switch freshness.State(fetchedAt, now) {
+	case repo.CacheFresh:
+		if d.serveCachedJSON(relPath, w, r) {
+			return nil
+		}
+	case repo.CacheRevalidate:
+		if d.serveCachedJSON(relPath, w, r) {
+			d.revalidateJSON(relPath, r)
+			return nil
+		}
+	}
+	result, err := d.fetchAndStoreJSON(ctx, relPath, r)
+	if (err != nil || result.status >= http.StatusInternalServerError) && freshness.ServeStaleOnError(fetchedAt, now) {
+		if d.serveCachedJSON(relPath, w, r) {
+			slog.WarnContext(ctx, "serving stale terraform metadata", "path", relPath, "fetched_at", fetchedAt, "error", err)
+			d.recordCacheStale(observability.CacheRefs)
+			return nil
+		}
+	}
 	if err != nil {
 		return err
 	}
-	defer resp.Body.Close()
+	for key, values := range result.header {
+		for _, value := range values {
+			w.Header().Add(key, value)
+		}
+	}
+	w.WriteHeader(result.status)
+	if len(result.body) > 0 {
+		if _, err := w.Write(result.body); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	body, err := io.ReadAll(resp.Body)
+// revalidateJSON refreshes relPath in the background after a stale entry has been served.
+func (d *tfInstance) revalidateJSON(relPath string, r *http.Request) {
+	ctx := context.WithoutCancel(r.Context())
+	req := r.Clone(ctx)
+	go func() {
+		if _, err := d.fetchAndStoreJSON(ctx, relPath, req); err != nil {
+			slog.WarnContext(ctx, "background revalidation of terraform metadata failed", "path", relPath, "error", err)
+		}
+	}()
+}
+
+// jsonFetchedAt returns when relPath was last fetched, falling back to the file modification time for entries cached before fetch records existed.
+func (d *tfInstance) jsonFetchedAt(ctx context.Context, relPath string) time.Time {
+	if d.refs == nil || relPath == "" {
+		return time.Time{}
+	}
+	if reader, err := d.refs.OpenFile(ctx, fetchRecordPath(relPath)); err == nil {
+		defer reader.Close()
+		var record fetchRecord
+		if err := json.NewDecoder(reader).Decode(&record); err == nil && !record.FetchedAt.IsZero() {
+			return record.FetchedAt
+		}
+	}
+	info, err := d.refs.StatFile(ctx, relPath)
 	if err != nil {
-		return err
+		return time.Time{}
 	}
+	return info.ModTime()
+}
 
-	d.writeHeadersFromResponse(w, resp)
-	w.WriteHeader(resp.StatusCode)
-	if len(body) > 0 {
-		if _, err := w.Write(body); err != nil {
-			return err
+// fetchAndStoreJSON fetches relPath from upstream once for concurrent callers and caches successful responses with their fetch time.
+func (d *tfInstance) fetchAndStoreJSON(ctx context.Context, relPath string, r *http.Request) (*upstreamJSON, error) {
+	val, err := d.flights.Do(ctx, "json:"+relPath, func(ctx context.Context) (any, error) {
+		resp, err := d.roundTripUpstream(ctx, r)
+		if err != nil {
+			return nil, err
 		}
-	}
+		defer resp.Body.Close()
 
-	if resp.StatusCode == http.StatusOK && len(body) > 0 && d.refs != nil && relPath != "" {
-		if n, err := d.refs.StoreFile(r.Context(), relPath, bytes.NewReader(body)); err != nil {
-			slog.ErrorContext(r.Context(), "failed to persist terraform metadata", "error", err, "path", relPath)
-			d.recordCacheError(observability.CacheRefs)
-		} else {
-			d.recordCacheBytes(observability.CacheRefs, "store", n)
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return nil, err
 		}
+		if resp.StatusCode == http.StatusOK && len(body) > 0 && d.refs != nil && relPath != "" {
+			d.storeJSON(ctx, relPath, body)
+		}
+		return &upstreamJSON{status: resp.StatusCode, header: resp.Header, body: body}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return val.(*upstreamJSON), nil
+}
+
+func (d *tfInstance) storeJSON(ctx context.Context, relPath string, body []byte) {
+	n, err := d.refs.StoreFile(ctx, relPath, bytes.NewReader(body))
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to persist terraform metadata", "error", err, "path", relPath)
+		d.recordCacheError(observability.CacheRefs)
+		return
+	}
+	d.recordCacheBytes(observability.CacheRefs, "store", n)
+	record, err := json.Marshal(fetchRecord{Kind: fetchRecordKind, FetchedAt: time.Now().UTC()})
+	if err != nil {
+		return
+	}
+	if _, err := d.refs.StoreFile(ctx, fetchRecordPath(relPath), bytes.NewReader(record)); err != nil {
+		slog.ErrorContext(ctx, "failed to record terraform metadata fetch time", "error", err, "path", relPath)
 	}
-	return nil
 }
 
 func parseDownloadTail(p *param) (*downloadRequest, error) {
@@ -314,11 +517,32 @@ func (d *tfInstance) handleDownloadMetadata(req *downloadRequest, w http.Respons
 	return err
 }
 
-func (d *tfInstance) ensurePackageCached(ctx context.Context, req *downloadRequest, filename, sourceURL string) error {
+// ensurePackageCached downloads the archive described by the download metadata payload into package storage, after
+// verifying it against the signed checksums the metadata links to.
+func (d *tfInstance) ensurePackageCached(ctx context.Context, req *downloadRequest, filename string, payload map[string]any) error {
 	if d.packages == nil {
 		return fmt.Errorf("package storage not configured")
 	}
 	relPath := d.packageRelPath(req, filename)
+	if _, err := d.packages.StatFile(ctx, relPath); err == nil {
+		return nil
+	}
+	_, err := d.flights.Do(ctx, "package:"+relPath, func(ctx context.Context) (any, error) {
+		if _, err := d.packages.StatFile(ctx, relPath); err == nil {
+			return nil, nil
+		}
+		shasum, err := d.verifiedShasum(ctx, req, filename, payload)
+		if err != nil {
+			return nil, err
+		}
+		return nil, d.downloadPackage(ctx, relPath, stringField(payload, "download_url"), shasum)
+	})
+	return err
+}
+
+// downloadPackage streams a provider archive from sourceURL into package storage unless a concurrent fetch already
+// stored it. When shasum is set the archive is only stored if its SHA-256 matches.
+func (d *tfInstance) downloadPackage(ctx context.Context, relPath, sourceURL, shasum string) error {
 	if _, err := d.packages.StatFile(ctx, relPath); err == nil {
 		return nil
 	}
@@ -330,7 +554,7 @@ func (d *tfInstance) ensurePackageCached(ctx context.Context, req *downloadReque
 	if err != nil {
 		return err
 	}
-	var c client.Interface = &http.Client{}
+	c := d.httpClientFactory()
 	c = d.pipeline.WrapClient(c)
 	resp, err := c.Do(httpReq)
 	if err != nil {
@@ -340,7 +564,16 @@ func (d *tfInstance) ensurePackageCached(ctx context.Context, req *downloadReque
 	if resp.StatusCode != http.StatusOK {
 		return fmt.Errorf("failed to download provider from upstream: %s", resp.Status)
 	}
-	n, err := d.packages.StoreFile(ctx, relPath, resp.Body)
+	var body io.Reader = resp.Body
+	if shasum != "" {
+		verified, err := spoolVerified(resp.Body, shasum)
+		if err != nil {
+			return err
+		}
+		defer verified.Close()
+		body = verified
+	}
+	n, err := d.packages.StoreFile(ctx, relPath, body)
 	if err != nil {
 		d.recordCacheError(observability.CachePackages)
 		return err
@@ -364,19 +597,28 @@ func (d *tfInstance) servePackageArchive(req *downloadRequest, w http.ResponseWr
 		return err
 	}
 	d.recordCacheHit(observability.CachePackages)
+	d.packages.RecordFileAccess(r.Context(), relPath)
 	defer reader.Close()
-	if info, err := d.packages.StatFile(r.Context(), relPath); err == nil {
-		w.Header().Set("Content-Length", fmt.Sprintf("%d", info.Size()))
-		d.recordCacheBytes(observability.CachePackages, "serve", info.Size())
+	info, err := d.packages.StatFile(r.Context(), relPath)
+	if err != nil {
+		info = nil
+	}
+	var etag string
+	if payload, err := d.cachedDownloadMetadataMap(r.Context(), req); err == nil {
+		if shasum := stringField(payload, "shasum"); shasum != "" && stringField(payload, "filename") == filename {
+			etag = "sha256:" + shasum
+		}
 	}
 	w.Header().Set("Content-Type", "application/zip")
 	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
-	w.WriteHeader(http.StatusOK)
-	_, err = io.Copy(w, reader)
-	if err != nil {
-		d.recordCacheError(observability.CachePackages)
-	}
-	return err
+	n := repo.ServeContent(w, r, reader, info, etag)
+	d.recordCacheBytes(observability.CachePackages, "serve", n)
+	return nil
+}
+
+// EnforceRetention applies the repository retention policy to cached provider packages.
+func (d *tfInstance) EnforceRetention(ctx context.Context) (*repo.EvictionReport, error) {
+	return d.packages.Evict(ctx, d.config.Retention)
 }
 
 func (d *tfInstance) ensurePackagePresence(ctx context.Context, req *downloadRequest, filename string) error {
@@ -571,7 +813,7 @@ func (d *tfInstance) ensurePackageCachedFromMetadata(ctx context.Context, req *d
 	if resolved == "" {
 		return fmt.Errorf("missing filename in upstream response")
 	}
-	return d.ensurePackageCached(ctx, req, resolved, sourceURL)
+	return d.ensurePackageCached(ctx, req, resolved, payload)
 }
 
 func stringField(m map[string]any, key string) string {
@@ -614,6 +856,11 @@ func (d *tfInstance) recordCacheError(cache string) {
 	observability.RecordCacheError(repoType, repoName, cache)
 }
 
+func (d *tfInstance) recordCacheStale(cache string) {
+	repoType, repoName := d.repoLabels()
+	observability.RecordCacheStale(repoType, repoName, cache)
+}
+
 func (d *tfInstance) recordCacheBytes(cache, action string, n int64) {
 	if n <= 0 {
 		return
@@ -0,0 +1,159 @@
+package tf
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/davidjspooner/go-fs/pkg/storage"
+	_ "github.com/davidjspooner/go-fs/pkg/storage/mem"
+	"github.com/davidjspooner/go-http-client/pkg/client"
+	"github.com/davidjspooner/repoxy/pkg/repo"
+)
+
+func newTFInstanceForTest(t *testing.T, freshness *repo.Freshness, handler func(req *http.Request) (*http.Response, error)) *tfInstance {
+	t.Helper()
+	stores := newTestStores(t)
+	inst, err := NewInstance(&repo.Repo{
+		Name:      "mirror",
+		Type:      "terraform",
+		Upstream:  repo.Upstream{URL: "https://registry.test"},
+		Freshness: freshness,
+	}, stores[0], stores[1], stores[2])
+	if err != nil {
+		t.Fatalf("NewInstance failed: %v", err)
+	}
+	inst.httpClientFactory = func() client.Interface {
+		return client.Func(handler)
+	}
+	return inst
+}
+
+// newTestStores returns the repository, refs and package storage of an instance, in memory.
+func newTestStores(t *testing.T) []repo.CommonStorage {
+	t.Helper()
+	ctx := context.Background()
+	fsRO, err := storage.OpenFileSystemFromString(ctx, "mem://", storage.Config{})
+	if err != nil {
+		t.Fatalf("open mem fs: %v", err)
+	}
+	root, ok := fsRO.(storage.WritableFS)
+	if !ok {
+		t.Fatalf("fs not writable")
+	}
+	stores := make([]repo.CommonStorage, 0, 3)
+	for _, sub := range []string{"proxy", "proxy/refs", "proxy/packages"} {
+		subFS, err := root.EnsureSub(ctx, sub)
+		if err != nil {
+			t.Fatalf("ensure %s: %v", sub, err)
+		}
+		store, err := repo.NewCommonStorage(subFS)
+		if err != nil {
+			t.Fatalf("new common storage: %v", err)
+		}
+		stores = append(stores, store)
+	}
+	return stores
+}
+
+func tfResponse(status int, body string) *http.Response {
+	return &http.Response{
+		StatusCode:    status,
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		Header:        http.Header{"Content-Type": []string{"application/json"}},
+		Body:          io.NopCloser(bytes.NewReader([]byte(body))),
+		ContentLength: int64(len(body)),
+	}
+}
+
+func versionList(inst *tfInstance) (int, string) {
+	p := &param{namespace: "hashicorp", name: "aws"}
+	req := httptest.NewRequest(http.MethodGet, "/v1/providers/hashicorp/aws/versions", nil)
+	rr := httptest.NewRecorder()
+	inst.HandleV1VersionList(p, rr, req)
+	return rr.Code, rr.Body.String()
+}
+
+func ageFetchRecord(t *testing.T, inst *tfInstance, age time.Duration) {
+	t.Helper()
+	relPath := inst.versionsRelPath(&param{namespace: "hashicorp", name: "aws"})
+	record, _ := json.Marshal(fetchRecord{Kind: fetchRecordKind, FetchedAt: time.Now().Add(-age)})
+	if _, err := inst.refs.StoreFile(context.Background(), fetchRecordPath(relPath), bytes.NewReader(record)); err != nil {
+		t.Fatalf("StoreFile failed: %v", err)
+	}
+}
+
+func TestVersionListRefetchedAfterTTL(t *testing.T) {
+	t.Parallel()
+	var hits atomic.Int32
+	inst := newTFInstanceForTest(t, &repo.Freshness{TTL: time.Hour}, func(req *http.Request) (*http.Response, error) {
+		return tfResponse(http.StatusOK, fmt.Sprintf(`{"hit":%d}`, hits.Add(1))), nil
+	})
+
+	if code, body := versionList(inst); code != http.StatusOK || body != `{"hit":1}` {
+		t.Fatalf("unexpected first response: %d %s", code, body)
+	}
+	if _, body := versionList(inst); body != `{"hit":1}` || hits.Load() != 1 {
+		t.Fatalf("expected fresh cache hit, got %s after %d upstream hits", body, hits.Load())
+	}
+	ageFetchRecord(t, inst, 2*time.Hour)
+	if _, body := versionList(inst); body != `{"hit":2}` {
+		t.Fatalf("expected expired entry to be refetched, got %s", body)
+	}
+}
+
+func TestVersionListServesStaleOnlyWhenUpstreamFails(t *testing.T) {
+	t.Parallel()
+	var fail atomic.Bool
+	inst := newTFInstanceForTest(t, &repo.Freshness{TTL: time.Hour, StaleIfError: 24 * time.Hour}, func(req *http.Request) (*http.Response, error) {
+		if fail.Load() {
+			return nil, errors.New("upstream unreachable")
+		}
+		return tfResponse(http.StatusOK, `{"versions":[]}`), nil
+	})
+	if code, _ := versionList(inst); code != http.StatusOK {
+		t.Fatalf("priming request failed: %d", code)
+	}
+
+	fail.Store(true)
+	ageFetchRecord(t, inst, 2*time.Hour)
+	if code, body := versionList(inst); code != http.StatusOK || body != `{"versions":[]}` {
+		t.Fatalf("expected stale copy during outage, got %d %s", code, body)
+	}
+	ageFetchRecord(t, inst, 48*time.Hour)
+	if code, _ := versionList(inst); code != http.StatusBadGateway {
+		t.Fatalf("expected 502 beyond stale-if-error window, got %d", code)
+	}
+}
+
+func TestVersionListRevalidatesInBackground(t *testing.T) {
+	t.Parallel()
+	var hits atomic.Int32
+	inst := newTFInstanceForTest(t, &repo.Freshness{TTL: time.Hour, StaleWhileRevalidate: time.Hour}, func(req *http.Request) (*http.Response, error) {
+		return tfResponse(http.StatusOK, fmt.Sprintf(`{"hit":%d}`, hits.Add(1))), nil
+	})
+	versionList(inst)
+	ageFetchRecord(t, inst, 90*time.Minute)
+
+	if _, body := versionList(inst); body != `{"hit":1}` {
+		t.Fatalf("expected stale copy while revalidating, got %s", body)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if _, body := versionList(inst); body != `{"hit":1}` {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("background revalidation did not refresh the cache")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,258 @@
+package tf
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// MirrorPath is the base URL path of the provider network mirror protocol. Clients configure
+// network_mirror { url = "https://<host>/v1/mirror/" } and request <hostname>/<namespace>/<type>/index.json below it,
+// where hostname selects the repository whose upstream is that registry.
+const MirrorPath = "/v1/mirror/"
+
+// upstreamHost returns the host of the upstream registry, which is the provider hostname the mirror serves.
+func (d *tfInstance) upstreamHost() string {
+	u, err := url.Parse(d.config.Upstream.URL)
+	if err != nil {
+		return ""
+	}
+	return u.Host
+}
+
+// HandleMirrorIndex serves index.json, the versions available for a provider.
+func (d *tfInstance) HandleMirrorIndex(param *param, w http.ResponseWriter, r *http.Request) {
+	if d.deniedByRules(ruleSubject(param, ""), w, r) {
+		return
+	}
+	doc, ok := d.mirrorVersionList(param, w, r)
+	if !ok {
+		return
+	}
+	versions := make(map[string]struct{}, len(doc.Versions))
+	for _, version := range doc.Versions {
+		versions[version.Version] = struct{}{}
+	}
+	writeMirrorJSON(w, r, map[string]any{"versions": versions})
+}
+
+// HandleMirrorVersion serves <version>.json, the archive of each platform with its hashes. zh: hashes come from the
+// upstream download metadata; h1: hashes are added once the archive is cached.
+func (d *tfInstance) HandleMirrorVersion(param *param, w http.ResponseWriter, r *http.Request) {
+	if d.deniedByRules(ruleSubject(param, ""), w, r) {
+		return
+	}
+	doc, ok := d.mirrorVersionList(param, w, r)
+	if !ok {
+		return
+	}
+	var platforms []mirrorPlatform
+	found := false
+	for _, version := range doc.Versions {
+		if version.Version == param.version {
+			platforms, found = version.Platforms, true
+			break
+		}
+	}
+	if !found {
+		writeErrors(w, http.StatusNotFound, fmt.Sprintf("%s/%s has no version %s", param.namespace, param.name, param.version))
+		return
+	}
+	archives := make(map[string]mirrorArchive, len(platforms))
+	for _, platform := range platforms {
+		req := &downloadRequest{param: param, OS: platform.OS, Arch: platform.Arch}
+		payload, err := d.loadOrFetchDownloadMetadataMap(r.Context(), req)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "failed to fetch terraform download metadata for mirror", "error", err,
+				"provider", param.namespace+"/"+param.name, "version", param.version, "platform", platform.OS+"/"+platform.Arch)
+			writeErrors(w, http.StatusBadGateway, "failed to fetch download metadata for "+platform.OS+"_"+platform.Arch)
+			return
+		}
+		filename, err := d.resolveDownloadFilename(req, payload)
+		if err != nil {
+			slog.WarnContext(r.Context(), "skipping terraform platform without a filename", "error", err, "platform", platform.OS+"/"+platform.Arch)
+			continue
+		}
+		var hashes []string
+		if h1 := d.packageH1(r.Context(), req, filename); h1 != "" {
+			hashes = append(hashes, h1)
+		}
+		if shasum := stringField(payload, "shasum"); shasum != "" {
+			hashes = append(hashes, "zh:"+shasum)
+		}
+		archives[platform.OS+"_"+platform.Arch] = mirrorArchive{
+			// Relative to the <version>.json URL, so the archive is fetched through this mirror and hostname.
+			URL:    path.Join(param.version, "download", platform.OS, platform.Arch, "archive", url.PathEscape(filename)),
+			Hashes: hashes,
+		}
+	}
+	writeMirrorJSON(w, r, map[string]any{"archives": archives})
+}
+
+// mirrorArchive is an entry of the archives map of <version>.json.
+type mirrorArchive struct {
+	URL    string   `json:"url"`
+	Hashes []string `json:"hashes,omitempty"`
+}
+
+// mirrorPlatform and mirrorVersionList are the parts of the registry protocol version list the mirror needs.
+type mirrorPlatform struct {
+	OS   string `json:"os"`
+	Arch string `json:"arch"`
+}
+
+type mirrorVersionList struct {
+	Versions []struct {
+		Version   string           `json:"version"`
+		Platforms []mirrorPlatform `json:"platforms"`
+	} `json:"versions"`
+}
+
+// mirrorVersionList loads the registry version list for param from cache or upstream, without what the repository
+// rules refuse. When it cannot it answers r itself and returns false.
+func (d *tfInstance) mirrorVersionList(param *param, w http.ResponseWriter, r *http.Request) (*mirrorVersionList, bool) {
+	upstream := r.Clone(r.Context())
+	upstream.URL = &url.URL{Path: fmt.Sprintf("/v1/providers/%s/%s/versions", param.namespace, param.name)}
+	upstream.Header = http.Header{"Accept": []string{"application/json"}}
+	buffer := &responseBuffer{header: http.Header{}, status: http.StatusOK}
+	if err := d.serveMetadataJSON(d.versionsRelPath(param), buffer, upstream); err != nil {
+		slog.ErrorContext(r.Context(), "failed to fetch terraform version list", "error", err)
+		writeErrors(w, http.StatusBadGateway, "failed to fetch version list")
+		return nil, false
+	}
+	if buffer.status != http.StatusOK {
+		if buffer.status == http.StatusNotFound {
+			writeErrors(w, http.StatusNotFound, fmt.Sprintf("provider %s/%s not found", param.namespace, param.name))
+		} else {
+			writeErrors(w, http.StatusBadGateway, fmt.Sprintf("upstream answered %d", buffer.status))
+		}
+		return nil, false
+	}
+	body := buffer.body.Bytes()
+	if d.config.Rules != nil {
+		filtered, err := d.filterVersionList(param, body)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "failed to filter terraform version list", "error", err)
+			writeErrors(w, http.StatusBadGateway, "invalid version list")
+			return nil, false
+		}
+		body = filtered
+	}
+	var doc mirrorVersionList
+	if err := json.Unmarshal(body, &doc); err != nil {
+		slog.ErrorContext(r.Context(), "failed to decode terraform version list", "error", err)
+		writeErrors(w, http.StatusBadGateway, "invalid version list")
+		return nil, false
+	}
+	return &doc, true
+}
+
+func writeMirrorJSON(w http.ResponseWriter, r *http.Request, doc any) {
+	body, err := json.Marshal(doc)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to encode terraform mirror response", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(body)
+}
+
+// packageHashRelPath is where the h1: hash of a cached archive is kept beside its download metadata.
+func (d *tfInstance) packageHashRelPath(req *downloadRequest) string {
+	return path.Join("providers", req.param.namespace, req.param.name, req.param.version, "download", req.OS, req.Arch+".h1")
+}
+
+// packageH1 returns the h1: hash of a cached archive, computing and remembering it on first use, or "" when the
+// archive is not cached.
+func (d *tfInstance) packageH1(ctx context.Context, req *downloadRequest, filename string) string {
+	hashPath := d.packageHashRelPath(req)
+	if reader, err := d.refs.OpenFile(ctx, hashPath); err == nil {
+		data, err := io.ReadAll(reader)
+		reader.Close()
+		if hash := strings.TrimSpace(string(data)); err == nil && strings.HasPrefix(hash, "h1:") {
+			return hash
+		}
+	}
+	relPath := d.packageRelPath(req, filename)
+	info, err := d.packages.StatFile(ctx, relPath)
+	if err != nil {
+		return ""
+	}
+	reader, err := d.packages.OpenFile(ctx, relPath)
+	if err != nil {
+		return ""
+	}
+	defer reader.Close()
+	hash, err := hashZipH1(reader, info.Size())
+	if err != nil {
+		slog.WarnContext(ctx, "failed to hash cached terraform provider archive", "error", err, "path", relPath)
+		return ""
+	}
+	if _, err := d.refs.StoreFile(ctx, hashPath, strings.NewReader(hash)); err != nil {
+		slog.WarnContext(ctx, "failed to store terraform provider archive hash", "error", err, "path", hashPath)
+	}
+	return hash
+}
+
+// hashZipH1 computes Terraform's h1: package hash of a provider archive: the SHA-256 of the sorted
+// "<sha256 hex>  <name>" lines of the files it contains.
+func hashZipH1(reader io.Reader, size int64) (string, error) {
+	readerAt, ok := reader.(io.ReaderAt)
+	if !ok {
+		tmp, err := os.CreateTemp("", "repoxy-h1-*")
+		if err != nil {
+			return "", err
+		}
+		defer os.Remove(tmp.Name())
+		defer tmp.Close()
+		if size, err = io.Copy(tmp, reader); err != nil {
+			return "", err
+		}
+		readerAt = tmp
+	}
+	archive, err := zip.NewReader(readerAt, size)
+	if err != nil {
+		return "", err
+	}
+	files := make([]*zip.File, 0, len(archive.File))
+	for _, file := range archive.File {
+		if strings.HasSuffix(file.Name, "/") {
+			continue
+		}
+		if strings.Contains(file.Name, "\n") {
+			return "", fmt.Errorf("archive entry %q contains a newline", file.Name)
+		}
+		files = append(files, file)
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+	var summary bytes.Buffer
+	for _, file := range files {
+		content, err := file.Open()
+		if err != nil {
+			return "", err
+		}
+		h := sha256.New()
+		_, err = io.Copy(h, content)
+		content.Close()
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&summary, "%x  %s\n", h.Sum(nil), file.Name)
+	}
+	sum := sha256.Sum256(summary.Bytes())
+	return "h1:" + base64.StdEncoding.EncodeToString(sum[:]), nil
+}
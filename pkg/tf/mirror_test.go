@@ -0,0 +1,116 @@
+package tf
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/davidjspooner/go-http-server/pkg/mux"
+)
+
+func providerZip(t *testing.T) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	fw, err := zw.Create("terraform-provider-aws_v5.1.0_x5")
+	if err != nil {
+		t.Fatalf("zip create: %v", err)
+	}
+	_, _ = fw.Write([]byte("#!/bin/provider\n"))
+	if err := zw.Close(); err != nil {
+		t.Fatalf("zip close: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestNetworkMirrorProtocol(t *testing.T) {
+	t.Parallel()
+	archive := providerZip(t)
+	sum := sha256.Sum256(archive)
+	shasum := hex.EncodeToString(sum[:])
+	var downloads atomic.Int32
+	inst := newTFInstanceForTest(t, nil, func(req *http.Request) (*http.Response, error) {
+		switch req.URL.Path {
+		case "/v1/providers/hashicorp/aws/versions":
+			return tfResponse(http.StatusOK, `{"versions":[{"version":"5.1.0","protocols":["5.0"],"platforms":[`+
+				`{"os":"linux","arch":"amd64"},{"os":"darwin","arch":"arm64"}]}]}`), nil
+		case "/v1/providers/hashicorp/aws/5.1.0/download/linux/amd64", "/v1/providers/hashicorp/aws/5.1.0/download/darwin/arm64":
+			platform := strings.Join(strings.Split(req.URL.Path, "/")[7:9], "_")
+			filename := "terraform-provider-aws_5.1.0_" + platform + ".zip"
+			return tfResponse(http.StatusOK, `{"filename":"`+filename+`","download_url":"https://releases.test/`+filename+`","shasum":"`+shasum+`"}`), nil
+		case "/terraform-provider-aws_5.1.0_linux_amd64.zip":
+			downloads.Add(1)
+			resp := tfResponse(http.StatusOK, string(archive))
+			resp.Header.Set("Content-Type", "application/zip")
+			return resp, nil
+		}
+		return tfResponse(http.StatusNotFound, `{"errors":["not found"]}`), nil
+	})
+	inst.nameMatchers.Set([]string{"hashicorp/*"})
+	m := mux.NewServeMux()
+	if err := (&tfType{instances: []*tfInstance{inst}}).Initialize(context.Background(), "terraform", m); err != nil {
+		t.Fatalf("Initialize failed: %v", err)
+	}
+	get := func(path string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		m.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, path, nil))
+		return rr
+	}
+	base := MirrorPath + "registry.test/hashicorp/aws/"
+
+	if rr := get(base + "index.json"); rr.Code != http.StatusOK || rr.Body.String() != `{"versions":{"5.1.0":{}}}` {
+		t.Fatalf("unexpected index.json: %d %s", rr.Code, rr.Body.String())
+	}
+
+	var doc struct {
+		Archives map[string]mirrorArchive `json:"archives"`
+	}
+	rr := get(base + "5.1.0.json")
+	if rr.Code != http.StatusOK || json.Unmarshal(rr.Body.Bytes(), &doc) != nil || len(doc.Archives) != 2 {
+		t.Fatalf("unexpected 5.1.0.json: %d %s", rr.Code, rr.Body.String())
+	}
+	linux := doc.Archives["linux_amd64"]
+	if linux.URL != "5.1.0/download/linux/amd64/archive/terraform-provider-aws_5.1.0_linux_amd64.zip" ||
+		len(linux.Hashes) != 1 || linux.Hashes[0] != "zh:"+shasum {
+		t.Fatalf("unexpected linux archive entry %+v", linux)
+	}
+
+	// The relative archive URL resolves below the mirror path, so the download stays on this hostname's repository.
+	rr = get(base + linux.URL)
+	if rr.Code != http.StatusOK || !bytes.Equal(rr.Body.Bytes(), archive) || downloads.Load() != 1 {
+		t.Fatalf("unexpected archive download: %d, %d upstream downloads", rr.Code, downloads.Load())
+	}
+
+	// Once the archive is cached its h1: hash is advertised too.
+	rr = get(base + "5.1.0.json")
+	doc.Archives = nil
+	if err := json.Unmarshal(rr.Body.Bytes(), &doc); err != nil {
+		t.Fatalf("decode 5.1.0.json: %v", err)
+	}
+	want := []string{"h1:1KYbo89WnO6f7GeQBVfxVQTEK9Ix816yGj5+JlkukoU=", "zh:" + shasum}
+	if got := doc.Archives["linux_amd64"].Hashes; len(got) != 2 || got[0] != want[0] || got[1] != want[1] {
+		t.Fatalf("expected hashes %v, got %v", want, got)
+	}
+	if got := doc.Archives["darwin_arm64"].Hashes; len(got) != 1 {
+		t.Fatalf("expected uncached archive to list only its zh: hash, got %v", got)
+	}
+
+	for _, path := range []string{
+		MirrorPath + "registry.terraform.io/hashicorp/aws/index.json", // no repository for that hostname
+		MirrorPath + "registry.test/other/aws/index.json",
+		base + "9.9.9.json",
+		base + "index.html",
+	} {
+		if rr := get(path); rr.Code != http.StatusNotFound {
+			t.Fatalf("%s: expected 404, got %d %s", path, rr.Code, rr.Body.String())
+		}
+	}
+}
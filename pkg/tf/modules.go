@@ -0,0 +1,416 @@
+package tf
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/davidjspooner/repoxy/pkg/observability"
+	"github.com/davidjspooner/repoxy/pkg/repo"
+)
+
+// moduleDownload is cached beside a module version to remember where its source lives.
+type moduleDownload struct {
+	// Source is the X-Terraform-Get value of the upstream registry, resolved to an absolute URL.
+	Source string `json:"source"`
+	// Root is the single top-level directory of the cached archive, for GitHub tarballs.
+	Root string `json:"root,omitempty"`
+	// SHA256 is the digest of the archive when it was first cached; later downloads and reads must match it.
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+// defaultModuleHosts are the hosts module archives are fetched from unless upstream.config.module_hosts lists others.
+// The upstream registry's own host is always allowed.
+var defaultModuleHosts = []string{"github.com", "codeload.github.com"}
+
+// moduleHosts returns the hosts repoxy fetches module archives from for config.
+func moduleHosts(config *repo.Repo) []string {
+	hosts := defaultModuleHosts
+	if list := config.Upstream.Config["module_hosts"]; list != "" {
+		hosts = nil
+		for _, host := range strings.Split(list, ",") {
+			if host = strings.TrimSpace(host); host != "" {
+				hosts = append(hosts, host)
+			}
+		}
+	}
+	if u, err := url.Parse(config.Upstream.URL); err == nil && u.Host != "" {
+		hosts = append(slices.Clip(hosts), u.Host)
+	}
+	return hosts
+}
+
+// moduleArchive is a module source repoxy can fetch and cache.
+type moduleArchive struct {
+	url        string // where the archive is downloaded from
+	subdir     string // the module's directory inside the archive, from the source's // suffix
+	filename   string // module.tar.gz or module.zip
+	detectRoot bool   // the archive wraps its content in one generated top-level directory
+}
+
+// HandleV1ModuleVersionList serves the version list of a module.
+func (d *tfInstance) HandleV1ModuleVersionList(param *param, w http.ResponseWriter, r *http.Request) {
+	if param == nil || param.namespace == "" || param.name == "" || param.provider == "" {
+		http.Error(w, "missing namespace, name or provider", http.StatusBadRequest)
+		return
+	}
+	if d.deniedByRules(ruleSubject(param, ""), w, r) {
+		return
+	}
+	relPath := d.moduleRelPath(param, "versions.json")
+	serve := func() error { return d.serveMetadataJSON(relPath, w, r) }
+	if d.config.Rules != nil {
+		serve = func() error {
+			return d.serveFilteredJSON(relPath, func(body []byte) ([]byte, error) { return d.filterModuleVersionList(param, body) }, w, r)
+		}
+	}
+	if err := serve(); err != nil {
+		slog.ErrorContext(r.Context(), "failed to fetch terraform module version list", "error", err)
+		w.WriteHeader(http.StatusBadGateway)
+	}
+}
+
+// HandleV1ModuleDownload answers with an X-Terraform-Get header. Sources repoxy can fetch are cached in package storage
+// and point back at this proxy; other sources, such as private git repositories, are passed through unchanged.
+func (d *tfInstance) HandleV1ModuleDownload(param *param, w http.ResponseWriter, r *http.Request) {
+	if d.deniedByRules(ruleSubject(param, ""), w, r) {
+		return
+	}
+	record, ok := d.moduleDownloadRecord(param, w, r)
+	if !ok {
+		return
+	}
+	archive, ok := d.cacheableModuleSource(record.Source)
+	if !ok {
+		slog.DebugContext(r.Context(), "passing through terraform module source", "module", param.path(), "source", record.Source)
+		w.Header().Set("X-Terraform-Get", record.Source)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if err := d.ensureModuleCached(r.Context(), param, archive, record); err != nil {
+		slog.ErrorContext(r.Context(), "failed to cache terraform module", "error", err, "module", param.path(), "source", record.Source)
+		writeErrors(w, http.StatusBadGateway, "failed to download module source")
+		return
+	}
+	local := fmt.Sprintf("%s://%s/v1/modules/%s/%s/archive/%s", detectScheme(r), r.Host, param.path(), param.version, archive.filename)
+	if subdir := path.Join(record.Root, archive.subdir); subdir != "." {
+		local += "//" + subdir
+	}
+	w.Header().Set("X-Terraform-Get", local)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleV1ModuleArchive serves a cached module archive, fetching it again when it has been evicted.
+func (d *tfInstance) HandleV1ModuleArchive(param *param, w http.ResponseWriter, r *http.Request) {
+	if d.deniedByRules(ruleSubject(param, ""), w, r) {
+		return
+	}
+	filename := filepath.Base(param.tail)
+	if filename != "module.tar.gz" && filename != "module.zip" {
+		http.Error(w, "unknown module archive", http.StatusNotFound)
+		return
+	}
+	relPath := d.moduleRelPath(param, param.version, filename)
+	record, ok := d.moduleDownloadRecord(param, w, r)
+	if !ok {
+		return
+	}
+	if _, err := d.packages.StatFile(r.Context(), relPath); err != nil || record.SHA256 == "" {
+		archive, ok := d.cacheableModuleSource(record.Source)
+		if !ok || archive.filename != filename {
+			http.Error(w, "unknown module archive", http.StatusNotFound)
+			return
+		}
+		if err := d.ensureModuleCached(r.Context(), param, archive, record); err != nil {
+			slog.ErrorContext(r.Context(), "failed to cache terraform module", "error", err, "module", param.path())
+			http.Error(w, "failed to download module", http.StatusBadGateway)
+			return
+		}
+	}
+	reader, err := d.packages.OpenFile(r.Context(), relPath)
+	if err != nil {
+		d.recordCacheMiss(observability.CachePackages)
+		http.Error(w, "failed to open module archive", http.StatusBadGateway)
+		return
+	}
+	defer reader.Close()
+	verified, err := spoolVerified(reader, record.SHA256)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "cached terraform module archive failed verification", "error", err, "module", param.path())
+		d.recordCacheError(observability.CachePackages)
+		http.Error(w, "failed to verify module archive", http.StatusBadGateway)
+		return
+	}
+	defer verified.Close()
+	d.recordCacheHit(observability.CachePackages)
+	d.packages.RecordFileAccess(r.Context(), relPath)
+	info, err := d.packages.StatFile(r.Context(), relPath)
+	if err != nil {
+		info = nil
+	}
+	if filename == "module.zip" {
+		w.Header().Set("Content-Type", "application/zip")
+	} else {
+		w.Header().Set("Content-Type", "application/gzip")
+	}
+	n := repo.ServeContent(w, r, verified, info, "")
+	d.recordCacheBytes(observability.CachePackages, "serve", n)
+}
+
+func (d *tfInstance) moduleRelPath(param *param, elem ...string) string {
+	return path.Join(append([]string{"modules", param.namespace, param.name, param.provider}, elem...)...)
+}
+
+// moduleDownloadRecord returns the cached source of a module version, asking upstream on first use. Versions are
+// immutable, so the record is kept without a freshness check. When it cannot it answers r itself and returns false.
+func (d *tfInstance) moduleDownloadRecord(param *param, w http.ResponseWriter, r *http.Request) (*moduleDownload, bool) {
+	ctx := r.Context()
+	relPath := d.moduleRelPath(param, param.version, "download.json")
+	if reader, err := d.refs.OpenFile(ctx, relPath); err == nil {
+		var record moduleDownload
+		err := json.NewDecoder(reader).Decode(&record)
+		reader.Close()
+		if err == nil && record.Source != "" {
+			d.recordCacheHit(observability.CacheRefs)
+			return &record, true
+		}
+	}
+	d.recordCacheMiss(observability.CacheRefs)
+	val, err := d.flights.Do(ctx, "module:"+relPath, func(ctx context.Context) (any, error) {
+		upstream := r.Clone(ctx)
+		upstream.URL = &url.URL{Path: fmt.Sprintf("/v1/modules/%s/%s/download", param.path(), param.version)}
+		upstream.Header = http.Header{}
+		resp, err := d.roundTripUpstream(ctx, upstream)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+		source := resp.Header.Get("X-Terraform-Get")
+		if resp.StatusCode/100 != 2 || source == "" {
+			return &upstreamJSON{status: resp.StatusCode, header: resp.Header, body: body}, nil
+		}
+		// The source may be relative to the download URL.
+		if base, err := d.upstreamURL(upstream.URL); err == nil && !strings.Contains(source, "::") {
+			if ref, err := url.Parse(source); err == nil && !ref.IsAbs() {
+				source = base.ResolveReference(ref).String()
+			}
+		}
+		record := &moduleDownload{Source: source}
+		d.storeModuleDownload(ctx, param, record)
+		return record, nil
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to fetch terraform module download location", "error", err, "module", param.path())
+		writeErrors(w, http.StatusBadGateway, "failed to fetch module download location")
+		return nil, false
+	}
+	switch result := val.(type) {
+	case *moduleDownload:
+		record := *result // shared with coalesced callers
+		return &record, true
+	case *upstreamJSON:
+		status := result.status
+		if status/100 == 2 {
+			status = http.StatusBadGateway // upstream answered without a source
+		}
+		w.Header().Set("Content-Type", result.header.Get("Content-Type"))
+		w.WriteHeader(status)
+		_, _ = w.Write(result.body)
+	}
+	return nil, false
+}
+
+func (d *tfInstance) storeModuleDownload(ctx context.Context, param *param, record *moduleDownload) {
+	relPath := d.moduleRelPath(param, param.version, "download.json")
+	body, err := json.Marshal(record)
+	if err != nil {
+		return
+	}
+	if n, err := d.refs.StoreFile(ctx, relPath, bytes.NewReader(body)); err != nil {
+		slog.ErrorContext(ctx, "failed to store terraform module download location", "error", err, "path", relPath)
+		d.recordCacheError(observability.CacheRefs)
+	} else {
+		d.recordCacheBytes(observability.CacheRefs, "store", n)
+	}
+}
+
+// ensureModuleCached downloads archive into package storage once for concurrent callers, verifying it against the
+// digest in record once one is known. It records the digest of the first download and, for archives with a generated
+// top-level directory, that directory in record.
+func (d *tfInstance) ensureModuleCached(ctx context.Context, param *param, archive moduleArchive, record *moduleDownload) error {
+	relPath := d.moduleRelPath(param, param.version, archive.filename)
+	if _, err := d.packages.StatFile(ctx, relPath); err != nil {
+		shasum := record.SHA256
+		if _, err := d.flights.Do(ctx, "package:"+relPath, func(ctx context.Context) (any, error) {
+			return nil, d.downloadPackage(ctx, relPath, archive.url, shasum)
+		}); err != nil {
+			return err
+		}
+	}
+	if record.SHA256 != "" && (!archive.detectRoot || record.Root != "") {
+		return nil
+	}
+	reader, err := d.packages.OpenFile(ctx, relPath)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	h := sha256.New()
+	body := io.TeeReader(reader, h)
+	if archive.detectRoot && record.Root == "" {
+		root, err := tarballRoot(body)
+		if err != nil {
+			return fmt.Errorf("failed to read module archive: %w", err)
+		}
+		record.Root = root
+	}
+	if _, err := io.Copy(io.Discard, body); err != nil {
+		return fmt.Errorf("failed to read module archive: %w", err)
+	}
+	if record.SHA256 == "" {
+		record.SHA256 = hex.EncodeToString(h.Sum(nil))
+	}
+	d.storeModuleDownload(ctx, param, record)
+	return nil
+}
+
+// cacheableModuleSource returns the archive of source when repoxy can cache it and its host is one repoxy fetches
+// module archives from. Other sources are left to the client, so upstream cannot make the proxy fetch internal URLs.
+func (d *tfInstance) cacheableModuleSource(source string) (moduleArchive, bool) {
+	archive, ok := parseModuleSource(source)
+	if !ok {
+		return moduleArchive{}, false
+	}
+	u, err := url.Parse(archive.url)
+	if err != nil || !slices.ContainsFunc(d.moduleHosts, func(host string) bool { return strings.EqualFold(host, u.Host) }) {
+		return moduleArchive{}, false
+	}
+	return archive, true
+}
+
+// parseModuleSource recognises the module sources repoxy can cache: http(s) archives and GitHub repositories at a
+// ref, which are fetched as tarballs. Sources use the go-getter syntax of Terraform, including a //subdir suffix.
+func parseModuleSource(source string) (moduleArchive, bool) {
+	getter, address, forced := strings.Cut(source, "::")
+	if !forced {
+		getter, address = "", source
+	}
+	u, err := url.Parse(address)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") {
+		return moduleArchive{}, false
+	}
+	var archive moduleArchive
+	if i := strings.Index(u.Path, "//"); i >= 0 {
+		archive.subdir = strings.Trim(u.Path[i+2:], "/")
+		u.Path = u.Path[:i]
+		u.RawPath = ""
+	}
+	query := u.Query()
+	switch getter {
+	case "git":
+		parts := strings.Split(strings.Trim(strings.TrimSuffix(u.Path, ".git"), "/"), "/")
+		ref := query.Get("ref")
+		if !strings.EqualFold(u.Host, "github.com") || len(parts) != 2 || ref == "" {
+			return moduleArchive{}, false
+		}
+		archive.url = fmt.Sprintf("https://codeload.github.com/%s/%s/tar.gz/%s", parts[0], parts[1], url.PathEscape(ref))
+		archive.filename, archive.detectRoot = "module.tar.gz", true
+	case "", "http", "https":
+		format := query.Get("archive")
+		query.Del("archive")
+		if format == "" {
+			switch {
+			case strings.HasSuffix(u.Path, ".tar.gz"), strings.HasSuffix(u.Path, ".tgz"):
+				format = "tar.gz"
+			case strings.HasSuffix(u.Path, ".zip"):
+				format = "zip"
+			}
+		}
+		switch format {
+		case "tar.gz", "tgz":
+			archive.filename = "module.tar.gz"
+		case "zip":
+			archive.filename = "module.zip"
+		default:
+			return moduleArchive{}, false
+		}
+		u.RawQuery = query.Encode()
+		archive.url = u.String()
+	default:
+		return moduleArchive{}, false
+	}
+	return archive, true
+}
+
+// tarballRoot returns the directory every entry of a gzipped tarball is in, or "" when there is no single one.
+func tarballRoot(reader io.Reader) (string, error) {
+	gz, err := gzip.NewReader(reader)
+	if err != nil {
+		return "", err
+	}
+	defer gz.Close()
+	tr := tar.NewReader(gz)
+	root := ""
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return root, nil
+		}
+		if err != nil {
+			return "", err
+		}
+		if header.Typeflag == tar.TypeXGlobalHeader {
+			continue
+		}
+		name := strings.TrimPrefix(path.Clean(header.Name), "./")
+		first, _, nested := strings.Cut(name, "/")
+		if !nested && header.Typeflag != tar.TypeDir {
+			return "", nil // a file at the top level
+		}
+		if root != "" && first != root {
+			return "", nil
+		}
+		root = first
+	}
+}
+
+// filterModuleVersionList removes the module versions the rules refuse.
+func (d *tfInstance) filterModuleVersionList(param *param, body []byte) ([]byte, error) {
+	var doc map[string]any
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return nil, err
+	}
+	modules, _ := doc["modules"].([]any)
+	for _, entry := range modules {
+		module, ok := entry.(map[string]any)
+		if !ok {
+			continue
+		}
+		versions, _ := module["versions"].([]any)
+		kept := make([]any, 0, len(versions))
+		for _, v := range versions {
+			version, _ := v.(map[string]any)
+			ref := *param
+			ref.version = stringField(version, "version")
+			if allowed, _ := d.config.Rules.Evaluate(ruleSubject(&ref, "")); allowed {
+				kept = append(kept, v)
+			}
+		}
+		module["versions"] = kept
+	}
+	return json.Marshal(doc)
+}
@@ -0,0 +1,187 @@
+package tf
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync/atomic"
+	"testing"
+
+	"github.com/davidjspooner/go-http-server/pkg/mux"
+	"github.com/davidjspooner/repoxy/pkg/repo"
+)
+
+// githubTarball builds a tarball shaped like codeload.github.com's: a pax global header and one top-level directory.
+func githubTarball(t *testing.T) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	entries := []struct {
+		header tar.Header
+		body   string
+	}{
+		{tar.Header{Name: "pax_global_header", Typeflag: tar.TypeXGlobalHeader, PAXRecords: map[string]string{"comment": "abc123"}}, ""},
+		{tar.Header{Name: "terraform-aws-vpc-5.0.0/", Typeflag: tar.TypeDir, Mode: 0o755}, ""},
+		{tar.Header{Name: "terraform-aws-vpc-5.0.0/main.tf", Typeflag: tar.TypeReg, Mode: 0o644}, "resource \"aws_vpc\" \"this\" {}\n"},
+	}
+	for _, entry := range entries {
+		entry.header.Size = int64(len(entry.body))
+		if err := tw.WriteHeader(&entry.header); err != nil {
+			t.Fatalf("tar header: %v", err)
+		}
+		_, _ = tw.Write([]byte(entry.body))
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("tar close: %v", err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatalf("gzip close: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestModuleRegistryProtocol(t *testing.T) {
+	t.Parallel()
+	tarball := githubTarball(t)
+	var upstreamCalls, tarballDownloads atomic.Int32
+	inst := newTFInstanceForTest(t, nil, func(req *http.Request) (*http.Response, error) {
+		upstreamCalls.Add(1)
+		source := map[string]string{
+			"/v1/modules/terraform-aws-modules/vpc/aws/5.0.0/download": "git::https://github.com/terraform-aws-modules/terraform-aws-vpc?ref=v5.0.0",
+			"/v1/modules/hashicorp/consul/aws/0.1.0/download":          "./consul.zip//modules/cluster",
+			"/v1/modules/corp/network/aws/1.0.0/download":              "git::ssh://git@git.corp.test/network.git?ref=v1.0.0",
+			"/v1/modules/corp/metadata/aws/1.0.0/download":             "http://169.254.169.254/latest/user-data?archive=zip",
+		}
+		switch target := req.URL.Host + req.URL.Path; {
+		case target == "registry.test/v1/modules/terraform-aws-modules/vpc/aws/versions":
+			return tfResponse(http.StatusOK, `{"modules":[{"versions":[{"version":"5.0.0"},{"version":"6.0.0"}]}]}`), nil
+		case source[req.URL.Path] != "":
+			resp := tfResponse(http.StatusNoContent, "")
+			resp.Header.Set("X-Terraform-Get", source[req.URL.Path])
+			return resp, nil
+		case target == "codeload.github.com/terraform-aws-modules/terraform-aws-vpc/tar.gz/v5.0.0":
+			tarballDownloads.Add(1)
+			return tfResponse(http.StatusOK, string(tarball)), nil
+		case target == "registry.test/v1/modules/hashicorp/consul/aws/0.1.0/consul.zip":
+			return tfResponse(http.StatusOK, "PK-not-really-a-zip"), nil
+		case req.URL.Host == "169.254.169.254":
+			t.Errorf("unexpected fetch of %s", req.URL)
+		}
+		return tfResponse(http.StatusNotFound, `{"errors":["not found"]}`), nil
+	})
+	inst.nameMatchers.Set([]string{"*/*/*"})
+	inst.config.Rules = &repo.Rules{Deny: []repo.Rule{{Name: "terraform-aws-modules/*/*", Version: ">= 6.0"}}}
+	m := mux.NewServeMux()
+	if err := (&tfType{instances: []*tfInstance{inst}}).Initialize(context.Background(), "terraform", m); err != nil {
+		t.Fatalf("Initialize failed: %v", err)
+	}
+	get := func(path string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "https://repoxy.test"+path, nil)
+		req.Header.Set("X-Forwarded-Proto", "https")
+		m.ServeHTTP(rr, req)
+		return rr
+	}
+
+	if rr := get("/v1/modules/terraform-aws-modules/vpc/aws/versions"); rr.Code != http.StatusOK ||
+		rr.Body.String() != `{"modules":[{"versions":[{"version":"5.0.0"}]}]}` {
+		t.Fatalf("unexpected version list: %d %s", rr.Code, rr.Body.String())
+	}
+	if rr := get("/v1/modules/terraform-aws-modules/vpc/aws/6.0.0/download"); rr.Code != http.StatusForbidden {
+		t.Fatalf("expected denied version to be refused, got %d", rr.Code)
+	}
+
+	// A GitHub source is fetched as a tarball and served from this proxy, inside the tarball's top-level directory.
+	want := "https://repoxy.test/v1/modules/terraform-aws-modules/vpc/aws/5.0.0/archive/module.tar.gz//terraform-aws-vpc-5.0.0"
+	for i := 0; i < 2; i++ {
+		rr := get("/v1/modules/terraform-aws-modules/vpc/aws/5.0.0/download")
+		if rr.Code != http.StatusNoContent || rr.Header().Get("X-Terraform-Get") != want {
+			t.Fatalf("unexpected download response: %d %q", rr.Code, rr.Header().Get("X-Terraform-Get"))
+		}
+	}
+	calls := upstreamCalls.Load()
+	rr := get("/v1/modules/terraform-aws-modules/vpc/aws/5.0.0/archive/module.tar.gz")
+	if rr.Code != http.StatusOK || !bytes.Equal(rr.Body.Bytes(), tarball) || rr.Header().Get("Content-Type") != "application/gzip" {
+		t.Fatalf("unexpected archive response: %d %q", rr.Code, rr.Header().Get("Content-Type"))
+	}
+	if tarballDownloads.Load() != 1 || upstreamCalls.Load() != calls {
+		t.Fatalf("expected the module to be served from cache, %d tarball downloads", tarballDownloads.Load())
+	}
+	// The digest of the first download is checked on every read.
+	ctx := context.Background()
+	archivePath := "modules/terraform-aws-modules/vpc/aws/5.0.0/module.tar.gz"
+	if _, err := inst.packages.StoreFile(ctx, archivePath, bytes.NewReader([]byte("tampered"))); err != nil {
+		t.Fatalf("StoreFile failed: %v", err)
+	}
+	if rr := get("/v1/modules/terraform-aws-modules/vpc/aws/5.0.0/archive/module.tar.gz"); rr.Code != http.StatusBadGateway {
+		t.Fatalf("expected a modified cached archive to be refused, got %d", rr.Code)
+	}
+
+	// Relative http archive sources are resolved against the upstream registry and keep their subdirectory.
+	rr = get("/v1/modules/hashicorp/consul/aws/0.1.0/download")
+	if want := "https://repoxy.test/v1/modules/hashicorp/consul/aws/0.1.0/archive/module.zip//modules/cluster"; rr.Code != http.StatusNoContent ||
+		rr.Header().Get("X-Terraform-Get") != want {
+		t.Fatalf("unexpected download response: %d %q", rr.Code, rr.Header().Get("X-Terraform-Get"))
+	}
+
+	// Sources repoxy cannot fetch are passed through.
+	rr = get("/v1/modules/corp/network/aws/1.0.0/download")
+	if rr.Code != http.StatusNoContent || rr.Header().Get("X-Terraform-Get") != "git::ssh://git@git.corp.test/network.git?ref=v1.0.0" {
+		t.Fatalf("unexpected pass-through response: %d %q", rr.Code, rr.Header().Get("X-Terraform-Get"))
+	}
+	// So are archives on hosts repoxy does not fetch module archives from.
+	rr = get("/v1/modules/corp/metadata/aws/1.0.0/download")
+	if rr.Code != http.StatusNoContent || rr.Header().Get("X-Terraform-Get") != "http://169.254.169.254/latest/user-data?archive=zip" {
+		t.Fatalf("unexpected pass-through response: %d %q", rr.Code, rr.Header().Get("X-Terraform-Get"))
+	}
+	if rr := get("/v1/modules/corp/metadata/aws/1.0.0/archive/module.zip"); rr.Code != http.StatusNotFound {
+		t.Fatalf("expected no archive for a passed-through source, got %d", rr.Code)
+	}
+	if rr := get("/v1/modules/corp/missing/aws/1.0.0/download"); rr.Code != http.StatusNotFound {
+		t.Fatalf("expected unknown module to be 404, got %d", rr.Code)
+	}
+}
+
+func TestParseModuleSource(t *testing.T) {
+	t.Parallel()
+	for source, want := range map[string]moduleArchive{
+		"git::https://github.com/org/repo.git//modules/x?ref=v1.2.0": {url: "https://codeload.github.com/org/repo/tar.gz/v1.2.0", subdir: "modules/x", filename: "module.tar.gz", detectRoot: true},
+		"https://example.test/vpc.zip":                               {url: "https://example.test/vpc.zip", filename: "module.zip"},
+		"https://example.test/get?id=1&archive=tgz":                  {url: "https://example.test/get?id=1", filename: "module.tar.gz"},
+	} {
+		if got, ok := parseModuleSource(source); !ok || got != want {
+			t.Fatalf("%s: expected %+v, got %+v", source, want, got)
+		}
+	}
+	for _, source := range []string{
+		"git::https://github.com/org/repo",         // no ref
+		"git::https://gitlab.test/org/repo?ref=v1", // not GitHub
+		"s3::https://s3.amazonaws.com/bucket/vpc.zip",
+		"https://example.test/module", // unknown archive format
+		"github.com/org/repo",
+	} {
+		if got, ok := parseModuleSource(source); ok {
+			t.Fatalf("%s: expected pass-through, got %+v", source, got)
+		}
+	}
+}
+
+func TestModuleHosts(t *testing.T) {
+	t.Parallel()
+	config := &repo.Repo{Upstream: repo.Upstream{URL: "https://registry.test:8443"}}
+	if got := moduleHosts(config); !slices.Equal(got, []string{"github.com", "codeload.github.com", "registry.test:8443"}) {
+		t.Fatalf("unexpected default hosts %v", got)
+	}
+	config.Upstream.Config = map[string]string{"module_hosts": "git.corp.test, artifacts.corp.test"}
+	if got := moduleHosts(config); !slices.Equal(got, []string{"git.corp.test", "artifacts.corp.test", "registry.test:8443"}) {
+		t.Fatalf("unexpected configured hosts %v", got)
+	}
+	if !slices.Equal(defaultModuleHosts, []string{"github.com", "codeload.github.com"}) {
+		t.Fatalf("defaults were modified: %v", defaultModuleHosts)
+	}
+}
@@ -1,9 +1,26 @@
 package tf
 
-// param represents a reference to a Terraform provider by namespace and name.
+import "strings"
+
+// param represents a reference to a Terraform provider by namespace and name, or to a module by namespace, name and
+// provider.
 type param struct {
 	namespace string
 	name      string
+	provider  string // the module's target system; empty for providers
 	version   string
 	tail      string
 }
+
+// parts returns the name segments matched against repository mappings.
+func (p *param) parts() []string {
+	if p.provider != "" {
+		return []string{p.namespace, p.name, p.provider}
+	}
+	return []string{p.namespace, p.name}
+}
+
+// path returns the provider or module name as namespace/name[/provider].
+func (p *param) path() string {
+	return strings.Join(p.parts(), "/")
+}
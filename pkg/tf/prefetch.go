@@ -0,0 +1,356 @@
+package tf
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/davidjspooner/repoxy/pkg/auth"
+	"github.com/davidjspooner/repoxy/pkg/observability"
+	"github.com/davidjspooner/repoxy/pkg/repo"
+)
+
+// PrefetchPath is the admin endpoint that warms the cache for the providers of a lock file. It accepts a
+// .terraform.lock.hcl, with the platforms as platform query parameters, or a JSON PrefetchRequest.
+const PrefetchPath = "/api/admin/v1/terraform/prefetch"
+
+const maxLockFileBytes = 1 << 20
+
+// PrefetchRequest lists the providers to cache and the platforms, as os_arch, to cache them for. Without platforms
+// every platform the version is published for is cached.
+type PrefetchRequest struct {
+	Providers []PrefetchProvider `json:"providers"`
+	Platforms []string           `json:"platforms,omitempty"`
+}
+
+// PrefetchProvider is a provider as written in a lock file. Version pins the version to cache; otherwise the newest
+// version satisfying Constraints is cached.
+type PrefetchProvider struct {
+	Source      string `json:"source"` // [hostname/]namespace/type
+	Version     string `json:"version,omitempty"`
+	Constraints string `json:"constraints,omitempty"`
+}
+
+// PrefetchEvent reports a completed step of a prefetch: the version list of a provider ("versions"), the version
+// metadata ("version"), the download metadata of a platform ("download") or its archive ("package").
+type PrefetchEvent struct {
+	Provider string `json:"provider"`
+	Version  string `json:"version,omitempty"`
+	Platform string `json:"platform,omitempty"`
+	Step     string `json:"step"`
+	File     string `json:"file,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// PrefetchSummary counts the archives cached by a prefetch and the steps that failed.
+type PrefetchSummary struct {
+	Packages int `json:"packages"`
+	Failed   int `json:"failed"`
+}
+
+var (
+	lockProviderPattern  = regexp.MustCompile(`^provider\s+"([^"]+)"\s*\{$`)
+	lockAttributePattern = regexp.MustCompile(`^(version|constraints)\s*=\s*"([^"]*)"$`)
+)
+
+// ParseLockFile reads the providers of a .terraform.lock.hcl. Terraform writes the file in a fixed layout of provider
+// blocks, so it is read line by line rather than with an HCL parser; hashes are left to terraform to check.
+func ParseLockFile(data []byte) ([]PrefetchProvider, error) {
+	var providers []PrefetchProvider
+	var current *PrefetchProvider
+	for n, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "//"):
+		case current == nil:
+			m := lockProviderPattern.FindStringSubmatch(line)
+			if m == nil {
+				return nil, fmt.Errorf("lock file line %d: expected a provider block", n+1)
+			}
+			providers = append(providers, PrefetchProvider{Source: m[1]})
+			current = &providers[len(providers)-1]
+		case line == "}":
+			if current.Version == "" {
+				return nil, fmt.Errorf("lock file provider %s has no version", current.Source)
+			}
+			current = nil
+		default:
+			if m := lockAttributePattern.FindStringSubmatch(line); m != nil {
+				if m[1] == "version" {
+					current.Version = m[2]
+				} else {
+					current.Constraints = m[2]
+				}
+			}
+		}
+	}
+	if current != nil {
+		return nil, fmt.Errorf("lock file provider %s is not terminated", current.Source)
+	}
+	return providers, nil
+}
+
+// Prefetch caches the providers of req in the registered repositories mapping them, reporting each step to progress.
+// It fails without fetching anything when a provider or platform is invalid or no repository proxies a provider.
+func Prefetch(ctx context.Context, req *PrefetchRequest, progress func(PrefetchEvent)) (*PrefetchSummary, error) {
+	targets, platforms, err := registered.prefetchTargets(req)
+	if err != nil {
+		return nil, err
+	}
+	return registered.runPrefetch(ctx, targets, platforms, progress), nil
+}
+
+// prefetchTarget is a provider of a prefetch request with the instance that proxies it.
+type prefetchTarget struct {
+	provider PrefetchProvider
+	instance *tfInstance
+	ref      *param
+}
+
+func (f *tfType) prefetchTargets(req *PrefetchRequest) ([]prefetchTarget, []mirrorPlatform, error) {
+	if req == nil || len(req.Providers) == 0 {
+		return nil, nil, fmt.Errorf("no providers to prefetch")
+	}
+	var platforms []mirrorPlatform
+	for _, platform := range req.Platforms {
+		goos, arch, ok := strings.Cut(platform, "_")
+		if !ok || goos == "" || arch == "" || strings.Contains(arch, "_") {
+			return nil, nil, fmt.Errorf("invalid platform %q, expected os_arch", platform)
+		}
+		platforms = append(platforms, mirrorPlatform{OS: goos, Arch: arch})
+	}
+	targets := make([]prefetchTarget, 0, len(req.Providers))
+	for _, provider := range req.Providers {
+		parts := strings.Split(provider.Source, "/")
+		var hostname string
+		if len(parts) == 3 {
+			hostname, parts = parts[0], parts[1:]
+		}
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, nil, fmt.Errorf("invalid provider source %q", provider.Source)
+		}
+		ref := &param{namespace: parts[0], name: parts[1]}
+		instance := f.instanceFor(ref, hostname)
+		if instance == nil || instance.hosted() {
+			return nil, nil, fmt.Errorf("no repository proxies %s", provider.Source)
+		}
+		targets = append(targets, prefetchTarget{provider: provider, instance: instance, ref: ref})
+	}
+	return targets, platforms, nil
+}
+
+func (f *tfType) runPrefetch(ctx context.Context, targets []prefetchTarget, platforms []mirrorPlatform, progress func(PrefetchEvent)) *PrefetchSummary {
+	summary := &PrefetchSummary{}
+	report := func(event PrefetchEvent, err error) {
+		if err != nil {
+			event.Error = err.Error()
+			summary.Failed++
+		} else if event.Step == "package" {
+			summary.Packages++
+		}
+		if progress != nil {
+			progress(event)
+		}
+	}
+	for _, target := range targets {
+		if ctx.Err() != nil {
+			break
+		}
+		target.instance.prefetchProvider(ctx, target, platforms, report)
+	}
+	return summary
+}
+
+// prefetchProvider caches the version list and version metadata of a provider, then the download metadata and archive
+// of each platform, through the same cache paths as registry requests.
+func (d *tfInstance) prefetchProvider(ctx context.Context, target prefetchTarget, platforms []mirrorPlatform, report func(PrefetchEvent, error)) {
+	event := PrefetchEvent{Provider: target.provider.Source, Step: "versions"}
+	ref := *target.ref
+	if allowed, reason := d.config.Rules.Evaluate(ruleSubject(&ref, "")); !allowed {
+		report(event, fmt.Errorf("%s is denied by repository rules (%s)", ref.path(), reason))
+		return
+	}
+	r, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("/v1/providers/%s/%s/versions", ref.namespace, ref.name), nil)
+	if err != nil {
+		report(event, err)
+		return
+	}
+	buffer := &responseBuffer{header: http.Header{}, status: http.StatusOK}
+	list, ok := d.mirrorVersionList(&ref, buffer, r)
+	if !ok {
+		report(event, bufferedError(buffer))
+		return
+	}
+	version, published, err := selectPrefetchVersion(list, target.provider)
+	event.Version = version
+	report(event, err)
+	if err != nil {
+		return
+	}
+	ref.version = version
+
+	event.Step = "version"
+	manifest := r.Clone(ctx)
+	manifest.URL.Path = fmt.Sprintf("/v1/providers/%s/%s/%s", ref.namespace, ref.name, version)
+	manifest.Header = http.Header{"Accept": []string{"application/json"}}
+	buffer = &responseBuffer{header: http.Header{}, status: http.StatusOK}
+	if err := d.serveMetadataJSON(d.manifestRelPath(&ref), buffer, manifest); err != nil {
+		report(event, err)
+	} else if buffer.status != http.StatusOK {
+		report(event, bufferedError(buffer))
+	} else {
+		report(event, nil)
+	}
+
+	if len(platforms) == 0 {
+		platforms = published
+	}
+	for _, platform := range platforms {
+		event := PrefetchEvent{Provider: target.provider.Source, Version: version, Platform: platform.OS + "_" + platform.Arch, Step: "download"}
+		if len(published) > 0 && !containsPlatform(published, platform) {
+			report(event, fmt.Errorf("%s %s is not available for %s", ref.path(), version, event.Platform))
+			continue
+		}
+		req := &downloadRequest{param: &ref, OS: platform.OS, Arch: platform.Arch}
+		payload, err := d.fetchDownloadMetadataMap(ctx, req)
+		if err == nil {
+			event.File, err = d.resolveDownloadFilename(req, payload)
+		}
+		report(event, err)
+		if err != nil {
+			continue
+		}
+		event.Step = "package"
+		report(event, d.ensurePackageCached(ctx, req, event.File, payload))
+	}
+}
+
+// selectPrefetchVersion returns the version of the list a provider asks for and the platforms it is published for.
+// Like terraform, constraints only select pre-releases they name exactly.
+func selectPrefetchVersion(list *mirrorVersionList, provider PrefetchProvider) (string, []mirrorPlatform, error) {
+	best := -1
+	for i, entry := range list.Versions {
+		if provider.Version != "" {
+			if entry.Version == provider.Version {
+				return entry.Version, entry.Platforms, nil
+			}
+			continue
+		}
+		if provider.Constraints != "" {
+			if strings.Contains(entry.Version, "-") {
+				continue
+			}
+			ok, err := repo.VersionAllowed(provider.Constraints, entry.Version)
+			if err != nil {
+				return "", nil, err
+			}
+			if !ok {
+				continue
+			}
+		}
+		if best < 0 || repo.CompareVersions(entry.Version, list.Versions[best].Version) > 0 {
+			best = i
+		}
+	}
+	switch {
+	case provider.Version != "":
+		return "", nil, fmt.Errorf("version %s of %s is not available", provider.Version, provider.Source)
+	case best < 0:
+		return "", nil, fmt.Errorf("no version of %s satisfies %q", provider.Source, provider.Constraints)
+	}
+	return list.Versions[best].Version, list.Versions[best].Platforms, nil
+}
+
+func containsPlatform(platforms []mirrorPlatform, platform mirrorPlatform) bool {
+	for _, p := range platforms {
+		if p == platform {
+			return true
+		}
+	}
+	return false
+}
+
+// bufferedError turns a registry error document captured in buffer into an error.
+func bufferedError(buffer *responseBuffer) error {
+	var doc struct {
+		Errors []string `json:"errors"`
+	}
+	if err := json.Unmarshal(buffer.body.Bytes(), &doc); err != nil || len(doc.Errors) == 0 {
+		return fmt.Errorf("upstream answered %d", buffer.status)
+	}
+	return errors.New(strings.Join(doc.Errors, "; "))
+}
+
+// readPrefetchRequest reads a JSON PrefetchRequest, or a lock file with the platforms in the query.
+func readPrefetchRequest(r *http.Request) (*PrefetchRequest, error) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxLockFileBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > maxLockFileBytes {
+		return nil, fmt.Errorf("request body exceeds %d bytes", maxLockFileBytes)
+	}
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "application/json" {
+		var req PrefetchRequest
+		if err := json.Unmarshal(body, &req); err != nil {
+			return nil, fmt.Errorf("invalid prefetch request: %w", err)
+		}
+		return &req, nil
+	}
+	providers, err := ParseLockFile(body)
+	if err != nil {
+		return nil, err
+	}
+	return &PrefetchRequest{Providers: providers, Platforms: r.URL.Query()["platform"]}, nil
+}
+
+// HandlePrefetch caches the providers of a lock file or prefetch request. It needs an authenticated client with admin
+// access to every provider and answers with a JSON line per completed step, flushed as it happens, followed by a
+// summary line. The prefetch runs to completion even if the client disconnects.
+func (f *tfType) HandlePrefetch(w http.ResponseWriter, r *http.Request) {
+	// Without client authentication access control allows everything, and anyone could make the proxy download
+	// every provider and platform upstream.
+	if auth.PrincipalFromContext(r.Context()) == nil {
+		writeErrors(w, http.StatusUnauthorized, "prefetching requires an authenticated client")
+		return
+	}
+	req, err := readPrefetchRequest(r)
+	if err != nil {
+		writeErrors(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	targets, platforms, err := f.prefetchTargets(req)
+	if err != nil {
+		writeErrors(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	for _, target := range targets {
+		if !repo.Authorized(r.Context(), &target.instance.config, target.ref.path(), repo.ActionAdmin) {
+			slog.InfoContext(r.Context(), "prefetch denied by access control", "name", target.ref.path())
+			repoType, repoName := target.instance.repoLabels()
+			observability.RecordDenied(repoType, repoName, repo.AccessDenied)
+			writeErrors(w, http.StatusForbidden, "prefetching "+target.ref.path()+" is denied")
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	encoder := json.NewEncoder(w)
+	flusher := http.NewResponseController(w)
+	summary := f.runPrefetch(context.WithoutCancel(r.Context()), targets, platforms, func(event PrefetchEvent) {
+		_ = encoder.Encode(event)
+		_ = flusher.Flush()
+	})
+	slog.InfoContext(r.Context(), "prefetch completed", "providers", len(targets), "packages", summary.Packages, "failed", summary.Failed)
+	_ = encoder.Encode(struct {
+		Step string `json:"step"`
+		*PrefetchSummary
+	}{Step: "done", PrefetchSummary: summary})
+}
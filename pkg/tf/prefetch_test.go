@@ -0,0 +1,196 @@
+package tf
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/davidjspooner/go-http-client/pkg/client"
+	"github.com/davidjspooner/go-http-server/pkg/mux"
+	"github.com/davidjspooner/repoxy/pkg/auth"
+)
+
+const testLockFile = `# This file is maintained automatically by "terraform init".
+# Manual edits may be lost in future updates.
+
+provider "registry.test/hashicorp/aws" {
+  version     = "5.1.0"
+  constraints = "~> 5.0"
+  hashes = [
+    "h1:AAAA",
+    "zh:BBBB",
+  ]
+}
+
+provider "registry.test/corp/internal" {
+  version = "3.6.0"
+}
+`
+
+func TestParseLockFile(t *testing.T) {
+	t.Parallel()
+	providers, err := ParseLockFile([]byte(testLockFile))
+	if err != nil {
+		t.Fatalf("ParseLockFile: %v", err)
+	}
+	want := []PrefetchProvider{
+		{Source: "registry.test/hashicorp/aws", Version: "5.1.0", Constraints: "~> 5.0"},
+		{Source: "registry.test/corp/internal", Version: "3.6.0"},
+	}
+	if !reflect.DeepEqual(providers, want) {
+		t.Fatalf("unexpected providers %+v", providers)
+	}
+	for name, data := range map[string]string{
+		"no version":      "provider \"registry.test/hashicorp/aws\" {\n}\n",
+		"unterminated":    "provider \"registry.test/hashicorp/aws\" {\n  version = \"5.1.0\"\n",
+		"not a lock file": "terraform {\n}\n",
+	} {
+		if _, err := ParseLockFile([]byte(data)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestSelectPrefetchVersion(t *testing.T) {
+	t.Parallel()
+	var list mirrorVersionList
+	_ = json.Unmarshal([]byte(`{"versions":[{"version":"5.0.0"},{"version":"5.10.1"},{"version":"5.9.0"},`+
+		`{"version":"6.0.0-beta1"},{"version":"4.67.0"}]}`), &list)
+	for _, tc := range []struct {
+		provider PrefetchProvider
+		want     string
+	}{
+		{PrefetchProvider{Version: "5.0.0"}, "5.0.0"},
+		{PrefetchProvider{Version: "6.0.0-beta1", Constraints: "~> 5.0"}, "6.0.0-beta1"},
+		{PrefetchProvider{Constraints: "~> 5.0"}, "5.10.1"},
+		{PrefetchProvider{Constraints: ">= 5.0"}, "5.10.1"},
+		{PrefetchProvider{Constraints: "< 5.0"}, "4.67.0"},
+		{PrefetchProvider{}, "6.0.0-beta1"},
+		{PrefetchProvider{Version: "5.2.0"}, ""},
+		{PrefetchProvider{Constraints: "> 7.0"}, ""},
+	} {
+		got, _, err := selectPrefetchVersion(&list, tc.provider)
+		if got != tc.want || (err != nil) != (tc.want == "") {
+			t.Errorf("%+v: got %q, %v, want %q", tc.provider, got, err, tc.want)
+		}
+	}
+}
+
+func TestPrefetchLockFile(t *testing.T) {
+	t.Parallel()
+	signer, armored := newSigningKey(t, "hashicorp")
+	upstream := newSignedProvider(t, signer, armored)
+	inst := newTFInstanceForTest(t, nil, func(req *http.Request) (*http.Response, error) {
+		switch req.URL.Path {
+		case "/v1/providers/hashicorp/aws/versions":
+			return tfResponse(http.StatusOK, `{"versions":[{"version":"5.0.0","platforms":[{"os":"linux","arch":"amd64"}]},`+
+				`{"version":"5.1.0","platforms":[{"os":"linux","arch":"amd64"},{"os":"darwin","arch":"arm64"}]}]}`), nil
+		case "/v1/providers/hashicorp/aws/5.1.0":
+			return tfResponse(http.StatusOK, `{"version":"5.1.0"}`), nil
+		}
+		return upstream.handle(req)
+	})
+	inst.nameMatchers.Set([]string{"hashicorp/*"})
+	m := mux.NewServeMux()
+	if err := (&tfType{instances: []*tfInstance{inst}}).Initialize(context.Background(), "terraform", m); err != nil {
+		t.Fatalf("Initialize failed: %v", err)
+	}
+	postAs := func(principal *auth.Principal, query, contentType, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, PrefetchPath+query, strings.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		if principal != nil {
+			req = req.WithContext(auth.WithPrincipal(req.Context(), principal))
+		}
+		rr := httptest.NewRecorder()
+		m.ServeHTTP(rr, req)
+		return rr
+	}
+	post := func(query, contentType, body string) *httptest.ResponseRecorder {
+		return postAs(&auth.Principal{Name: "ops"}, query, contentType, body)
+	}
+
+	// Without client authentication access control allows everything, so anonymous clients are refused outright.
+	if rr := postAs(nil, "?platform=linux_amd64", "text/plain", testLockFile); rr.Code != http.StatusUnauthorized {
+		t.Fatalf("expected anonymous prefetch to be refused, got %d %s", rr.Code, rr.Body.String())
+	}
+	// Nothing is fetched unless every provider and platform is usable.
+	if rr := post("?platform=linux_amd64", "text/plain", testLockFile); rr.Code != http.StatusBadRequest ||
+		!strings.Contains(rr.Body.String(), "no repository proxies registry.test/corp/internal") {
+		t.Fatalf("expected unmapped provider to be rejected, got %d %s", rr.Code, rr.Body.String())
+	}
+	if rr := post("", "application/json", `{"providers":[{"source":"hashicorp/aws"}],"platforms":["linux"]}`); rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected invalid platform to be rejected, got %d %s", rr.Code, rr.Body.String())
+	}
+	if upstream.downloads.Load() != 0 {
+		t.Fatalf("expected no downloads for rejected requests")
+	}
+
+	lockFile, _, _ := strings.Cut(testLockFile, `provider "registry.test/corp/internal"`)
+	rr := post("?platform=linux_amd64&platform=darwin_arm64&platform=windows_amd64", "text/plain", lockFile)
+	if rr.Code != http.StatusOK || rr.Header().Get("Content-Type") != "application/x-ndjson" {
+		t.Fatalf("expected a progress stream, got %d %s", rr.Code, rr.Body.String())
+	}
+	var steps []string
+	var summary struct {
+		Step string `json:"step"`
+		PrefetchSummary
+	}
+	scanner := bufio.NewScanner(rr.Body)
+	for scanner.Scan() {
+		var event PrefetchEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatalf("invalid progress line %q: %v", scanner.Text(), err)
+		}
+		if event.Step == "done" {
+			_ = json.Unmarshal(scanner.Bytes(), &summary)
+			continue
+		}
+		step := event.Step + " " + event.Version + " " + event.Platform
+		if event.Error != "" {
+			step += " failed"
+		}
+		steps = append(steps, strings.TrimSpace(step))
+	}
+	want := []string{
+		"versions 5.1.0",
+		"version 5.1.0",
+		"download 5.1.0 linux_amd64",
+		"package 5.1.0 linux_amd64",
+		"download 5.1.0 darwin_arm64 failed",  // upstream has no metadata for it
+		"download 5.1.0 windows_amd64 failed", // not published
+	}
+	if !reflect.DeepEqual(steps, want) {
+		t.Fatalf("unexpected progress:\n%s", strings.Join(steps, "\n"))
+	}
+	if summary.Step != "done" || summary.Packages != 1 || summary.Failed != 2 {
+		t.Fatalf("unexpected summary %+v", summary)
+	}
+
+	// The cache now answers terraform init without upstream.
+	inst.httpClientFactory = func() client.Interface {
+		return client.Func(func(req *http.Request) (*http.Response, error) {
+			t.Errorf("unexpected upstream request for %s", req.URL)
+			return tfResponse(http.StatusBadGateway, `{"errors":["offline"]}`), nil
+		})
+	}
+	for _, path := range []string{
+		"/v1/providers/hashicorp/aws/versions",
+		"/v1/providers/hashicorp/aws/5.1.0",
+		"/v1/providers/hashicorp/aws/5.1.0/download/linux/amd64",
+		"/v1/providers/hashicorp/aws/5.1.0/download/linux/amd64/archive/terraform-provider-aws_5.1.0_linux_amd64.zip",
+	} {
+		rr := httptest.NewRecorder()
+		m.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, path, nil))
+		if rr.Code != http.StatusOK {
+			t.Errorf("%s: expected a cached response, got %d %s", path, rr.Code, rr.Body.String())
+		}
+	}
+	if upstream.downloads.Load() != 1 {
+		t.Fatalf("expected the archive to be downloaded once, got %d", upstream.downloads.Load())
+	}
+}
@@ -0,0 +1,119 @@
+package tf
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/davidjspooner/repoxy/pkg/observability"
+	"github.com/davidjspooner/repoxy/pkg/repo"
+)
+
+// ruleSubject describes a provider or module request for the repository rules; platform is "os/arch" for provider
+// downloads.
+func ruleSubject(param *param, platform string) repo.RuleSubject {
+	return repo.RuleSubject{Name: param.path(), Reference: param.version, Platform: platform}
+}
+
+// deniedByRules refuses requests the repository rules do not allow, before anything is fetched from upstream, and
+// reports whether it did.
+func (d *tfInstance) deniedByRules(subject repo.RuleSubject, w http.ResponseWriter, r *http.Request) bool {
+	allowed, reason := d.config.Rules.Evaluate(subject)
+	if allowed {
+		return false
+	}
+	slog.InfoContext(r.Context(), "request denied by repository rules", "name", subject.Name, "version", subject.Reference,
+		"platform", subject.Platform, "reason", reason)
+	repoType, repoName := d.repoLabels()
+	observability.RecordDenied(repoType, repoName, reason)
+	writeErrors(w, http.StatusForbidden, "access to "+subject.Name+" is denied by repository rules")
+	return true
+}
+
+// writeErrors answers with the registry protocol's error document.
+func writeErrors(w http.ResponseWriter, status int, messages ...string) {
+	body, _ := json.Marshal(map[string][]string{"errors": messages})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write(body)
+}
+
+// serveFilteredVersionList serves the version list without the versions and platforms the rules refuse, so terraform
+// selects a version it will be allowed to download.
+func (d *tfInstance) serveFilteredVersionList(param *param, w http.ResponseWriter, r *http.Request) error {
+	return d.serveFilteredJSON(d.versionsRelPath(param), func(body []byte) ([]byte, error) { return d.filterVersionList(param, body) }, w, r)
+}
+
+// serveFilteredJSON serves the metadata document at relPath rewritten by filter.
+func (d *tfInstance) serveFilteredJSON(relPath string, filter func([]byte) ([]byte, error), w http.ResponseWriter, r *http.Request) error {
+	buffer := &responseBuffer{header: http.Header{}, status: http.StatusOK}
+	if err := d.serveMetadataJSON(relPath, buffer, r); err != nil {
+		return err
+	}
+	body := buffer.body.Bytes()
+	if buffer.status == http.StatusOK {
+		if filtered, err := filter(body); err == nil {
+			body = filtered
+		} else {
+			slog.WarnContext(r.Context(), "failed to filter terraform version list", "error", err)
+		}
+	}
+	for key, values := range buffer.header {
+		w.Header()[key] = values
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(buffer.status)
+	_, err := w.Write(body)
+	return err
+}
+
+func (d *tfInstance) filterVersionList(param *param, body []byte) ([]byte, error) {
+	var doc map[string]any
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return nil, err
+	}
+	versions, _ := doc["versions"].([]any)
+	kept := make([]any, 0, len(versions))
+	for _, entry := range versions {
+		version, ok := entry.(map[string]any)
+		if !ok {
+			continue
+		}
+		ref := *param
+		ref.version = stringField(version, "version")
+		if allowed, _ := d.config.Rules.Evaluate(ruleSubject(&ref, "")); !allowed {
+			continue
+		}
+		if platforms, ok := version["platforms"].([]any); ok {
+			allowedPlatforms := make([]any, 0, len(platforms))
+			for _, p := range platforms {
+				platform, _ := p.(map[string]any)
+				if allowed, _ := d.config.Rules.Evaluate(ruleSubject(&ref, stringField(platform, "os")+"/"+stringField(platform, "arch"))); allowed {
+					allowedPlatforms = append(allowedPlatforms, p)
+				}
+			}
+			if len(allowedPlatforms) == 0 {
+				continue
+			}
+			version["platforms"] = allowedPlatforms
+		}
+		kept = append(kept, version)
+	}
+	doc["versions"] = kept
+	return json.Marshal(doc)
+}
+
+// responseBuffer captures a response so it can be rewritten before reaching the client.
+type responseBuffer struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (b *responseBuffer) Header() http.Header { return b.header }
+
+func (b *responseBuffer) WriteHeader(status int) { b.status = status }
+
+func (b *responseBuffer) Write(p []byte) (int, error) { return b.body.Write(p) }
@@ -0,0 +1,49 @@
+package tf
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/davidjspooner/repoxy/pkg/repo"
+)
+
+func TestRulesFilterVersionListAndDenyDownloads(t *testing.T) {
+	t.Parallel()
+	var fetched []string
+	inst := newTFInstanceForTest(t, nil, func(req *http.Request) (*http.Response, error) {
+		fetched = append(fetched, req.URL.Path)
+		return tfResponse(http.StatusOK, `{"versions":[`+
+			`{"version":"5.1.0","protocols":["5.0"],"platforms":[{"os":"linux","arch":"amd64"},{"os":"windows","arch":"amd64"}]},`+
+			`{"version":"6.0.0","protocols":["5.0"],"platforms":[{"os":"linux","arch":"amd64"}]},`+
+			`{"version":"5.2.0","protocols":["5.0"],"platforms":[{"os":"windows","arch":"amd64"}]}]}`), nil
+	})
+	inst.config.Rules = &repo.Rules{
+		Allow: []repo.Rule{{Name: "hashicorp/*", Version: "< 6.0"}},
+		Deny:  []repo.Rule{{Platform: "windows/*"}},
+	}
+
+	code, body := versionList(inst)
+	want := `{"versions":[{"platforms":[{"arch":"amd64","os":"linux"}],"protocols":["5.0"],"version":"5.1.0"}]}`
+	if code != http.StatusOK || body != want {
+		t.Fatalf("unexpected filtered version list: %d %s", code, body)
+	}
+
+	for _, target := range []struct {
+		param *param
+		path  string
+	}{
+		{&param{namespace: "hashicorp", name: "aws", version: "6.0.0", tail: "download/linux/amd64"}, "/v1/providers/hashicorp/aws/6.0.0/download/linux/amd64"},
+		{&param{namespace: "hashicorp", name: "aws", version: "5.1.0", tail: "download/windows/amd64"}, "/v1/providers/hashicorp/aws/5.1.0/download/windows/amd64"},
+		{&param{namespace: "other", name: "aws", version: "1.0.0", tail: "download/linux/amd64"}, "/v1/providers/other/aws/1.0.0/download/linux/amd64"},
+	} {
+		rr := httptest.NewRecorder()
+		inst.HandleV1VersionDownload(target.param, rr, httptest.NewRequest(http.MethodGet, target.path, nil))
+		if rr.Code != http.StatusForbidden || rr.Header().Get("Content-Type") != "application/json" {
+			t.Fatalf("expected %s to be denied, got %d %s", target.path, rr.Code, rr.Body.String())
+		}
+	}
+	if len(fetched) != 1 {
+		t.Fatalf("denied downloads reached upstream: %v", fetched)
+	}
+}
@@ -0,0 +1,208 @@
+package tf
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/davidjspooner/repoxy/pkg/observability"
+	"github.com/davidjspooner/repoxy/pkg/repo"
+)
+
+// errPackageVerification is returned when a provider archive or its checksums fail verification.
+var errPackageVerification = errors.New("provider package failed verification")
+
+// maxShasumsBytes bounds the size of SHA256SUMS files and their signatures.
+const maxShasumsBytes = 1 << 20
+
+// loadKeyring reads the armored OpenPGP public keys of a terraform repository policy.
+func loadKeyring(files []string) (openpgp.EntityList, error) {
+	var keyring openpgp.EntityList
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("%w: failed to read policy key: %v", repo.ErrInvalidRepoConfig, err)
+		}
+		entities, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s is not an armored OpenPGP key: %v", repo.ErrInvalidRepoConfig, file, err)
+		}
+		keyring = append(keyring, entities...)
+	}
+	return keyring, nil
+}
+
+// metadataKeyring reads the signing_keys.gpg_public_keys of provider download metadata.
+func metadataKeyring(payload map[string]any) (openpgp.EntityList, error) {
+	signingKeys, _ := payload["signing_keys"].(map[string]any)
+	keys, _ := signingKeys["gpg_public_keys"].([]any)
+	var keyring openpgp.EntityList
+	for _, entry := range keys {
+		key, _ := entry.(map[string]any)
+		entities, err := openpgp.ReadArmoredKeyRing(strings.NewReader(stringField(key, "ascii_armor")))
+		if err != nil {
+			return nil, fmt.Errorf("invalid signing key %q: %v", stringField(key, "key_id"), err)
+		}
+		keyring = append(keyring, entities...)
+	}
+	if len(keyring) == 0 {
+		return nil, errors.New("download metadata has no signing keys")
+	}
+	return keyring, nil
+}
+
+// verifiedShasum returns the SHA-256 the archive filename must have. When the metadata links a SHA256SUMS file and its
+// signature, the signature is checked against the repository policy keys, or else the keys in the metadata, and the
+// checksum is taken from the signed file. A repository with policy keys refuses packages without signed checksums.
+func (d *tfInstance) verifiedShasum(ctx context.Context, req *downloadRequest, filename string, payload map[string]any) (string, error) {
+	shasum := strings.ToLower(stringField(payload, "shasum"))
+	sumsURL := stringField(payload, "shasums_url")
+	sigURL := stringField(payload, "shasums_signature_url")
+	if sumsURL == "" || sigURL == "" {
+		if d.keyring != nil {
+			return "", fmt.Errorf("%w: %s has no signed SHA256SUMS", errPackageVerification, filename)
+		}
+		return shasum, nil
+	}
+	keyring := d.keyring
+	if keyring == nil {
+		var err error
+		if keyring, err = metadataKeyring(payload); err != nil {
+			return "", fmt.Errorf("%w: %v", errPackageVerification, err)
+		}
+	}
+	sumsPath := path.Join("providers", req.param.namespace, req.param.name, req.param.version, "SHA256SUMS")
+	sums, sig, cached := d.cachedShasums(ctx, sumsPath)
+	if !cached {
+		var err error
+		if sums, err = d.fetchUpstreamFile(ctx, sumsURL); err != nil {
+			return "", fmt.Errorf("failed to fetch SHA256SUMS: %w", err)
+		}
+		if sig, err = d.fetchUpstreamFile(ctx, sigURL); err != nil {
+			return "", fmt.Errorf("failed to fetch SHA256SUMS signature: %w", err)
+		}
+	}
+	if _, err := openpgp.CheckDetachedSignature(keyring, bytes.NewReader(sums), bytes.NewReader(sig), nil); err != nil {
+		return "", fmt.Errorf("%w: SHA256SUMS signature of %s: %v", errPackageVerification, req.param.version, err)
+	}
+	if !cached {
+		// The checksums of a version are shared by its platforms; keep them so each download does not refetch them.
+		for relPath, body := range map[string][]byte{sumsPath: sums, sumsPath + ".sig": sig} {
+			if _, err := d.refs.StoreFile(ctx, relPath, bytes.NewReader(body)); err != nil {
+				slog.WarnContext(ctx, "failed to store terraform SHA256SUMS", "error", err, "path", relPath)
+			}
+		}
+	}
+	listed := shasumFor(sums, filename)
+	if listed == "" {
+		return "", fmt.Errorf("%w: %s is not listed in SHA256SUMS", errPackageVerification, filename)
+	}
+	if shasum != "" && shasum != listed {
+		return "", fmt.Errorf("%w: shasum of %s does not match SHA256SUMS", errPackageVerification, filename)
+	}
+	return listed, nil
+}
+
+func (d *tfInstance) cachedShasums(ctx context.Context, relPath string) ([]byte, []byte, bool) {
+	read := func(relPath string) []byte {
+		reader, err := d.refs.OpenFile(ctx, relPath)
+		if err != nil {
+			return nil
+		}
+		defer reader.Close()
+		data, err := io.ReadAll(io.LimitReader(reader, maxShasumsBytes))
+		if err != nil {
+			return nil
+		}
+		return data
+	}
+	sums, sig := read(relPath), read(relPath+".sig")
+	return sums, sig, len(sums) > 0 && len(sig) > 0
+}
+
+// fetchUpstreamFile downloads a small file such as SHA256SUMS through the upstream client pipeline.
+func (d *tfInstance) fetchUpstreamFile(ctx context.Context, sourceURL string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, sourceURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := d.pipeline.WrapClient(d.httpClientFactory()).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s from %s", resp.Status, sourceURL)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, maxShasumsBytes))
+}
+
+// shasumFor returns the checksum SHA256SUMS lists for filename.
+func shasumFor(sums []byte, filename string) string {
+	scanner := bufio.NewScanner(bytes.NewReader(sums))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && strings.TrimPrefix(fields[1], "*") == filename {
+			return strings.ToLower(fields[0])
+		}
+	}
+	return ""
+}
+
+// spoolVerified copies body to a temporary file and returns it for reading if its SHA-256 is shasum, so nothing is
+// stored before the archive is verified. The file is removed when it is closed.
+func spoolVerified(body io.Reader, shasum string) (io.ReadCloser, error) {
+	tmp, err := os.CreateTemp("", "repoxy-provider-*")
+	if err != nil {
+		return nil, err
+	}
+	spooled := &tempFile{File: tmp}
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tmp, h), body); err != nil {
+		spooled.Close()
+		return nil, err
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); got != shasum {
+		spooled.Close()
+		return nil, fmt.Errorf("%w: archive has sha256 %s, expected %s", errPackageVerification, got, shasum)
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		spooled.Close()
+		return nil, err
+	}
+	return spooled, nil
+}
+
+// tempFile removes itself when closed.
+type tempFile struct {
+	*os.File
+}
+
+func (f *tempFile) Close() error {
+	err := f.File.Close()
+	os.Remove(f.Name())
+	return err
+}
+
+// deniedByVerification refuses a request whose package failed verification and reports whether it did.
+func (d *tfInstance) deniedByVerification(err error, w http.ResponseWriter, r *http.Request) bool {
+	if !errors.Is(err, errPackageVerification) {
+		return false
+	}
+	slog.WarnContext(r.Context(), "terraform provider package rejected", "error", err)
+	repoType, repoName := d.repoLabels()
+	observability.RecordDenied(repoType, repoName, "signature")
+	writeErrors(w, http.StatusForbidden, err.Error())
+	return true
+}
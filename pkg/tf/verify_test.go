@@ -0,0 +1,194 @@
+package tf
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/davidjspooner/go-http-server/pkg/mux"
+	"github.com/davidjspooner/repoxy/pkg/repo"
+)
+
+func newSigningKey(t *testing.T, name string) (*openpgp.Entity, string) {
+	t.Helper()
+	entity, err := openpgp.NewEntity(name, "", name+"@example.test", nil)
+	if err != nil {
+		t.Fatalf("new entity: %v", err)
+	}
+	var buf bytes.Buffer
+	w, err := armor.Encode(&buf, openpgp.PublicKeyType, nil)
+	if err != nil {
+		t.Fatalf("armor: %v", err)
+	}
+	if err := entity.Serialize(w); err != nil {
+		t.Fatalf("serialize key: %v", err)
+	}
+	_ = w.Close()
+	return entity, buf.String()
+}
+
+func detachSign(t *testing.T, signer *openpgp.Entity, data []byte) []byte {
+	t.Helper()
+	var sig bytes.Buffer
+	if err := openpgp.DetachSign(&sig, signer, bytes.NewReader(data), nil); err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	return sig.Bytes()
+}
+
+// signedProvider is an upstream that publishes one provider archive with a SHA256SUMS file signed by signer and
+// announces announced as its signing key.
+type signedProvider struct {
+	archive   []byte
+	shasum    string
+	sums      []byte
+	sig       []byte
+	announced string
+	downloads atomic.Int32
+}
+
+func newSignedProvider(t *testing.T, signer *openpgp.Entity, announced string) *signedProvider {
+	archive := providerZip(t)
+	sum := sha256.Sum256(archive)
+	sums := []byte(hex.EncodeToString(sum[:]) + "  terraform-provider-aws_5.1.0_linux_amd64.zip\n")
+	return &signedProvider{archive: archive, shasum: hex.EncodeToString(sum[:]), sums: sums, sig: detachSign(t, signer, sums), announced: announced}
+}
+
+func (p *signedProvider) handle(req *http.Request) (*http.Response, error) {
+	switch req.URL.Path {
+	case "/v1/providers/hashicorp/aws/5.1.0/download/linux/amd64":
+		body, _ := json.Marshal(map[string]any{
+			"filename":              "terraform-provider-aws_5.1.0_linux_amd64.zip",
+			"download_url":          "https://releases.test/terraform-provider-aws_5.1.0_linux_amd64.zip",
+			"shasum":                p.shasum,
+			"shasums_url":           "https://releases.test/terraform-provider-aws_5.1.0_SHA256SUMS",
+			"shasums_signature_url": "https://releases.test/terraform-provider-aws_5.1.0_SHA256SUMS.sig",
+			"signing_keys":          map[string]any{"gpg_public_keys": []any{map[string]any{"key_id": "ABC", "ascii_armor": p.announced}}},
+		})
+		return tfResponse(http.StatusOK, string(body)), nil
+	case "/terraform-provider-aws_5.1.0_linux_amd64.zip":
+		p.downloads.Add(1)
+		return tfResponse(http.StatusOK, string(p.archive)), nil
+	case "/terraform-provider-aws_5.1.0_SHA256SUMS":
+		return tfResponse(http.StatusOK, string(p.sums)), nil
+	case "/terraform-provider-aws_5.1.0_SHA256SUMS.sig":
+		return tfResponse(http.StatusOK, string(p.sig)), nil
+	}
+	return tfResponse(http.StatusNotFound, `{"errors":["not found"]}`), nil
+}
+
+func serveProviderForTest(t *testing.T, inst *tfInstance) func(path string) *httptest.ResponseRecorder {
+	t.Helper()
+	inst.nameMatchers.Set([]string{"hashicorp/*"})
+	m := mux.NewServeMux()
+	if err := (&tfType{instances: []*tfInstance{inst}}).Initialize(context.Background(), "terraform", m); err != nil {
+		t.Fatalf("Initialize failed: %v", err)
+	}
+	return func(path string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		m.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, path, nil))
+		return rr
+	}
+}
+
+func TestProviderPackageVerification(t *testing.T) {
+	t.Parallel()
+	signer, armored := newSigningKey(t, "hashicorp")
+	const metadata = "/v1/providers/hashicorp/aws/5.1.0/download/linux/amd64"
+	const archivePath = metadata + "/archive/terraform-provider-aws_5.1.0_linux_amd64.zip"
+	relPath := "providers/hashicorp/aws/5.1.0/download/linux/amd64/terraform-provider-aws_5.1.0_linux_amd64.zip"
+
+	t.Run("valid", func(t *testing.T) {
+		t.Parallel()
+		upstream := newSignedProvider(t, signer, armored)
+		inst := newTFInstanceForTest(t, nil, upstream.handle)
+		get := serveProviderForTest(t, inst)
+		if rr := get(metadata); rr.Code != http.StatusOK {
+			t.Fatalf("expected metadata, got %d %s", rr.Code, rr.Body.String())
+		}
+		if rr := get(archivePath); rr.Code != http.StatusOK || !bytes.Equal(rr.Body.Bytes(), upstream.archive) || upstream.downloads.Load() != 1 {
+			t.Fatalf("unexpected archive response: %d, %d downloads", rr.Code, upstream.downloads.Load())
+		}
+		if _, err := inst.refs.StatFile(context.Background(), "providers/hashicorp/aws/5.1.0/SHA256SUMS.sig"); err != nil {
+			t.Fatalf("expected verified SHA256SUMS to be cached: %v", err)
+		}
+	})
+
+	t.Run("tampered archive", func(t *testing.T) {
+		t.Parallel()
+		upstream := newSignedProvider(t, signer, armored)
+		inst := newTFInstanceForTest(t, nil, upstream.handle)
+		upstream.archive = append(bytes.Clone(upstream.archive), 0)
+		get := serveProviderForTest(t, inst)
+		for _, path := range []string{metadata, archivePath} {
+			if rr := get(path); rr.Code != http.StatusForbidden {
+				t.Fatalf("%s: expected 403, got %d %s", path, rr.Code, rr.Body.String())
+			}
+		}
+		if _, err := inst.packages.StatFile(context.Background(), relPath); err == nil {
+			t.Fatalf("expected tampered archive not to be stored")
+		}
+	})
+
+	t.Run("untrusted signature", func(t *testing.T) {
+		t.Parallel()
+		other, _ := newSigningKey(t, "mallory")
+		upstream := newSignedProvider(t, other, armored)
+		inst := newTFInstanceForTest(t, nil, upstream.handle)
+		if rr := serveProviderForTest(t, inst)(metadata); rr.Code != http.StatusForbidden || upstream.downloads.Load() != 0 {
+			t.Fatalf("expected 403 before downloading, got %d, %d downloads", rr.Code, upstream.downloads.Load())
+		}
+	})
+
+	t.Run("policy keyring", func(t *testing.T) {
+		t.Parallel()
+		// The registry announces a key an attacker controls; only the configured key is trusted.
+		mallory, malloryArmored := newSigningKey(t, "mallory")
+		keyFile := filepath.Join(t.TempDir(), "hashicorp.asc")
+		if err := os.WriteFile(keyFile, []byte(armored), 0o600); err != nil {
+			t.Fatalf("write key: %v", err)
+		}
+		keyring, err := loadKeyring([]string{keyFile})
+		if err != nil {
+			t.Fatalf("loadKeyring: %v", err)
+		}
+
+		forged := newSignedProvider(t, mallory, malloryArmored)
+		inst := newTFInstanceForTest(t, nil, forged.handle)
+		inst.keyring = keyring
+		if rr := serveProviderForTest(t, inst)(metadata); rr.Code != http.StatusForbidden {
+			t.Fatalf("expected forged SHA256SUMS to be refused, got %d", rr.Code)
+		}
+
+		genuine := newSignedProvider(t, signer, malloryArmored)
+		inst = newTFInstanceForTest(t, nil, genuine.handle)
+		inst.keyring = keyring
+		if rr := serveProviderForTest(t, inst)(metadata); rr.Code != http.StatusOK {
+			t.Fatalf("expected SHA256SUMS signed by the policy key to be accepted, got %d %s", rr.Code, rr.Body.String())
+		}
+	})
+}
+
+func TestLoadKeyringRejectsInvalidKeys(t *testing.T) {
+	t.Parallel()
+	keyFile := filepath.Join(t.TempDir(), "bad.asc")
+	if err := os.WriteFile(keyFile, []byte("not a key"), 0o600); err != nil {
+		t.Fatalf("write key: %v", err)
+	}
+	for _, files := range [][]string{{keyFile}, {keyFile + ".missing"}} {
+		if _, err := loadKeyring(files); !errors.Is(err, repo.ErrInvalidRepoConfig) {
+			t.Fatalf("%v: expected ErrInvalidRepoConfig, got %v", files, err)
+		}
+	}
+}